@@ -12,6 +12,7 @@ import (
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
+	"strings"
 	"syscall"
 
 	"github.com/mozilla-services/pushgo/simplepush"
@@ -23,7 +24,11 @@ var (
 	memProfile *string = flag.String("memProfile", "", "Profile file output")
 	logging    *int    = flag.Int("logging", 0,
 		"logging level (0=none,1=critical ... 10=verbose")
-	version *bool = flag.Bool("version", false, "Print the version and exit")
+	version     *bool = flag.Bool("version", false, "Print the version and exit")
+	checkConfig *bool = flag.Bool("check-config", false,
+		"Validate the configuration file and exit")
+	printConfig *bool = flag.Bool("print-config", false,
+		"Print the resolved configuration, with secrets redacted, and exit")
 )
 
 const SIGUSR1 = syscall.SIGUSR1
@@ -37,6 +42,10 @@ func main() {
 		return
 	}
 
+	if *checkConfig || *printConfig {
+		os.Exit(check())
+	}
+
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	// Only create profiles if requested. To view the application profiles,
 	// see http://blog.golang.org/profiling-go-programs
@@ -74,31 +83,126 @@ func main() {
 
 	// wait for sigint
 	sigChan := make(chan os.Signal)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGHUP, SIGUSR1)
+	signal.Notify(sigChan, syscall.SIGINT)
+
+	// SIGUSR1 reopens the log file after external log rotation.
+	reopenChan := make(chan os.Signal, 1)
+	signal.Notify(reopenChan, SIGUSR1)
+
+	// SIGHUP reloads the configuration file and TLS certificates.
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
+
+	// SIGTERM drains client connections before shutting down.
+	drainChan := make(chan os.Signal, 1)
+	signal.Notify(drainChan, syscall.SIGTERM)
 
 	// And we're underway!
 	errChan := app.Run()
 
 	logger := app.Logger()
 	exitCode := 0
-	select {
-	case err = <-errChan:
-		exitCode = 1
-		if logger.ShouldLog(simplepush.ERROR) {
-			logger.Error("main", "Run encountered an error; shutting down.",
-				simplepush.LogFields{"error": err.Error()})
-		}
+	for done := false; !done; {
+		select {
+		case err = <-errChan:
+			exitCode = 1
+			done = true
+			if logger.ShouldLog(simplepush.ERROR) {
+				logger.Error("main", "Run encountered an error; shutting down.",
+					simplepush.LogFields{"error": err.Error()})
+			}
+
+		case <-drainChan:
+			if logger.ShouldLog(simplepush.INFO) {
+				logger.Info("main", "Received SIGTERM, draining connections.", nil)
+			}
+			app.Drain()
+
+		case <-reloadChan:
+			if logger.ShouldLog(simplepush.INFO) {
+				logger.Info("main", "Received SIGHUP, reloading configuration.", nil)
+			}
+			reload(app)
+			if err := app.ReloadCertificates(); err != nil {
+				if logger.ShouldLog(simplepush.ERROR) {
+					logger.Error("main", "Error reloading TLS certificates",
+						simplepush.LogFields{"error": err.Error()})
+				}
+			}
+
+		case <-reopenChan:
+			if err := logger.Reopen(); err != nil {
+				if logger.ShouldLog(simplepush.ERROR) {
+					logger.Error("main", "Error reopening log file",
+						simplepush.LogFields{"error": err.Error()})
+				}
+			} else if logger.ShouldLog(simplepush.INFO) {
+				logger.Info("main", "Received SIGUSR1, reopened log file.", nil)
+			}
+
+		case <-app.Drained():
+			done = true
+			if logger.ShouldLog(simplepush.INFO) {
+				logger.Info("main", "Connections drained, shutting down.", nil)
+			}
 
-	case <-sigChan:
-		if logger.ShouldLog(simplepush.INFO) {
-			logger.Info("main", "Recieved signal, shutting down.", nil)
+		case <-sigChan:
+			done = true
+			if logger.ShouldLog(simplepush.INFO) {
+				logger.Info("main", "Recieved signal, shutting down.", nil)
+			}
 		}
 	}
 	if err = app.Close(); err != nil {
 		log.Fatalf("Error shutting down: %s", err)
 	}
+	// Write any queued log messages before exiting.
+	logger.Close()
 	os.Exit(exitCode)
 }
 
+// check validates the configuration file without starting the server, and
+// prints the resolved configuration if requested. Returns the exit code.
+func check() int {
+	sections, errs := simplepush.CheckApplicationFromFileName(*configFile)
+	if *printConfig {
+		if err := simplepush.WriteConfig(os.Stdout, sections); err != nil {
+			log.Fatalf("Error printing configuration: %s", err)
+		}
+	}
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(errs) > 0 {
+		return 1
+	}
+	if *checkConfig {
+		fmt.Fprintf(os.Stderr, "Configuration file %s is valid\n", *configFile)
+	}
+	return 0
+}
+
+// reload re-reads the configuration file, and logs the settings applied to the
+// running server and the settings that require a restart.
+func reload(app *simplepush.Application) {
+	logger := app.Logger()
+	result, err := simplepush.ReloadApplicationFromFileName(app, *configFile)
+	if err != nil && logger.ShouldLog(simplepush.ERROR) {
+		logger.Error("main", "Error reloading configuration",
+			simplepush.LogFields{"error": err.Error()})
+	}
+	if result == nil {
+		return
+	}
+	if logger.ShouldLog(simplepush.INFO) {
+		logger.Info("main", "Applied configuration changes", simplepush.LogFields{
+			"applied": strings.Join(result.Applied, ", ")})
+	}
+	if len(result.Rejected) > 0 && logger.ShouldLog(simplepush.WARNING) {
+		logger.Warn("main", "Rejected configuration changes; restart to apply",
+			simplepush.LogFields{"rejected": strings.Join(result.Rejected, ", ")})
+	}
+}
+
 // 04fs
 // vim: set tabstab=4 softtabstop=4 shiftwidth=4 noexpandtab
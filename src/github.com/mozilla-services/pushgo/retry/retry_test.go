@@ -150,6 +150,35 @@ func TestRetryAttempt(t *testing.T) {
 	}
 }
 
+func TestRetryDelay(t *testing.T) {
+	rh := &Helper{
+		Backoff:   2,
+		Retries:   5,
+		Delay:     100 * time.Millisecond,
+		MaxDelay:  1 * time.Second,
+		MaxJitter: 50 * time.Millisecond,
+	}
+	expectedDelays := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		1 * time.Second,
+		1 * time.Second,
+	}
+	rand.Seed(1)
+	for i := range expectedDelays {
+		expectedDelays[i] += time.Duration(rand.Int63n(int64(rh.MaxJitter)))
+	}
+	rand.Seed(1)
+	for i, expected := range expectedDelays {
+		attempt := i + 1
+		if actual := rh.RetryDelay(attempt); actual != expected {
+			t.Errorf("Wrong delay for attempt %d: got %s; want %s", attempt, actual, expected)
+		}
+	}
+}
+
 func TestCanRetry(t *testing.T) {
 	defer func() {
 		timeAfter = time.After
@@ -16,11 +16,18 @@ import (
 	"sync/atomic"
 	"text/template"
 	"time"
+
+	"github.com/kitcambridge/envconf"
+	"github.com/mozilla-services/pushgo/retry"
 )
 
 // The Simple Push server version.
 const VERSION = "1.5.0"
 
+// minClientAckTimeout is the shortest allowed client ACK timeout. Unacked
+// updates are checked at half this interval.
+const minClientAckTimeout = 1 * time.Second
+
 var (
 	ErrMissingOrigin = errors.New("Missing WebSocket origin")
 	ErrInvalidOrigin = errors.New("WebSocket origin not allowed")
@@ -36,12 +43,29 @@ type ApplicationConfig struct {
 	ClientHelloTimeout string `toml:"client_hello_timeout" env:"client_hello_timeout"`
 	PushLongPongs      bool   `toml:"push_long_pongs" env:"push_long_pongs"`
 	ClientPongInterval string `toml:"client_pong_interval" env:"client_pong_interval"`
+	ClientAckTimeout   string `toml:"client_ack_timeout" env:"client_ack_timeout"`
+	ClientRedeliveries int    `toml:"client_max_redeliveries" env:"client_max_redeliveries"`
+	ClientQueueSize    int    `toml:"client_queue_size" env:"client_queue_size"`
+	ClientWriteTimeout string `toml:"client_write_timeout" env:"client_write_timeout"`
+	ClientBatchWindow  string `toml:"client_batch_window" env:"client_batch_window"`
+	DeviceAuth         bool   `toml:"device_auth" env:"device_auth"`
+	DeviceAuthMigrate  bool   `toml:"device_auth_migrate" env:"device_auth_migrate"`
+
+	// Tracing configures distributed tracing for updates.
+	Tracing TracingConfig `toml:"tracing" env:"tracing"`
+
+	// Receipts configures delivery receipts for app servers.
+	Receipts ReceiptsConfig `toml:"receipts" env:"receipts"`
+
+	// Drain configures connection draining on shutdown.
+	Drain DrainConfig `toml:"drain" env:"drain"`
 }
 
 func NewApplication() (a *Application) {
 	a = &Application{
-		workers:   make(map[string]Worker),
-		closeChan: make(chan bool),
+		workers:     make(map[string]Worker),
+		closeChan:   make(chan bool),
+		drainedChan: make(chan bool),
 	}
 	return a
 }
@@ -51,11 +75,16 @@ type Application struct {
 	hostname           string
 	host               string
 	port               int
-	clientMinPing      time.Duration
 	clientHelloTimeout time.Duration
 	clientPongInterval time.Duration
+	clientAckTimeout   time.Duration
+	clientRedeliveries int
+	clientQueueSize    int
+	clientWriteTimeout time.Duration
+	clientBatchWindow  time.Duration
 	pushLongPongs      bool
-	tokenKey           []byte
+	deviceAuth         bool
+	deviceAuthMigrate  bool
 	endpointTemplate   *template.Template
 	log                *SimpleLogger
 	metrics            Statistician
@@ -69,9 +98,26 @@ type Application struct {
 	sh                 Handler // WebSocket handler.
 	eh                 Handler // HTTP update handler.
 	ph                 Handler // Performance profiling handlers.
+	ah                 Handler // Admin API handlers.
 	propping           PropPinger
+	tracer             *Tracer
+	receipts           *ReceiptDispatcher
+	drainRate          int
+	drainDeadline      time.Duration
+	drainRedirect      bool
+	drainOnce          Once
+	drainedChan        chan bool
+	balancerOnce       Once
+	locatorOnce        Once
 	closeChan          chan bool
 	closeOnce          Once
+
+	configFile ConfigFile // The configuration used to load the app.
+	configEnv  envconf.Environment
+
+	settingsLock  sync.RWMutex // Protects settings changed by reloads.
+	clientMinPing time.Duration
+	tokenKey      []byte
 }
 
 func (a *Application) ConfigStruct() interface{} {
@@ -83,6 +129,32 @@ func (a *Application) ConfigStruct() interface{} {
 		ResolveHost:        false,
 		ClientMinPing:      "20s",
 		ClientHelloTimeout: "30s",
+		ClientRedeliveries: 3,
+		ClientQueueSize:    32,
+		ClientWriteTimeout: "10s",
+		Tracing: TracingConfig{
+			Exporter:      "otlp",
+			Endpoint:      "http://localhost:4318/v1/traces",
+			ServiceName:   "pushgo",
+			BatchSize:     100,
+			FlushInterval: "5s",
+		},
+		Receipts: ReceiptsConfig{
+			Expiry:  "72h",
+			Workers: 10,
+			MaxSize: 1000,
+			Timeout: "10s",
+			Retry: retry.Config{
+				Retries:   5,
+				Delay:     "1s",
+				MaxDelay:  "5m",
+				MaxJitter: "1s",
+			},
+		},
+		Drain: DrainConfig{
+			Rate:     100,
+			Deadline: "5m",
+		},
 	}
 }
 
@@ -129,10 +201,143 @@ func (a *Application) Init(_ *Application, config interface{}) (err error) {
 		return fmt.Errorf("Unable to parse 'client_hello_timeout': %s",
 			err.Error())
 	}
+	if len(conf.ClientAckTimeout) > 0 {
+		if a.clientAckTimeout, err = time.ParseDuration(conf.ClientAckTimeout); err != nil {
+			return fmt.Errorf("Unable to parse 'client_ack_timeout': %s",
+				err.Error())
+		}
+		if err = checkAckTimeout(a.clientAckTimeout); err != nil {
+			return err
+		}
+	}
+	a.clientRedeliveries = conf.ClientRedeliveries
+	a.clientQueueSize = conf.ClientQueueSize
+	if len(conf.ClientWriteTimeout) > 0 {
+		if a.clientWriteTimeout, err = time.ParseDuration(conf.ClientWriteTimeout); err != nil {
+			return fmt.Errorf("Unable to parse 'client_write_timeout': %s",
+				err.Error())
+		}
+	}
+	if len(conf.ClientBatchWindow) > 0 {
+		if a.clientBatchWindow, err = time.ParseDuration(conf.ClientBatchWindow); err != nil {
+			return fmt.Errorf("Unable to parse 'client_batch_window': %s",
+				err.Error())
+		}
+	}
 	a.pushLongPongs = conf.PushLongPongs
+	a.deviceAuth = conf.DeviceAuth
+	a.deviceAuthMigrate = conf.DeviceAuthMigrate
+	if conf.Tracing.Enabled {
+		if a.tracer, err = NewTracer(a, &conf.Tracing); err != nil {
+			return fmt.Errorf("Error configuring tracing: %s", err)
+		}
+	}
+	a.drainRate = conf.Drain.Rate
+	a.drainRedirect = conf.Drain.Redirect
+	a.drainDeadline = defaultDrainDeadline
+	if len(conf.Drain.Deadline) > 0 {
+		if a.drainDeadline, err = time.ParseDuration(conf.Drain.Deadline); err != nil {
+			return fmt.Errorf("Unable to parse 'drain.deadline': %s", err.Error())
+		}
+	}
+	if conf.Receipts.Enabled {
+		if a.receipts, err = NewReceiptDispatcher(a, &conf.Receipts); err != nil {
+			return fmt.Errorf("Error configuring receipts: %s", err)
+		}
+	}
 	return
 }
 
+// CheckConfig validates the application settings. Implements
+// ConfigChecker.CheckConfig().
+func (a *Application) CheckConfig(config interface{}) (err error) {
+	conf := config.(*ApplicationConfig)
+	if !conf.UseAwsHost && len(conf.Hostname) == 0 {
+		return fmt.Errorf("Missing 'current_host'")
+	}
+	if len(conf.TokenKey) > 0 {
+		key, err := base64.URLEncoding.DecodeString(conf.TokenKey)
+		if err != nil {
+			return fmt.Errorf("Malformed token key: %s", err)
+		}
+		if n := len(key); n != 16 && n != 24 && n != 32 {
+			return fmt.Errorf("Token key must be 16, 24, or 32 bytes; got %d", n)
+		}
+	}
+	if _, err = template.New("Push").Parse(conf.PushEndpoint); err != nil {
+		return fmt.Errorf("Error parsing push endpoint template: %s", err)
+	}
+	if err = checkDuration("client_min_ping_interval", conf.ClientMinPing); err != nil {
+		return err
+	}
+	if err = checkDuration("client_hello_timeout", conf.ClientHelloTimeout); err != nil {
+		return err
+	}
+	// Optional durations.
+	for _, setting := range []struct{ name, value string }{
+		{"client_pong_interval", conf.ClientPongInterval},
+		{"client_ack_timeout", conf.ClientAckTimeout},
+		{"client_write_timeout", conf.ClientWriteTimeout},
+		{"client_batch_window", conf.ClientBatchWindow},
+		{"drain.deadline", conf.Drain.Deadline},
+	} {
+		if len(setting.value) == 0 {
+			continue
+		}
+		if err = checkDuration(setting.name, setting.value); err != nil {
+			return err
+		}
+	}
+	if len(conf.ClientAckTimeout) > 0 {
+		timeout, _ := time.ParseDuration(conf.ClientAckTimeout)
+		if err = checkAckTimeout(timeout); err != nil {
+			return err
+		}
+	}
+	if conf.Tracing.Enabled {
+		switch conf.Tracing.Exporter {
+		case "otlp":
+			if err = checkURL("tracing.endpoint", conf.Tracing.Endpoint); err != nil {
+				return err
+			}
+		case "memory":
+		default:
+			return ErrUnknownExporter
+		}
+		if len(conf.Tracing.FlushInterval) > 0 {
+			err = checkDuration("tracing.flush_interval", conf.Tracing.FlushInterval)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if conf.Receipts.Enabled {
+		if len(conf.Receipts.Key) == 0 {
+			return fmt.Errorf("Missing receipt signing key")
+		}
+		if err = checkDuration("receipts.expiry", conf.Receipts.Expiry); err != nil {
+			return err
+		}
+		if err = checkDuration("receipts.timeout", conf.Receipts.Timeout); err != nil {
+			return err
+		}
+		if _, err = conf.Receipts.Retry.NewHelper(); err != nil {
+			return fmt.Errorf("Invalid receipt retry settings: %s", err)
+		}
+	}
+	return nil
+}
+
+// checkAckTimeout rejects client ACK timeouts too short to redeliver updates.
+// A timeout of 0 disables redelivery.
+func checkAckTimeout(timeout time.Duration) error {
+	if timeout != 0 && timeout < minClientAckTimeout {
+		return fmt.Errorf("'client_ack_timeout' must be 0 or at least %s; got %s",
+			minClientAckTimeout, timeout)
+	}
+	return nil
+}
+
 // Set a logger
 func (a *Application) SetLogger(logger Logger) (err error) {
 	a.log, err = NewLogger(logger)
@@ -150,10 +355,26 @@ func (a *Application) SetMetrics(metrics Statistician) error {
 }
 
 func (a *Application) SetStore(store Store) error {
+	if a.deviceAuth {
+		if _, ok := store.(DeviceAuthStore); !ok {
+			return ErrNoDeviceAuth
+		}
+	}
+	if a.receipts != nil {
+		if _, ok := store.(ReceiptStore); !ok {
+			return ErrNoReceiptStore
+		}
+	}
 	a.store = store
 	return nil
 }
 
+// SetTracer sets the tracer used to record spans for updates.
+func (a *Application) SetTracer(tracer *Tracer) error {
+	a.tracer = tracer
+	return nil
+}
+
 func (a *Application) SetRouter(router Router) error {
 	a.router = router
 	return nil
@@ -184,14 +405,35 @@ func (a *Application) SetProfileHandlers(h Handler) error {
 	return nil
 }
 
+func (a *Application) SetAdminHandlers(h Handler) error {
+	a.ah = h
+	return nil
+}
+
 // Start the application
 func (a *Application) Run() (errChan chan error) {
-	errChan = make(chan error, 4)
+	errChan = make(chan error, 5)
 
 	go a.sh.Start(errChan)
 	go a.eh.Start(errChan)
 	go a.router.Start(errChan)
 	go a.ph.Start(errChan)
+	if a.ah != nil {
+		go a.ah.Start(errChan)
+	}
+
+	if a.tracer != nil {
+		a.tracer.Start()
+	}
+	if a.receipts != nil {
+		a.receipts.Start()
+	}
+
+	for _, certs := range a.certStores() {
+		if certs.WatchInterval > 0 {
+			go a.watchCerts(certs)
+		}
+	}
 
 	go a.sendClientCount()
 	return errChan
@@ -222,6 +464,16 @@ func (a *Application) Metrics() Statistician {
 	return a.metrics
 }
 
+// Tracer returns the tracer, or nil if tracing is disabled.
+func (a *Application) Tracer() *Tracer {
+	return a.tracer
+}
+
+// Receipts returns the receipt dispatcher, or nil if receipts are disabled.
+func (a *Application) Receipts() *ReceiptDispatcher {
+	return a.receipts
+}
+
 func (a *Application) Router() Router {
 	return a.router
 }
@@ -246,17 +498,86 @@ func (a *Application) ProfileHandlers() Handler {
 	return a.ph
 }
 
+func (a *Application) AdminHandlers() Handler {
+	return a.ah
+}
+
 func (a *Application) TokenKey() []byte {
+	a.settingsLock.RLock()
+	defer a.settingsLock.RUnlock()
 	return a.tokenKey
 }
 
 func (a *Application) SetTokenKey(key string) (err error) {
-	if len(key) == 0 {
-		a.tokenKey = nil
+	var tokenKey []byte
+	if len(key) > 0 {
+		if tokenKey, err = base64.URLEncoding.DecodeString(key); err != nil {
+			return err
+		}
+	}
+	a.settingsLock.Lock()
+	a.tokenKey = tokenKey
+	a.settingsLock.Unlock()
+	return nil
+}
+
+// ClientMinPing returns the minimum interval between client pings.
+func (a *Application) ClientMinPing() time.Duration {
+	a.settingsLock.RLock()
+	defer a.settingsLock.RUnlock()
+	return a.clientMinPing
+}
+
+// Reload applies the token key and minimum client ping interval from a
+// reloaded configuration. Other application settings require a restart.
+// Implements Reloader.Reload().
+func (a *Application) Reload(config interface{}, changed []string) (
+	rejected []string, err error) {
+
+	conf := config.(*ApplicationConfig)
+	apply, rejected := liveSettings(changed, "client_min_ping_interval",
+		"token_key")
+	if apply["client_min_ping_interval"] {
+		var clientMinPing time.Duration
+		if clientMinPing, err = time.ParseDuration(conf.ClientMinPing); err != nil {
+			return nil, fmt.Errorf("Unable to parse 'client_min_ping_interval': %s",
+				err.Error())
+		}
+		a.settingsLock.Lock()
+		a.clientMinPing = clientMinPing
+		a.settingsLock.Unlock()
+	}
+	if apply["token_key"] {
+		if err = a.SetTokenKey(conf.TokenKey); err != nil {
+			return nil, fmt.Errorf("Malformed token key: %s", err)
+		}
+	}
+	return rejected, nil
+}
+
+// config returns the configuration file and environment used to load the
+// app, or nil if the app was not loaded from a file.
+func (a *Application) config() (ConfigFile, envconf.Environment) {
+	return a.configFile, a.configEnv
+}
+
+// setConfig records the configuration used to load the app, for comparison
+// when reloading.
+func (a *Application) setConfig(configFile ConfigFile, env envconf.Environment) {
+	a.configFile = make(ConfigFile, len(configFile))
+	for name, section := range configFile {
+		a.configFile[name] = section
+	}
+	a.configEnv = env
+}
+
+// setSectionConfig records a reloaded configuration section.
+func (a *Application) setSectionConfig(name string, configFile ConfigFile) {
+	if section, ok := configFile[name]; ok {
+		a.configFile[name] = section
 	} else {
-		a.tokenKey, err = base64.URLEncoding.DecodeString(key)
+		delete(a.configFile, name)
 	}
-	return
 }
 
 func (a *Application) WorkerCount() (count int) {
@@ -369,11 +690,9 @@ func (a *Application) close() error {
 			errors = append(errors, err)
 		}
 	}
-	if b := a.Balancer(); b != nil {
-		// Deregister from the balancer.
-		if err := b.Close(); err != nil {
-			errors = append(errors, err)
-		}
+	// Deregister from the balancer, unless the node has already drained.
+	if err := a.closeBalancer(); err != nil {
+		errors = append(errors, err)
 	}
 	if sh := a.SocketHandler(); sh != nil {
 		// Close the WebSocket listener.
@@ -385,11 +704,9 @@ func (a *Application) close() error {
 	a.closeWorkers()
 	// Stop publishing client counts.
 	close(a.closeChan)
-	if l := a.Locator(); l != nil {
-		// Deregister from the discovery service.
-		if err := a.locator.Close(); err != nil {
-			errors = append(errors, err)
-		}
+	// Deregister from the discovery service.
+	if err := a.closeLocator(); err != nil {
+		errors = append(errors, err)
 	}
 	if r := a.Router(); r != nil {
 		// Close the routing listener.
@@ -403,6 +720,24 @@ func (a *Application) close() error {
 			errors = append(errors, err)
 		}
 	}
+	if ah := a.AdminHandlers(); ah != nil {
+		// Stop the admin listener.
+		if err := ah.Close(); err != nil {
+			errors = append(errors, err)
+		}
+	}
+	if t := a.Tracer(); t != nil {
+		// Export the remaining spans.
+		if err := t.Close(); err != nil {
+			errors = append(errors, err)
+		}
+	}
+	if d := a.Receipts(); d != nil {
+		// Stop sending receipts.
+		if err := d.Close(); err != nil {
+			errors = append(errors, err)
+		}
+	}
 	if s := a.Store(); s != nil {
 		// Close database connections.
 		if err := s.Close(); err != nil {
@@ -417,6 +752,8 @@ func (a *Application) close() error {
 
 func (a *Application) sendClientCount() {
 	metrics := a.Metrics()
+	logger := a.Logger()
+	var lastDropped int64
 	ticker := time.NewTicker(1 * time.Second)
 	for ok := true; ok; {
 		select {
@@ -424,6 +761,80 @@ func (a *Application) sendClientCount() {
 		case <-ticker.C:
 			metrics.Gauge("goroutines", int64(runtime.NumGoroutine()))
 			metrics.Gauge("update.client.connections", int64(a.WorkerCount()))
+			if logger == nil {
+				continue
+			}
+			if dropped := logger.DroppedMessages(); dropped > lastDropped {
+				metrics.IncrementBy("logging.dropped", dropped-lastDropped)
+				lastDropped = dropped
+			}
+		}
+	}
+	ticker.Stop()
+}
+
+// certStores returns the certificate stores of all TLS listeners.
+func (a *Application) certStores() (stores []*CertStore) {
+	handlers := []interface{}{a.sh, a.eh, a.router, a.ph, a.ah}
+	for _, h := range handlers {
+		lh, ok := h.(interface {
+			Listener() net.Listener
+		})
+		if !ok {
+			continue
+		}
+		if ln, ok := lh.Listener().(*TLSListener); ok {
+			stores = append(stores, ln.Certs)
+		}
+	}
+	return stores
+}
+
+// ReloadCertificates reloads the certificates of all TLS listeners. A
+// listener keeps its current certificates if any of its new certificates
+// fail to load.
+func (a *Application) ReloadCertificates() error {
+	var errors MultipleError
+	for _, certs := range a.certStores() {
+		if err := certs.Reload(); err != nil {
+			errors = append(errors, err)
+		}
+	}
+	if len(errors) > 0 {
+		return errors
+	}
+	return nil
+}
+
+// watchCerts reloads certs when the certificate files change.
+func (a *Application) watchCerts(certs *CertStore) {
+	metrics := a.Metrics()
+	logger := a.Logger()
+	ticker := time.NewTicker(certs.WatchInterval)
+	for ok := true; ok; {
+		select {
+		case ok = <-a.closeChan:
+		case <-ticker.C:
+			modified, err := certs.Modified()
+			if err == nil && !modified {
+				continue
+			}
+			if err == nil {
+				err = certs.Reload()
+			}
+			if err != nil {
+				metrics.Increment("tls.reload.error")
+				if logger.ShouldLog(WARNING) {
+					logger.Warn("app", "Error reloading TLS certificates",
+						LogFields{"certs": certs.String(), "error": err.Error()})
+				}
+				continue
+			}
+			metrics.Increment("tls.reload")
+			if logger.ShouldLog(INFO) {
+				logger.Info("app", "Reloaded TLS certificates",
+					LogFields{"certs": certs.String()})
+			}
 		}
 	}
 	ticker.Stop()
@@ -19,3 +19,10 @@ type Balancer interface {
 	// Close stops and releases any resources associated with the balancer.
 	Close() error
 }
+
+// A PeerChooser is a Balancer that can choose a peer regardless of the number
+// of connected clients. Draining nodes use it to redirect their clients.
+type PeerChooser interface {
+	// ChoosePeer returns the origin of a peer that can accept clients.
+	ChoosePeer() (origin string, ok bool, err error)
+}
@@ -0,0 +1,265 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bbangert/toml"
+	"github.com/kitcambridge/envconf"
+)
+
+// A ConfigChecker validates a configuration struct without initializing the
+// plugin. CheckConfig should not open listeners or connect to remote
+// services.
+type ConfigChecker interface {
+	CheckConfig(config interface{}) error
+}
+
+// ConfigSection is a resolved configuration section.
+type ConfigSection struct {
+	Name   string
+	Type   string      // The plugin type, for sections with a "type" setting.
+	Config interface{} // The config struct, with environment overrides.
+}
+
+// secretSettings lists the settings redacted by WriteConfig.
+var secretSettings = map[string]bool{
+	"token_key": true, // Endpoint token encryption key.
+	"key":       true, // Receipt signing key.
+	"token":     true, // Admin API bearer token.
+	"api_key":   true, // GCM API key.
+}
+
+// checkSection describes a configuration section to check.
+type checkSection struct {
+	name       string
+	extensions AvailableExtensions // Plugin types, for sections with a "type".
+	newPlugin  func() HasConfigStruct
+	optional   bool // The section may be omitted.
+}
+
+// checkSections returns the configuration sections, in load order.
+func checkSections() []checkSection {
+	return []checkSection{
+		{"default", nil, func() HasConfigStruct { return NewApplication() }, false},
+		{"logging", AvailableLoggers, nil, false},
+		{"metrics", nil, func() HasConfigStruct { return new(Metrics) }, false},
+		{"storage", AvailableStores, nil, false},
+		{"propping", AvailablePings, nil, false},
+		{"router", AvailableRouters, nil, false},
+		{"discovery", AvailableLocators, nil, false},
+		{"websocket", nil, func() HasConfigStruct { return NewSocketHandler() }, false},
+		{"balancer", AvailableBalancers, nil, false},
+		{"endpoint", nil, func() HasConfigStruct { return NewEndpointHandler() }, false},
+		{"profile", nil, func() HasConfigStruct { return new(ProfileHandlers) }, true},
+		{"admin", nil, func() HasConfigStruct { return NewAdminHandlers() }, true},
+	}
+}
+
+// CheckApplicationFromFileName reads a TOML configuration file and validates
+// each section, without loading the application.
+func CheckApplicationFromFileName(filename string) (
+	sections []ConfigSection, errs []error) {
+
+	var configFile ConfigFile
+	if _, err := toml.DecodeFile(filename, &configFile); err != nil {
+		return nil, []error{fmt.Errorf("Error decoding config file: %s", err)}
+	}
+	env := envconf.Load()
+	return CheckApplication(configFile, env)
+}
+
+// CheckApplication decodes every section of configFile, applying environment
+// overrides, and validates the settings of plugins that implement
+// ConfigChecker. Unlike LoadApplication, unknown settings are reported for
+// all sections. The resolved sections are returned with all errors found.
+func CheckApplication(configFile ConfigFile, env envconf.Environment) (
+	sections []ConfigSection, errs []error) {
+
+	for _, section := range checkSections() {
+		resolved, err := section.check(env, configFile)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if resolved != nil {
+			sections = append(sections, *resolved)
+		}
+	}
+	return sections, errs
+}
+
+// check decodes and validates the section. check may return a resolved
+// section with an error if the section decoded, but failed validation.
+func (s checkSection) check(env envconf.Environment, configFile ConfigFile) (
+	resolved *ConfigSection, err error) {
+
+	var obj HasConfigStruct
+	conf, ok := configFile[s.name]
+	if s.extensions != nil {
+		if !ok {
+			return nil, fmt.Errorf("Missing section '%s'", s.name)
+		}
+		if obj, err = newExtension(s.name, s.extensions, env, conf); err != nil {
+			return nil, err
+		}
+	} else {
+		if !ok && !s.optional {
+			return nil, fmt.Errorf("Missing section '%s'", s.name)
+		}
+		obj = s.newPlugin()
+	}
+	resolved = &ConfigSection{Name: s.name, Type: extensionName(s.extensions, obj)}
+	if ok {
+		resolved.Config, err = LoadConfigStruct(s.name, env, conf, obj)
+	} else if resolved.Config = obj.ConfigStruct(); resolved.Config != nil {
+		err = env.Decode(toEnvName(s.name), EnvSep, resolved.Config)
+		if err != nil {
+			err = fmt.Errorf("Invalid environment variable for section '%s': %s",
+				s.name, err)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resolved.Config == nil {
+		return resolved, nil
+	}
+	if checker, ok := obj.(ConfigChecker); ok {
+		if err = checker.CheckConfig(resolved.Config); err != nil {
+			return resolved, fmt.Errorf("Invalid config for section '%s': %s",
+				s.name, err)
+		}
+	}
+	return resolved, nil
+}
+
+// extensionName returns the registered name of an extensible plugin.
+func extensionName(extensions AvailableExtensions, obj HasConfigStruct) string {
+	typ := reflect.TypeOf(obj)
+	for name, ext := range extensions {
+		if name != "default" && reflect.TypeOf(ext()) == typ {
+			return name
+		}
+	}
+	return ""
+}
+
+// WriteConfig writes resolved configuration sections as TOML. Secret settings
+// are redacted.
+func WriteConfig(w io.Writer, sections []ConfigSection) error {
+	bw := bufio.NewWriter(w)
+	for i, section := range sections {
+		if i > 0 {
+			bw.WriteString("\n")
+		}
+		fmt.Fprintf(bw, "[%s]\n", section.Name)
+		if len(section.Type) > 0 {
+			fmt.Fprintf(bw, "type = %s\n", strconv.Quote(section.Type))
+		}
+		if section.Config != nil {
+			writeConfigTable(bw, section.Name, reflect.ValueOf(section.Config))
+		}
+	}
+	return bw.Flush()
+}
+
+// writeConfigTable writes the settings of a config struct, followed by its
+// nested structs as subtables.
+func writeConfigTable(w *bufio.Writer, table string, v reflect.Value) {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+	typ := v.Type()
+	var tables []int
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if len(field.PkgPath) > 0 {
+			continue
+		}
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct ||
+			fv.Kind() == reflect.Ptr && fv.Elem().Kind() == reflect.Struct {
+
+			tables = append(tables, i)
+			continue
+		}
+		key := configKey(field)
+		if secretSettings[key] && fv.Kind() == reflect.String && fv.Len() > 0 {
+			fmt.Fprintf(w, "%s = \"[redacted]\"\n", key)
+			continue
+		}
+		if value, ok := formatConfigValue(fv); ok {
+			fmt.Fprintf(w, "%s = %s\n", key, value)
+		}
+	}
+	for _, i := range tables {
+		name := table + "." + configKey(typ.Field(i))
+		fmt.Fprintf(w, "\n[%s]\n", name)
+		writeConfigTable(w, name, v.Field(i))
+	}
+}
+
+// formatConfigValue formats a setting as a TOML value. ok is false if the
+// setting cannot be represented in TOML.
+func formatConfigValue(v reflect.Value) (value string, ok bool) {
+	switch v.Kind() {
+	case reflect.String:
+		return strconv.Quote(v.String()), true
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), true
+	case reflect.Float32, reflect.Float64:
+		value = strconv.FormatFloat(v.Float(), 'g', -1, 64)
+		if !strings.ContainsAny(value, ".eEn") {
+			// TOML floats require a fractional part.
+			value += ".0"
+		}
+		return value, true
+	case reflect.Slice, reflect.Array:
+		values := make([]string, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			if value, ok = formatConfigValue(v.Index(i)); !ok {
+				return "", false
+			}
+			values = append(values, value)
+		}
+		return "[" + strings.Join(values, ", ") + "]", true
+	}
+	return "", false
+}
+
+// checkDuration validates a duration setting.
+func checkDuration(name, value string) error {
+	if _, err := time.ParseDuration(value); err != nil {
+		return fmt.Errorf("Unable to parse '%s': %s", name, err)
+	}
+	return nil
+}
+
+// checkURL validates an absolute URL setting.
+func checkURL(name, value string) error {
+	u, err := url.ParseRequestURI(value)
+	if err != nil {
+		return fmt.Errorf("Unable to parse '%s': %s", name, err)
+	}
+	if len(u.Scheme) == 0 || len(u.Host) == 0 {
+		return fmt.Errorf("Invalid '%s': %q is not an absolute URL", name, value)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/bbangert/toml"
+	"github.com/kitcambridge/envconf"
+)
+
+func TestCheckApplication(t *testing.T) {
+	var configFile ConfigFile
+	if _, err := toml.Decode(configSource, &configFile); err != nil {
+		t.Fatalf("Error decoding config: %s", err)
+	}
+	sections, errs := CheckApplication(configFile, env)
+	if len(errs) > 0 {
+		t.Fatalf("Unexpected errors checking valid config: %#v", errs)
+	}
+	if len(sections) != len(checkSections()) {
+		t.Errorf("Wrong section count: got %d; want %d",
+			len(sections), len(checkSections()))
+	}
+	buf := new(bytes.Buffer)
+	if err := WriteConfig(buf, sections); err != nil {
+		t.Fatalf("Error writing config: %s", err)
+	}
+	output := buf.String()
+	for _, setting := range []string{
+		"[endpoint]\nmax_data_len = 512\n", // Environment override.
+		"[logging]\ntype = \"stdout\"\nformat = \"text\"\n",
+		"[balancer]\ntype = \"none\"\n",
+		"[websocket.listener]\naddr = \"\"\nmax_connections = 25000\n",
+		"[metrics.gauges]\nprefix = \"\"\nsuffix = \"{{.Host}}\"\n",
+	} {
+		if !strings.Contains(output, setting) {
+			t.Errorf("Missing setting %q in resolved config:\n%s", setting, output)
+		}
+	}
+	// The resolved config should be valid TOML.
+	var resolved ConfigFile
+	if _, err := toml.Decode(output, &resolved); err != nil {
+		t.Errorf("Error decoding resolved config: %s", err)
+	}
+}
+
+func TestCheckApplicationSecrets(t *testing.T) {
+	source := configSource + `
+[admin]
+enabled = true
+token = "s3cr3t"
+`
+	source = strings.Replace(source, "use_aws_host = true",
+		`token_key = "W8FfY9Tw9PtMSEFJF0MAkw=="`, 1)
+	var configFile ConfigFile
+	if _, err := toml.Decode(source, &configFile); err != nil {
+		t.Fatalf("Error decoding config: %s", err)
+	}
+	sections, errs := CheckApplication(configFile, envconf.New(nil))
+	if len(errs) > 0 {
+		t.Fatalf("Unexpected errors checking valid config: %#v", errs)
+	}
+	buf := new(bytes.Buffer)
+	if err := WriteConfig(buf, sections); err != nil {
+		t.Fatalf("Error writing config: %s", err)
+	}
+	output := buf.String()
+	for _, secret := range []string{"W8FfY9Tw9PtMSEFJF0MAkw==", "s3cr3t"} {
+		if strings.Contains(output, secret) {
+			t.Errorf("Secret %q not redacted:\n%s", secret, output)
+		}
+	}
+	for _, setting := range []string{
+		"token_key = \"[redacted]\"\n",
+		"token = \"[redacted]\"\n",
+	} {
+		if !strings.Contains(output, setting) {
+			t.Errorf("Missing setting %q in resolved config:\n%s", setting, output)
+		}
+	}
+}
+
+func TestCheckApplicationErrors(t *testing.T) {
+	source := strings.NewReplacer(
+		"use_aws_host = true", `token_key = "c2hvcnQ="
+client_min_ping_interval = "soon"`,
+		`type = "static"`, `type = "bogus"`,
+		"max_data_len = 256", "max_data_length = 256",
+	).Replace(configSource)
+	var configFile ConfigFile
+	if _, err := toml.Decode(source, &configFile); err != nil {
+		t.Fatalf("Error decoding config: %s", err)
+	}
+	delete(configFile, "router")
+	_, errs := CheckApplication(configFile, envconf.New(nil))
+	want := []string{
+		"Token key must be 16, 24, or 32 bytes; got 5",
+		"Missing section 'router'",
+		"max_data_length",
+		"No type 'bogus' available to load for section 'balancer'",
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("Wrong errors: got %#v; want %#v", errs, want)
+	}
+	for _, err := range errs {
+		found := false
+		for _, msg := range want {
+			if strings.Contains(err.Error(), msg) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("Unexpected error: %s", err)
+		}
+	}
+}
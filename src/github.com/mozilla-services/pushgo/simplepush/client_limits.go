@@ -0,0 +1,188 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Names of the per-client limits, used in errors and metric names.
+const (
+	ClientLimitConns     = "connections"
+	ClientLimitCIDRConns = "cidr_connections"
+	ClientLimitConnRate  = "connection_rate"
+	ClientLimitHelloRate = "hello_rate"
+)
+
+// A ClientLimitError is returned when a client exceeds a per-client limit.
+type ClientLimitError struct {
+	Limit      string
+	RetryAfter time.Duration // Zero for concurrent connection limits.
+}
+
+func (err *ClientLimitError) Error() string {
+	return fmt.Sprintf("Client exceeded %s limit", err.Limit)
+}
+
+// ClientLimitsConfig configures per-client connection and handshake limits.
+// Clients are identified by IP address; the CIDR limit groups addresses by
+// network prefix, to catch clients behind large carrier NATs or spread across
+// a block of addresses. Zero disables a limit.
+type ClientLimitsConfig struct {
+	// MaxConnsPerIP and MaxConnsPerCIDR cap the number of concurrent
+	// connections from a single address or network.
+	MaxConnsPerIP   int `toml:"max_connections_per_ip" env:"max_connections_per_ip"`
+	MaxConnsPerCIDR int `toml:"max_connections_per_cidr" env:"max_connections_per_cidr"`
+
+	// CIDRPrefixV4 and CIDRPrefixV6 are the prefix lengths used to group
+	// addresses for MaxConnsPerCIDR.
+	CIDRPrefixV4 int `toml:"cidr_prefix_v4" env:"cidr_prefix_v4"`
+	CIDRPrefixV6 int `toml:"cidr_prefix_v6" env:"cidr_prefix_v6"`
+
+	// ConnRate and HelloRate are the number of new connections and handshake
+	// attempts allowed per second from each address, with bursts of up to
+	// ConnBurst and HelloBurst.
+	ConnRate   float64 `toml:"connection_rate" env:"connection_rate"`
+	ConnBurst  int     `toml:"connection_burst" env:"connection_burst"`
+	HelloRate  float64 `toml:"hello_rate" env:"hello_rate"`
+	HelloBurst int     `toml:"hello_burst" env:"hello_burst"`
+
+	// MaxTracked is the number of addresses tracked for rate limiting. The
+	// least recently seen address is forgotten once the limit is reached.
+	MaxTracked int `toml:"max_tracked_ips" env:"max_tracked_ips"`
+}
+
+// Enabled indicates whether any limits are set.
+func (conf ClientLimitsConfig) Enabled() bool {
+	return conf.MaxConnsPerIP > 0 || conf.MaxConnsPerCIDR > 0 ||
+		conf.ConnRate > 0 || conf.HelloRate > 0
+}
+
+// Check validates the limit settings.
+func (conf ClientLimitsConfig) Check() error {
+	if conf.MaxConnsPerIP < 0 || conf.MaxConnsPerCIDR < 0 {
+		return fmt.Errorf("Connection limits must not be negative")
+	}
+	if conf.ConnRate < 0 || conf.HelloRate < 0 {
+		return fmt.Errorf("Rate limits must not be negative")
+	}
+	if conf.MaxConnsPerCIDR > 0 {
+		if conf.CIDRPrefixV4 < 1 || conf.CIDRPrefixV4 > 8*net.IPv4len {
+			return fmt.Errorf("Invalid 'cidr_prefix_v4': %d", conf.CIDRPrefixV4)
+		}
+		if conf.CIDRPrefixV6 < 1 || conf.CIDRPrefixV6 > 8*net.IPv6len {
+			return fmt.Errorf("Invalid 'cidr_prefix_v6': %d", conf.CIDRPrefixV6)
+		}
+	}
+	return nil
+}
+
+// NewClientLimiter creates a limiter with the given settings.
+func NewClientLimiter(conf ClientLimitsConfig) *ClientLimiter {
+	l := &ClientLimiter{
+		maxPerIP:   conf.MaxConnsPerIP,
+		maxPerCIDR: conf.MaxConnsPerCIDR,
+		v4Mask:     net.CIDRMask(conf.CIDRPrefixV4, 8*net.IPv4len),
+		v6Mask:     net.CIDRMask(conf.CIDRPrefixV6, 8*net.IPv6len),
+		conns:      make(map[string]int),
+		cidrConns:  make(map[string]int),
+	}
+	if conf.ConnRate > 0 {
+		l.connRate = NewRateLimiter(conf.ConnRate, conf.ConnBurst, conf.MaxTracked)
+	}
+	if conf.HelloRate > 0 {
+		l.helloRate = NewRateLimiter(conf.HelloRate, conf.HelloBurst, conf.MaxTracked)
+	}
+	return l
+}
+
+// A ClientLimiter enforces per-client limits on concurrent connections, new
+// connections, and handshakes. Concurrent connection counts are only kept for
+// clients with open connections, so they are bounded by the listener's
+// maximum connection count.
+type ClientLimiter struct {
+	maxPerIP   int
+	maxPerCIDR int
+	v4Mask     net.IPMask
+	v6Mask     net.IPMask
+	connRate   *RateLimiter
+	helloRate  *RateLimiter
+	connsLock  sync.Mutex // Protects conns and cidrConns.
+	conns      map[string]int
+	cidrConns  map[string]int
+}
+
+// clientIP returns the client IP address of req, without the port.
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// network returns the network prefix used to group ip for the CIDR limit.
+func (l *ClientLimiter) network(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ip
+	}
+	if addr4 := addr.To4(); addr4 != nil {
+		return addr4.Mask(l.v4Mask).String()
+	}
+	return addr.Mask(l.v6Mask).String()
+}
+
+// Acquire records a new connection from ip. If the connection exceeds a
+// limit, Acquire returns a *ClientLimitError; otherwise, the caller must
+// call Release once the connection is closed.
+func (l *ClientLimiter) Acquire(ip string) error {
+	network := l.network(ip)
+	l.connsLock.Lock()
+	defer l.connsLock.Unlock()
+	if l.maxPerIP > 0 && l.conns[ip] >= l.maxPerIP {
+		return &ClientLimitError{Limit: ClientLimitConns}
+	}
+	if l.maxPerCIDR > 0 && l.cidrConns[network] >= l.maxPerCIDR {
+		return &ClientLimitError{Limit: ClientLimitCIDRConns}
+	}
+	if l.connRate != nil {
+		if ok, retryAfter := l.connRate.Allow(ip); !ok {
+			return &ClientLimitError{ClientLimitConnRate, retryAfter}
+		}
+	}
+	l.conns[ip]++
+	l.cidrConns[network]++
+	return nil
+}
+
+// Release records a closed connection from ip.
+func (l *ClientLimiter) Release(ip string) {
+	network := l.network(ip)
+	l.connsLock.Lock()
+	defer l.connsLock.Unlock()
+	if l.conns[ip]--; l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+	if l.cidrConns[network]--; l.cidrConns[network] <= 0 {
+		delete(l.cidrConns, network)
+	}
+}
+
+// AllowHello records a handshake attempt from ip, returning a
+// *ClientLimitError if the client exceeded the handshake rate.
+func (l *ClientLimiter) AllowHello(ip string) error {
+	if l.helloRate == nil {
+		return nil
+	}
+	if ok, retryAfter := l.helloRate.Allow(ip); !ok {
+		return &ClientLimitError{ClientLimitHelloRate, retryAfter}
+	}
+	return nil
+}
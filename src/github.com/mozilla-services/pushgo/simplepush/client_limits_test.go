@@ -0,0 +1,184 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rafrombrc/gomock/gomock"
+)
+
+func limitName(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.(*ClientLimitError).Limit
+}
+
+func TestClientLimiterConns(t *testing.T) {
+	l := NewClientLimiter(ClientLimitsConfig{
+		MaxConnsPerIP:   2,
+		MaxConnsPerCIDR: 3,
+		CIDRPrefixV4:    24,
+		CIDRPrefixV6:    64,
+	})
+	tests := []struct {
+		ip    string
+		limit string
+	}{
+		{"192.0.2.1", ""},
+		{"192.0.2.1", ""},
+		{"192.0.2.1", ClientLimitConns},
+		{"192.0.2.2", ""},
+		{"192.0.2.3", ClientLimitCIDRConns},
+		{"198.51.100.1", ""},
+		{"2001:db8::1", ""},
+		{"2001:db8::2", ""},
+		{"2001:db8::3", ""},
+		{"2001:db8::4", ClientLimitCIDRConns},
+		{"2001:db8:1::1", ""},
+	}
+	for i, test := range tests {
+		if limit := limitName(l.Acquire(test.ip)); limit != test.limit {
+			t.Errorf("On test %d (%s), got limit %q; want %q", i, test.ip,
+				limit, test.limit)
+		}
+	}
+	l.Release("192.0.2.1")
+	if err := l.Acquire("192.0.2.3"); err != nil {
+		t.Errorf("Error acquiring connection after release: %s", err)
+	}
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		l.Release(ip)
+	}
+	_, ipTracked := l.conns["192.0.2.1"]
+	_, cidrTracked := l.cidrConns["192.0.2.0"]
+	if ipTracked || cidrTracked {
+		t.Errorf("Closed connections not removed: %#v, %#v", l.conns, l.cidrConns)
+	}
+}
+
+func TestClientLimiterRates(t *testing.T) {
+	now := time.Unix(1257894000, 0).UTC()
+	timeNow = func() time.Time { return now }
+	defer useStdFuncs()
+
+	l := NewClientLimiter(ClientLimitsConfig{
+		ConnRate:   1,
+		ConnBurst:  1,
+		HelloRate:  0.5,
+		HelloBurst: 2,
+	})
+	if err := l.Acquire("192.0.2.1"); err != nil {
+		t.Errorf("Error acquiring first connection: %s", err)
+	}
+	err := l.Acquire("192.0.2.1")
+	if limitErr, ok := err.(*ClientLimitError); !ok ||
+		limitErr.Limit != ClientLimitConnRate || limitErr.RetryAfter != time.Second {
+		t.Errorf("Wrong error for connection rate: got %#v", err)
+	}
+	if err := l.Acquire("192.0.2.2"); err != nil {
+		t.Errorf("Error acquiring connection from different IP: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := l.AllowHello("192.0.2.1"); err != nil {
+			t.Errorf("Error on handshake %d: %s", i, err)
+		}
+	}
+	if limit := limitName(l.AllowHello("192.0.2.1")); limit != ClientLimitHelloRate {
+		t.Errorf("Wrong handshake limit: got %q; want %q", limit, ClientLimitHelloRate)
+	}
+	now = now.Add(2 * time.Second)
+	if err := l.AllowHello("192.0.2.1"); err != nil {
+		t.Errorf("Error on handshake after refill: %s", err)
+	}
+}
+
+func TestClientLimitsCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		conf ClientLimitsConfig
+		ok   bool
+	}{
+		{"Disabled", ClientLimitsConfig{}, true},
+		{"Negative connections", ClientLimitsConfig{MaxConnsPerIP: -1}, false},
+		{"Negative rate", ClientLimitsConfig{HelloRate: -1}, false},
+		{"Missing prefix", ClientLimitsConfig{MaxConnsPerCIDR: 5}, false},
+		{"IPv4 prefix too long", ClientLimitsConfig{MaxConnsPerCIDR: 5,
+			CIDRPrefixV4: 33, CIDRPrefixV6: 64}, false},
+		{"CIDR limit", ClientLimitsConfig{MaxConnsPerCIDR: 5,
+			CIDRPrefixV4: 24, CIDRPrefixV6: 64}, true},
+	}
+	for _, test := range tests {
+		if err := test.conf.Check(); (err == nil) != test.ok {
+			t.Errorf("On test %s, got error %v; want ok %v", test.name, err, test.ok)
+		}
+	}
+}
+
+func TestSocketHandlerLimits(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(),
+		gomock.Any(), gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+
+	app := NewApplication()
+	app.SetLogger(mckLogger)
+	app.SetMetrics(mckStat)
+
+	sh := NewSocketHandler()
+	sh.setApp(app)
+	sh.limits = NewClientLimiter(ClientLimitsConfig{MaxConnsPerIP: 1})
+
+	served := make(chan bool)
+	release := make(chan bool)
+	sh.mux.HandleFunc("/status", func(http.ResponseWriter, *http.Request) {
+		served <- true
+		<-release
+	})
+	newRequest := func() *http.Request {
+		req, _ := http.NewRequest("GET", "/status", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		return req
+	}
+
+	// The first connection is held open until released.
+	go sh.serveLimited(httptest.NewRecorder(), newRequest())
+	<-served
+
+	mckStat.EXPECT().Increment("client.limit." + ClientLimitConns)
+	resp := httptest.NewRecorder()
+	sh.serveLimited(resp, newRequest())
+	if resp.Code != http.StatusTooManyRequests {
+		t.Errorf("Wrong status for second connection: got %d; want %d",
+			resp.Code, http.StatusTooManyRequests)
+	}
+	release <- true
+
+	// Wait for the first connection to be released.
+	for i := 0; i < 100; i++ {
+		sh.limits.connsLock.Lock()
+		open := len(sh.limits.conns)
+		sh.limits.connsLock.Unlock()
+		if open == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	go func() { <-served; release <- true }()
+	resp = httptest.NewRecorder()
+	sh.serveLimited(resp, newRequest())
+	if resp.Code != http.StatusOK {
+		t.Errorf("Wrong status after release: got %d; want %d", resp.Code,
+			http.StatusOK)
+	}
+}
@@ -89,6 +89,7 @@ const (
 	PluginEndpoint
 	PluginHealth
 	PluginProfile
+	PluginAdmin
 )
 
 var pluginNames = map[PluginType]string{
@@ -104,6 +105,7 @@ var pluginNames = map[PluginType]string{
 	PluginEndpoint: "endpoint",
 	PluginHealth:   "health",
 	PluginProfile:  "profile",
+	PluginAdmin:    "admin",
 }
 
 func (t PluginType) String() string {
@@ -240,6 +242,14 @@ func (l PluginLoaders) Load(logging int) (*Application, error) {
 	ph := obj.(Handler)
 	app.SetProfileHandlers(ph)
 
+	// Set up the admin API.
+	// Deps: PluginLogger, PluginMetrics, PluginStore, PluginRouter.
+	if obj, err = l.loadPlugin(PluginAdmin, app); err != nil {
+		return nil, err
+	}
+	ah := obj.(Handler)
+	app.SetAdminHandlers(ah)
+
 	return app, nil
 }
 
@@ -332,13 +342,28 @@ func LoadExtensibleSection(app *Application, sectionName string,
 	extensions AvailableExtensions, env envconf.Environment,
 	configFile ConfigFile) (obj HasConfigStruct, err error) {
 
-	confSection := new(ExtensibleGlobals)
-
 	conf, ok := configFile[sectionName]
 	if !ok {
 		return nil, fmt.Errorf("Missing section '%s'", sectionName)
 	}
+	if obj, err = newExtension(sectionName, extensions, env, conf); err != nil {
+		return nil, err
+	}
+	loadedConfig, err := LoadConfigStruct(sectionName, env, conf, obj)
+	if err != nil {
+		return nil, err
+	}
+
+	err = obj.Init(app, loadedConfig)
+	return obj, err
+}
 
+// newExtension returns an uninitialized plugin for an extensible section,
+// chosen by the section's "type" setting.
+func newExtension(sectionName string, extensions AvailableExtensions,
+	env envconf.Environment, conf toml.Primitive) (obj HasConfigStruct, err error) {
+
+	confSection := new(ExtensibleGlobals)
 	if err = toml.PrimitiveDecode(conf, confSection); err != nil {
 		return nil, err
 	}
@@ -351,15 +376,15 @@ func LoadExtensibleSection(app *Application, sectionName string,
 		return nil, fmt.Errorf("No type '%s' available to load for section '%s'",
 			confSection.Typ, sectionName)
 	}
+	return ext(), nil
+}
 
-	obj = ext()
-	loadedConfig, err := LoadConfigStruct(sectionName, env, conf, obj)
-	if err != nil {
-		return nil, err
+// configKey returns the TOML key for a config struct field.
+func configKey(field reflect.StructField) string {
+	if key := field.Tag.Get("toml"); len(key) > 0 {
+		return key
 	}
-
-	err = obj.Init(app, loadedConfig)
-	return obj, err
+	return strings.ToLower(field.Name)
 }
 
 // Handles reading a TOML based configuration file, and loading an
@@ -443,9 +468,28 @@ func LoadApplication(configFile ConfigFile, env envconf.Environment,
 			}
 			return h, nil
 		},
+		PluginAdmin: func(app *Application) (plugin HasConfigStruct, err error) {
+			h := NewAdminHandlers()
+			sectionName := "admin"
+			if _, ok := configFile[sectionName]; ok {
+				// The admin API is optional and disabled by default.
+				err = LoadConfigForSection(app, sectionName, h, env, configFile)
+			} else {
+				confStruct := h.ConfigStruct()
+				err = LoadConfigFromEnvironment(app, sectionName, h, env, confStruct)
+			}
+			if err != nil {
+				return nil, err
+			}
+			return h, nil
+		},
 	}
 
-	return loaders.Load(logging)
+	if app, err = loaders.Load(logging); err != nil {
+		return nil, err
+	}
+	app.setConfig(configFile, env)
+	return app, nil
 }
 
 func toEnvName(params ...string) string {
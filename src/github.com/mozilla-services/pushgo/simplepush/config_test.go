@@ -160,6 +160,7 @@ func TestLoad(t *testing.T) {
 		appInst                                                    *Application
 		mockApp, mockMetrics, mockRouter                           *mockPlugin
 		mockSocket, mockEndpoint, mockHealth, mockProfile          *mockPlugin
+		mockAdmin                                                  *mockPlugin
 		mockLogger, mockStore, mockPing, mockLocator, mockBalancer *mockPlugin
 	)
 	loader := PluginLoaders{
@@ -291,12 +292,23 @@ func TestLoad(t *testing.T) {
 			}
 			return h, nil
 		},
+		PluginAdmin: func(app *Application) (HasConfigStruct, error) {
+			if err := isReady(mockLogger, mockMetrics, mockStore, mockRouter); err != nil {
+				return nil, err
+			}
+			h := NewAdminHandlers()
+			mockAdmin = newMockPlugin(PluginAdmin, h)
+			if err := mockAdmin.Init(app, mockAdmin.ConfigStruct()); err != nil {
+				return nil, fmt.Errorf("Error initializing admin handlers: %s", err)
+			}
+			return h, nil
+		},
 	}
 	app, err := loader.Load(0)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err := isReady(mockHealth); err != nil {
+	if err := isReady(mockHealth, mockAdmin); err != nil {
 		t.Fatal(err)
 	}
 	defer app.Close()
@@ -0,0 +1,59 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+)
+
+var ErrNoDeviceAuth = errors.New(
+	"Storage adapter does not support device authentication")
+
+// A DeviceAuthStore is a Store that can persist device credentials.
+type DeviceAuthStore interface {
+	// FetchDeviceAuth returns the credentials issued to a device, or nil if
+	// the device does not have any.
+	FetchDeviceAuth(suaid string) (*DeviceAuth, error)
+
+	// PutDeviceAuth stores the credentials for a device.
+	PutDeviceAuth(suaid string, auth *DeviceAuth) error
+}
+
+// DeviceAuth holds the credentials issued to a device on its first
+// handshake. Only a hash of the secret is stored, so reading the store is not
+// enough to impersonate a device. On later handshakes, the client must
+// present the secret; clients should only send it over TLS.
+type DeviceAuth struct {
+	SecretHash string `json:"secret"`
+}
+
+// Verify reports whether the secret sent by a client matches the stored
+// credentials.
+func (a *DeviceAuth) Verify(secret string) bool {
+	if len(secret) == 0 {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashDeviceSecret(secret)),
+		[]byte(a.SecretHash)) == 1
+}
+
+// newDeviceToken returns a random hex-encoded 256-bit device secret.
+func newDeviceToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// hashDeviceSecret returns the hex-encoded SHA-256 hash of a device secret.
+func hashDeviceSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
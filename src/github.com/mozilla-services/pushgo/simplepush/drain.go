@@ -0,0 +1,205 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"strconv"
+	"time"
+)
+
+// defaultDrainDeadline is the drain deadline used if none is configured.
+const defaultDrainDeadline = 5 * time.Minute
+
+type DrainConfig struct {
+	// Rate is the maximum number of idle clients closed per second.
+	Rate int
+
+	// Deadline is the maximum time to wait for clients to become idle. Any
+	// remaining clients are closed once the deadline passes. Defaults to
+	// "5m".
+	Deadline string
+
+	// Redirect asks closing clients to reconnect to a peer chosen by the
+	// balancer. The balancer must support choosing peers.
+	Redirect bool
+}
+
+// Drain starts draining the node. The node deregisters from the discovery
+// service and the balancer, then closes idle clients at the configured rate
+// until none remain, or the drain deadline passes. The channel returned by
+// Drained is closed once all clients have disconnected. Drain does not close
+// the application.
+func (a *Application) Drain() error {
+	return a.drainOnce.Do(a.drain)
+}
+
+// Draining indicates whether the node is draining connections.
+func (a *Application) Draining() bool {
+	return a.drainOnce.IsDone()
+}
+
+// Drained returns a channel that is closed once a draining node has closed
+// all client connections.
+func (a *Application) Drained() <-chan bool {
+	return a.drainedChan
+}
+
+func (a *Application) drain() (err error) {
+	logger := a.Logger()
+	if logger.ShouldLog(WARNING) {
+		logger.Warn("app", "Draining client connections", LogFields{
+			"clients":  strconv.Itoa(a.WorkerCount()),
+			"rate":     strconv.Itoa(a.drainRate),
+			"deadline": a.drainDeadline.String()})
+	}
+	a.Metrics().Increment("drain.started")
+	// Stop routing updates and redirecting clients to this node.
+	if err = a.closeBalancer(); err != nil && logger.ShouldLog(ERROR) {
+		logger.Error("app", "Error deregistering from balancer",
+			LogFields{"error": err.Error()})
+	}
+	if err = a.closeLocator(); err != nil && logger.ShouldLog(ERROR) {
+		logger.Error("app", "Error deregistering from discovery service",
+			LogFields{"error": err.Error()})
+	}
+	go a.drainWorkers()
+	return nil
+}
+
+// drainWorkers closes idle clients until none remain, closing the remaining
+// clients once the deadline passes. Clients remain registered until they
+// disconnect, so closing clients are tracked to avoid closing them twice.
+func (a *Application) drainWorkers() {
+	defer close(a.drainedChan)
+	rate := a.drainRate
+	if rate < 1 {
+		rate = 1
+	}
+	ticker := time.NewTicker(time.Second / time.Duration(rate))
+	defer ticker.Stop()
+	var deadline <-chan time.Time
+	if a.drainDeadline > 0 {
+		timer := time.NewTimer(a.drainDeadline)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	closing := make(map[Worker]bool)
+	for a.WorkerCount() > 0 {
+		select {
+		case <-a.closeChan:
+			return
+		case <-deadline:
+			a.forceDrain(closing)
+			return
+		case <-ticker.C:
+			a.drainIdleWorker(closing)
+		}
+	}
+	if logger := a.Logger(); logger.ShouldLog(WARNING) {
+		logger.Warn("app", "Client connections drained", nil)
+	}
+}
+
+// drainIdleWorker closes a client that has acknowledged all updates written
+// to it, skipping clients that are already closing.
+func (a *Application) drainIdleWorker(closing map[Worker]bool) {
+	var worker Worker
+	a.workerMux.RLock()
+	for _, w := range a.workers {
+		if !closing[w] && w.Idle() {
+			worker = w
+			break
+		}
+	}
+	a.workerMux.RUnlock()
+	if worker == nil {
+		return
+	}
+	closing[worker] = true
+	a.redirectWorker(worker)
+	a.Metrics().Increment("drain.closed")
+	worker.Close()
+}
+
+// forceDrain closes all remaining clients once the drain deadline passes.
+// Clients that are already closing are skipped.
+func (a *Application) forceDrain(closing map[Worker]bool) {
+	a.workerMux.RLock()
+	workers := make([]Worker, 0, len(a.workers))
+	for _, worker := range a.workers {
+		if closing[worker] {
+			continue
+		}
+		workers = append(workers, worker)
+	}
+	a.workerMux.RUnlock()
+	if logger := a.Logger(); logger.ShouldLog(WARNING) {
+		logger.Warn("app", "Drain deadline exceeded; closing remaining clients",
+			LogFields{"clients": strconv.Itoa(len(workers))})
+	}
+	a.Metrics().IncrementBy("drain.forced", int64(len(workers)))
+	for _, worker := range workers {
+		a.redirectWorker(worker)
+		worker.Close()
+	}
+}
+
+// redirectWorker asks a closing client to reconnect to a peer, if redirects
+// are enabled.
+func (a *Application) redirectWorker(worker Worker) {
+	if !a.drainRedirect {
+		return
+	}
+	origin, ok := a.drainPeer()
+	if !ok {
+		return
+	}
+	if err := worker.Redirect(origin); err != nil {
+		if logger := a.Logger(); logger.ShouldLog(WARNING) {
+			logger.Warn("app", "Failed to redirect draining client", LogFields{
+				"uaid": worker.UAID(), "error": err.Error()})
+		}
+		return
+	}
+	a.Metrics().Increment("drain.redirected")
+}
+
+// drainPeer chooses a peer for clients of a draining node.
+func (a *Application) drainPeer() (origin string, ok bool) {
+	chooser, ok := a.Balancer().(PeerChooser)
+	if !ok {
+		return "", false
+	}
+	origin, ok, err := chooser.ChoosePeer()
+	if err != nil {
+		if logger := a.Logger(); logger.ShouldLog(WARNING) {
+			logger.Warn("app", "Failed to choose peer for draining client",
+				LogFields{"error": err.Error()})
+		}
+		return "", false
+	}
+	return origin, ok
+}
+
+// closeBalancer deregisters from the balancer. The balancer is closed
+// exactly once, whether the node drains or shuts down.
+func (a *Application) closeBalancer() error {
+	return a.balancerOnce.Do(func() error {
+		if b := a.Balancer(); b != nil {
+			return b.Close()
+		}
+		return nil
+	})
+}
+
+// closeLocator deregisters from the discovery service.
+func (a *Application) closeLocator() error {
+	return a.locatorOnce.Do(func() error {
+		if l := a.Locator(); l != nil {
+			return l.Close()
+		}
+		return nil
+	})
+}
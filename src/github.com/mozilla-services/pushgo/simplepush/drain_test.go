@@ -0,0 +1,98 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rafrombrc/gomock/gomock"
+)
+
+// chooserBalancer adds peer selection to a mock balancer.
+type chooserBalancer struct {
+	*MockBalancer
+	origin string
+}
+
+func (b *chooserBalancer) ChoosePeer() (string, bool, error) {
+	return b.origin, true, nil
+}
+
+func TestDrain(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(false).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+	mckBalancer := NewMockBalancer(mockCtrl)
+	mckLocator := NewMockLocator(mockCtrl)
+
+	app := NewApplication()
+	app.SetLogger(mckLogger)
+	app.SetMetrics(mckStat)
+	app.SetBalancer(&chooserBalancer{mckBalancer, "https://peer.example.com"})
+	app.SetLocator(mckLocator)
+	app.drainRate = 100
+	app.drainDeadline = 100 * time.Millisecond
+	app.drainRedirect = true
+
+	idleID := "f7e9fc483f7344c398701b6fa0e85e4f"
+	idleWorker := NewMockWorker(mockCtrl)
+	app.AddWorker(idleID, idleWorker)
+
+	busyID := "737b7a0d25674be4bb184f015fce02cf"
+	busyWorker := NewMockWorker(mockCtrl)
+	app.AddWorker(busyID, busyWorker)
+
+	gomock.InOrder(
+		mckStat.EXPECT().Increment("drain.started"),
+		mckBalancer.EXPECT().Close(),
+		mckLocator.EXPECT().Close(),
+	)
+	idleWorker.EXPECT().Idle().Return(true).AnyTimes()
+	gomock.InOrder(
+		idleWorker.EXPECT().Redirect("https://peer.example.com"),
+		mckStat.EXPECT().Increment("drain.redirected"),
+		mckStat.EXPECT().Increment("drain.closed"),
+		// Closing clients stay registered until they disconnect, and should
+		// not be closed again.
+		idleWorker.EXPECT().Close().Do(func() {
+			time.AfterFunc(50*time.Millisecond, func() {
+				app.RemoveWorker(idleID, idleWorker)
+			})
+		}),
+	)
+	// The busy worker should be closed once the deadline passes.
+	busyWorker.EXPECT().Idle().Return(false).AnyTimes()
+	gomock.InOrder(
+		mckStat.EXPECT().IncrementBy("drain.forced", int64(1)),
+		busyWorker.EXPECT().Redirect("https://peer.example.com"),
+		mckStat.EXPECT().Increment("drain.redirected"),
+		busyWorker.EXPECT().Close().Do(func() {
+			app.RemoveWorker(busyID, busyWorker)
+		}),
+	)
+
+	if err := app.Drain(); err != nil {
+		t.Fatalf("Error draining connections: %s", err)
+	}
+	if !app.Draining() {
+		t.Errorf("Application not draining after Drain")
+	}
+	select {
+	case <-app.Drained():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for connections to drain")
+	}
+	if n := app.WorkerCount(); n != 0 {
+		t.Errorf("Wrong worker count after draining: %d", n)
+	}
+	// Draining again should not deregister twice.
+	if err := app.Drain(); err != nil {
+		t.Errorf("Error draining drained node: %s", err)
+	}
+}
@@ -122,6 +122,7 @@ type EmceeStore struct {
 	clients        *list.List
 	capacity       int
 	isClosed       bool
+	queueLock      sync.Mutex
 }
 
 // EmceeConf specifies memcached adapter options.
@@ -154,6 +155,31 @@ func (*EmceeStore) ConfigStruct() interface{} {
 	}
 }
 
+// CheckConfig validates the memcached server list and timeouts. Implements
+// ConfigChecker.CheckConfig().
+func (*EmceeStore) CheckConfig(config interface{}) (err error) {
+	conf := config.(*EmceeConf)
+	if len(conf.ElastiCacheConfigEndpoint) == 0 && len(conf.Driver.Hosts) == 0 {
+		return fmt.Errorf("Missing memcached servers")
+	}
+	for _, timeout := range []struct {
+		name      string
+		value     string
+		precision time.Duration
+	}{
+		{"db.handle_timeout", conf.Db.HandleTimeout, time.Millisecond},
+		{"memcache.recv_timeout", conf.Driver.RecvTimeout, time.Microsecond},
+		{"memcache.send_timeout", conf.Driver.SendTimeout, time.Microsecond},
+		{"memcache.poll_timeout", conf.Driver.PollTimeout, time.Millisecond},
+		{"memcache.retry_timeout", conf.Driver.RetryTimeout, time.Second},
+	} {
+		if _, err = parseTimeout(timeout.value, timeout.precision); err != nil {
+			return fmt.Errorf("Invalid '%s': %s", timeout.name, err)
+		}
+	}
+	return nil
+}
+
 // Init initializes the memcached adapter with the given configuration.
 // Implements HasConfigStruct.Init().
 func (s *EmceeStore) Init(app *Application, config interface{}) (err error) {
@@ -336,7 +362,9 @@ func (s *EmceeStore) Exists(uaid string) bool {
 }
 
 // Stores a new channel record in memcached.
-func (s *EmceeStore) storeRegister(uaid, chid string, version int64) error {
+func (s *EmceeStore) storeRegister(uaid, chid string, version int64,
+	accepted time.Time) error {
+
 	chids, err := s.fetchAppIDArray(uaid)
 	if err != nil && !isMissing(err) {
 		return err
@@ -354,6 +382,7 @@ func (s *EmceeStore) storeRegister(uaid, chid string, version int64) error {
 	if version != 0 {
 		rec.State = StateLive
 		rec.Version = uint64(version)
+		rec.Accepted = accepted.UnixNano()
 	}
 	key := joinIDs(uaid, chid)
 	if err = s.storeRec(key, rec); err != nil {
@@ -378,11 +407,13 @@ func (s *EmceeStore) Register(uaid, chid string, version int64) (err error) {
 	if !id.Valid(chid) {
 		return ErrInvalidChannel
 	}
-	return s.storeRegister(uaid, chid, version)
+	return s.storeRegister(uaid, chid, version, timeNow())
 }
 
 // Updates a channel record in memcached.
-func (s *EmceeStore) storeUpdate(uaid, chid string, version int64) error {
+func (s *EmceeStore) storeUpdate(uaid, chid string, version int64,
+	accepted time.Time) error {
+
 	key := joinIDs(uaid, chid)
 	cRec, err := s.fetchRec(key)
 	if err != nil && !isMissing(err) {
@@ -407,6 +438,7 @@ func (s *EmceeStore) storeUpdate(uaid, chid string, version int64) error {
 				State:       StateLive,
 				Version:     uint64(version),
 				LastTouched: time.Now().UTC().Unix(),
+				Accepted:    accepted.UnixNano(),
 			}
 			if err = s.storeRec(key, newRecord); err != nil {
 				return err
@@ -422,7 +454,7 @@ func (s *EmceeStore) storeUpdate(uaid, chid string, version int64) error {
 			"version":   strconv.FormatInt(version, 10),
 		})
 	}
-	if err = s.storeRegister(uaid, chid, version); err != nil {
+	if err = s.storeRegister(uaid, chid, version, accepted); err != nil {
 		return err
 	}
 	return nil
@@ -430,7 +462,9 @@ func (s *EmceeStore) storeUpdate(uaid, chid string, version int64) error {
 
 // Update updates the version for the given device ID and channel ID.
 // Implements Store.Update().
-func (s *EmceeStore) Update(uaid, chid string, version int64) (err error) {
+func (s *EmceeStore) Update(uaid, chid string, version int64,
+	accepted time.Time) (err error) {
+
 	if len(uaid) == 0 {
 		return ErrNoID
 	}
@@ -444,7 +478,7 @@ func (s *EmceeStore) Update(uaid, chid string, version int64) (err error) {
 	if !id.Valid(chid) {
 		return ErrInvalidChannel
 	}
-	return s.storeUpdate(uaid, chid, version)
+	return s.storeUpdate(uaid, chid, version, accepted)
 }
 
 // Marks a memcached channel record as expired.
@@ -603,6 +637,9 @@ func (s *EmceeStore) FetchAll(uaid string, since time.Time) ([]Update, []string,
 				ChannelID: channelString,
 				Version:   version,
 			}
+			if channel.Accepted > 0 {
+				update.Accepted = time.Unix(0, channel.Accepted)
+			}
 			updates = append(updates, update)
 		case StateDeleted:
 			if s.logger.ShouldLog(DEBUG) {
@@ -644,13 +681,139 @@ func (s *EmceeStore) DropAll(uaid string) (err error) {
 	for _, chid := range chids {
 		key := joinIDs(uaid, chid)
 		client.Delete(key, 0)
+		client.Delete(receiptKey(uaid, chid), 0)
 	}
+	client.Delete(cursorKey(uaid), 0)
+	client.Delete(authKey(uaid), 0)
 	if err = client.Delete(uaid, 0); err != nil && !isMissing(err) {
 		return err
 	}
 	return nil
 }
 
+// FetchCursor returns the flush cursor for the given device ID. Implements
+// CursorStore.FetchCursor().
+func (s *EmceeStore) FetchCursor(uaid string) (cursor time.Time, err error) {
+	if !id.Valid(uaid) {
+		return time.Time{}, ErrInvalidID
+	}
+	client, err := s.getClient()
+	defer s.releaseWithout(client, &err)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var sec int64
+	if err = client.Get(cursorKey(uaid), &sec); err != nil {
+		if isMissing(err) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+	return time.Unix(sec, 0), nil
+}
+
+// PutCursor stores the flush cursor for the given device ID. The cursor
+// expires with the device's channel records. Implements
+// CursorStore.PutCursor().
+func (s *EmceeStore) PutCursor(uaid string, cursor time.Time) (err error) {
+	if !id.Valid(uaid) {
+		return ErrInvalidID
+	}
+	client, err := s.getClient()
+	defer s.releaseWithout(client, &err)
+	if err != nil {
+		return err
+	}
+	return client.Set(cursorKey(uaid), cursor.Unix(), s.TimeoutLive)
+}
+
+// FetchDeviceAuth returns the credentials issued to the given device ID.
+// Implements DeviceAuthStore.FetchDeviceAuth().
+func (s *EmceeStore) FetchDeviceAuth(uaid string) (auth *DeviceAuth, err error) {
+	if !id.Valid(uaid) {
+		return nil, ErrInvalidID
+	}
+	client, err := s.getClient()
+	defer s.releaseWithout(client, &err)
+	if err != nil {
+		return nil, err
+	}
+	auth = new(DeviceAuth)
+	if err = client.Get(authKey(uaid), auth); err != nil {
+		if isMissing(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return auth, nil
+}
+
+// PutDeviceAuth stores the credentials for the given device ID. Implements
+// DeviceAuthStore.PutDeviceAuth().
+func (s *EmceeStore) PutDeviceAuth(uaid string, auth *DeviceAuth) (err error) {
+	if !id.Valid(uaid) {
+		return ErrInvalidID
+	}
+	client, err := s.getClient()
+	defer s.releaseWithout(client, &err)
+	if err != nil {
+		return err
+	}
+	return client.Set(authKey(uaid), auth, 0)
+}
+
+// FetchReceipt returns the receipt request for the given channel. Implements
+// ReceiptStore.FetchReceipt().
+func (s *EmceeStore) FetchReceipt(uaid, chid string) (receipt *Receipt, err error) {
+	if !id.Valid(uaid) || !id.Valid(chid) {
+		return nil, ErrInvalidID
+	}
+	client, err := s.getClient()
+	defer s.releaseWithout(client, &err)
+	if err != nil {
+		return nil, err
+	}
+	receipt = new(Receipt)
+	if err = client.Get(receiptKey(uaid, chid), receipt); err != nil {
+		if isMissing(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return receipt, nil
+}
+
+// PutReceipt stores the receipt request for the given channel. The request
+// expires with the channel record. Implements ReceiptStore.PutReceipt().
+func (s *EmceeStore) PutReceipt(uaid, chid string, receipt *Receipt) (err error) {
+	if !id.Valid(uaid) || !id.Valid(chid) {
+		return ErrInvalidID
+	}
+	client, err := s.getClient()
+	defer s.releaseWithout(client, &err)
+	if err != nil {
+		return err
+	}
+	return client.Set(receiptKey(uaid, chid), receipt, s.TimeoutLive)
+}
+
+// DropReceipt removes the receipt request for the given channel. Implements
+// ReceiptStore.DropReceipt().
+func (s *EmceeStore) DropReceipt(uaid, chid string) (err error) {
+	if !id.Valid(uaid) || !id.Valid(chid) {
+		return ErrInvalidID
+	}
+	client, err := s.getClient()
+	defer s.releaseWithout(client, &err)
+	if err != nil {
+		return err
+	}
+	if err = client.Delete(receiptKey(uaid, chid), 0); err != nil && !isMissing(err) {
+		return err
+	}
+	return nil
+}
+
 // FetchPing retrieves proprietary ping information for the given device ID
 // from memcached. Implements Store.FetchPing().
 func (s *EmceeStore) FetchPing(uaid string) (pingData []byte, err error) {
@@ -700,6 +863,103 @@ func (s *EmceeStore) DropPing(uaid string) (err error) {
 	return client.Delete(s.PingPrefix+uaid, 0)
 }
 
+// PutQueuedPing persists a queued proprietary ping for the given host.
+// Implements PingQueueStore.PutQueuedPing().
+func (s *EmceeStore) PutQueuedPing(host string, ping *QueuedPing) (err error) {
+	client, err := s.getClient()
+	defer s.releaseWithout(client, &err)
+	if err != nil {
+		return err
+	}
+	if err = client.Set(s.PingPrefix+"queued-"+ping.ID, ping, 0); err != nil {
+		return err
+	}
+	s.queueLock.Lock()
+	defer s.queueLock.Unlock()
+	pingIDs, err := s.fetchQueuedPingIDs(client, host)
+	if err != nil {
+		return err
+	}
+	for _, pingID := range pingIDs {
+		if pingID == ping.ID {
+			return nil
+		}
+	}
+	pingIDs = append(pingIDs, ping.ID)
+	return client.Set(s.PingPrefix+"queue-"+host, pingIDs, 0)
+}
+
+// DropQueuedPing removes a persisted proprietary ping for the given host.
+// Implements PingQueueStore.DropQueuedPing().
+func (s *EmceeStore) DropQueuedPing(host, pingID string) (err error) {
+	client, err := s.getClient()
+	defer s.releaseWithout(client, &err)
+	if err != nil {
+		return err
+	}
+	s.queueLock.Lock()
+	pingIDs, err := s.fetchQueuedPingIDs(client, host)
+	if err == nil {
+		for i, queuedID := range pingIDs {
+			if queuedID == pingID {
+				pingIDs = append(pingIDs[:i], pingIDs[i+1:]...)
+				err = client.Set(s.PingPrefix+"queue-"+host, pingIDs, 0)
+				break
+			}
+		}
+	}
+	s.queueLock.Unlock()
+	if err != nil {
+		return err
+	}
+	if err = client.Delete(s.PingPrefix+"queued-"+pingID, 0); err != nil &&
+		!isMissing(err) {
+		return err
+	}
+	return nil
+}
+
+// FetchQueuedPings returns all persisted proprietary pings for the given host.
+// Implements PingQueueStore.FetchQueuedPings().
+func (s *EmceeStore) FetchQueuedPings(host string) (pings []*QueuedPing, err error) {
+	client, err := s.getClient()
+	defer s.releaseWithout(client, &err)
+	if err != nil {
+		return nil, err
+	}
+	s.queueLock.Lock()
+	pingIDs, err := s.fetchQueuedPingIDs(client, host)
+	s.queueLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	pings = make([]*QueuedPing, 0, len(pingIDs))
+	for _, pingID := range pingIDs {
+		ping := new(QueuedPing)
+		if err = client.Get(s.PingPrefix+"queued-"+pingID, ping); err != nil {
+			if isMissing(err) {
+				continue
+			}
+			return nil, err
+		}
+		pings = append(pings, ping)
+	}
+	return pings, nil
+}
+
+// Returns the IDs of all persisted proprietary pings for the given host.
+func (s *EmceeStore) fetchQueuedPingIDs(client mc.Client, host string) (
+	pingIDs []string, err error) {
+
+	if err = client.Get(s.PingPrefix+"queue-"+host, &pingIDs); err != nil {
+		if isMissing(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return pingIDs, nil
+}
+
 // Queries memcached for a list of current subscriptions associated with the
 // given device ID.
 func (s *EmceeStore) fetchChannelIDs(uaid string) (result ChannelIDs, err error) {
@@ -53,6 +53,7 @@ var (
 	ErrExistingID         = &ServiceError{202, http.StatusServiceUnavailable, "Device ID already assigned to this client"}
 	ErrTooManyPings       = &ServiceError{203, http.StatusUnauthorized, "Client sent too many pings"}
 	ErrNonexistentChannel = &ServiceError{204, http.StatusServiceUnavailable, "The specified channel ID does not exist"}
+	ErrSlowClient         = &ServiceError{205, http.StatusServiceUnavailable, "Client is not reading updates"}
 )
 
 // 300-class errors indicate bad app server input (e.g., invalid update
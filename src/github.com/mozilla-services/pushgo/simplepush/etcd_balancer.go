@@ -76,13 +76,15 @@ type EtcdBalancerConf struct {
 type EtcdBalancer struct {
 	client    *etcd.Client
 	maxConns  int
-	threshold float64
 	dir       string
 	url       *url.URL
 	key       string
 	rh        *retry.Helper
 	connCount func() int
 
+	thresholdLock sync.RWMutex // Protects threshold, which may be reloaded.
+	threshold     float64
+
 	fetchLock sync.RWMutex // Protects the following fields.
 	peers     *EtcdPeers
 	fetchErr  error
@@ -165,6 +167,30 @@ func (b *EtcdBalancer) ConfigStruct() interface{} {
 	}
 }
 
+// CheckConfig validates the etcd server URLs, durations, and retry
+// settings. Implements ConfigChecker.CheckConfig().
+func (b *EtcdBalancer) CheckConfig(config interface{}) (err error) {
+	conf := config.(*EtcdBalancerConf)
+	for _, server := range conf.Servers {
+		if err = checkURL("servers", server); err != nil {
+			return err
+		}
+	}
+	if err = checkDuration("update_interval", conf.UpdateInterval); err != nil {
+		return err
+	}
+	if err = checkDuration("ttl", conf.TTL); err != nil {
+		return err
+	}
+	if err = checkDuration("close_delay", conf.CloseDelay); err != nil {
+		return err
+	}
+	if _, err = conf.Retry.NewHelper(); err != nil {
+		return fmt.Errorf("Invalid retry settings: %s", err)
+	}
+	return nil
+}
+
 func (b *EtcdBalancer) Init(app *Application, config interface{}) (err error) {
 	conf := config.(*EtcdBalancerConf)
 	b.log = app.Logger()
@@ -228,12 +254,30 @@ func (b *EtcdBalancer) Init(app *Application, config interface{}) (err error) {
 	return nil
 }
 
+// Reload applies the redirection threshold from a reloaded configuration.
+// Implements Reloader.Reload().
+func (b *EtcdBalancer) Reload(config interface{}, changed []string) (
+	rejected []string, err error) {
+
+	conf := config.(*EtcdBalancerConf)
+	apply, rejected := liveSettings(changed, "threshold")
+	if apply["threshold"] {
+		b.thresholdLock.Lock()
+		b.threshold = conf.Threshold
+		b.thresholdLock.Unlock()
+	}
+	return rejected, nil
+}
+
 func (b *EtcdBalancer) shouldRedirect() (currentConns int64, ok bool) {
 	if b.closeOnce.IsDone() {
 		return
 	}
 	currentConns = int64(b.connCount())
-	ok = float64(currentConns+1)/float64(b.maxConns) >= b.threshold
+	b.thresholdLock.RLock()
+	threshold := b.threshold
+	b.thresholdLock.RUnlock()
+	ok = float64(currentConns+1)/float64(b.maxConns) >= threshold
 	return
 }
 
@@ -256,6 +300,22 @@ func (b *EtcdBalancer) RedirectURL() (url string, ok bool, err error) {
 	return peer.URL, true, err
 }
 
+// ChoosePeer returns the origin of a peer chosen by free connection count.
+// Implements PeerChooser.ChoosePeer().
+func (b *EtcdBalancer) ChoosePeer() (url string, ok bool, err error) {
+	b.fetchLock.RLock()
+	peers := b.peers
+	b.fetchLock.RUnlock()
+	if peers == nil {
+		return "", false, ErrNoPeers
+	}
+	peer, ok := peers.Choose()
+	if !ok {
+		return "", false, ErrNoPeers
+	}
+	return peer.URL, true, nil
+}
+
 func (b *EtcdBalancer) updateCounts() {
 	defer b.closeWait.Done()
 	ticker := time.NewTicker(b.updateInterval)
@@ -107,6 +107,37 @@ func (*EtcdLocator) ConfigStruct() interface{} {
 	}
 }
 
+// CheckConfig validates the etcd server URLs, durations, and retry
+// settings. Implements ConfigChecker.CheckConfig().
+func (l *EtcdLocator) CheckConfig(config interface{}) (err error) {
+	conf := config.(*EtcdLocatorConf)
+	for _, server := range conf.Servers {
+		if err = checkURL("servers", server); err != nil {
+			return err
+		}
+	}
+	if err = checkDuration("refresh_interval", conf.RefreshInterval); err != nil {
+		return err
+	}
+	defaultTTL, err := time.ParseDuration(conf.DefaultTTL)
+	if err != nil {
+		return fmt.Errorf("Unable to parse 'defaultTTL': %s", err)
+	}
+	if defaultTTL < minTTL {
+		return ErrMinTTL
+	}
+	if err = checkDuration("start_delay", conf.StartDelay); err != nil {
+		return err
+	}
+	if err = checkDuration("close_delay", conf.CloseDelay); err != nil {
+		return err
+	}
+	if _, err = conf.Retry.NewHelper(); err != nil {
+		return fmt.Errorf("Invalid retry settings: %s", err)
+	}
+	return nil
+}
+
 func (l *EtcdLocator) Init(app *Application, config interface{}) (err error) {
 	conf := config.(*EtcdLocatorConf)
 	l.logger = app.Logger()
@@ -8,9 +8,11 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"math"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	mc "github.com/bradfitz/gomemcache/memcache"
@@ -41,6 +43,7 @@ type GomemcStore struct {
 	defaultHost   string
 	logger        *SimpleLogger
 	client        *mc.Client
+	queueLock     sync.Mutex
 }
 
 // GomemcConf specifies memcached adapter options.
@@ -69,6 +72,16 @@ func (*GomemcStore) ConfigStruct() interface{} {
 	}
 }
 
+// CheckConfig validates the memcached server list and handle timeout.
+// Implements ConfigChecker.CheckConfig().
+func (*GomemcStore) CheckConfig(config interface{}) error {
+	conf := config.(*GomemcConf)
+	if len(conf.ElastiCacheConfigEndpoint) == 0 && len(conf.Driver.Hosts) == 0 {
+		return fmt.Errorf("Missing memcached servers")
+	}
+	return checkDuration("db.handle_timeout", conf.Db.HandleTimeout)
+}
+
 // Init initializes the memcached adapter with the given configuration.
 // Implements HasConfigStruct.Init().
 func (s *GomemcStore) Init(app *Application, config interface{}) (err error) {
@@ -221,7 +234,9 @@ func (s *GomemcStore) Exists(uaid string) bool {
 }
 
 // Stores a new channel record in memcached.
-func (s *GomemcStore) storeRegister(uaid, chid string, version int64) error {
+func (s *GomemcStore) storeRegister(uaid, chid string, version int64,
+	accepted time.Time) error {
+
 	key := joinIDs(uaid, chid)
 	chids, err := s.fetchAppIDArray(uaid)
 	if err != nil && err != mc.ErrCacheMiss {
@@ -239,6 +254,7 @@ func (s *GomemcStore) storeRegister(uaid, chid string, version int64) error {
 	if version != 0 {
 		rec.State = StateLive
 		rec.Version = uint64(version)
+		rec.Accepted = accepted.UnixNano()
 	}
 	if err = s.storeRec(key, rec); err != nil {
 		return err
@@ -262,11 +278,13 @@ func (s *GomemcStore) Register(uaid, chid string, version int64) (err error) {
 	if !id.Valid(chid) {
 		return ErrInvalidChannel
 	}
-	return s.storeRegister(uaid, chid, version)
+	return s.storeRegister(uaid, chid, version, timeNow())
 }
 
 // Updates a channel record in memcached.
-func (s *GomemcStore) storeUpdate(uaid, chid string, version int64) error {
+func (s *GomemcStore) storeUpdate(uaid, chid string, version int64,
+	accepted time.Time) error {
+
 	key := joinIDs(uaid, chid)
 	cRec, err := s.fetchRec(key)
 	if err != nil && err != mc.ErrCacheMiss {
@@ -287,6 +305,7 @@ func (s *GomemcStore) storeUpdate(uaid, chid string, version int64) error {
 				State:       StateLive,
 				Version:     uint64(version),
 				LastTouched: time.Now().UTC().Unix(),
+				Accepted:    accepted.UnixNano(),
 			}
 			return s.storeRec(key, newRecord)
 		}
@@ -299,12 +318,14 @@ func (s *GomemcStore) storeUpdate(uaid, chid string, version int64) error {
 			"version":   strconv.FormatInt(version, 10),
 		})
 	}
-	return s.storeRegister(uaid, chid, version)
+	return s.storeRegister(uaid, chid, version, accepted)
 }
 
 // Update updates the version for the given device ID and channel ID.
 // Implements Store.Update().
-func (s *GomemcStore) Update(uaid, chid string, version int64) (err error) {
+func (s *GomemcStore) Update(uaid, chid string, version int64,
+	accepted time.Time) (err error) {
+
 	if len(uaid) == 0 {
 		return ErrNoID
 	}
@@ -318,7 +339,7 @@ func (s *GomemcStore) Update(uaid, chid string, version int64) (err error) {
 	if !id.Valid(chid) {
 		return ErrInvalidChannel
 	}
-	return s.storeUpdate(uaid, chid, version)
+	return s.storeUpdate(uaid, chid, version, accepted)
 }
 
 // Marks a memcached channel record as expired.
@@ -469,6 +490,9 @@ func (s *GomemcStore) FetchAll(uaid string, since time.Time) ([]Update, []string
 				ChannelID: chid,
 				Version:   version,
 			}
+			if channel.Accepted > 0 {
+				update.Accepted = time.Unix(0, channel.Accepted)
+			}
 			updates = append(updates, update)
 		case StateDeleted:
 			if s.logger.ShouldLog(DEBUG) {
@@ -505,13 +529,186 @@ func (s *GomemcStore) DropAll(uaid string) error {
 	for _, chid := range chids {
 		key := joinIDs(uaid, chid)
 		s.client.Delete(key)
+		s.client.Delete(receiptKey(uaid, chid))
 	}
+	s.client.Delete(cursorKey(uaid))
+	s.client.Delete(authKey(uaid))
 	if err = s.client.Delete(uaid); err != nil && err != mc.ErrCacheMiss {
 		return err
 	}
 	return nil
 }
 
+// FetchCursor returns the flush cursor for the given device ID. Implements
+// CursorStore.FetchCursor().
+func (s *GomemcStore) FetchCursor(uaid string) (cursor time.Time, err error) {
+	if !id.Valid(uaid) {
+		return time.Time{}, ErrInvalidID
+	}
+	raw, err := s.client.Get(cursorKey(uaid))
+	if err != nil {
+		if err == mc.ErrCacheMiss {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+	sec, err := strconv.ParseInt(string(raw.Value), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(sec, 0), nil
+}
+
+// PutCursor stores the flush cursor for the given device ID. The cursor
+// expires with the device's channel records. Implements
+// CursorStore.PutCursor().
+func (s *GomemcStore) PutCursor(uaid string, cursor time.Time) error {
+	if !id.Valid(uaid) {
+		return ErrInvalidID
+	}
+	return s.client.Set(&mc.Item{
+		Key:        cursorKey(uaid),
+		Value:      []byte(strconv.FormatInt(cursor.Unix(), 10)),
+		Expiration: int32(s.TimeoutLive.Seconds())})
+}
+
+// FetchDeviceAuth returns the credentials issued to the given device ID.
+// Implements DeviceAuthStore.FetchDeviceAuth().
+func (s *GomemcStore) FetchDeviceAuth(uaid string) (*DeviceAuth, error) {
+	if !id.Valid(uaid) {
+		return nil, ErrInvalidID
+	}
+	raw, err := s.client.Get(authKey(uaid))
+	if err != nil {
+		if err == mc.ErrCacheMiss {
+			return nil, nil
+		}
+		return nil, err
+	}
+	auth := new(DeviceAuth)
+	if err = json.Unmarshal(raw.Value, auth); err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+// PutDeviceAuth stores the credentials for the given device ID. Implements
+// DeviceAuthStore.PutDeviceAuth().
+func (s *GomemcStore) PutDeviceAuth(uaid string, auth *DeviceAuth) error {
+	if !id.Valid(uaid) {
+		return ErrInvalidID
+	}
+	raw, err := json.Marshal(auth)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(&mc.Item{
+		Key:        authKey(uaid),
+		Value:      raw,
+		Expiration: 0})
+}
+
+// FetchReceipt returns the receipt request for the given channel. Implements
+// ReceiptStore.FetchReceipt().
+func (s *GomemcStore) FetchReceipt(uaid, chid string) (*Receipt, error) {
+	if !id.Valid(uaid) || !id.Valid(chid) {
+		return nil, ErrInvalidID
+	}
+	raw, err := s.client.Get(receiptKey(uaid, chid))
+	if err != nil {
+		if err == mc.ErrCacheMiss {
+			return nil, nil
+		}
+		return nil, err
+	}
+	receipt := new(Receipt)
+	if err = json.Unmarshal(raw.Value, receipt); err != nil {
+		return nil, err
+	}
+	return receipt, nil
+}
+
+// PutReceipt stores the receipt request for the given channel. The request
+// expires with the channel record. Implements ReceiptStore.PutReceipt().
+func (s *GomemcStore) PutReceipt(uaid, chid string, receipt *Receipt) error {
+	if !id.Valid(uaid) || !id.Valid(chid) {
+		return ErrInvalidID
+	}
+	raw, err := json.Marshal(receipt)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(&mc.Item{
+		Key:        receiptKey(uaid, chid),
+		Value:      raw,
+		Expiration: int32(s.TimeoutLive.Seconds())})
+}
+
+// DropReceipt removes the receipt request for the given channel. Implements
+// ReceiptStore.DropReceipt().
+func (s *GomemcStore) DropReceipt(uaid, chid string) error {
+	if !id.Valid(uaid) || !id.Valid(chid) {
+		return ErrInvalidID
+	}
+	err := s.client.Delete(receiptKey(uaid, chid))
+	if err != nil && err != mc.ErrCacheMiss {
+		return err
+	}
+	return nil
+}
+
+// maxRateLimitAttempts is the number of times TakeToken retries a conflicting
+// update before giving up.
+const maxRateLimitAttempts = 5
+
+// TakeToken consumes a token from a rate limit bucket shared by all nodes.
+// Buckets are stored as the next theoretical arrival time, in nanoseconds,
+// and updated with compare-and-swap; nodes should have synchronized clocks.
+// Implements RateLimitStore.TakeToken().
+func (s *GomemcStore) TakeToken(key string, rate float64, burst int) (
+	ok bool, retryAfter time.Duration, err error) {
+
+	key = rateLimitKey(key)
+	// Full buckets don't need to be stored, so expire them once they refill.
+	expiration := int32(math.Ceil(float64(burst)/rate)) + 1
+	for attempt := 0; attempt < maxRateLimitAttempts; attempt++ {
+		var tat time.Time
+		item, err := s.client.Get(key)
+		if err == nil {
+			nsec, err := strconv.ParseInt(string(item.Value), 10, 64)
+			if err == nil {
+				tat = time.Unix(0, nsec)
+			}
+		} else if err == mc.ErrCacheMiss {
+			item = nil
+		} else {
+			return false, 0, err
+		}
+		next, ok, retryAfter := gcraTake(tat, timeNow(), rate, burst)
+		if !ok {
+			return false, retryAfter, nil
+		}
+		value := []byte(strconv.FormatInt(next.UnixNano(), 10))
+		if item == nil {
+			err = s.client.Add(&mc.Item{
+				Key:        key,
+				Value:      value,
+				Expiration: expiration})
+		} else {
+			item.Value = value
+			item.Expiration = expiration
+			err = s.client.CompareAndSwap(item)
+		}
+		if err == nil {
+			return true, 0, nil
+		}
+		if err != mc.ErrNotStored && err != mc.ErrCASConflict {
+			return false, 0, err
+		}
+	}
+	return false, 0, ErrRateLimitConflict
+}
+
 // FetchPing retrieves proprietary ping information for the given device ID
 // from memcached. Implements Store.FetchPing().
 func (s *GomemcStore) FetchPing(uaid string) (pingData []byte, err error) {
@@ -552,6 +749,122 @@ func (s *GomemcStore) DropPing(uaid string) error {
 	return s.client.Delete(s.PingPrefix + uaid)
 }
 
+// PutQueuedPing persists a queued proprietary ping for the given host.
+// Implements PingQueueStore.PutQueuedPing().
+func (s *GomemcStore) PutQueuedPing(host string, ping *QueuedPing) error {
+	raw, err := json.Marshal(ping)
+	if err != nil {
+		return err
+	}
+	err = s.client.Set(&mc.Item{
+		Key:        s.PingPrefix + "queued-" + ping.ID,
+		Value:      raw,
+		Expiration: 0})
+	if err != nil {
+		return err
+	}
+	s.queueLock.Lock()
+	defer s.queueLock.Unlock()
+	pingIDs, err := s.fetchQueuedPingIDs(host)
+	if err != nil {
+		return err
+	}
+	for _, pingID := range pingIDs {
+		if pingID == ping.ID {
+			return nil
+		}
+	}
+	return s.storeQueuedPingIDs(host, append(pingIDs, ping.ID))
+}
+
+// DropQueuedPing removes a persisted proprietary ping for the given host.
+// Implements PingQueueStore.DropQueuedPing().
+func (s *GomemcStore) DropQueuedPing(host, pingID string) error {
+	s.queueLock.Lock()
+	pingIDs, err := s.fetchQueuedPingIDs(host)
+	if err == nil {
+		for i, queuedID := range pingIDs {
+			if queuedID == pingID {
+				err = s.storeQueuedPingIDs(host,
+					append(pingIDs[:i], pingIDs[i+1:]...))
+				break
+			}
+		}
+	}
+	s.queueLock.Unlock()
+	if err != nil {
+		return err
+	}
+	if err = s.client.Delete(s.PingPrefix + "queued-" + pingID); err != nil &&
+		err != mc.ErrCacheMiss {
+		return err
+	}
+	return nil
+}
+
+// FetchQueuedPings returns all persisted proprietary pings for the given host.
+// Implements PingQueueStore.FetchQueuedPings().
+func (s *GomemcStore) FetchQueuedPings(host string) (pings []*QueuedPing, err error) {
+	s.queueLock.Lock()
+	pingIDs, err := s.fetchQueuedPingIDs(host)
+	s.queueLock.Unlock()
+	if err != nil || len(pingIDs) == 0 {
+		return nil, err
+	}
+	keys := make([]string, len(pingIDs))
+	for i, pingID := range pingIDs {
+		keys[i] = s.PingPrefix + "queued-" + pingID
+	}
+	items, err := s.client.GetMulti(keys)
+	if err != nil {
+		return nil, err
+	}
+	pings = make([]*QueuedPing, 0, len(items))
+	for _, key := range keys {
+		item, ok := items[key]
+		if !ok {
+			continue
+		}
+		ping := new(QueuedPing)
+		if err = json.Unmarshal(item.Value, ping); err != nil {
+			if s.logger.ShouldLog(WARNING) {
+				s.logger.Warn("gomemc", "Could not decode queued ping",
+					LogFields{"error": err.Error(), "key": key})
+			}
+			continue
+		}
+		pings = append(pings, ping)
+	}
+	return pings, nil
+}
+
+// Returns the IDs of all persisted proprietary pings for the given host.
+func (s *GomemcStore) fetchQueuedPingIDs(host string) (pingIDs []string, err error) {
+	raw, err := s.client.Get(s.PingPrefix + "queue-" + host)
+	if err != nil {
+		if err == mc.ErrCacheMiss {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if err = json.Unmarshal(raw.Value, &pingIDs); err != nil {
+		return nil, err
+	}
+	return pingIDs, nil
+}
+
+// Writes the IDs of all persisted proprietary pings for the given host.
+func (s *GomemcStore) storeQueuedPingIDs(host string, pingIDs []string) error {
+	raw, err := json.Marshal(pingIDs)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(&mc.Item{
+		Key:        s.PingPrefix + "queue-" + host,
+		Value:      raw,
+		Expiration: 0})
+}
+
 // Returns a duplicate-free list of subscriptions associated with the device
 // ID.
 func (s *GomemcStore) fetchAppIDArray(uaid string) (result ChannelIDs, err error) {
@@ -138,7 +138,7 @@ func Test_storeRegister(t *testing.T) {
 
 	var err error
 
-	err = testGm.storeRegister(TESTUAID, TESTCHID, 12345)
+	err = testGm.storeRegister(TESTUAID, TESTCHID, 12345, time.Now())
 	if err != nil {
 		t.Errorf("Test_storeRegister returned error: %v", err)
 		return
@@ -210,23 +210,23 @@ func Test_Update(t *testing.T) {
 		t.Skip("Skipping, no server.")
 	}
 
-	err := testGm.Update(TESTUAID, TESTCHID, 12345)
+	err := testGm.Update(TESTUAID, TESTCHID, 12345, time.Now())
 	if err != nil {
 		t.Errorf("Update returned error: %v", err)
 	}
-	err = testGm.Update("", TESTCHID, 12345)
+	err = testGm.Update("", TESTCHID, 12345, time.Now())
 	if err == nil {
 		t.Error("Update failed to reject empty UAID")
 	}
-	err = testGm.Update(TESTUAID, "", 12345)
+	err = testGm.Update(TESTUAID, "", 12345, time.Now())
 	if err == nil {
 		t.Error("Update failed to reject empty ChannelID")
 	}
-	err = testGm.Update("Invalid", TESTCHID, 12345)
+	err = testGm.Update("Invalid", TESTCHID, 12345, time.Now())
 	if err == nil {
 		t.Error("Update failed to reject invalid UAID")
 	}
-	err = testGm.Update(TESTUAID, "Invalid", 12345)
+	err = testGm.Update(TESTUAID, "Invalid", 12345, time.Now())
 	if err == nil {
 		t.Error("Update failed to reject invalid ChannelID")
 	}
@@ -5,8 +5,10 @@
 package simplepush
 
 import (
+	"fmt"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -63,11 +65,42 @@ type ListenerConfig interface {
 }
 
 type TCPListenerConfig struct {
+	// Addr is a TCP address, like ":8080"; a Unix domain socket path
+	// prefixed with "unix:"; or the name or index of a socket passed by
+	// systemd, prefixed with "systemd:".
 	Addr            string
 	MaxConns        int    `toml:"max_connections" env:"max_connections"`
 	KeepAlivePeriod string `toml:"tcp_keep_alive" env:"tcp_keep_alive"`
 	CertFile        string `toml:"cert_file" env:"cert_file"`
 	KeyFile         string `toml:"key_file" env:"key_file"`
+
+	// SocketMode and SocketOwner set the permissions of "unix:" sockets.
+	// SocketMode is an octal mode, like "0660"; SocketOwner is a user,
+	// optionally followed by a colon and a group.
+	SocketMode  string `toml:"socket_mode" env:"socket_mode"`
+	SocketOwner string `toml:"socket_owner" env:"socket_owner"`
+
+	// SNICertFiles and SNIKeyFiles list additional certificates, selected by
+	// the server name requested by the client. CertFile and KeyFile are
+	// served to clients that don't request a name, or request an unknown
+	// name.
+	SNICertFiles []string `toml:"sni_cert_files" env:"sni_cert_files"`
+	SNIKeyFiles  []string `toml:"sni_key_files" env:"sni_key_files"`
+
+	// CertReloadInterval is how often to check the certificate files for
+	// changes. Changed certificates are used for new connections without
+	// restarting the listener. Certificates are also reloaded on SIGHUP.
+	CertReloadInterval string `toml:"cert_reload_interval" env:"cert_reload_interval"`
+
+	// ProxyProtocol accepts PROXY protocol v1 and v2 headers from the peers
+	// listed in ProxyTrusted, typically TCP load balancers. Trusted peers
+	// must send a header; other peers are treated as clients.
+	ProxyProtocol bool     `toml:"proxy_protocol" env:"proxy_protocol"`
+	ProxyTrusted  []string `toml:"proxy_trusted" env:"proxy_trusted"`
+
+	// Limits sets per-client connection and handshake limits. Only the
+	// WebSocket listener enforces these limits.
+	Limits ClientLimitsConfig
 }
 
 func (conf TCPListenerConfig) UseTLS() bool {
@@ -78,13 +111,119 @@ func (conf TCPListenerConfig) GetMaxConns() int {
 	return conf.MaxConns
 }
 
+// Check validates the listener settings without binding the address.
+func (conf TCPListenerConfig) Check() error {
+	if err := checkDuration("tcp_keep_alive", conf.KeepAlivePeriod); err != nil {
+		return err
+	}
+	if (len(conf.CertFile) > 0) != (len(conf.KeyFile) > 0) {
+		return fmt.Errorf("TLS requires both 'cert_file' and 'key_file'")
+	}
+	if err := conf.checkAddr(); err != nil {
+		return err
+	}
+	if len(conf.SNICertFiles) != len(conf.SNIKeyFiles) {
+		return fmt.Errorf("Mismatched 'sni_cert_files' and 'sni_key_files'")
+	}
+	if len(conf.SNICertFiles) > 0 && !conf.UseTLS() {
+		return fmt.Errorf("SNI certificates require 'cert_file' and 'key_file'")
+	}
+	if len(conf.CertReloadInterval) > 0 {
+		err := checkDuration("cert_reload_interval", conf.CertReloadInterval)
+		if err != nil {
+			return err
+		}
+	}
+	if conf.UseTLS() {
+		if _, err := NewCertStore(conf.certPairs()); err != nil {
+			return err
+		}
+	}
+	if _, err := conf.proxyProtocol(); err != nil {
+		return err
+	}
+	if err := conf.Limits.Check(); err != nil {
+		return fmt.Errorf("Invalid client limits: %s", err)
+	}
+	return nil
+}
+
+// checkAddr validates the listener address and socket permissions.
+func (conf TCPListenerConfig) checkAddr() error {
+	isUnix := strings.HasPrefix(conf.Addr, UnixAddrPrefix)
+	if isUnix && len(conf.Addr) == len(UnixAddrPrefix) {
+		return fmt.Errorf("Missing Unix socket path in 'addr'")
+	}
+	if !isUnix && (len(conf.SocketMode) > 0 || len(conf.SocketOwner) > 0) {
+		return fmt.Errorf("'socket_mode' and 'socket_owner' require a Unix socket")
+	}
+	if _, err := ParseSocketPerms(conf.SocketMode, conf.SocketOwner); err != nil {
+		return err
+	}
+	return nil
+}
+
+// certPairs returns the default and SNI certificate pairs.
+func (conf TCPListenerConfig) certPairs() []CertPair {
+	pairs := []CertPair{{conf.CertFile, conf.KeyFile}}
+	for i, certFile := range conf.SNICertFiles {
+		pairs = append(pairs, CertPair{certFile, conf.SNIKeyFiles[i]})
+	}
+	return pairs
+}
+
+// certStore loads the listener certificates.
+func (conf TCPListenerConfig) certStore() (certs *CertStore, err error) {
+	if len(conf.SNICertFiles) != len(conf.SNIKeyFiles) {
+		return nil, fmt.Errorf("Mismatched 'sni_cert_files' and 'sni_key_files'")
+	}
+	if certs, err = NewCertStore(conf.certPairs()); err != nil {
+		return nil, err
+	}
+	if len(conf.CertReloadInterval) > 0 {
+		if certs.WatchInterval, err = time.ParseDuration(conf.CertReloadInterval); err != nil {
+			return nil, err
+		}
+	}
+	return certs, nil
+}
+
+// proxyProtocol returns the PROXY protocol settings, or nil if the PROXY
+// protocol is disabled.
+func (conf TCPListenerConfig) proxyProtocol() (*ProxyProtocol, error) {
+	if !conf.ProxyProtocol {
+		return nil, nil
+	}
+	if len(conf.ProxyTrusted) == 0 {
+		return nil, fmt.Errorf("PROXY protocol requires 'proxy_trusted'")
+	}
+	trusted, err := ParseCIDRs(conf.ProxyTrusted)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse 'proxy_trusted': %s", err)
+	}
+	return &ProxyProtocol{Trusted: trusted}, nil
+}
+
 func (conf TCPListenerConfig) Listen() (ln net.Listener, err error) {
 	keepAlivePeriod, err := time.ParseDuration(conf.KeepAlivePeriod)
 	if err != nil {
 		return nil, err
 	}
+	proxy, err := conf.proxyProtocol()
+	if err != nil {
+		return nil, err
+	}
+	perms, err := ParseSocketPerms(conf.SocketMode, conf.SocketOwner)
+	if err != nil {
+		return nil, err
+	}
 	if conf.UseTLS() {
-		return ListenTLS(conf.Addr, conf.CertFile, conf.KeyFile, conf.MaxConns, keepAlivePeriod)
+		certs, err := conf.certStore()
+		if err != nil {
+			return nil, err
+		}
+		return ListenTLS(conf.Addr, perms, certs, conf.MaxConns, keepAlivePeriod,
+			proxy)
 	}
-	return Listen(conf.Addr, conf.MaxConns, keepAlivePeriod)
+	return Listen(conf.Addr, perms, conf.MaxConns, keepAlivePeriod, proxy)
 }
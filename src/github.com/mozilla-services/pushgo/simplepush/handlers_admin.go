@@ -0,0 +1,475 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/mozilla-services/pushgo/id"
+)
+
+type AdminHandlersConfig struct {
+	Enabled bool
+
+	// Token is the bearer token required to access the admin API. Required
+	// if the admin API is enabled.
+	Token string
+
+	Listener TCPListenerConfig
+}
+
+// DeviceReport describes a device for the admin API.
+type DeviceReport struct {
+	DeviceID  string          `json:"uaid"`
+	Exists    bool            `json:"exists"`
+	Connected bool            `json:"connected"`
+	Born      int64           `json:"born,omitempty"`
+	Origin    string          `json:"origin,omitempty"`
+	Channels  []ChannelReport `json:"channels"`
+	Expired   []string        `json:"expired"`
+	HasPing   bool            `json:"hasPing"`
+}
+
+// ChannelReport describes a pending update for the admin API.
+type ChannelReport struct {
+	ChannelID string `json:"channelID"`
+	Version   uint64 `json:"version"`
+	Data      string `json:"data,omitempty"`
+}
+
+// TraceReply lists the devices traced by the logger.
+type TraceReply struct {
+	DeviceIDs []string `json:"uaids"`
+}
+
+// DrainReply is returned when the admin API starts draining the node.
+type DrainReply struct {
+	Draining bool `json:"draining"`
+	Clients  int  `json:"clients"`
+}
+
+// NotifyReply is returned when the admin API sends a test notification.
+type NotifyReply struct {
+	ChannelID string `json:"channelID"`
+	Version   int64  `json:"version"`
+	Delivered bool   `json:"delivered"`
+}
+
+func NewAdminHandlers() (h *AdminHandlers) {
+	h = &AdminHandlers{mux: mux.NewRouter()}
+	h.mux.HandleFunc("/devices/{uaid}", h.DeviceHandler).Methods("GET")
+	h.mux.HandleFunc("/devices/{uaid}", h.DropHandler).Methods("DELETE")
+	h.mux.HandleFunc("/devices/{uaid}/connection",
+		h.DisconnectHandler).Methods("DELETE")
+	h.mux.HandleFunc("/devices/{uaid}/channels/{chid}/notify",
+		h.NotifyHandler).Methods("POST")
+	h.mux.HandleFunc("/devices/{uaid}/trace", h.TraceHandler).Methods("PUT")
+	h.mux.HandleFunc("/devices/{uaid}/trace", h.UntraceHandler).Methods("DELETE")
+	h.mux.HandleFunc("/trace", h.TraceListHandler).Methods("GET")
+	h.mux.HandleFunc("/drain", h.DrainHandler).Methods("POST")
+	return h
+}
+
+// AdminHandlers exposes an authenticated API for inspecting and controlling
+// connected devices. Support teams use it to debug customer reports.
+type AdminHandlers struct {
+	app      *Application
+	logger   *SimpleLogger
+	metrics  Statistician
+	store    Store
+	router   Router
+	token    []byte
+	listener net.Listener
+	server   *ServeCloser
+	mux      *mux.Router
+	url      string
+	maxConns int
+}
+
+func (h *AdminHandlers) ConfigStruct() interface{} {
+	return &AdminHandlersConfig{
+		Enabled: false,
+		Listener: TCPListenerConfig{
+			Addr:            ":8083",
+			MaxConns:        100,
+			KeepAlivePeriod: "3m",
+		},
+	}
+}
+
+// CheckConfig validates the admin API token and listener settings. Implements
+// ConfigChecker.CheckConfig().
+func (h *AdminHandlers) CheckConfig(config interface{}) error {
+	conf := config.(*AdminHandlersConfig)
+	if !conf.Enabled {
+		return nil
+	}
+	if len(conf.Token) == 0 {
+		return fmt.Errorf("Missing admin API token")
+	}
+	if err := conf.Listener.Check(); err != nil {
+		return fmt.Errorf("Invalid admin listener: %s", err)
+	}
+	return nil
+}
+
+func (h *AdminHandlers) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*AdminHandlersConfig)
+	h.setApp(app)
+
+	if !conf.Enabled {
+		return nil
+	}
+
+	if len(conf.Token) == 0 {
+		h.logger.Panic("handlers_admin", "Missing admin API token", nil)
+		return ConfigurationErr
+	}
+	h.token = []byte(conf.Token)
+
+	if h.listener, err = conf.Listener.Listen(); err != nil {
+		h.logger.Panic("handlers_admin", "Could not attach admin listener",
+			LogFields{"error": err.Error()})
+		return err
+	}
+
+	var scheme string
+	if conf.Listener.UseTLS() {
+		scheme = "https"
+	} else {
+		scheme = "http"
+	}
+	host, port := HostPort(h.listener, app)
+	h.url = CanonicalURL(scheme, host, port)
+
+	h.maxConns = conf.Listener.MaxConns
+	h.server = NewServeCloser(&http.Server{
+		Handler: &LogHandler{h, h.logger},
+		ErrorLog: log.New(&LogWriter{
+			Logger: h.logger,
+			Name:   "handlers_admin",
+			Level:  ERROR,
+		}, "", 0),
+	})
+
+	return nil
+}
+
+// setApp sets the parent application for the admin handlers.
+func (h *AdminHandlers) setApp(app *Application) {
+	h.app = app
+	h.logger = app.Logger()
+	h.metrics = app.Metrics()
+	h.store = app.Store()
+	h.router = app.Router()
+}
+
+func (h *AdminHandlers) Listener() net.Listener { return h.listener }
+func (h *AdminHandlers) MaxConns() int          { return h.maxConns }
+func (h *AdminHandlers) URL() string            { return h.url }
+func (h *AdminHandlers) ServeMux() ServeMux     { return (*RouteMux)(h.mux) }
+
+// ServeHTTP authenticates admin requests before dispatching them.
+func (h *AdminHandlers) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if !h.authorized(req) {
+		if h.logger.ShouldLog(WARNING) {
+			h.logger.Warn("handlers_admin", "Rejected unauthorized admin request",
+				LogFields{"rid": req.Header.Get(HeaderID), "path": req.URL.Path,
+					"remoteAddr": req.RemoteAddr})
+		}
+		h.metrics.Increment("admin.unauthorized")
+		resp.Header().Set("WWW-Authenticate", `Bearer realm="pushgo"`)
+		writeJSON(resp, http.StatusUnauthorized, []byte(`"Unauthorized"`))
+		return
+	}
+	h.mux.ServeHTTP(resp, req)
+}
+
+// authorized indicates whether req includes the admin bearer token.
+func (h *AdminHandlers) authorized(req *http.Request) bool {
+	header := req.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(h.token) == 0 || !strings.HasPrefix(header, prefix) {
+		return false
+	}
+	token := []byte(strings.TrimSpace(header[len(prefix):]))
+	return subtle.ConstantTimeCompare(token, h.token) == 1
+}
+
+// deviceVars extracts and validates the device ID from the request path.
+func (h *AdminHandlers) deviceVars(resp http.ResponseWriter,
+	req *http.Request) (uaid string, ok bool) {
+
+	if uaid = mux.Vars(req)["uaid"]; !id.Valid(uaid) {
+		writeJSON(resp, http.StatusBadRequest, []byte(`"Invalid UAID"`))
+		return "", false
+	}
+	return uaid, true
+}
+
+// DeviceHandler reports whether a device is connected to this node, and
+// lists its pending updates and expired channels.
+func (h *AdminHandlers) DeviceHandler(resp http.ResponseWriter, req *http.Request) {
+	uaid, ok := h.deviceVars(resp, req)
+	if !ok {
+		return
+	}
+	h.metrics.Increment("admin.device.inspect")
+	report := DeviceReport{
+		DeviceID: uaid,
+		Exists:   h.store.Exists(uaid),
+		Channels: []ChannelReport{},
+		Expired:  []string{},
+	}
+	if worker, ok := h.app.GetWorker(uaid); ok {
+		report.Connected = true
+		report.Born = worker.Born().Unix()
+		report.Origin = worker.Origin()
+	}
+	updates, expired, err := h.store.FetchAll(uaid, time.Time{})
+	if err != nil {
+		h.writeError(resp, req, "Could not fetch channels", uaid, err)
+		return
+	}
+	for _, update := range updates {
+		report.Channels = append(report.Channels, ChannelReport{
+			ChannelID: update.ChannelID,
+			Version:   update.Version,
+			Data:      update.Data,
+		})
+	}
+	if expired != nil {
+		report.Expired = expired
+	}
+	if pingData, err := h.store.FetchPing(uaid); err == nil {
+		report.HasPing = len(pingData) > 0
+	}
+	h.writeReply(resp, req, report)
+}
+
+// DisconnectHandler closes the device's connection to this node. The client
+// will reconnect and flush its pending updates.
+func (h *AdminHandlers) DisconnectHandler(resp http.ResponseWriter, req *http.Request) {
+	uaid, ok := h.deviceVars(resp, req)
+	if !ok {
+		return
+	}
+	worker, ok := h.app.GetWorker(uaid)
+	if !ok {
+		writeJSON(resp, http.StatusNotFound, []byte(`"Device Not Connected"`))
+		return
+	}
+	if h.logger.ShouldLog(WARNING) {
+		h.logger.Warn("handlers_admin", "Disconnecting device", LogFields{
+			"rid": req.Header.Get(HeaderID), "uaid": uaid})
+	}
+	h.metrics.Increment("admin.device.disconnect")
+	worker.Close()
+	writeSuccess(resp)
+}
+
+// DropHandler disconnects a device, and removes its channel records and
+// proprietary ping info from the store.
+func (h *AdminHandlers) DropHandler(resp http.ResponseWriter, req *http.Request) {
+	uaid, ok := h.deviceVars(resp, req)
+	if !ok {
+		return
+	}
+	if h.logger.ShouldLog(WARNING) {
+		h.logger.Warn("handlers_admin", "Dropping device", LogFields{
+			"rid": req.Header.Get(HeaderID), "uaid": uaid})
+	}
+	h.metrics.Increment("admin.device.drop")
+	if worker, ok := h.app.GetWorker(uaid); ok {
+		worker.Close()
+	}
+	if err := h.store.DropAll(uaid); err != nil {
+		h.writeError(resp, req, "Could not drop channels", uaid, err)
+		return
+	}
+	if err := h.store.DropPing(uaid); err != nil {
+		h.writeError(resp, req, "Could not drop proprietary ping info", uaid, err)
+		return
+	}
+	writeSuccess(resp)
+}
+
+// NotifyHandler stores a test notification for a channel, and delivers it to
+// the device if it is connected to this node or a peer. The version defaults
+// to the current time, as with app server updates.
+func (h *AdminHandlers) NotifyHandler(resp http.ResponseWriter, req *http.Request) {
+	uaid, ok := h.deviceVars(resp, req)
+	if !ok {
+		return
+	}
+	requestID := req.Header.Get(HeaderID)
+	chid := mux.Vars(req)["chid"]
+	if !id.Valid(chid) {
+		writeJSON(resp, http.StatusBadRequest, []byte(`"Invalid Channel ID"`))
+		return
+	}
+	version := timeNow().UTC().Unix()
+	if v := req.FormValue("version"); len(v) > 0 {
+		var err error
+		if version, err = strconv.ParseInt(v, 10, 64); err != nil || version < 0 {
+			writeJSON(resp, http.StatusBadRequest, []byte(`"Invalid Version"`))
+			return
+		}
+	}
+	data := req.FormValue("data")
+	h.metrics.Increment("admin.device.notify")
+	acceptedAt := timeNow().UTC()
+	if err := h.store.Update(uaid, chid, version, acceptedAt); err != nil {
+		h.writeError(resp, req, "Could not update channel", uaid, err)
+		return
+	}
+	delivered := false
+	if worker, ok := h.app.GetWorker(uaid); ok {
+		err := worker.Send(chid, version, data, acceptedAt, DeliveryDirect, nil)
+		delivered = err == nil
+	}
+	if !delivered && h.router != nil {
+		delivered, _ = h.router.Route(nil, uaid, chid, version, acceptedAt,
+			requestID, data, nil)
+	}
+	if h.logger.ShouldLog(INFO) {
+		h.logger.Info("handlers_admin", "Sent test notification", LogFields{
+			"rid":       requestID,
+			"uaid":      uaid,
+			"chid":      chid,
+			"version":   strconv.FormatInt(version, 10),
+			"delivered": strconv.FormatBool(delivered)})
+	}
+	h.writeReply(resp, req, NotifyReply{chid, version, delivered})
+}
+
+// TraceHandler logs all worker, endpoint, and router messages for a device,
+// regardless of the configured log levels.
+func (h *AdminHandlers) TraceHandler(resp http.ResponseWriter, req *http.Request) {
+	uaid, ok := h.deviceVars(resp, req)
+	if !ok {
+		return
+	}
+	if !h.logger.TraceDevice(uaid) {
+		writeJSON(resp, http.StatusNotImplemented,
+			[]byte(`"Tracing Not Supported"`))
+		return
+	}
+	if h.logger.ShouldLog(WARNING) {
+		h.logger.Warn("handlers_admin", "Tracing device", LogFields{
+			"rid": req.Header.Get(HeaderID), "uaid": uaid})
+	}
+	h.metrics.Increment("admin.device.trace")
+	writeSuccess(resp)
+}
+
+// UntraceHandler stops tracing a device.
+func (h *AdminHandlers) UntraceHandler(resp http.ResponseWriter, req *http.Request) {
+	uaid, ok := h.deviceVars(resp, req)
+	if !ok {
+		return
+	}
+	if !h.logger.UntraceDevice(uaid) {
+		writeJSON(resp, http.StatusNotFound, []byte(`"Device Not Traced"`))
+		return
+	}
+	if h.logger.ShouldLog(WARNING) {
+		h.logger.Warn("handlers_admin", "Stopped tracing device", LogFields{
+			"rid": req.Header.Get(HeaderID), "uaid": uaid})
+	}
+	writeSuccess(resp)
+}
+
+// TraceListHandler lists the traced devices.
+func (h *AdminHandlers) TraceListHandler(resp http.ResponseWriter, req *http.Request) {
+	uaids := h.logger.TracedDevices()
+	if uaids == nil {
+		uaids = []string{}
+	}
+	h.writeReply(resp, req, TraceReply{uaids})
+}
+
+// DrainHandler starts draining client connections. The node shuts down once
+// all clients have disconnected.
+func (h *AdminHandlers) DrainHandler(resp http.ResponseWriter, req *http.Request) {
+	if h.logger.ShouldLog(WARNING) {
+		h.logger.Warn("handlers_admin", "Drain requested",
+			LogFields{"rid": req.Header.Get(HeaderID)})
+	}
+	if err := h.app.Drain(); err != nil {
+		h.writeError(resp, req, "Could not drain node", "", err)
+		return
+	}
+	body, _ := json.Marshal(DrainReply{true, h.app.WorkerCount()})
+	writeJSON(resp, http.StatusAccepted, body)
+}
+
+func (h *AdminHandlers) writeReply(resp http.ResponseWriter,
+	req *http.Request, reply interface{}) {
+
+	body, err := json.Marshal(reply)
+	if err != nil {
+		h.writeError(resp, req, "Could not encode reply", "", err)
+		return
+	}
+	writeJSON(resp, http.StatusOK, body)
+}
+
+func (h *AdminHandlers) writeError(resp http.ResponseWriter,
+	req *http.Request, message, uaid string, err error) {
+
+	if h.logger.ShouldLog(WARNING) {
+		h.logger.Warn("handlers_admin", message, LogFields{
+			"rid":   req.Header.Get(HeaderID),
+			"uaid":  uaid,
+			"error": err.Error()})
+	}
+	h.metrics.Increment("admin.error")
+	status, _ := ErrToStatus(err)
+	if status < http.StatusInternalServerError {
+		status = http.StatusServiceUnavailable
+	}
+	body, _ := json.Marshal(message)
+	writeJSON(resp, status, body)
+}
+
+func (h *AdminHandlers) Start(errChan chan<- error) {
+	if h.server == nil {
+		if h.logger.ShouldLog(INFO) {
+			h.logger.Info("handlers_admin", "Admin server disabled", nil)
+		}
+		return
+	}
+	if h.logger.ShouldLog(WARNING) {
+		h.logger.Warn("handlers_admin", "Starting admin server",
+			LogFields{"url": h.url})
+	}
+	errChan <- h.server.Serve(h.listener)
+}
+
+func (h *AdminHandlers) Close() (err error) {
+	if h.listener != nil {
+		if err = h.listener.Close(); err != nil {
+			if h.logger.ShouldLog(ERROR) {
+				h.logger.Error("handlers_admin", "Error closing admin listener",
+					LogFields{"error": err.Error(), "url": h.url})
+			}
+		}
+	}
+	if h.server != nil {
+		h.server.Close()
+	}
+	return
+}
@@ -0,0 +1,212 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAdminHandlers(t *testing.T) {
+	useMockFuncs()
+	defer useStdFuncs()
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(false).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+	mckStore := NewMockStore(mockCtrl)
+	mckRouter := NewMockRouter(mockCtrl)
+	mckWorker := NewMockWorker(mockCtrl)
+
+	uaid := "f7e9fc483f7344c398701b6fa0e85e4f"
+	chid := "737b7a0d25674be4bb184f015fce02cf"
+
+	Convey("Admin API", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		app.SetStore(mckStore)
+		app.SetRouter(mckRouter)
+
+		ah := NewAdminHandlers()
+		ah.setApp(app)
+		ah.token = []byte("s3cr3t")
+
+		newRequest := func(method, path string, body url.Values) *http.Request {
+			req := &http.Request{
+				Method: method,
+				Header: http.Header{"Authorization": {"Bearer s3cr3t"}},
+				URL:    &url.URL{Path: path},
+			}
+			if body != nil {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				req.Body = formReader(body)
+			}
+			return req
+		}
+
+		Convey("Should reject unauthenticated requests", func() {
+			resp := httptest.NewRecorder()
+			req := newRequest("GET", "/devices/"+uaid, nil)
+			req.Header.Set("Authorization", "Bearer wrong")
+			mckStat.EXPECT().Increment("admin.unauthorized")
+			ah.ServeHTTP(resp, req)
+
+			So(resp.Code, ShouldEqual, 401)
+		})
+
+		Convey("Should reject invalid device IDs", func() {
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("GET", "/devices/abc", nil))
+
+			So(resp.Code, ShouldEqual, 400)
+		})
+
+		Convey("Should report connected devices and their channels", func() {
+			app.AddWorker(uaid, mckWorker)
+			born := time.Unix(1257893000, 0)
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("admin.device.inspect"),
+				mckStore.EXPECT().Exists(uaid).Return(true),
+				mckWorker.EXPECT().Born().Return(born),
+				mckWorker.EXPECT().Origin().Return("https://example.com"),
+				mckStore.EXPECT().FetchAll(uaid, time.Time{}).Return(
+					[]Update{{ChannelID: chid, Version: 3}}, nil, nil),
+				mckStore.EXPECT().FetchPing(uaid).Return(nil, nil),
+			)
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("GET", "/devices/"+uaid, nil))
+
+			So(resp.Code, ShouldEqual, 200)
+			report := new(DeviceReport)
+			So(json.Unmarshal(resp.Body.Bytes(), report), ShouldBeNil)
+			So(report, ShouldResemble, &DeviceReport{
+				DeviceID:  uaid,
+				Exists:    true,
+				Connected: true,
+				Born:      born.Unix(),
+				Origin:    "https://example.com",
+				Channels:  []ChannelReport{{ChannelID: chid, Version: 3}},
+				Expired:   []string{},
+			})
+		})
+
+		Convey("Should return a 404 when disconnecting unknown devices", func() {
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("DELETE", "/devices/"+uaid+"/connection", nil))
+
+			So(resp.Code, ShouldEqual, 404)
+		})
+
+		Convey("Should disconnect connected devices", func() {
+			app.AddWorker(uaid, mckWorker)
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("admin.device.disconnect"),
+				mckWorker.EXPECT().Close(),
+			)
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("DELETE", "/devices/"+uaid+"/connection", nil))
+
+			So(resp.Code, ShouldEqual, 200)
+		})
+
+		Convey("Should drop devices", func() {
+			app.AddWorker(uaid, mckWorker)
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("admin.device.drop"),
+				mckWorker.EXPECT().Close(),
+				mckStore.EXPECT().DropAll(uaid),
+				mckStore.EXPECT().DropPing(uaid),
+			)
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("DELETE", "/devices/"+uaid, nil))
+
+			So(resp.Code, ShouldEqual, 200)
+		})
+
+		Convey("Should route test notifications to disconnected devices", func() {
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("admin.device.notify"),
+				mckStore.EXPECT().Update(uaid, chid, int64(5), timeNow().UTC()),
+				mckRouter.EXPECT().Route(nil, uaid, chid, int64(5), timeNow().UTC(),
+					"", "hello", nil).Return(true, nil),
+			)
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("POST",
+				"/devices/"+uaid+"/channels/"+chid+"/notify",
+				url.Values{"version": {"5"}, "data": {"hello"}}))
+
+			So(resp.Code, ShouldEqual, 200)
+			reply := new(NotifyReply)
+			So(json.Unmarshal(resp.Body.Bytes(), reply), ShouldBeNil)
+			So(reply, ShouldResemble, &NotifyReply{chid, 5, true})
+		})
+
+		Convey("Should send test notifications to connected devices", func() {
+			app.AddWorker(uaid, mckWorker)
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("admin.device.notify"),
+				mckStore.EXPECT().Update(uaid, chid, timeNow().UTC().Unix(),
+					timeNow().UTC()),
+				mckWorker.EXPECT().Send(chid, timeNow().UTC().Unix(), "",
+					timeNow().UTC(), DeliveryDirect, nil),
+			)
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("POST",
+				"/devices/"+uaid+"/channels/"+chid+"/notify", url.Values{}))
+
+			So(resp.Code, ShouldEqual, 200)
+			reply := new(NotifyReply)
+			So(json.Unmarshal(resp.Body.Bytes(), reply), ShouldBeNil)
+			So(reply.Delivered, ShouldBeTrue)
+		})
+
+		Convey("Should reject tracing if the logger does not support it", func() {
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("PUT", "/devices/"+uaid+"/trace", nil))
+
+			So(resp.Code, ShouldEqual, 501)
+		})
+
+		Convey("Should trace and untrace devices", func() {
+			tracer := new(StdOutLogger)
+			tracer.LogEmitter = NewTextEmitter(ioutil.Discard)
+			app.SetLogger(tracer)
+			ah.setApp(app)
+
+			mckStat.EXPECT().Increment("admin.device.trace")
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("PUT", "/devices/"+uaid+"/trace", nil))
+			So(resp.Code, ShouldEqual, 200)
+
+			resp = httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("GET", "/trace", nil))
+			So(resp.Code, ShouldEqual, 200)
+			reply := new(TraceReply)
+			So(json.Unmarshal(resp.Body.Bytes(), reply), ShouldBeNil)
+			So(reply.DeviceIDs, ShouldResemble, []string{uaid})
+
+			resp = httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("DELETE", "/devices/"+uaid+"/trace", nil))
+			So(resp.Code, ShouldEqual, 200)
+			So(tracer.TracedDevices(), ShouldBeEmpty)
+
+			resp = httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("DELETE", "/devices/"+uaid+"/trace", nil))
+			So(resp.Code, ShouldEqual, 404)
+		})
+	})
+}
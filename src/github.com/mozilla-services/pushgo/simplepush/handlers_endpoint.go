@@ -11,9 +11,11 @@ import (
 	"net"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/mozilla-services/pushgo/retry"
 )
 
 func NewEndpointHandler() (h *EndpointHandler) {
@@ -27,6 +29,10 @@ type EndpointHandlerConfig struct {
 	AlwaysRoute bool `toml:"always_route" env:"always_route"`
 	EnableCORS  bool `toml:"enable_cors" env:"enable_cors"`
 	Listener    TCPListenerConfig
+	PingQueue   PingQueueConfig `toml:"ping_queue" env:"ping_queue"`
+
+	// RateLimits sets per-sender, per-device, and per-channel update limits.
+	RateLimits UpdateLimitsConfig `toml:"rate_limits" env:"rate_limits"`
 }
 
 type EndpointHandler struct {
@@ -36,14 +42,16 @@ type EndpointHandler struct {
 	store       Store
 	router      Router
 	pinger      PropPinger
+	pingQueue   *PingQueue
+	limits      *UpdateLimiter
 	balancer    Balancer
 	hostname    string
-	tokenKey    []byte
 	listener    net.Listener
 	server      *ServeCloser
 	mux         *mux.Router
 	url         string
 	maxConns    int
+	maxDataLock sync.RWMutex // Protects maxDataLen, which may be reloaded.
 	maxDataLen  int
 	alwaysRoute bool
 	closeOnce   Once
@@ -60,6 +68,24 @@ func (h *EndpointHandler) ConfigStruct() interface{} {
 			MaxConns:        1000,
 			KeepAlivePeriod: "3m",
 		},
+		PingQueue: PingQueueConfig{
+			Enabled: false,
+			Workers: 10,
+			MaxSize: 1000,
+			MaxAge:  "1h",
+			Retry: retry.Config{
+				Retries:   10,
+				Delay:     "1s",
+				MaxDelay:  "5m",
+				MaxJitter: "1s",
+			},
+		},
+		RateLimits: UpdateLimitsConfig{
+			IPBurst:      10,
+			UAIDBurst:    10,
+			ChannelBurst: 10,
+			MaxTracked:   DefaultMaxTrackedKeys,
+		},
 	}
 }
 
@@ -87,6 +113,22 @@ func (h *EndpointHandler) Init(app *Application, config interface{}) (err error)
 	h.alwaysRoute = conf.AlwaysRoute
 	h.enableCors = conf.EnableCORS
 
+	if conf.PingQueue.Enabled && h.pinger != nil {
+		if h.pingQueue, err = NewPingQueue(app, &conf.PingQueue); err != nil {
+			return err
+		}
+		h.pingQueue.Sent = h.sentPing
+		h.pingQueue.Fallback = h.fallbackPing
+	}
+
+	if conf.RateLimits.Enabled() {
+		if h.limits, err = NewUpdateLimiter(conf.RateLimits, h.store); err != nil {
+			h.logger.Panic("handlers_endpoint", "Could not set up update limits",
+				LogFields{"error": err.Error()})
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -103,7 +145,6 @@ func (h *EndpointHandler) setApp(app *Application) {
 	h.store = app.Store()
 	h.router = app.Router()
 	h.pinger = app.PropPinger()
-	h.tokenKey = app.TokenKey()
 	h.server = NewServeCloser(&http.Server{
 		ConnState: func(c net.Conn, state http.ConnState) {
 			if state == http.StateNew {
@@ -121,9 +162,58 @@ func (h *EndpointHandler) setApp(app *Application) {
 	})
 }
 
+// CheckConfig validates the listener and ping queue settings. Implements
+// ConfigChecker.CheckConfig().
+func (h *EndpointHandler) CheckConfig(config interface{}) (err error) {
+	conf := config.(*EndpointHandlerConfig)
+	if conf.MaxDataLen < 0 {
+		return fmt.Errorf("Invalid 'max_data_len': %d", conf.MaxDataLen)
+	}
+	if err = conf.Listener.Check(); err != nil {
+		return fmt.Errorf("Invalid update listener: %s", err)
+	}
+	if err = conf.RateLimits.Check(); err != nil {
+		return fmt.Errorf("Invalid update rate limits: %s", err)
+	}
+	if conf.PingQueue.Enabled {
+		if len(conf.PingQueue.MaxAge) > 0 {
+			err = checkDuration("ping_queue.max_age", conf.PingQueue.MaxAge)
+			if err != nil {
+				return err
+			}
+		}
+		if _, err = conf.PingQueue.Retry.NewHelper(); err != nil {
+			return fmt.Errorf("Invalid ping queue retry settings: %s", err)
+		}
+	}
+	return nil
+}
+
 // setMaxDataLen sets the maximum data length to v
 func (h *EndpointHandler) setMaxDataLen(v int) {
+	h.maxDataLock.Lock()
 	h.maxDataLen = v
+	h.maxDataLock.Unlock()
+}
+
+// MaxDataLen returns the maximum data length, in bytes.
+func (h *EndpointHandler) MaxDataLen() int {
+	h.maxDataLock.RLock()
+	defer h.maxDataLock.RUnlock()
+	return h.maxDataLen
+}
+
+// Reload applies the maximum data length from a reloaded configuration.
+// Implements Reloader.Reload().
+func (h *EndpointHandler) Reload(config interface{}, changed []string) (
+	rejected []string, err error) {
+
+	conf := config.(*EndpointHandlerConfig)
+	apply, rejected := liveSettings(changed, "max_data_len")
+	if apply["max_data_len"] {
+		h.setMaxDataLen(conf.MaxDataLen)
+	}
+	return rejected, nil
 }
 
 func (h *EndpointHandler) Start(errChan chan<- error) {
@@ -131,6 +221,9 @@ func (h *EndpointHandler) Start(errChan chan<- error) {
 		h.logger.Info("handlers_endpoint", "Starting update server",
 			LogFields{"url": h.url})
 	}
+	if h.pingQueue != nil {
+		h.pingQueue.Start()
+	}
 	errChan <- h.server.Serve(h.listener)
 }
 
@@ -138,10 +231,11 @@ func (h *EndpointHandler) decodePK(token string) (key string, err error) {
 	if len(token) == 0 {
 		return "", fmt.Errorf("Missing primary key")
 	}
-	if len(h.tokenKey) == 0 {
+	tokenKey := h.app.TokenKey()
+	if len(tokenKey) == 0 {
 		return token, nil
 	}
-	bpk, err := Decode(h.tokenKey, token)
+	bpk, err := Decode(tokenKey, token)
 	if err != nil {
 		return "", err
 	}
@@ -164,11 +258,16 @@ func (h *EndpointHandler) resolvePK(token string) (uaid, chid string, err error)
 	return uaid, chid, nil
 }
 
-func (h *EndpointHandler) doPropPing(uaid string, version int64, data string) (ok bool, err error) {
+func (h *EndpointHandler) doPropPing(uaid string, version int64, data string,
+	span *Span) (ok bool, err error) {
+
 	if h.pinger == nil {
 		return false, nil
 	}
-	if ok, err = h.pinger.Send(uaid, version, data); err != nil {
+	pingSpan := span.Child("ping.send")
+	ok, err = h.pinger.Send(uaid, version, data)
+	pingSpan.Finish(err)
+	if err != nil {
 		return false, fmt.Errorf("Could not send proprietary ping: %s", err)
 	}
 	if !ok {
@@ -179,6 +278,55 @@ func (h *EndpointHandler) doPropPing(uaid string, version int64, data string) (o
 	return h.pinger.CanBypassWebsocket(), nil
 }
 
+// queuePropPing queues a proprietary ping for asynchronous delivery. Pings
+// are only queued if the pinger can bypass the WebSocket; otherwise, the
+// update must still be delivered while handling the request.
+func (h *EndpointHandler) queuePropPing(uaid, chid string, version int64,
+	data string, requestID string) (ok bool) {
+
+	if h.pingQueue == nil || !h.pinger.CanBypassWebsocket() {
+		return false
+	}
+	err := h.pingQueue.Enqueue(uaid, chid, version, data, requestID)
+	if err != nil {
+		if h.logger.ShouldLog(WARNING) {
+			h.logger.Warn("handlers_endpoint", "Could not queue proprietary ping",
+				LogFields{"rid": requestID, "uaid": uaid, "error": err.Error()})
+		}
+		return false
+	}
+	h.metrics.Increment("updates.appserver.queued")
+	return true
+}
+
+// sentPing sends the receipt for a queued update accepted by the proprietary
+// service.
+func (h *EndpointHandler) sentPing(ping *QueuedPing) {
+	h.bypassedReceipt(ping.UAID, ping.ChannelID, ping.Version, ping.RequestID)
+}
+
+// fallbackPing stores an update that could not be sent via the proprietary
+// ping queue, and attempts to deliver it over the WebSocket. Delivery runs in
+// a separate goroutine, so that a slow route does not block the queue.
+func (h *EndpointHandler) fallbackPing(ping *QueuedPing) {
+	acceptedAt := time.Unix(0, ping.QueuedAt).UTC()
+	err := h.store.Update(ping.UAID, ping.ChannelID, ping.Version, acceptedAt)
+	if err != nil {
+		if h.logger.ShouldLog(WARNING) {
+			h.logger.Warn("handlers_endpoint", "Could not update channel", LogFields{
+				"rid":     ping.RequestID,
+				"uaid":    ping.UAID,
+				"chid":    ping.ChannelID,
+				"version": strconv.FormatInt(ping.Version, 10),
+				"error":   err.Error()})
+		}
+		h.metrics.Increment("updates.appserver.error")
+		return
+	}
+	go h.deliver(nil, ping.UAID, ping.ChannelID, ping.Version, acceptedAt,
+		ping.RequestID, ping.Data, nil)
+}
+
 // getUpdateParams extracts the update version and data from req.
 func (h *EndpointHandler) getUpdateParams(req *http.Request) (version int64, data string, err error) {
 	if req.Header.Get("Content-Type") == "" {
@@ -195,7 +343,7 @@ func (h *EndpointHandler) getUpdateParams(req *http.Request) (version int64, dat
 	}
 
 	data = req.FormValue("data")
-	if len(data) > h.maxDataLen {
+	if len(data) > h.MaxDataLen() {
 		return 0, "", ErrDataTooLong
 	}
 	return
@@ -208,8 +356,10 @@ func (h *EndpointHandler) addCorsHeaders(resp http.ResponseWriter) {
 }
 
 func (h *EndpointHandler) UpdateHandler(resp http.ResponseWriter, req *http.Request) {
-	// Handle the version updates.
+	// Handle the version updates. The update is accepted when the request is
+	// received, so that delivery latency includes storing the update.
 	timer := timeNow()
+	acceptedAt := timer.UTC()
 	requestID := req.Header.Get(HeaderID)
 	logWarning := h.logger.ShouldLog(WARNING)
 	var (
@@ -219,11 +369,19 @@ func (h *EndpointHandler) UpdateHandler(resp http.ResponseWriter, req *http.Requ
 		uaid, chid string
 	)
 
+	span := h.app.Tracer().StartSpanFromHeader("endpoint.update",
+		req.Header.Get(HeaderTraceParent))
+	span.SetAttribute("rid", requestID)
+
 	defer func() {
+		span.SetAttribute("uaid", uaid)
+		span.SetAttribute("chid", chid)
+		span.SetAttribute("delivered", strconv.FormatBool(updateSent))
+		span.Finish(err)
 		now := timeNow()
 		if h.logger.ShouldLog(DEBUG) {
 			h.logger.Debug("handlers_endpoint", "+++++++++++++ DONE +++",
-				LogFields{"rid": requestID})
+				LogFields{"rid": requestID, "uaid": uaid})
 		}
 		if h.logger.ShouldLog(INFO) {
 			h.logger.Info("handlers_endpoint", "Client Update complete", LogFields{
@@ -237,11 +395,6 @@ func (h *EndpointHandler) UpdateHandler(resp http.ResponseWriter, req *http.Requ
 		}
 	}()
 
-	if h.logger.ShouldLog(INFO) {
-		h.logger.Info("handlers_endpoint", "Handling Update",
-			LogFields{"rid": requestID})
-	}
-
 	if h.enableCors {
 		h.addCorsHeaders(resp)
 	}
@@ -256,6 +409,10 @@ func (h *EndpointHandler) UpdateHandler(resp http.ResponseWriter, req *http.Requ
 		return
 	}
 
+	if !h.allowUpdate(resp, UpdateLimitIP, clientIP(req), requestID) {
+		return
+	}
+
 	version, data, err := h.getUpdateParams(req)
 	if err != nil {
 		if err == ErrDataTooLong {
@@ -264,7 +421,7 @@ func (h *EndpointHandler) UpdateHandler(resp http.ResponseWriter, req *http.Requ
 					LogFields{"rid": requestID})
 			}
 			writeJSON(resp, http.StatusRequestEntityTooLarge, []byte(fmt.Sprintf(
-				`"Data exceeds max length of %d bytes"`, h.maxDataLen)))
+				`"Data exceeds max length of %d bytes"`, h.MaxDataLen())))
 			h.metrics.Increment("updates.appserver.toolong")
 			return
 		}
@@ -272,6 +429,12 @@ func (h *EndpointHandler) UpdateHandler(resp http.ResponseWriter, req *http.Requ
 		h.metrics.Increment("updates.appserver.invalid")
 		return
 	}
+	receiptURL := req.Header.Get(HeaderReceiptURL)
+	if len(receiptURL) > 0 && !ValidReceiptURL(receiptURL) {
+		writeJSON(resp, http.StatusBadRequest, []byte(`"Invalid Receipt URL"`))
+		h.metrics.Increment("updates.appserver.invalid")
+		return
+	}
 
 	// TODO:
 	// is there a magic flag for proxyable endpoints?
@@ -288,11 +451,28 @@ func (h *EndpointHandler) UpdateHandler(resp http.ResponseWriter, req *http.Requ
 		return
 	}
 
+	// Log once the device is known, so that traced devices include it.
+	if h.logger.ShouldLog(INFO) {
+		h.logger.Info("handlers_endpoint", "Handling Update",
+			LogFields{"rid": requestID, "uaid": uaid, "chid": chid})
+	}
+
+	if !h.allowUpdate(resp, UpdateLimitUAID, uaid, requestID) ||
+		!h.allowUpdate(resp, UpdateLimitChannel, joinIDs(uaid, chid), requestID) {
+		return
+	}
+
 	// At this point we should have a valid endpoint in the URL
 	h.metrics.Increment("updates.appserver.incoming")
 
 	// is there a Proprietary Ping for this?
-	updateSent, err = h.doPropPing(uaid, version, data)
+	if h.queuePropPing(uaid, chid, version, data, requestID) {
+		// The queue stores the update if the ping can't be delivered.
+		h.trackReceipt(uaid, chid, version, acceptedAt, receiptURL, requestID)
+		writeJSON(resp, http.StatusAccepted, []byte("{}"))
+		return
+	}
+	updateSent, err = h.doPropPing(uaid, version, data, span)
 	if err != nil {
 		if logWarning {
 			h.logger.Warn("handlers_endpoint", "Could not send proprietary ping",
@@ -300,6 +480,8 @@ func (h *EndpointHandler) UpdateHandler(resp http.ResponseWriter, req *http.Requ
 		}
 	} else if updateSent {
 		// Neat! Might as well return.
+		h.trackReceipt(uaid, chid, version, acceptedAt, receiptURL, requestID)
+		h.bypassedReceipt(uaid, chid, version, requestID)
 		h.metrics.Increment("updates.appserver.received")
 		writeSuccess(resp)
 		return
@@ -311,7 +493,10 @@ func (h *EndpointHandler) UpdateHandler(resp http.ResponseWriter, req *http.Requ
 				"version": strconv.FormatInt(version, 10)})
 	}
 
-	if err = h.store.Update(uaid, chid, version); err != nil {
+	storeSpan := span.Child("store.update")
+	err = h.store.Update(uaid, chid, version, acceptedAt)
+	storeSpan.Finish(err)
+	if err != nil {
 		if logWarning {
 			h.logger.Warn("handlers_endpoint", "Could not update channel", LogFields{
 				"rid":     requestID,
@@ -325,9 +510,11 @@ func (h *EndpointHandler) UpdateHandler(resp http.ResponseWriter, req *http.Requ
 		writeJSON(resp, status, []byte(`"Could not update channel version"`))
 		return
 	}
-
+	// Only track receipts for stored updates, so that failed updates don't
+	// produce expired receipts.
+	h.trackReceipt(uaid, chid, version, acceptedAt, receiptURL, requestID)
 	cn, _ := resp.(http.CloseNotifier)
-	if !h.deliver(cn, uaid, chid, version, requestID, data) {
+	if !h.deliver(cn, uaid, chid, version, acceptedAt, requestID, data, span) {
 		// We've accepted the valid endpoint, stored the data for
 		// eventual pickup by the client, but failed to deliver to
 		// the client via routing.
@@ -340,9 +527,85 @@ func (h *EndpointHandler) UpdateHandler(resp http.ResponseWriter, req *http.Requ
 	return
 }
 
-// deliver routes an incoming update to the appropriate server.
+// trackReceipt records the receipt request for an update accepted at
+// acceptedAt, if receipts are enabled.
+func (h *EndpointHandler) trackReceipt(uaid, chid string, version int64,
+	acceptedAt time.Time, receiptURL, requestID string) {
+
+	receipts := h.app.Receipts()
+	if receipts == nil {
+		return
+	}
+	err := receipts.Track(uaid, chid, version, acceptedAt, receiptURL,
+		requestID)
+	if err != nil && h.logger.ShouldLog(WARNING) {
+		h.logger.Warn("handlers_endpoint", "Could not track receipt", LogFields{
+			"rid":   requestID,
+			"uaid":  uaid,
+			"chid":  chid,
+			"error": err.Error()})
+	}
+}
+
+// bypassedReceipt sends the delivered receipt for an update accepted by a
+// proprietary service that bypasses the WebSocket. The client never
+// acknowledges these updates, so the receipt is sent once the service
+// accepts the update.
+func (h *EndpointHandler) bypassedReceipt(uaid, chid string, version int64,
+	requestID string) {
+
+	receipts := h.app.Receipts()
+	if receipts == nil {
+		return
+	}
+	if err := receipts.Acked(uaid, chid, version); err != nil &&
+		h.logger.ShouldLog(WARNING) {
+
+		h.logger.Warn("handlers_endpoint", "Could not send receipt", LogFields{
+			"rid":   requestID,
+			"uaid":  uaid,
+			"chid":  chid,
+			"error": err.Error()})
+	}
+}
+
+// allowUpdate consumes a token for key from the named update limit. If the
+// sender exceeded the limit, allowUpdate writes a 429 response and returns
+// false. Updates are allowed if the shared limit state is unavailable.
+func (h *EndpointHandler) allowUpdate(resp http.ResponseWriter, limit, key,
+	requestID string) bool {
+
+	if h.limits == nil {
+		return true
+	}
+	ok, retryAfter, err := h.limits.Allow(limit, key)
+	if err != nil {
+		if h.logger.ShouldLog(WARNING) {
+			h.logger.Warn("handlers_endpoint", "Could not check update limit",
+				LogFields{"rid": requestID, "limit": limit, "error": err.Error()})
+		}
+		h.metrics.Increment("updates.appserver.limit_error")
+		return true
+	}
+	if ok {
+		return true
+	}
+	if h.logger.ShouldLog(NOTICE) {
+		h.logger.Notice("handlers_endpoint", "Update rate limit exceeded",
+			LogFields{"rid": requestID, "limit": limit, "key": key})
+	}
+	h.metrics.Increment("updates.appserver.limited." + limit)
+	resp.Header().Set("Retry-After", FormatRetryAfter(retryAfter))
+	writeJSON(resp, http.StatusTooManyRequests, []byte(`"Too Many Requests"`))
+	return false
+}
+
+// deliver routes an incoming update to the appropriate server. acceptedAt is
+// the time the update was accepted from the app server. span is the update's
+// trace span, or nil if the update is not traced.
 func (h *EndpointHandler) deliver(cn http.CloseNotifier, uaid, chid string,
-	version int64, requestID string, data string) (delivered bool) {
+	version int64, acceptedAt time.Time, requestID string, data string,
+	span *Span) (delivered bool) {
 
 	worker, workerConnected := h.app.GetWorker(uaid)
 	var routingTime time.Duration
@@ -361,7 +624,7 @@ func (h *EndpointHandler) deliver(cn http.CloseNotifier, uaid, chid string,
 		// Route the update.
 		startTime := timeNow().UTC()
 		delivered, _ = h.router.Route(cancelSignal, uaid, chid, version,
-			startTime, requestID, data)
+			acceptedAt, requestID, data, span)
 		routingTime = timeNow().UTC().Sub(startTime)
 
 		// Increment appropriate metrics
@@ -379,7 +642,8 @@ func (h *EndpointHandler) deliver(cn http.CloseNotifier, uaid, chid string,
 	shouldLocalDeliver := workerConnected && (h.alwaysRoute || !delivered)
 
 	if shouldLocalDeliver {
-		if err := worker.Send(chid, version, data); err == nil {
+		if err := worker.Send(chid, version, data, acceptedAt,
+			DeliveryDirect, span); err == nil {
 			delivered = true
 		}
 	}
@@ -409,6 +673,9 @@ func (h *EndpointHandler) close() (err error) {
 			LogFields{"error": err.Error(), "url": h.url})
 	}
 	h.server.Close()
+	if h.pingQueue != nil {
+		h.pingQueue.Close()
+	}
 	return
 }
 
@@ -20,6 +20,8 @@ import (
 
 	"github.com/rafrombrc/gomock/gomock"
 	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/mozilla-services/pushgo/retry"
 )
 
 type keyTest struct {
@@ -342,6 +344,26 @@ func TestEndpointInvalidParams(t *testing.T) {
 			So(isJSON, ShouldBeTrue)
 			So(body.String(), ShouldEqual, `"Data exceeds max length of 512 bytes"`)
 		})
+
+		Convey("Should reject invalid receipt URLs", func() {
+			vals := make(url.Values)
+			vals.Set("version", "1")
+
+			resp := httptest.NewRecorder()
+			req := &http.Request{
+				Method: "PUT",
+				Header: http.Header{HeaderReceiptURL: {"/receipts"}},
+				URL:    &url.URL{Path: "/update/123"},
+				Body:   formReader(vals),
+			}
+			mckStat.EXPECT().Increment("updates.appserver.invalid")
+			eh.ServeMux().ServeHTTP(resp, req)
+
+			So(resp.Code, ShouldEqual, 400)
+			body, isJSON := getJSON(resp.HeaderMap, resp.Body)
+			So(isJSON, ShouldBeTrue)
+			So(body.String(), ShouldEqual, `"Invalid Receipt URL"`)
+		})
 	})
 }
 
@@ -401,6 +423,142 @@ func TestEndpointPinger(t *testing.T) {
 			So(body.String(), ShouldEqual, "{}")
 		})
 
+		Convey("Should queue pings if the pinger can bypass the WebSocket", func() {
+			uaid := "2dbd1e8e4d0b4d3aa9a7f1b0b4cd8b1c"
+			app.AddWorker(uaid, mckWorker)
+
+			q, err := NewPingQueue(app, &PingQueueConfig{
+				Enabled: true,
+				Workers: 1,
+				MaxSize: 1,
+				Retry: retry.Config{
+					Delay:     "1s",
+					MaxDelay:  "1s",
+					MaxJitter: "0",
+				},
+			})
+			So(err, ShouldBeNil)
+			defer q.Close()
+			eh.pingQueue = q
+
+			resp := httptest.NewRecorder()
+			req := &http.Request{
+				Method: "PUT",
+				Header: http.Header{},
+				URL:    &url.URL{Path: "/update/123"},
+				Body:   nil,
+			}
+			gomock.InOrder(
+				mckStore.EXPECT().KeyToIDs("123").Return(uaid, "456", nil),
+				mckStat.EXPECT().Increment("updates.appserver.incoming"),
+				mckPinger.EXPECT().CanBypassWebsocket().Return(true),
+				mckStat.EXPECT().Increment("ping.queue.queued"),
+				mckStat.EXPECT().Increment("updates.appserver.queued"),
+			)
+			eh.ServeMux().ServeHTTP(resp, req)
+
+			So(resp.Code, ShouldEqual, 202)
+			body, isJSON := getJSON(resp.HeaderMap, resp.Body)
+			So(isJSON, ShouldBeTrue)
+			So(body.String(), ShouldEqual, "{}")
+			So(q.Len(), ShouldEqual, 1)
+		})
+
+		Convey("Should send receipts for updates sent via proprietary pings", func() {
+			uaid := "5d0e2c4a8f1b4e6c9a3d7b2f1e0c8a94"
+			app.AddWorker(uaid, mckWorker)
+
+			d, err := NewReceiptDispatcher(app, &ReceiptsConfig{
+				Key:     "secret",
+				Expiry:  "1h",
+				MaxSize: 1,
+				Timeout: "1s",
+				Retry: retry.Config{
+					Delay:     "1s",
+					MaxDelay:  "1s",
+					MaxJitter: "0",
+				},
+			})
+			So(err, ShouldBeNil)
+			app.receipts = d
+			store := &receiptStore{
+				MockStore: mckStore,
+				receipts:  make(map[string]*Receipt),
+			}
+			So(app.SetStore(store), ShouldBeNil)
+			eh.setApp(app)
+
+			resp := httptest.NewRecorder()
+			req := &http.Request{
+				Method: "PUT",
+				Header: http.Header{
+					HeaderReceiptURL: {"https://example.com/receipts"}},
+				URL:  &url.URL{Path: "/update/123"},
+				Body: nil,
+			}
+			gomock.InOrder(
+				mckStore.EXPECT().KeyToIDs("123").Return(uaid, "456", nil),
+				mckStat.EXPECT().Increment("updates.appserver.incoming"),
+				mckPinger.EXPECT().Send(uaid, int64(1257894000), "").Return(true, nil),
+				mckPinger.EXPECT().CanBypassWebsocket().Return(true),
+				mckStat.EXPECT().Increment("receipts.queued"),
+				mckStat.EXPECT().Increment("updates.appserver.received"),
+				mckStat.EXPECT().Timer("updates.handled", gomock.Any()),
+			)
+			eh.ServeMux().ServeHTTP(resp, req)
+
+			So(resp.Code, ShouldEqual, 200)
+			So(d.Len(), ShouldEqual, 1)
+			So(store.receipts, ShouldBeEmpty)
+		})
+
+		Convey("Should not track receipts for updates that cannot be stored", func() {
+			uaid := "0b5a6c1e7d2f4a8b9c3e6f1a2d4b7c8e"
+			app.AddWorker(uaid, mckWorker)
+
+			d, err := NewReceiptDispatcher(app, &ReceiptsConfig{
+				Key:     "secret",
+				Expiry:  "1h",
+				MaxSize: 1,
+				Timeout: "1s",
+				Retry: retry.Config{
+					Delay:     "1s",
+					MaxDelay:  "1s",
+					MaxJitter: "0",
+				},
+			})
+			So(err, ShouldBeNil)
+			app.receipts = d
+			store := &receiptStore{
+				MockStore: mckStore,
+				receipts:  make(map[string]*Receipt),
+			}
+			So(app.SetStore(store), ShouldBeNil)
+			eh.setApp(app)
+
+			resp := httptest.NewRecorder()
+			req := &http.Request{
+				Method: "PUT",
+				Header: http.Header{
+					HeaderReceiptURL: {"https://example.com/receipts"}},
+				URL:  &url.URL{Path: "/update/123"},
+				Body: nil,
+			}
+			gomock.InOrder(
+				mckStore.EXPECT().KeyToIDs("123").Return(uaid, "456", nil),
+				mckStat.EXPECT().Increment("updates.appserver.incoming"),
+				mckPinger.EXPECT().Send(uaid, int64(1257894000), "").Return(false, nil),
+				mckStore.EXPECT().Update(uaid, "456", int64(1257894000),
+					timeNow().UTC()).Return(ErrInvalidID),
+				mckStat.EXPECT().Increment("updates.appserver.error"),
+			)
+			eh.ServeMux().ServeHTTP(resp, req)
+
+			So(resp.Code, ShouldNotEqual, 200)
+			So(d.Len(), ShouldEqual, 0)
+			So(store.receipts, ShouldBeEmpty)
+		})
+
 		Convey("Should continue if the pinger cannot bypass the WebSocket", func() {
 			uaid := "e3fc2cf1dc44424685010148b076d08b"
 			app.AddWorker(uaid, mckWorker)
@@ -421,8 +579,10 @@ func TestEndpointPinger(t *testing.T) {
 				mckStat.EXPECT().Increment("updates.appserver.incoming"),
 				mckPinger.EXPECT().Send(uaid, int64(1257894000), data).Return(true, nil),
 				mckPinger.EXPECT().CanBypassWebsocket().Return(false),
-				mckStore.EXPECT().Update(uaid, "456", int64(1257894000)),
-				mckWorker.EXPECT().Send("456", int64(1257894000), data),
+				mckStore.EXPECT().Update(uaid, "456", int64(1257894000),
+					timeNow().UTC()),
+				mckWorker.EXPECT().Send("456", int64(1257894000), data, gomock.Any(),
+					DeliveryDirect, gomock.Any()),
 				mckStat.EXPECT().Increment("updates.appserver.received"),
 				mckStat.EXPECT().Timer("updates.handled", gomock.Any()),
 			)
@@ -452,8 +612,9 @@ func TestEndpointPinger(t *testing.T) {
 				mckStat.EXPECT().Increment("updates.appserver.incoming"),
 				mckPinger.EXPECT().Send(uaid, int64(7), "").Return(
 					true, errors.New("oops")),
-				mckStore.EXPECT().Update(uaid, "456", int64(7)),
-				mckWorker.EXPECT().Send("456", int64(7), ""),
+				mckStore.EXPECT().Update(uaid, "456", int64(7), timeNow().UTC()),
+				mckWorker.EXPECT().Send("456", int64(7), "", timeNow().UTC(),
+					DeliveryDirect, gomock.Any()),
 				mckStat.EXPECT().Increment("updates.appserver.received"),
 				mckStat.EXPECT().Timer("updates.handled", gomock.Any()),
 			)
@@ -501,12 +662,12 @@ func TestEndpointDelivery(t *testing.T) {
 				gomock.InOrder(
 					mckStat.EXPECT().Increment("updates.routed.outgoing"),
 					mckRouter.EXPECT().Route(nil, uaid, chid, int64(3), timeNow().UTC(),
-						"", "").Return(true, nil),
+						"", "", gomock.Any()).Return(true, nil),
 					mckStat.EXPECT().Increment("router.broadcast.hit"),
 					mckStat.EXPECT().Timer("updates.routed.hits", gomock.Any()),
 					mckStat.EXPECT().Increment("updates.appserver.received"),
 				)
-				ok := eh.deliver(nil, uaid, chid, 3, "", "")
+				ok := eh.deliver(nil, uaid, chid, 3, timeNow().UTC(), "", "", nil)
 				So(ok, ShouldBeTrue)
 			})
 
@@ -524,10 +685,11 @@ func TestEndpointDelivery(t *testing.T) {
 				gomock.InOrder(
 					mckStore.EXPECT().KeyToIDs("123").Return("123", "456", nil),
 					mckStat.EXPECT().Increment("updates.appserver.incoming"),
-					mckStore.EXPECT().Update("123", "456", int64(1)).Return(nil),
+					mckStore.EXPECT().Update("123", "456", int64(1),
+						timeNow().UTC()).Return(nil),
 					mckStat.EXPECT().Increment("updates.routed.outgoing"),
 					mckRouter.EXPECT().Route(nil, "123", "456", int64(1),
-						gomock.Any(), "reqID", "").Return(false, nil),
+						timeNow().UTC(), "reqID", "", gomock.Any()).Return(false, nil),
 					mckStat.EXPECT().Increment("router.broadcast.miss"),
 					mckStat.EXPECT().Timer("updates.routed.misses", gomock.Any()),
 					mckStat.EXPECT().Increment("updates.appserver.rejected"),
@@ -546,11 +708,13 @@ func TestEndpointDelivery(t *testing.T) {
 				app.AddWorker(uaid, mckWorker)
 
 				gomock.InOrder(
-					mckWorker.EXPECT().Send(chid, int64(3), "").Return(
+					mckWorker.EXPECT().Send(chid, int64(3), "", gomock.Any(),
+						DeliveryDirect, gomock.Any()).Return(
 						errors.New("client gone")),
 					mckStat.EXPECT().Increment("updates.appserver.rejected"),
 				)
-				ok := eh.deliver(nil, uaid, chid, int64(3), "", "")
+				ok := eh.deliver(nil, uaid, chid, int64(3), timeNow().UTC(), "", "",
+					nil)
 				So(ok, ShouldBeFalse)
 			})
 
@@ -566,7 +730,8 @@ func TestEndpointDelivery(t *testing.T) {
 				gomock.InOrder(
 					mckStore.EXPECT().KeyToIDs("123").Return("123", "456", nil),
 					mckStat.EXPECT().Increment("updates.appserver.incoming"),
-					mckStore.EXPECT().Update("123", "456", int64(2)).Return(updateErr),
+					mckStore.EXPECT().Update("123", "456", int64(2),
+						gomock.Any()).Return(updateErr),
 					mckStat.EXPECT().Increment("updates.appserver.error"),
 				)
 				eh.ServeMux().ServeHTTP(resp, req)
@@ -595,14 +760,16 @@ func TestEndpointDelivery(t *testing.T) {
 				gomock.InOrder(
 					mckStat.EXPECT().Increment("updates.routed.outgoing"),
 					mckRouter.EXPECT().Route(nil, uaid, chid, version,
-						gomock.Any(), "", data).Return(false, nil),
+						gomock.Any(), "", data, gomock.Any()).Return(false, nil),
 					mckStat.EXPECT().Increment("router.broadcast.miss"),
 					mckStat.EXPECT().Timer("updates.routed.misses", gomock.Any()),
-					mckWorker.EXPECT().Send(chid, version, data).Return(nil),
+					mckWorker.EXPECT().Send(chid, version, data, gomock.Any(),
+						DeliveryDirect, gomock.Any()).Return(nil),
 					mckStat.EXPECT().Increment("updates.appserver.received"),
 				)
 
-				ok := eh.deliver(nil, uaid, chid, version, "", data)
+				ok := eh.deliver(nil, uaid, chid, version, timeNow().UTC(), "",
+					data, nil)
 				So(ok, ShouldBeTrue)
 			})
 
@@ -610,14 +777,16 @@ func TestEndpointDelivery(t *testing.T) {
 				gomock.InOrder(
 					mckStat.EXPECT().Increment("updates.routed.outgoing"),
 					mckRouter.EXPECT().Route(nil, uaid, chid, version,
-						gomock.Any(), "", data).Return(true, nil),
+						gomock.Any(), "", data, gomock.Any()).Return(true, nil),
 					mckStat.EXPECT().Increment("router.broadcast.hit"),
 					mckStat.EXPECT().Timer("updates.routed.hits", gomock.Any()),
-					mckWorker.EXPECT().Send(chid, version, data).Return(nil),
+					mckWorker.EXPECT().Send(chid, version, data, gomock.Any(),
+						DeliveryDirect, gomock.Any()).Return(nil),
 					mckStat.EXPECT().Increment("updates.appserver.received"),
 				)
 
-				ok := eh.deliver(nil, uaid, chid, version, "", data)
+				ok := eh.deliver(nil, uaid, chid, version, timeNow().UTC(), "",
+					data, nil)
 				So(ok, ShouldBeTrue)
 			})
 
@@ -625,15 +794,17 @@ func TestEndpointDelivery(t *testing.T) {
 				gomock.InOrder(
 					mckStat.EXPECT().Increment("updates.routed.outgoing"),
 					mckRouter.EXPECT().Route(nil, uaid, chid, version,
-						gomock.Any(), "", data).Return(true, nil),
+						gomock.Any(), "", data, gomock.Any()).Return(true, nil),
 					mckStat.EXPECT().Increment("router.broadcast.hit"),
 					mckStat.EXPECT().Timer("updates.routed.hits", gomock.Any()),
-					mckWorker.EXPECT().Send(chid, version, data).Return(
+					mckWorker.EXPECT().Send(chid, version, data, gomock.Any(),
+						DeliveryDirect, gomock.Any()).Return(
 						errors.New("client gone")),
 					mckStat.EXPECT().Increment("updates.appserver.received"),
 				)
 
-				ok := eh.deliver(nil, uaid, chid, version, "", data)
+				ok := eh.deliver(nil, uaid, chid, version, timeNow().UTC(), "",
+					data, nil)
 				So(ok, ShouldBeTrue)
 			})
 
@@ -641,18 +812,92 @@ func TestEndpointDelivery(t *testing.T) {
 				gomock.InOrder(
 					mckStat.EXPECT().Increment("updates.routed.outgoing"),
 					mckRouter.EXPECT().Route(nil, uaid, chid, version,
-						gomock.Any(), "", data).Return(false, nil),
+						gomock.Any(), "", data, gomock.Any()).Return(false, nil),
 					mckStat.EXPECT().Increment("router.broadcast.miss"),
 					mckStat.EXPECT().Timer("updates.routed.misses", gomock.Any()),
-					mckWorker.EXPECT().Send(chid, version, data).Return(
+					mckWorker.EXPECT().Send(chid, version, data, gomock.Any(),
+						DeliveryDirect, gomock.Any()).Return(
 						errors.New("client gone")),
 					mckStat.EXPECT().Increment("updates.appserver.rejected"),
 				)
 
-				ok := eh.deliver(nil, uaid, chid, version, "", data)
+				ok := eh.deliver(nil, uaid, chid, version, timeNow().UTC(), "",
+					data, nil)
 				So(ok, ShouldBeFalse)
 			})
 
 		})
 	})
 }
+
+func TestEndpointTrace(t *testing.T) {
+	useMockFuncs()
+	defer useStdFuncs()
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckStat := NewMockStatistician(mockCtrl)
+	mckStore := NewMockStore(mockCtrl)
+	mckWorker := NewMockWorker(mockCtrl)
+
+	Convey("Traced devices", t, func() {
+		logs := new(bytes.Buffer)
+		logger := &StdOutLogger{LogEmitter: NewTextEmitter(logs)}
+		logger.SetFilter(ERROR)
+
+		app := NewApplication()
+		app.SetLogger(logger)
+		app.SetMetrics(mckStat)
+		app.SetStore(mckStore)
+
+		eh := NewEndpointHandler()
+		eh.setApp(app)
+		app.SetEndpointHandler(eh)
+
+		tracedID := "6ce0de1ba0e2451c9a8bd6a4b0e2ad5e"
+		untracedID := "1d46fb41d3e8473eb2c4a2c8ef32bb0b"
+		So(app.Logger().TraceDevice(tracedID), ShouldBeTrue)
+
+		sendUpdate := func(key, uaid string) {
+			app.AddWorker(uaid, mckWorker)
+			defer app.RemoveWorker(uaid, mckWorker)
+
+			resp := httptest.NewRecorder()
+			req := &http.Request{
+				Method: "PUT",
+				Header: http.Header{HeaderID: {"reqID"}},
+				URL:    &url.URL{Path: "/update/" + key},
+				Body:   formReader(url.Values{"version": {"1"}}),
+			}
+			gomock.InOrder(
+				mckStore.EXPECT().KeyToIDs(key).Return(uaid, "456", nil),
+				mckStat.EXPECT().Increment("updates.appserver.incoming"),
+				mckStore.EXPECT().Update(uaid, "456", int64(1),
+					timeNow().UTC()).Return(nil),
+				mckWorker.EXPECT().Send("456", int64(1), "", timeNow().UTC(),
+					DeliveryDirect, gomock.Any()).Return(nil),
+				mckStat.EXPECT().Increment("updates.appserver.received"),
+				mckStat.EXPECT().Timer("updates.handled", gomock.Any()),
+			)
+			eh.ServeMux().ServeHTTP(resp, req)
+			So(resp.Code, ShouldEqual, 200)
+		}
+
+		Convey("Should log endpoint messages for traced devices", func() {
+			sendUpdate("123", tracedID)
+
+			for _, msg := range []string{"Handling Update", "+++++++++++++ DONE +++"} {
+				So(logs.String(), ShouldContainSubstring, msg)
+			}
+			for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+				So(line, ShouldContainSubstring, "uaid:"+tracedID)
+			}
+		})
+
+		Convey("Should not log endpoint messages for other devices", func() {
+			sendUpdate("789", untracedID)
+			So(logs.String(), ShouldBeEmpty)
+		})
+	})
+}
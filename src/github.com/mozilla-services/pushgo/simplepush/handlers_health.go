@@ -79,6 +79,11 @@ func (h *HealthHandlers) Init(app *Application, _ interface{}) error {
 	endpointMux.HandleFunc("/status/", h.StatusHandler)
 	endpointMux.HandleFunc("/realstatus/", h.RealStatusHandler)
 	endpointMux.HandleFunc("/metrics/", h.MetricsHandler)
+	if exporter, ok := h.metrics.(PrometheusExporter); ok {
+		if registry := exporter.Prometheus(); registry != nil {
+			endpointMux.Handle("/metrics", registry)
+		}
+	}
 
 	return nil
 }
@@ -105,6 +110,13 @@ func (h *HealthHandlers) MetricsHandler(resp http.ResponseWriter, req *http.Requ
 // VIP response
 func (h *HealthHandlers) StatusHandler(resp http.ResponseWriter,
 	req *http.Request) {
+	if h.app.Draining() {
+		// Remove draining nodes from the load balancer.
+		reply := []byte(fmt.Sprintf(`{"status":"DRAINING","clients":%d,"version":"%s"}`,
+			h.app.WorkerCount(), VERSION))
+		writeJSON(resp, http.StatusServiceUnavailable, reply)
+		return
+	}
 	reply := []byte(fmt.Sprintf(`{"status":"OK","clients":%d,"version":"%s"}`,
 		h.app.WorkerCount(), VERSION))
 
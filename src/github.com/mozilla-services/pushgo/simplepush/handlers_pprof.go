@@ -5,6 +5,7 @@
 package simplepush
 
 import (
+	"fmt"
 	"log"
 	"net"
 	"net/http"
@@ -37,6 +38,19 @@ func (p *ProfileHandlers) ConfigStruct() interface{} {
 	}
 }
 
+// CheckConfig validates the profiling listener settings. Implements
+// ConfigChecker.CheckConfig().
+func (p *ProfileHandlers) CheckConfig(config interface{}) error {
+	conf := config.(*ProfileHandlersConfig)
+	if !conf.Enabled {
+		return nil
+	}
+	if err := conf.Listener.Check(); err != nil {
+		return fmt.Errorf("Invalid profiling listener: %s", err)
+	}
+	return nil
+}
+
 func (p *ProfileHandlers) Init(app *Application, config interface{}) (err error) {
 	conf := config.(*ProfileHandlersConfig)
 	p.logger = app.Logger()
@@ -60,9 +74,20 @@ func (p *ProfileHandlers) Init(app *Application, config interface{}) (err error)
 	host, port := HostPort(p.listener, app)
 	p.url = CanonicalURL(scheme, host, port)
 
+	// Serve Prometheus metrics alongside the profiling handlers.
+	handler := http.Handler(http.DefaultServeMux)
+	if exporter, ok := app.Metrics().(PrometheusExporter); ok {
+		if registry := exporter.Prometheus(); registry != nil {
+			mux := http.NewServeMux()
+			mux.Handle("/", http.DefaultServeMux)
+			mux.Handle("/metrics", registry)
+			handler = mux
+		}
+	}
+
 	p.maxConns = conf.Listener.MaxConns
 	p.server = NewServeCloser(&http.Server{
-		Handler: &LogHandler{http.DefaultServeMux, p.logger},
+		Handler: &LogHandler{handler, p.logger},
 		ErrorLog: log.New(&LogWriter{
 			Logger: p.logger,
 			Name:   "handlers_profile",
@@ -10,6 +10,7 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -36,12 +37,14 @@ type SocketHandler struct {
 	metrics   Statistician
 	store     Store
 	locator   Locator
+	originMux sync.RWMutex // Protects origins.
 	origins   []*url.URL
 	listener  net.Listener
 	server    Server
 	mux       *mux.Router
 	url       string
 	maxConns  int
+	limits    *ClientLimiter
 	closeOnce Once
 }
 
@@ -51,6 +54,13 @@ func (h *SocketHandler) ConfigStruct() interface{} {
 			Addr:            ":8080",
 			MaxConns:        1000,
 			KeepAlivePeriod: "3m",
+			Limits: ClientLimitsConfig{
+				CIDRPrefixV4: 24,
+				CIDRPrefixV6: 64,
+				ConnBurst:    10,
+				HelloBurst:   10,
+				MaxTracked:   DefaultMaxTrackedKeys,
+			},
 		},
 	}
 }
@@ -68,8 +78,13 @@ func (h *SocketHandler) Init(app *Application, config interface{}) (err error) {
 			LogFields{"error": err.Error()})
 		return err
 	}
+	var handler http.Handler = h.mux
+	if conf.Listener.Limits.Enabled() {
+		h.limits = NewClientLimiter(conf.Listener.Limits)
+		handler = http.HandlerFunc(h.serveLimited)
+	}
 	h.server = NewServeCloser(&http.Server{
-		Handler: &LogHandler{h.mux, h.logger},
+		Handler: &LogHandler{handler, h.logger},
 		ErrorLog: log.New(&LogWriter{
 			Logger: h.logger,
 			Name:   "handlers_socket",
@@ -105,17 +120,50 @@ func (h *SocketHandler) listenWithConfig(conf ListenerConfig) (err error) {
 	return nil
 }
 
+// CheckConfig validates the allowed origins and listener settings.
+// Implements ConfigChecker.CheckConfig().
+func (h *SocketHandler) CheckConfig(config interface{}) error {
+	conf := config.(*SocketHandlerConfig)
+	for _, origin := range conf.Origins {
+		if _, err := url.ParseRequestURI(origin); err != nil {
+			return fmt.Errorf("Error parsing origin %q: %s", origin, err)
+		}
+	}
+	if err := conf.Listener.Check(); err != nil {
+		return fmt.Errorf("Invalid WebSocket listener: %s", err)
+	}
+	return nil
+}
+
 // setOrigins sets the allowed WebSocket origins.
 func (h *SocketHandler) setOrigins(origins []string) (err error) {
-	h.origins = make([]*url.URL, len(origins))
+	urls := make([]*url.URL, len(origins))
 	for i, origin := range origins {
-		if h.origins[i], err = url.ParseRequestURI(origin); err != nil {
+		if urls[i], err = url.ParseRequestURI(origin); err != nil {
 			return fmt.Errorf("Error parsing origin %q: %s", origin, err)
 		}
 	}
+	h.originMux.Lock()
+	h.origins = urls
+	h.originMux.Unlock()
 	return nil
 }
 
+// Reload applies the allowed WebSocket origins from a reloaded configuration.
+// Implements Reloader.Reload().
+func (h *SocketHandler) Reload(config interface{}, changed []string) (
+	rejected []string, err error) {
+
+	conf := config.(*SocketHandlerConfig)
+	apply, rejected := liveSettings(changed, "origins")
+	if apply["origins"] {
+		if err = h.setOrigins(conf.Origins); err != nil {
+			return nil, err
+		}
+	}
+	return rejected, nil
+}
+
 func (h *SocketHandler) Listener() net.Listener { return h.listener }
 func (h *SocketHandler) MaxConns() int          { return h.maxConns }
 func (h *SocketHandler) URL() string            { return h.url }
@@ -137,6 +185,10 @@ func (h *SocketHandler) Start(errChan chan<- error) {
 func (h *SocketHandler) PushSocketHandler(ws *websocket.Conn) {
 	requestID := ws.Request().Header.Get(HeaderID)
 	worker := NewWorker(h.app, (*WebSocket)(ws), requestID)
+	if h.limits != nil {
+		worker.limits = h.limits
+		worker.clientIP = clientIP(ws.Request())
+	}
 
 	if h.logger.ShouldLog(INFO) {
 		h.logger.Info("handlers_socket", "websocket connection",
@@ -159,6 +211,34 @@ func (h *SocketHandler) PushSocketHandler(ws *websocket.Conn) {
 	}
 }
 
+// serveLimited rejects clients that exceed a connection limit with a 429
+// response, and serves the WebSocket handshake otherwise.
+func (h *SocketHandler) serveLimited(res http.ResponseWriter, req *http.Request) {
+	ip := clientIP(req)
+	if err := h.limits.Acquire(ip); err != nil {
+		h.rejectClient(res, req, ip, err.(*ClientLimitError))
+		return
+	}
+	defer h.limits.Release(ip)
+	h.mux.ServeHTTP(res, req)
+}
+
+// rejectClient responds to a client that exceeded a connection limit.
+func (h *SocketHandler) rejectClient(res http.ResponseWriter, req *http.Request,
+	ip string, err *ClientLimitError) {
+
+	h.metrics.Increment("client.limit." + err.Limit)
+	if h.logger.ShouldLog(NOTICE) {
+		h.logger.Notice("handlers_socket", "Rejected WebSocket connection",
+			LogFields{"rid": req.Header.Get(HeaderID), "remoteAddr": ip,
+				"error": err.Error()})
+	}
+	if err.RetryAfter > 0 {
+		res.Header().Set("Retry-After", FormatRetryAfter(err.RetryAfter))
+	}
+	http.Error(res, "Too Many Requests", http.StatusTooManyRequests)
+}
+
 func (h *SocketHandler) checkOrigin(conf *websocket.Config, req *http.Request) (err error) {
 	if conf.Origin, err = websocket.Origin(conf, req); err != nil {
 		if h.logger.ShouldLog(NOTICE) {
@@ -166,13 +246,16 @@ func (h *SocketHandler) checkOrigin(conf *websocket.Config, req *http.Request) (
 				LogFields{"rid": req.Header.Get(HeaderID), "error": err.Error()})
 		}
 	}
-	if len(h.origins) == 0 {
+	h.originMux.RLock()
+	origins := h.origins
+	h.originMux.RUnlock()
+	if len(origins) == 0 {
 		return nil
 	}
 	if conf.Origin == nil {
 		return ErrMissingOrigin
 	}
-	for _, origin := range h.origins {
+	for _, origin := range origins {
 		if isSameOrigin(conf.Origin, origin) {
 			return nil
 		}
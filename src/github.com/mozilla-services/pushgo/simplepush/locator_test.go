@@ -178,7 +178,7 @@ func TestLocatorReadyNotify(t *testing.T) {
 			return
 		}
 		ok := false
-		expected := Update{chid, uint64(version), data}
+		expected := Update{ChannelID: chid, Version: uint64(version), Data: data}
 		for _, update := range flushReply.Updates {
 			if ok = update == expected; ok {
 				break
@@ -218,7 +218,7 @@ func TestLocatorReadyNotify(t *testing.T) {
 	// Initial routing attempt should fail; the WebSocket listener shouldn't
 	// accept client connections before the locator is ready.
 	delivered, err := sndApp.Router().Route(nil, uaid, chid, version, timeNow(),
-		"disconnected", data)
+		"disconnected", data, nil)
 	if err != nil {
 		t.Errorf("Error routing to disconnected client: %s", err)
 	} else if delivered {
@@ -233,7 +233,7 @@ func TestLocatorReadyNotify(t *testing.T) {
 	}
 	// Routing should succeed once the client is connected.
 	delivered, err = sndApp.Router().Route(nil, uaid, chid, version, timeNow(),
-		"connected", data)
+		"connected", data, nil)
 	if err != nil {
 		t.Errorf("Error routing to connected client: %s", err)
 	} else if !delivered {
@@ -18,6 +18,7 @@ import (
 	"time"
 
 	"github.com/mozilla-services/pushgo/id"
+	"github.com/mozilla-services/pushgo/retry"
 )
 
 // A LogLevel represents a message log level.
@@ -70,15 +71,101 @@ type SimpleLogger struct {
 	Logger
 }
 
+// A LogReopener is a Logger that writes to a file, which can be reopened
+// after it is moved by an external log rotation tool.
+type LogReopener interface {
+	Reopen() error
+}
+
+// Reopen reopens the log file, if the underlying logger writes to one.
+func (sl *SimpleLogger) Reopen() error {
+	if reopener, ok := sl.Logger.(LogReopener); ok {
+		return reopener.Reopen()
+	}
+	return nil
+}
+
+// DroppedMessages returns the number of messages dropped by the underlying
+// logger's queue.
+func (sl *SimpleLogger) DroppedMessages() int64 {
+	if counter, ok := sl.Logger.(LogDropCounter); ok {
+		return counter.DroppedMessages()
+	}
+	return 0
+}
+
+// TraceDevice logs all messages for uaid, regardless of the configured log
+// levels. Returns false if the underlying logger does not support tracing.
+func (sl *SimpleLogger) TraceDevice(uaid string) bool {
+	tracer, ok := sl.Logger.(LogTracer)
+	if !ok {
+		return false
+	}
+	tracer.TraceDevice(uaid)
+	return true
+}
+
+// UntraceDevice stops tracing uaid, returning false if uaid was not traced.
+func (sl *SimpleLogger) UntraceDevice(uaid string) bool {
+	if tracer, ok := sl.Logger.(LogTracer); ok {
+		return tracer.UntraceDevice(uaid)
+	}
+	return false
+}
+
+// TracedDevices returns the list of traced devices.
+func (sl *SimpleLogger) TracedDevices() []string {
+	if tracer, ok := sl.Logger.(LogTracer); ok {
+		return tracer.TracedDevices()
+	}
+	return nil
+}
+
 type LoggerConfig interface {
 	Open() (io.Writer, error)
 	GetName() string
 	GetEnvVersion() string
 }
 
+// openedLoggerConfig passes an open writer to a log emitter.
+type openedLoggerConfig struct {
+	LoggerConfig
+	writer io.Writer
+}
+
+func (conf openedLoggerConfig) Open() (io.Writer, error) {
+	return conf.writer, nil
+}
+
 var logEmitters = map[string]func(*Application, LoggerConfig) (
 	LogEmitter, error){
 
+	"fluentd": func(app *Application, conf LoggerConfig) (LogEmitter, error) {
+		if datagramLogger(conf) {
+			return nil, fmt.Errorf("Fluentd format requires a stream protocol")
+		}
+		w, err := conf.Open()
+		if err != nil {
+			return nil, err
+		}
+		hostname := app.Hostname()
+		loggerName := fmt.Sprintf("%s-%s", conf.GetName(), VERSION)
+		return NewFluentdEmitter(w, conf.GetName(), conf.GetEnvVersion(),
+			hostname, loggerName), nil
+	},
+	"gelf": func(app *Application, conf LoggerConfig) (LogEmitter, error) {
+		w, err := conf.Open()
+		if err != nil {
+			return nil, err
+		}
+		chunkSize := 0
+		if datagramLogger(conf) {
+			chunkSize = GELFChunkSize
+		}
+		hostname := app.Hostname()
+		loggerName := fmt.Sprintf("%s-%s", conf.GetName(), VERSION)
+		return NewGELFEmitter(w, hostname, loggerName, chunkSize), nil
+	},
 	"json": func(app *Application, conf LoggerConfig) (LogEmitter, error) {
 		w, err := conf.Open()
 		if err != nil {
@@ -173,25 +260,41 @@ type NetworkLoggerConfig struct {
 	EnvVersion string `toml:"env_version" env:"env_version"`
 	Name       string `toml:"name" env:"name"`
 	Filter     int32
+	Levels     string
+	Queue      LogQueueConfig
+
+	// Retry controls the backoff between attempts to reconnect to the remote
+	// host. Retry.Retries is ignored; reconnects are attempted indefinitely.
+	Retry retry.Config
 }
 
+// Open dials the remote host, returning a writer that reconnects with
+// backoff if the connection is lost.
 func (conf *NetworkLoggerConfig) Open() (io.Writer, error) {
 	if len(conf.Addr) == 0 {
 		return nil, fmt.Errorf("Missing remote host")
 	}
+	rh, err := conf.Retry.NewHelper()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid reconnect settings: %s", err)
+	}
+	dial := func() (net.Conn, error) {
+		return net.Dial(conf.Proto, conf.Addr)
+	}
 	if conf.UseTLS {
-		conn, err := tls.Dial(conf.Proto, conf.Addr, nil)
-		if err != nil {
-			return nil, fmt.Errorf("Error dialing TLS host %q: %s",
-				conf.Addr, err)
+		dial = func() (net.Conn, error) {
+			conn, err := tls.Dial(conf.Proto, conf.Addr, nil)
+			if err != nil {
+				return nil, err
+			}
+			return conn, nil
 		}
-		return conn, nil
 	}
-	conn, err := net.Dial(conf.Proto, conf.Addr)
+	w, err := newRedialWriter(dial, rh)
 	if err != nil {
 		return nil, fmt.Errorf("Error dialing host %q: %s", conf.Addr, err)
 	}
-	return conn, nil
+	return w, nil
 }
 
 func (conf *NetworkLoggerConfig) GetName() string { return conf.Name }
@@ -200,11 +303,11 @@ func (conf *NetworkLoggerConfig) GetEnvVersion() string {
 	return conf.EnvVersion
 }
 
-// A NetworkLogger sends log messages to a remote Heka instance over TCP,
-// UDP, or a Unix domain socket.
+// A NetworkLogger sends log messages to a remote Heka, Graylog, or Fluentd
+// instance over TCP, UDP, or a Unix domain socket.
 type NetworkLogger struct {
 	LogEmitter
-	filter LogLevel
+	logFilter
 }
 
 func (nl *NetworkLogger) ConfigStruct() interface{} {
@@ -214,7 +317,42 @@ func (nl *NetworkLogger) ConfigStruct() interface{} {
 		EnvVersion: "2",
 		Name:       "pushgo",
 		Filter:     0,
+		Queue: LogQueueConfig{
+			Size:   1024,
+			Policy: string(LogQueueDropOldest),
+		},
+		Retry: retry.Config{
+			Delay:     "100ms",
+			MaxDelay:  "30s",
+			MaxJitter: "100ms",
+		},
+	}
+}
+
+// CheckConfig validates the log format, remote host, queue, and reconnect
+// settings. Implements ConfigChecker.CheckConfig().
+func (nl *NetworkLogger) CheckConfig(config interface{}) error {
+	conf := config.(*NetworkLoggerConfig)
+	if _, err := ParseLogLevels(conf.Levels); err != nil {
+		return err
+	}
+	if _, ok := logEmitters[conf.Format]; !ok {
+		return fmt.Errorf("Unrecognized log format %q", conf.Format)
+	}
+	if conf.Format == "fluentd" && datagramLogger(conf) {
+		return fmt.Errorf("Fluentd format requires a stream protocol, got %q",
+			conf.Proto)
+	}
+	if len(conf.Addr) == 0 {
+		return fmt.Errorf("Missing remote host")
+	}
+	if err := conf.Queue.CheckConfig(); err != nil {
+		return err
 	}
+	if _, err := conf.Retry.NewHelper(); err != nil {
+		return fmt.Errorf("Invalid reconnect settings: %s", err)
+	}
+	return nil
 }
 
 func (nl *NetworkLogger) Init(app *Application, config interface{}) (err error) {
@@ -224,23 +362,33 @@ func (nl *NetworkLogger) Init(app *Application, config interface{}) (err error)
 		return fmt.Errorf("NetworkLogger: Unrecognized log format %q",
 			conf.Format)
 	}
-	if nl.LogEmitter, err = f(app, conf); err != nil {
+	emitter, err := f(app, conf)
+	if err != nil {
+		return fmt.Errorf("NetworkLogger: %s", err)
+	}
+	nl.LogEmitter = conf.Queue.Wrap(emitter)
+	if err = nl.setFilterConfig(conf.Filter, conf.Levels); err != nil {
 		return fmt.Errorf("NetworkLogger: %s", err)
 	}
-	nl.filter = LogLevel(conf.Filter)
 	return nil
 }
 
-func (nl *NetworkLogger) ShouldLog(level LogLevel) bool {
-	return level <= nl.filter
+// DroppedMessages implements LogDropCounter.DroppedMessages().
+func (nl *NetworkLogger) DroppedMessages() int64 {
+	return DroppedMessages(nl.LogEmitter)
 }
 
-func (nl *NetworkLogger) SetFilter(level LogLevel) {
-	nl.filter = level
+// Reload applies the log levels from a reloaded configuration. Implements
+// Reloader.Reload().
+func (nl *NetworkLogger) Reload(config interface{}, changed []string) (
+	rejected []string, err error) {
+
+	conf := config.(*NetworkLoggerConfig)
+	return nl.reloadFilter(changed, conf.Filter, conf.Levels)
 }
 
 func (nl *NetworkLogger) Log(level LogLevel, messageType, payload string, fields LogFields) (err error) {
-	if !nl.ShouldLog(level) {
+	if !nl.shouldEmit(level, messageType, fields) {
 		return
 	}
 	return nl.Emit(level, messageType, payload, fields)
@@ -252,19 +400,47 @@ type FileLoggerConfig struct {
 	EnvVersion string `toml:"env_version" env:"env_version"`
 	Name       string `toml:"name" env:"name"`
 	Filter     int32
+	Levels     string
+
+	// MaxSize is the size, in megabytes, at which the log file is rotated.
+	// Disabled if 0.
+	MaxSize int `toml:"max_size" env:"max_size"`
+
+	// MaxAge is the age at which the log file is rotated. Disabled if empty.
+	MaxAge string `toml:"max_age" env:"max_age"`
+
+	// MaxBackups is the number of rotated files to keep. Keeps all rotated
+	// files if 0.
+	MaxBackups int `toml:"max_backups" env:"max_backups"`
+
+	// Compress gzips rotated files.
+	Compress bool `toml:"compress" env:"compress"`
+
+	Queue LogQueueConfig
 }
 
-func (conf *FileLoggerConfig) Open() (io.Writer, error) {
+// OpenFile opens the log file, with the configured rotation options.
+func (conf *FileLoggerConfig) OpenFile() (*RotatingFile, error) {
 	if len(conf.Path) == 0 {
 		return nil, fmt.Errorf("Missing log file path")
 	}
-	logFile, err := os.OpenFile(conf.Path,
-		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
-	if err != nil {
-		return nil, fmt.Errorf("Error opening log file %q: %s",
-			conf.Path, err)
+	opts := RotateOptions{
+		MaxSize:    int64(conf.MaxSize) * 1024 * 1024,
+		MaxBackups: conf.MaxBackups,
+		Compress:   conf.Compress,
 	}
-	return logFile, nil
+	if len(conf.MaxAge) > 0 {
+		maxAge, err := time.ParseDuration(conf.MaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse 'max_age': %s", err)
+		}
+		opts.MaxAge = maxAge
+	}
+	return OpenRotatingFile(conf.Path, opts)
+}
+
+func (conf *FileLoggerConfig) Open() (io.Writer, error) {
+	return conf.OpenFile()
 }
 
 func (conf *FileLoggerConfig) GetName() string { return conf.Name }
@@ -276,7 +452,8 @@ func (conf *FileLoggerConfig) GetEnvVersion() string {
 // A FileLogger writes log messages to a file.
 type FileLogger struct {
 	LogEmitter
-	filter LogLevel
+	file *RotatingFile
+	logFilter
 }
 
 func (fl *FileLogger) ConfigStruct() interface{} {
@@ -285,7 +462,35 @@ func (fl *FileLogger) ConfigStruct() interface{} {
 		EnvVersion: "2",
 		Filter:     0,
 		Name:       "pushgo",
+		Queue:      LogQueueConfig{Policy: string(LogQueueBlock)},
+	}
+}
+
+// CheckConfig validates the log format, file path, and queue settings. Implements
+// ConfigChecker.CheckConfig().
+func (fl *FileLogger) CheckConfig(config interface{}) error {
+	conf := config.(*FileLoggerConfig)
+	if _, err := ParseLogLevels(conf.Levels); err != nil {
+		return err
 	}
+	if _, ok := logEmitters[conf.Format]; !ok {
+		return fmt.Errorf("Unrecognized log format %q", conf.Format)
+	}
+	if len(conf.Path) == 0 {
+		return fmt.Errorf("Missing log file path")
+	}
+	if conf.MaxSize < 0 {
+		return fmt.Errorf("Invalid 'max_size': %d", conf.MaxSize)
+	}
+	if conf.MaxBackups < 0 {
+		return fmt.Errorf("Invalid 'max_backups': %d", conf.MaxBackups)
+	}
+	if len(conf.MaxAge) > 0 {
+		if err := checkDuration("max_age", conf.MaxAge); err != nil {
+			return err
+		}
+	}
+	return conf.Queue.CheckConfig()
 }
 
 func (fl *FileLogger) Init(app *Application, config interface{}) (err error) {
@@ -295,23 +500,43 @@ func (fl *FileLogger) Init(app *Application, config interface{}) (err error) {
 		return fmt.Errorf("FileLogger: Unrecognized log format %q",
 			conf.Format)
 	}
-	if fl.LogEmitter, err = f(app, conf); err != nil {
+	if fl.file, err = conf.OpenFile(); err != nil {
+		return fmt.Errorf("FileLogger: %s", err)
+	}
+	emitter, err := f(app, openedLoggerConfig{conf, fl.file})
+	if err != nil {
+		fl.file.Close()
+		return fmt.Errorf("FileLogger: %s", err)
+	}
+	fl.LogEmitter = conf.Queue.Wrap(emitter)
+	if err = fl.setFilterConfig(conf.Filter, conf.Levels); err != nil {
 		return fmt.Errorf("FileLogger: %s", err)
 	}
-	fl.filter = LogLevel(conf.Filter)
 	return nil
 }
 
-func (fl *FileLogger) ShouldLog(level LogLevel) bool {
-	return level <= fl.filter
+// Reopen reopens the log file after it is moved by an external log rotation
+// tool. Implements LogReopener.Reopen().
+func (fl *FileLogger) Reopen() error {
+	return fl.file.Reopen()
 }
 
-func (fl *FileLogger) SetFilter(level LogLevel) {
-	fl.filter = level
+// DroppedMessages implements LogDropCounter.DroppedMessages().
+func (fl *FileLogger) DroppedMessages() int64 {
+	return DroppedMessages(fl.LogEmitter)
+}
+
+// Reload applies the log levels from a reloaded configuration. Implements
+// Reloader.Reload().
+func (fl *FileLogger) Reload(config interface{}, changed []string) (
+	rejected []string, err error) {
+
+	conf := config.(*FileLoggerConfig)
+	return fl.reloadFilter(changed, conf.Filter, conf.Levels)
 }
 
 func (fl *FileLogger) Log(level LogLevel, messageType, payload string, fields LogFields) (err error) {
-	if !fl.ShouldLog(level) {
+	if !fl.shouldEmit(level, messageType, fields) {
 		return
 	}
 	return fl.Emit(level, messageType, payload, fields)
@@ -321,7 +546,9 @@ type StdOutLoggerConfig struct {
 	Format     string
 	EnvVersion string `toml:"env_version" env:"env_version"`
 	Filter     int32
+	Levels     string
 	Name       string `toml:"name" env:"name"`
+	Queue      LogQueueConfig
 }
 
 func (*StdOutLoggerConfig) Open() (io.Writer, error) {
@@ -337,7 +564,7 @@ func (conf *StdOutLoggerConfig) GetEnvVersion() string {
 // StdOutLogger writes log messages to standard output.
 type StdOutLogger struct {
 	LogEmitter
-	filter LogLevel
+	logFilter
 }
 
 func (ml *StdOutLogger) ConfigStruct() interface{} {
@@ -346,9 +573,23 @@ func (ml *StdOutLogger) ConfigStruct() interface{} {
 		EnvVersion: "2",
 		Filter:     0,
 		Name:       "pushgo",
+		Queue:      LogQueueConfig{Policy: string(LogQueueBlock)},
 	}
 }
 
+// CheckConfig validates the log format and queue settings. Implements
+// ConfigChecker.CheckConfig().
+func (ml *StdOutLogger) CheckConfig(config interface{}) error {
+	conf := config.(*StdOutLoggerConfig)
+	if _, err := ParseLogLevels(conf.Levels); err != nil {
+		return err
+	}
+	if _, ok := logEmitters[conf.Format]; !ok {
+		return fmt.Errorf("Unrecognized log format %q", conf.Format)
+	}
+	return conf.Queue.CheckConfig()
+}
+
 func (ml *StdOutLogger) Init(app *Application, config interface{}) (err error) {
 	conf := config.(*StdOutLoggerConfig)
 	f, ok := logEmitters[conf.Format]
@@ -356,24 +597,34 @@ func (ml *StdOutLogger) Init(app *Application, config interface{}) (err error) {
 		return fmt.Errorf("StdOutLogger: Unrecognized log format %q",
 			conf.Format)
 	}
-	if ml.LogEmitter, err = f(app, conf); err != nil {
+	emitter, err := f(app, conf)
+	if err != nil {
+		return fmt.Errorf("StdOutLogger: %s", err)
+	}
+	ml.LogEmitter = conf.Queue.Wrap(emitter)
+	if err = ml.setFilterConfig(conf.Filter, conf.Levels); err != nil {
 		return fmt.Errorf("StdOutLogger: %s", err)
 	}
-	ml.filter = LogLevel(conf.Filter)
 	return nil
 }
 
-func (ml *StdOutLogger) ShouldLog(level LogLevel) bool {
-	return level <= ml.filter
+// DroppedMessages implements LogDropCounter.DroppedMessages().
+func (ml *StdOutLogger) DroppedMessages() int64 {
+	return DroppedMessages(ml.LogEmitter)
 }
 
-func (ml *StdOutLogger) SetFilter(level LogLevel) {
-	ml.filter = level
+// Reload applies the log levels from a reloaded configuration. Implements
+// Reloader.Reload().
+func (ml *StdOutLogger) Reload(config interface{}, changed []string) (
+	rejected []string, err error) {
+
+	conf := config.(*StdOutLoggerConfig)
+	return ml.reloadFilter(changed, conf.Filter, conf.Levels)
 }
 
 func (ml *StdOutLogger) Log(level LogLevel, messageType, payload string, fields LogFields) (err error) {
 	// Return ASAP if we shouldn't be logging
-	if !ml.ShouldLog(level) {
+	if !ml.shouldEmit(level, messageType, fields) {
 		return
 	}
 	if err = ml.Emit(level, messageType, payload, fields); err != nil {
@@ -577,5 +828,7 @@ func init() {
 	AvailableLoggers["stdout"] = func() HasConfigStruct { return new(StdOutLogger) }
 	AvailableLoggers["net"] = func() HasConfigStruct { return new(NetworkLogger) }
 	AvailableLoggers["file"] = func() HasConfigStruct { return new(FileLogger) }
+	AvailableLoggers["syslog"] = func() HasConfigStruct { return new(SyslogLogger) }
+	AvailableLoggers["journald"] = func() HasConfigStruct { return new(JournaldLogger) }
 	AvailableLoggers.SetDefault("stdout")
 }
@@ -0,0 +1,295 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mozilla-services/pushgo/retry"
+)
+
+var (
+	// ErrLogQueueClosed is returned when emitting a message after the log
+	// queue is closed.
+	ErrLogQueueClosed = errors.New("Log queue closed")
+
+	// ErrLogConnClosed is returned when writing to a closed log connection.
+	ErrLogConnClosed = errors.New("Log connection closed")
+
+	// ErrLogReconnecting is returned when writing to a disconnected log
+	// writer before its reconnect backoff expires.
+	ErrLogReconnecting = errors.New("Log connection down; waiting to reconnect")
+)
+
+// LogQueuePolicy specifies what happens to a message logged while the log
+// queue is full.
+type LogQueuePolicy string
+
+const (
+	// LogQueueBlock blocks the caller until the queue has room.
+	LogQueueBlock LogQueuePolicy = "block"
+
+	// LogQueueDropOldest discards the oldest queued message.
+	LogQueueDropOldest LogQueuePolicy = "drop-oldest"
+
+	// LogQueueDropNewest discards the new message.
+	LogQueueDropNewest LogQueuePolicy = "drop-newest"
+)
+
+type LogQueueConfig struct {
+	// Size is the maximum number of queued messages. If 0, messages are
+	// written synchronously by the logging goroutine.
+	Size int
+
+	// Policy is "block", "drop-oldest", or "drop-newest".
+	Policy string
+}
+
+// CheckConfig validates the queue size and policy.
+func (conf *LogQueueConfig) CheckConfig() error {
+	if conf.Size < 0 {
+		return fmt.Errorf("Invalid 'queue.size': %d", conf.Size)
+	}
+	switch LogQueuePolicy(conf.Policy) {
+	case LogQueueBlock, LogQueueDropOldest, LogQueueDropNewest:
+	default:
+		return fmt.Errorf("Unrecognized log queue policy %q", conf.Policy)
+	}
+	return nil
+}
+
+// Wrap returns an emitter that writes to emitter from a background
+// goroutine, or emitter itself if the queue is disabled.
+func (conf *LogQueueConfig) Wrap(emitter LogEmitter) LogEmitter {
+	if conf.Size <= 0 {
+		return emitter
+	}
+	return NewAsyncEmitter(emitter, conf.Size, LogQueuePolicy(conf.Policy))
+}
+
+// A LogDropCounter is a Logger that can drop messages instead of blocking
+// the caller.
+type LogDropCounter interface {
+	DroppedMessages() int64
+}
+
+// DroppedMessages returns the number of messages dropped by emitter, if it
+// is an AsyncEmitter.
+func DroppedMessages(emitter LogEmitter) int64 {
+	if ae, ok := emitter.(*AsyncEmitter); ok {
+		return ae.Dropped()
+	}
+	return 0
+}
+
+// asyncLogMessage is a log message waiting to be written.
+type asyncLogMessage struct {
+	level       LogLevel
+	messageType string
+	payload     string
+	fields      LogFields
+}
+
+// NewAsyncEmitter creates an emitter that queues up to size messages for
+// emitter, applying policy when the queue is full.
+func NewAsyncEmitter(emitter LogEmitter, size int,
+	policy LogQueuePolicy) *AsyncEmitter {
+
+	ae := &AsyncEmitter{
+		LogEmitter:  emitter,
+		policy:      policy,
+		queue:       make(chan asyncLogMessage, size),
+		closeSignal: make(chan bool),
+		done:        make(chan bool),
+	}
+	go ae.run()
+	return ae
+}
+
+// An AsyncEmitter writes log messages to another emitter from a background
+// goroutine, so that a slow destination does not block the logging
+// goroutine. Messages dropped because the queue is full, or because the
+// underlying emitter returned an error, are counted.
+type AsyncEmitter struct {
+	LogEmitter
+	policy      LogQueuePolicy
+	queue       chan asyncLogMessage
+	dropped     int64 // Accessed atomically.
+	lastErr     string
+	closeOnce   sync.Once
+	closeSignal chan bool
+	done        chan bool
+}
+
+// Emit queues a log message. Implements LogEmitter.Emit.
+func (ae *AsyncEmitter) Emit(level LogLevel, messageType, payload string,
+	fields LogFields) error {
+
+	msg := asyncLogMessage{level, messageType, payload, fields}
+	for {
+		select {
+		case <-ae.closeSignal:
+			return ErrLogQueueClosed
+		default:
+		}
+		switch ae.policy {
+		case LogQueueDropOldest:
+			select {
+			case ae.queue <- msg:
+				return nil
+			default:
+			}
+			// Make room by discarding the oldest message, then try again.
+			select {
+			case <-ae.queue:
+				atomic.AddInt64(&ae.dropped, 1)
+			default:
+			}
+
+		case LogQueueDropNewest:
+			select {
+			case ae.queue <- msg:
+			default:
+				atomic.AddInt64(&ae.dropped, 1)
+			}
+			return nil
+
+		default:
+			select {
+			case ae.queue <- msg:
+				return nil
+			case <-ae.closeSignal:
+				return ErrLogQueueClosed
+			}
+		}
+	}
+}
+
+// Dropped returns the number of dropped messages.
+func (ae *AsyncEmitter) Dropped() int64 {
+	return atomic.LoadInt64(&ae.dropped)
+}
+
+// run writes queued messages until the emitter is closed, then writes the
+// remaining messages.
+func (ae *AsyncEmitter) run() {
+	defer close(ae.done)
+	for {
+		select {
+		case msg := <-ae.queue:
+			ae.write(msg)
+		case <-ae.closeSignal:
+			for {
+				select {
+				case msg := <-ae.queue:
+					ae.write(msg)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (ae *AsyncEmitter) write(msg asyncLogMessage) {
+	err := ae.LogEmitter.Emit(msg.level, msg.messageType, msg.payload,
+		msg.fields)
+	if err == nil {
+		ae.lastErr = ""
+		return
+	}
+	atomic.AddInt64(&ae.dropped, 1)
+	// Report each new error once, so that a down log destination doesn't
+	// flood standard error.
+	if errStr := err.Error(); errStr != ae.lastErr {
+		ae.lastErr = errStr
+		log.Printf("Error writing queued log message: %s", err)
+	}
+}
+
+// Close writes the queued messages, then closes the underlying emitter.
+// Implements LogEmitter.Close.
+func (ae *AsyncEmitter) Close() error {
+	ae.closeOnce.Do(func() { close(ae.closeSignal) })
+	<-ae.done
+	return ae.LogEmitter.Close()
+}
+
+// maxRedialAttempts caps the backoff exponent used by a redialWriter.
+const maxRedialAttempts = 16
+
+// newRedialWriter dials a connection, returning a writer that redials with
+// exponential backoff if a write fails.
+func newRedialWriter(dial func() (net.Conn, error),
+	rh *retry.Helper) (*redialWriter, error) {
+
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	return &redialWriter{dial: dial, rh: rh, conn: conn}, nil
+}
+
+// A redialWriter writes to a network connection. If a write fails, the
+// connection is closed and redialed on the next write. If redialing fails,
+// writes return ErrLogReconnecting without blocking until the backoff
+// expires. Each write is sent to exactly one connection, so framed messages
+// are never split across connections.
+type redialWriter struct {
+	dial     func() (net.Conn, error)
+	rh       *retry.Helper
+	lock     sync.Mutex // Protects the following fields.
+	conn     net.Conn
+	attempts int
+	nextDial time.Time
+	closed   bool
+}
+
+func (w *redialWriter) Write(p []byte) (n int, err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return 0, ErrLogConnClosed
+	}
+	if w.conn == nil {
+		if timeNow().Before(w.nextDial) {
+			return 0, ErrLogReconnecting
+		}
+		conn, err := w.dial()
+		if err != nil {
+			if w.attempts < maxRedialAttempts {
+				w.attempts++
+			}
+			w.nextDial = timeNow().Add(w.rh.RetryDelay(w.attempts))
+			return 0, fmt.Errorf("Error redialing log host: %s", err)
+		}
+		w.conn, w.attempts = conn, 0
+	}
+	if n, err = w.conn.Write(p); err != nil {
+		w.conn.Close()
+		w.conn = nil
+	}
+	return n, err
+}
+
+func (w *redialWriter) Close() (err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if w.conn != nil {
+		err = w.conn.Close()
+		w.conn = nil
+	}
+	return err
+}
@@ -0,0 +1,231 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/pushgo/retry"
+)
+
+// blockingEmitter records emitted payloads, blocking each Emit call until
+// the emitter is released.
+type blockingEmitter struct {
+	sync.Mutex
+	release  chan bool
+	started  chan bool
+	payloads []string
+	closed   bool
+}
+
+func newBlockingEmitter() *blockingEmitter {
+	return &blockingEmitter{
+		release: make(chan bool),
+		started: make(chan bool, 100),
+	}
+}
+
+func (be *blockingEmitter) Emit(level LogLevel, messageType, payload string,
+	fields LogFields) error {
+
+	be.started <- true
+	<-be.release
+	be.Lock()
+	be.payloads = append(be.payloads, payload)
+	be.Unlock()
+	return nil
+}
+
+func (be *blockingEmitter) Close() error {
+	be.Lock()
+	be.closed = true
+	be.Unlock()
+	return nil
+}
+
+// fillAsyncEmitter emits "busy", waits for the background writer to block
+// on it, then emits the remaining payloads.
+func fillAsyncEmitter(t *testing.T, ae *AsyncEmitter, be *blockingEmitter,
+	payloads ...string) {
+
+	if err := ae.Emit(INFO, "test", "busy", nil); err != nil {
+		t.Fatalf("Error emitting message: %s", err)
+	}
+	select {
+	case <-be.started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for background writer")
+	}
+	for _, payload := range payloads {
+		if err := ae.Emit(INFO, "test", payload, nil); err != nil {
+			t.Fatalf("Error emitting %q: %s", payload, err)
+		}
+	}
+}
+
+func TestAsyncEmitterDropPolicies(t *testing.T) {
+	tests := []struct {
+		policy   LogQueuePolicy
+		expected []string
+	}{
+		{LogQueueDropOldest, []string{"busy", "c", "d"}},
+		{LogQueueDropNewest, []string{"busy", "a", "b"}},
+	}
+	for _, test := range tests {
+		be := newBlockingEmitter()
+		ae := NewAsyncEmitter(be, 2, test.policy)
+		fillAsyncEmitter(t, ae, be, "a", "b", "c", "d")
+		if dropped := ae.Dropped(); dropped != 2 {
+			t.Errorf("On test %s, got %d dropped messages; want 2",
+				test.policy, dropped)
+		}
+		close(be.release)
+		if err := ae.Close(); err != nil {
+			t.Errorf("On test %s, error closing emitter: %s", test.policy, err)
+		}
+		if !reflect.DeepEqual(be.payloads, test.expected) {
+			t.Errorf("On test %s, wrong payloads: got %#v; want %#v",
+				test.policy, be.payloads, test.expected)
+		}
+		if !be.closed {
+			t.Errorf("On test %s, underlying emitter not closed", test.policy)
+		}
+	}
+}
+
+func TestAsyncEmitterBlock(t *testing.T) {
+	be := newBlockingEmitter()
+	ae := NewAsyncEmitter(be, 1, LogQueueBlock)
+	fillAsyncEmitter(t, ae, be, "a")
+
+	emitted := make(chan error, 1)
+	go func() { emitted <- ae.Emit(INFO, "test", "b", nil) }()
+	select {
+	case err := <-emitted:
+		t.Fatalf("Emit returned before the queue had room: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	be.release <- true
+	select {
+	case err := <-emitted:
+		if err != nil {
+			t.Errorf("Error emitting blocked message: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for blocked Emit")
+	}
+	close(be.release)
+	ae.Close()
+	if dropped := ae.Dropped(); dropped != 0 {
+		t.Errorf("Got %d dropped messages; want 0", dropped)
+	}
+	if expected := []string{"busy", "a", "b"}; !reflect.DeepEqual(be.payloads, expected) {
+		t.Errorf("Wrong payloads: got %#v; want %#v", be.payloads, expected)
+	}
+	if err := ae.Emit(INFO, "test", "c", nil); err != ErrLogQueueClosed {
+		t.Errorf("Wrong error emitting after close: got %#v; want %#v",
+			err, ErrLogQueueClosed)
+	}
+}
+
+func TestLogQueueConfig(t *testing.T) {
+	be := newBlockingEmitter()
+	conf := &LogQueueConfig{Policy: "block"}
+	if err := conf.CheckConfig(); err != nil {
+		t.Errorf("Error checking default queue config: %s", err)
+	}
+	if emitter := conf.Wrap(be); emitter != LogEmitter(be) {
+		t.Errorf("Disabled queue should not wrap emitter; got %#v", emitter)
+	}
+	conf.Policy = "drop-everything"
+	if err := conf.CheckConfig(); err == nil {
+		t.Errorf("Expected error for unrecognized queue policy")
+	}
+}
+
+func TestRedialWriter(t *testing.T) {
+	useStdFuncs()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	addr := l.Addr().String()
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	acceptConn := func() net.Conn {
+		select {
+		case conn := <-accepted:
+			return conn
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for connection")
+		}
+		return nil
+	}
+
+	dials := 0
+	dial := func() (net.Conn, error) {
+		dials++
+		return net.Dial("tcp", addr)
+	}
+	rh := &retry.Helper{Backoff: 2, Delay: 1 * time.Hour, MaxDelay: 1 * time.Hour}
+	w, err := newRedialWriter(dial, rh)
+	if err != nil {
+		t.Fatalf("Error dialing: %s", err)
+	}
+	defer w.Close()
+
+	conn := acceptConn()
+	if _, err = w.Write([]byte("one\n")); err != nil {
+		t.Fatalf("Error writing first message: %s", err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "one\n" {
+		t.Fatalf("Wrong first message: got %q, %v", line, err)
+	}
+
+	// Break the connection; the writer should redial after a failed write.
+	w.conn.Close()
+	if _, err = w.Write([]byte("lost\n")); err == nil {
+		t.Fatalf("Expected error writing to closed connection")
+	}
+	if _, err = w.Write([]byte("two\n")); err != nil {
+		t.Fatalf("Error writing after redial: %s", err)
+	}
+	line, err = bufio.NewReader(acceptConn()).ReadString('\n')
+	if err != nil || line != "two\n" {
+		t.Fatalf("Wrong message after redial: got %q, %v", line, err)
+	}
+
+	// Once redialing fails, writes fail fast until the backoff expires.
+	l.Close()
+	w.conn.Close()
+	w.Write([]byte("lost\n"))
+	if _, err = w.Write([]byte("lost\n")); err == nil {
+		t.Fatalf("Expected error redialing closed listener")
+	}
+	failedDials := dials
+	if _, err = w.Write([]byte("lost\n")); err != ErrLogReconnecting {
+		t.Errorf("Wrong error during backoff: got %#v; want %#v",
+			err, ErrLogReconnecting)
+	}
+	if dials != failedDials {
+		t.Errorf("Redialed during backoff: got %d dials; want %d",
+			dials, failedDials)
+	}
+}
@@ -0,0 +1,219 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// levelsByName maps lower-case level names and common aliases to levels.
+var levelsByName = map[string]LogLevel{
+	"emergency": EMERGENCY,
+	"panic":     EMERGENCY,
+	"alert":     ALERT,
+	"critical":  CRITICAL,
+	"crit":      CRITICAL,
+	"error":     ERROR,
+	"err":       ERROR,
+	"warning":   WARNING,
+	"warn":      WARNING,
+	"notice":    NOTICE,
+	"info":      INFO,
+	"debug":     DEBUG,
+}
+
+// ParseLogLevel parses a level name, like "debug" or "warn", or a syslog
+// severity number.
+func ParseLogLevel(s string) (LogLevel, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if level, ok := levelsByName[s]; ok {
+		return level, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < int(EMERGENCY) || n > int(DEBUG) {
+		return 0, fmt.Errorf("Unrecognized log level %q", s)
+	}
+	return LogLevel(n), nil
+}
+
+// ParseLogLevels parses a comma-separated list of per-component log level
+// overrides, like "router=debug, worker=warn". Components are matched
+// against log message types.
+func ParseLogLevels(s string) (levels map[string]LogLevel, err error) {
+	levels = make(map[string]LogLevel)
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); len(pair) == 0 {
+			continue
+		}
+		i := strings.IndexByte(pair, '=')
+		if i < 1 {
+			return nil, fmt.Errorf("Invalid log level override %q", pair)
+		}
+		component := strings.TrimSpace(pair[:i])
+		if levels[component], err = ParseLogLevel(pair[i+1:]); err != nil {
+			return nil, fmt.Errorf("Invalid log level for %q: %s", component, err)
+		}
+	}
+	return levels, nil
+}
+
+// A LogTracer is a Logger that logs every message for a set of traced
+// devices, regardless of its log levels.
+type LogTracer interface {
+	TraceDevice(uaid string)
+	UntraceDevice(uaid string) bool
+	TracedDevices() []string
+}
+
+// logFilter filters messages by level, with per-component level overrides
+// and a set of traced devices. It is embedded by the logger plugins, which
+// call shouldEmit before emitting a message.
+type logFilter struct {
+	filter    LogLevel     // The default level. Accessed atomically.
+	verbose   LogLevel     // The most verbose level. Accessed atomically.
+	levels    atomic.Value // Per-component overrides; map[string]LogLevel.
+	setLock   sync.Mutex   // Serializes level changes.
+	traceLock sync.RWMutex // Protects traced.
+	traced    map[string]bool
+	tracing   int32 // The number of traced devices. Accessed atomically.
+}
+
+// ShouldLog indicates whether a message at the given level may be logged
+// for any component or device. Callers use ShouldLog to skip building log
+// fields; shouldEmit makes the final decision.
+func (f *logFilter) ShouldLog(level LogLevel) bool {
+	if level <= LogLevel(atomic.LoadInt32((*int32)(&f.verbose))) {
+		return true
+	}
+	return atomic.LoadInt32(&f.tracing) > 0
+}
+
+// SetFilter sets the default level for components without an override.
+func (f *logFilter) SetFilter(level LogLevel) {
+	f.setLock.Lock()
+	defer f.setLock.Unlock()
+	atomic.StoreInt32((*int32)(&f.filter), int32(level))
+	f.updateVerbose()
+}
+
+// SetLevels replaces the per-component level overrides.
+func (f *logFilter) SetLevels(levels map[string]LogLevel) {
+	f.setLock.Lock()
+	defer f.setLock.Unlock()
+	f.levels.Store(levels)
+	f.updateVerbose()
+}
+
+// updateVerbose recomputes the most verbose level. The caller must hold
+// setLock.
+func (f *logFilter) updateVerbose() {
+	verbose := LogLevel(atomic.LoadInt32((*int32)(&f.filter)))
+	levels, _ := f.levels.Load().(map[string]LogLevel)
+	for _, level := range levels {
+		if level > verbose {
+			verbose = level
+		}
+	}
+	atomic.StoreInt32((*int32)(&f.verbose), int32(verbose))
+}
+
+// setFilterConfig applies the level settings from a logger configuration.
+func (f *logFilter) setFilterConfig(filter int32, levels string) error {
+	overrides, err := ParseLogLevels(levels)
+	if err != nil {
+		return err
+	}
+	f.SetFilter(LogLevel(filter))
+	f.SetLevels(overrides)
+	return nil
+}
+
+// reloadFilter applies the level settings from a reloaded configuration.
+func (f *logFilter) reloadFilter(changed []string, filter int32,
+	levels string) (rejected []string, err error) {
+
+	apply, rejected := liveSettings(changed, "filter", "levels")
+	if apply["levels"] {
+		overrides, err := ParseLogLevels(levels)
+		if err != nil {
+			return nil, err
+		}
+		f.SetLevels(overrides)
+	}
+	if apply["filter"] {
+		f.SetFilter(LogLevel(filter))
+	}
+	return rejected, nil
+}
+
+// shouldEmit indicates whether a message should be emitted: either the
+// level is enabled for the message type, or the message concerns a traced
+// device.
+func (f *logFilter) shouldEmit(level LogLevel, messageType string,
+	fields LogFields) bool {
+
+	levels, _ := f.levels.Load().(map[string]LogLevel)
+	componentLevel, ok := levels[messageType]
+	if !ok {
+		componentLevel = LogLevel(atomic.LoadInt32((*int32)(&f.filter)))
+	}
+	if level <= componentLevel {
+		return true
+	}
+	if atomic.LoadInt32(&f.tracing) == 0 {
+		return false
+	}
+	uaid := fields["uaid"]
+	if len(uaid) == 0 {
+		return false
+	}
+	f.traceLock.RLock()
+	traced := f.traced[uaid]
+	f.traceLock.RUnlock()
+	return traced
+}
+
+// TraceDevice logs all messages for the given device at any level.
+// Implements LogTracer.TraceDevice().
+func (f *logFilter) TraceDevice(uaid string) {
+	f.traceLock.Lock()
+	defer f.traceLock.Unlock()
+	if f.traced == nil {
+		f.traced = make(map[string]bool)
+	}
+	f.traced[uaid] = true
+	atomic.StoreInt32(&f.tracing, int32(len(f.traced)))
+}
+
+// UntraceDevice stops tracing the given device, returning false if the device
+// was not traced. Implements LogTracer.UntraceDevice().
+func (f *logFilter) UntraceDevice(uaid string) bool {
+	f.traceLock.Lock()
+	defer f.traceLock.Unlock()
+	if !f.traced[uaid] {
+		return false
+	}
+	delete(f.traced, uaid)
+	atomic.StoreInt32(&f.tracing, int32(len(f.traced)))
+	return true
+}
+
+// TracedDevices returns the sorted list of traced devices. Implements
+// LogTracer.TracedDevices().
+func (f *logFilter) TracedDevices() []string {
+	f.traceLock.RLock()
+	defer f.traceLock.RUnlock()
+	uaids := make([]string, 0, len(f.traced))
+	for uaid := range f.traced {
+		uaids = append(uaids, uaid)
+	}
+	sort.Strings(uaids)
+	return uaids
+}
@@ -0,0 +1,117 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLogLevels(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected map[string]LogLevel
+		ok       bool
+	}{
+		{"", map[string]LogLevel{}, true},
+		{"router=debug, worker=warn", map[string]LogLevel{
+			"router": DEBUG, "worker": WARNING}, true},
+		{" handlers_endpoint = 6 ,", map[string]LogLevel{
+			"handlers_endpoint": INFO}, true},
+		{"router=loud", nil, false},
+		{"router=8", nil, false},
+		{"=debug", nil, false},
+		{"router", nil, false},
+	}
+	for _, test := range tests {
+		levels, err := ParseLogLevels(test.input)
+		if (err == nil) != test.ok {
+			t.Errorf("On test %q, got error %v; want ok %v", test.input, err, test.ok)
+			continue
+		}
+		if test.ok && !reflect.DeepEqual(levels, test.expected) {
+			t.Errorf("On test %q, got levels %#v; want %#v",
+				test.input, levels, test.expected)
+		}
+	}
+}
+
+func TestLogFilterLevels(t *testing.T) {
+	f := new(logFilter)
+	if err := f.setFilterConfig(int32(WARNING), "router=debug, worker=error"); err != nil {
+		t.Fatalf("Error setting log levels: %s", err)
+	}
+	if !f.ShouldLog(DEBUG) {
+		t.Errorf("Should log DEBUG messages with a DEBUG override")
+	}
+	tests := []struct {
+		level       LogLevel
+		messageType string
+		expected    bool
+	}{
+		{DEBUG, "router", true},
+		{DEBUG, "worker", false},
+		{WARNING, "worker", false},
+		{ERROR, "worker", true},
+		{WARNING, "handlers_endpoint", true},
+		{INFO, "handlers_endpoint", false},
+	}
+	for _, test := range tests {
+		if actual := f.shouldEmit(test.level, test.messageType, nil); actual != test.expected {
+			t.Errorf("On test %s/%s, got %v; want %v", test.messageType,
+				test.level, actual, test.expected)
+		}
+	}
+
+	// Reloading the overrides should recompute the most verbose level.
+	rejected, err := f.reloadFilter([]string{"levels", "name"}, int32(WARNING), "")
+	if err != nil {
+		t.Fatalf("Error reloading log levels: %s", err)
+	}
+	if !reflect.DeepEqual(rejected, []string{"name"}) {
+		t.Errorf("Wrong rejected settings: got %#v", rejected)
+	}
+	if f.ShouldLog(DEBUG) {
+		t.Errorf("Should not log DEBUG messages after removing overrides")
+	}
+	if f.shouldEmit(DEBUG, "router", nil) {
+		t.Errorf("Should not emit DEBUG router messages after removing overrides")
+	}
+}
+
+func TestLogFilterTrace(t *testing.T) {
+	f := new(logFilter)
+	f.SetFilter(ERROR)
+	uaid := "f7e9fc483f7344c398701b6fa0e85e4f"
+
+	if f.ShouldLog(DEBUG) {
+		t.Errorf("Should not log DEBUG messages without traced devices")
+	}
+	f.TraceDevice(uaid)
+	if !f.ShouldLog(DEBUG) {
+		t.Errorf("Should log DEBUG messages while tracing devices")
+	}
+	if !f.shouldEmit(DEBUG, "worker", LogFields{"uaid": uaid}) {
+		t.Errorf("Should emit DEBUG messages for traced device")
+	}
+	if f.shouldEmit(DEBUG, "worker", LogFields{"uaid": "other"}) {
+		t.Errorf("Should not emit DEBUG messages for untraced device")
+	}
+	if f.shouldEmit(DEBUG, "worker", nil) {
+		t.Errorf("Should not emit DEBUG messages without a device ID")
+	}
+	if traced := f.TracedDevices(); !reflect.DeepEqual(traced, []string{uaid}) {
+		t.Errorf("Wrong traced devices: got %#v", traced)
+	}
+	if !f.UntraceDevice(uaid) {
+		t.Errorf("UntraceDevice should return true for traced device")
+	}
+	if f.UntraceDevice(uaid) {
+		t.Errorf("UntraceDevice should return false for untraced device")
+	}
+	if f.ShouldLog(DEBUG) {
+		t.Errorf("Should not log DEBUG messages after untracing devices")
+	}
+}
@@ -0,0 +1,173 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// fluentdEventTime is the MessagePack extension type used for Fluentd
+// EventTime values, which carry nanosecond precision timestamps.
+const fluentdEventTime = 0x00
+
+// msgpackWriter appends MessagePack-encoded values to a buffer. Only the
+// types used by the Fluentd forward protocol are supported.
+type msgpackWriter struct {
+	bytes.Buffer
+}
+
+func (mw *msgpackWriter) writeUint(n uint64) {
+	var b [9]byte
+	switch {
+	case n < 1<<7:
+		mw.WriteByte(byte(n))
+		return
+	case n < 1<<8:
+		b[0], b[1] = 0xcc, byte(n)
+		mw.Write(b[:2])
+	case n < 1<<16:
+		b[0] = 0xcd
+		binary.BigEndian.PutUint16(b[1:], uint16(n))
+		mw.Write(b[:3])
+	case n < 1<<32:
+		b[0] = 0xce
+		binary.BigEndian.PutUint32(b[1:], uint32(n))
+		mw.Write(b[:5])
+	default:
+		b[0] = 0xcf
+		binary.BigEndian.PutUint64(b[1:], n)
+		mw.Write(b[:9])
+	}
+}
+
+// writeHeader writes a length-prefixed type header. fix is the tag for the
+// "fix" variant of the type, which stores lengths up to fixMax in the tag
+// itself; tag16 and tag32 are followed by 2- and 4-byte lengths.
+func (mw *msgpackWriter) writeHeader(n int, fix byte, fixMax int,
+	tag16, tag32 byte) {
+
+	var b [5]byte
+	switch {
+	case n <= fixMax:
+		mw.WriteByte(fix | byte(n))
+	case n < 1<<16:
+		b[0] = tag16
+		binary.BigEndian.PutUint16(b[1:], uint16(n))
+		mw.Write(b[:3])
+	default:
+		b[0] = tag32
+		binary.BigEndian.PutUint32(b[1:], uint32(n))
+		mw.Write(b[:5])
+	}
+}
+
+func (mw *msgpackWriter) writeArrayHeader(n int) {
+	mw.writeHeader(n, 0x90, 15, 0xdc, 0xdd)
+}
+
+func (mw *msgpackWriter) writeMapHeader(n int) {
+	mw.writeHeader(n, 0x80, 15, 0xde, 0xdf)
+}
+
+func (mw *msgpackWriter) writeString(s string) {
+	if n := len(s); n > 31 && n < 1<<8 {
+		mw.WriteByte(0xd9)
+		mw.WriteByte(byte(n))
+	} else {
+		mw.writeHeader(n, 0xa0, 31, 0xda, 0xdb)
+	}
+	mw.WriteString(s)
+}
+
+// writeEventTime writes a Fluentd EventTime: a fixext 8 value containing the
+// seconds and nanoseconds since the epoch as big-endian 32-bit integers.
+func (mw *msgpackWriter) writeEventTime(sec, nsec int64) {
+	var b [10]byte
+	b[0], b[1] = 0xd7, fluentdEventTime
+	binary.BigEndian.PutUint32(b[2:], uint32(sec))
+	binary.BigEndian.PutUint32(b[6:], uint32(nsec))
+	mw.Write(b[:])
+}
+
+// NewFluentdEmitter creates a Fluentd forward protocol message emitter.
+// Messages are tagged with tagPrefix and the message type; for example,
+// "pushgo.worker".
+func NewFluentdEmitter(writer io.Writer, tagPrefix, envVersion,
+	hostname, loggerName string) *FluentdEmitter {
+
+	return &FluentdEmitter{
+		Writer:     writer,
+		TagPrefix:  tagPrefix,
+		LogName:    loggerName,
+		Pid:        int32(osGetPid()),
+		EnvVersion: envVersion,
+		Hostname:   hostname,
+	}
+}
+
+// A FluentdEmitter emits MessagePack-encoded events in the Fluentd forward
+// protocol "Message" mode. Each record contains the same message attributes
+// as a Heka message; log fields are nested under "fields".
+type FluentdEmitter struct {
+	io.Writer
+	TagPrefix  string
+	LogName    string
+	Pid        int32
+	EnvVersion string
+	Hostname   string
+}
+
+// Emit encodes and sends a Fluentd event. Implements LogEmitter.Emit.
+func (fe *FluentdEmitter) Emit(level LogLevel, messageType, payload string,
+	fields LogFields) (err error) {
+
+	now := timeNow()
+	mw := new(msgpackWriter)
+	mw.writeArrayHeader(3)
+	mw.writeString(fe.TagPrefix + "." + messageType)
+	mw.writeEventTime(now.Unix(), int64(now.Nanosecond()))
+
+	// Record keys are written in sorted order.
+	mw.writeMapHeader(8)
+	mw.writeString("env_version")
+	mw.writeString(fe.EnvVersion)
+	mw.writeString("fields")
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	mw.writeMapHeader(len(names))
+	for _, name := range names {
+		mw.writeString(name)
+		mw.writeString(fields[name])
+	}
+	mw.writeString("hostname")
+	mw.writeString(fe.Hostname)
+	mw.writeString("logger")
+	mw.writeString(fe.LogName)
+	mw.writeString("payload")
+	mw.writeString(payload)
+	mw.writeString("pid")
+	mw.writeUint(uint64(fe.Pid))
+	mw.writeString("severity")
+	mw.writeUint(uint64(level))
+	mw.writeString("type")
+	mw.writeString(messageType)
+
+	if _, err = mw.WriteTo(fe.Writer); err != nil {
+		return fmt.Errorf("Error sending Fluentd log message: %s", err)
+	}
+	return nil
+}
+
+// Close closes the underlying write stream. Implements LogEmitter.Close.
+func (fe *FluentdEmitter) Close() error {
+	return TryClose(fe.Writer)
+}
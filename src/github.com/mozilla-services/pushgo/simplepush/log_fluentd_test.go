@@ -0,0 +1,74 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestFluentdEmitter(t *testing.T) {
+	useMockFuncs()
+	defer useStdFuncs()
+
+	tests := []struct {
+		name    string
+		payload string
+		fields  LogFields
+	}{
+		{"fluentd", "Howdy", LogFields{"c": "d", "a": "b", "e": "f"}},
+		{"fluentd_long", strings.Repeat("Howdy ", 50), nil},
+	}
+	for _, test := range tests {
+		fr := new(frameRecorder)
+		fe := NewFluentdEmitter(fr, "pushgo", "2", "example.com",
+			"test-fluentd-emitter")
+		if err := fe.Emit(INFO, "test", test.payload, test.fields); err != nil {
+			t.Errorf("On test %s, error emitting Fluentd message: %s",
+				test.name, err)
+			continue
+		}
+		if len(fr.frames) != 1 {
+			t.Errorf("On test %s, got %d frames; want 1", test.name, len(fr.frames))
+		}
+		checkGolden(t, test.name, fr.frames)
+	}
+}
+
+func TestMsgpackWriter(t *testing.T) {
+	tests := []struct {
+		name     string
+		write    func(*msgpackWriter)
+		expected []byte
+	}{
+		{"fixint", func(mw *msgpackWriter) { mw.writeUint(6) }, []byte{0x06}},
+		{"uint8", func(mw *msgpackWriter) { mw.writeUint(200) }, []byte{0xcc, 0xc8}},
+		{"uint16", func(mw *msgpackWriter) { mw.writeUint(1234) },
+			[]byte{0xcd, 0x04, 0xd2}},
+		{"uint32", func(mw *msgpackWriter) { mw.writeUint(1 << 16) },
+			[]byte{0xce, 0x00, 0x01, 0x00, 0x00}},
+		{"fixstr", func(mw *msgpackWriter) { mw.writeString("ab") },
+			[]byte{0xa2, 'a', 'b'}},
+		{"str8", func(mw *msgpackWriter) { mw.writeString(strings.Repeat("a", 32)) },
+			append([]byte{0xd9, 0x20}, bytes.Repeat([]byte{'a'}, 32)...)},
+		{"str16", func(mw *msgpackWriter) { mw.writeString(strings.Repeat("a", 256)) },
+			append([]byte{0xda, 0x01, 0x00}, bytes.Repeat([]byte{'a'}, 256)...)},
+		{"fixmap", func(mw *msgpackWriter) { mw.writeMapHeader(2) }, []byte{0x82}},
+		{"map16", func(mw *msgpackWriter) { mw.writeMapHeader(16) },
+			[]byte{0xde, 0x00, 0x10}},
+		{"fixarray", func(mw *msgpackWriter) { mw.writeArrayHeader(3) }, []byte{0x93}},
+		{"eventtime", func(mw *msgpackWriter) { mw.writeEventTime(1257894000, 5) },
+			[]byte{0xd7, 0x00, 0x4a, 0xf9, 0xf0, 0x70, 0x00, 0x00, 0x00, 0x05}},
+	}
+	for _, test := range tests {
+		mw := new(msgpackWriter)
+		test.write(mw)
+		if !bytes.Equal(mw.Bytes(), test.expected) {
+			t.Errorf("On test %s, got %#v; want %#v", test.name, mw.Bytes(),
+				test.expected)
+		}
+	}
+}
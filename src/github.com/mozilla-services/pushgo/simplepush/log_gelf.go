@@ -0,0 +1,157 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+const (
+	// GELFChunkSize is the default maximum size of a GELF datagram. Graylog
+	// recommends 1420 bytes for messages sent over the Internet.
+	GELFChunkSize = 1420
+
+	// GELFMaxChunks is the maximum number of chunks in a GELF message.
+	GELFMaxChunks = 128
+
+	gelfChunkHeaderSize = 12
+	gelfVersion         = "1.1"
+)
+
+// gelfChunkMagic prefixes each chunk of a chunked GELF message.
+var gelfChunkMagic = []byte{0x1e, 0x0f}
+
+// datagramLogger indicates whether each write to the logger's destination is
+// sent as a separate datagram.
+func datagramLogger(conf LoggerConfig) bool {
+	nc, ok := conf.(*NetworkLoggerConfig)
+	return ok && !syslogStreamProto(nc.Proto)
+}
+
+// gelfFieldName converts a log field name to a GELF additional field name.
+// Additional field names are prefixed with an underscore, and may only
+// contain letters, numbers, underscores, dashes, and dots. "_id" is
+// reserved.
+func gelfFieldName(name string) string {
+	b := make([]byte, 1, len(name)+1)
+	b[0] = '_'
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+			c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.' {
+			b = append(b, c)
+			continue
+		}
+		b = append(b, '_')
+	}
+	if string(b) == "_id" {
+		return "_f_id"
+	}
+	return string(b)
+}
+
+// NewGELFEmitter creates a Graylog Extended Log Format message emitter. If
+// chunkSize > 0, each message is written as one or more datagrams of at most
+// chunkSize bytes; otherwise, messages are delimited by null bytes, as
+// expected by Graylog's TCP input.
+func NewGELFEmitter(writer io.Writer, hostname, loggerName string,
+	chunkSize int) *GELFEmitter {
+
+	return &GELFEmitter{
+		Writer:    writer,
+		LogName:   loggerName,
+		Pid:       int32(osGetPid()),
+		Hostname:  hostname,
+		ChunkSize: chunkSize,
+	}
+}
+
+// A GELFEmitter emits GELF 1.1 messages. Log levels map directly to GELF
+// levels; the logger name, message type, pid, and log fields are sent as
+// additional fields.
+type GELFEmitter struct {
+	io.Writer
+	LogName   string
+	Pid       int32
+	Hostname  string
+	ChunkSize int
+}
+
+// Emit encodes and sends a GELF message. Implements LogEmitter.Emit.
+func (ge *GELFEmitter) Emit(level LogLevel, messageType, payload string,
+	fields LogFields) (err error) {
+
+	now := timeNow()
+	msg := make(map[string]interface{}, len(fields)+8)
+	for name, val := range fields {
+		msg[gelfFieldName(name)] = val
+	}
+	msg["version"] = gelfVersion
+	msg["host"] = ge.Hostname
+	msg["short_message"] = payload
+	msg["timestamp"] = float64(now.Unix()) + float64(now.Nanosecond()/1e3)/1e6
+	msg["level"] = int32(level)
+	msg["_logger"] = ge.LogName
+	msg["_type"] = messageType
+	msg["_pid"] = ge.Pid
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("Error encoding GELF log message: %s", err)
+	}
+	if ge.ChunkSize > 0 {
+		err = ge.writeChunks(data)
+	} else {
+		_, err = ge.Writer.Write(append(data, 0))
+	}
+	if err != nil {
+		return fmt.Errorf("Error sending GELF log message: %s", err)
+	}
+	return nil
+}
+
+// writeChunks writes data as a single datagram if it fits, or splits it into
+// chunks that share a random 8-byte message ID.
+func (ge *GELFEmitter) writeChunks(data []byte) (err error) {
+	if len(data) <= ge.ChunkSize {
+		_, err = ge.Writer.Write(data)
+		return err
+	}
+	chunkDataSize := ge.ChunkSize - gelfChunkHeaderSize
+	if chunkDataSize <= 0 {
+		return fmt.Errorf("Chunk size %d too small", ge.ChunkSize)
+	}
+	count := (len(data) + chunkDataSize - 1) / chunkDataSize
+	if count > GELFMaxChunks {
+		return fmt.Errorf("Message size %d exceeds maximum size %d",
+			len(data), GELFMaxChunks*chunkDataSize)
+	}
+	msgID, err := idGenerateBytes()
+	if err != nil {
+		return fmt.Errorf("Error generating message ID: %s", err)
+	}
+	chunk := make([]byte, 0, ge.ChunkSize)
+	for i := 0; i < count; i++ {
+		chunk = append(chunk[:0], gelfChunkMagic...)
+		chunk = append(chunk, msgID[:8]...)
+		chunk = append(chunk, byte(i), byte(count))
+		end := (i + 1) * chunkDataSize
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk = append(chunk, data[i*chunkDataSize:end]...)
+		if _, err = ge.Writer.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the underlying write stream. Implements LogEmitter.Close.
+func (ge *GELFEmitter) Close() error {
+	return TryClose(ge.Writer)
+}
@@ -0,0 +1,114 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "Update golden files in testdata")
+
+// frameRecorder records each write as a separate frame.
+type frameRecorder struct {
+	frames [][]byte
+}
+
+func (fr *frameRecorder) Write(p []byte) (int, error) {
+	fr.frames = append(fr.frames, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+// checkGolden compares captured frames to testdata/<name>.golden, which
+// holds the frames in order.
+func checkGolden(t *testing.T, name string, frames [][]byte) {
+	path := filepath.Join("testdata", name+".golden")
+	actual := bytes.Join(frames, nil)
+	if *updateGolden {
+		if err := ioutil.WriteFile(path, actual, 0644); err != nil {
+			t.Fatalf("Error updating golden file %s: %s", path, err)
+		}
+		return
+	}
+	expected, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error reading golden file %s: %s", path, err)
+	}
+	if !bytes.Equal(actual, expected) {
+		t.Errorf("On test %s, malformed frames: got %q; want %q",
+			name, actual, expected)
+	}
+}
+
+func TestGELFEmitter(t *testing.T) {
+	useMockFuncs()
+	defer useStdFuncs()
+
+	fields := LogFields{"c": "d", "a": "b", "id": "1", "rem ote": "x"}
+	tests := []struct {
+		name      string
+		chunkSize int
+		payload   string
+		frames    int
+	}{
+		{"gelf_stream", 0, "Howdy", 1},
+		{"gelf_datagram", GELFChunkSize, "Howdy", 1},
+		{"gelf_chunked", 64, strings.Repeat("Howdy ", 20), 6},
+	}
+	for _, test := range tests {
+		fr := new(frameRecorder)
+		ge := NewGELFEmitter(fr, "example.com", "test-gelf-emitter",
+			test.chunkSize)
+		if err := ge.Emit(INFO, "test", test.payload, fields); err != nil {
+			t.Errorf("On test %s, error emitting GELF message: %s", test.name, err)
+			continue
+		}
+		if len(fr.frames) != test.frames {
+			t.Errorf("On test %s, got %d frames; want %d", test.name,
+				len(fr.frames), test.frames)
+		}
+		for i, frame := range fr.frames {
+			if len(frame) > test.chunkSize && test.chunkSize > 0 {
+				t.Errorf("On test %s, frame %d exceeds chunk size: %d bytes",
+					test.name, i, len(frame))
+			}
+		}
+		checkGolden(t, test.name, fr.frames)
+	}
+}
+
+func TestGELFEmitterTooLarge(t *testing.T) {
+	fr := new(frameRecorder)
+	ge := NewGELFEmitter(fr, "example.com", "test-gelf-emitter", 64)
+	payload := strings.Repeat("x", GELFMaxChunks*(64-gelfChunkHeaderSize))
+	if err := ge.Emit(INFO, "test", payload, nil); err == nil {
+		t.Errorf("Expected error emitting oversized GELF message")
+	}
+	if len(fr.frames) > 0 {
+		t.Errorf("Wrote %d frames for oversized GELF message", len(fr.frames))
+	}
+}
+
+func TestGELFFieldName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"uaid", "_uaid"},
+		{"remote-addr", "_remote-addr"},
+		{"user agent", "_user_agent"},
+		{"id", "_f_id"},
+		{"", "_"},
+	}
+	for _, test := range tests {
+		if actual := gelfFieldName(test.name); actual != test.expected {
+			t.Errorf("On test %q, got %q; want %q", test.name, actual, test.expected)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// JournalSocket is the path to the journald native protocol socket.
+const JournalSocket = "/run/systemd/journal/socket"
+
+type JournaldLoggerConfig struct {
+	// Path is the journald socket path.
+	Path string
+
+	// Name is the SYSLOG_IDENTIFIER attached to each entry.
+	Name string `toml:"name" env:"name"`
+
+	Filter int32
+	Levels string
+	Queue  LogQueueConfig
+}
+
+// A JournaldLogger sends log messages to the systemd journal using the
+// native protocol. Log levels are sent as the PRIORITY field, and log fields
+// are sent as upper-case journal fields.
+type JournaldLogger struct {
+	LogEmitter
+	logFilter
+}
+
+func (jl *JournaldLogger) ConfigStruct() interface{} {
+	return &JournaldLoggerConfig{
+		Path:   JournalSocket,
+		Name:   "pushgo",
+		Filter: 0,
+		Queue:  LogQueueConfig{Policy: string(LogQueueBlock)},
+	}
+}
+
+// CheckConfig validates the socket path and queue settings. Implements
+// ConfigChecker.CheckConfig().
+func (jl *JournaldLogger) CheckConfig(config interface{}) error {
+	conf := config.(*JournaldLoggerConfig)
+	if _, err := ParseLogLevels(conf.Levels); err != nil {
+		return err
+	}
+	if len(conf.Path) == 0 {
+		return fmt.Errorf("Missing journald socket path")
+	}
+	return conf.Queue.CheckConfig()
+}
+
+func (jl *JournaldLogger) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*JournaldLoggerConfig)
+	// Datagram sockets are connectionless, so there is no need to redial if
+	// journald restarts.
+	conn, err := net.Dial("unixgram", conf.Path)
+	if err != nil {
+		return fmt.Errorf("JournaldLogger: Error connecting to journald: %s", err)
+	}
+	jl.LogEmitter = conf.Queue.Wrap(&JournalEmitter{
+		conn:       conn,
+		identifier: conf.Name,
+	})
+	if err = jl.setFilterConfig(conf.Filter, conf.Levels); err != nil {
+		return fmt.Errorf("JournaldLogger: %s", err)
+	}
+	return nil
+}
+
+// DroppedMessages implements LogDropCounter.DroppedMessages().
+func (jl *JournaldLogger) DroppedMessages() int64 {
+	return DroppedMessages(jl.LogEmitter)
+}
+
+// Reload applies the log levels from a reloaded configuration. Implements
+// Reloader.Reload().
+func (jl *JournaldLogger) Reload(config interface{}, changed []string) (
+	rejected []string, err error) {
+
+	conf := config.(*JournaldLoggerConfig)
+	return jl.reloadFilter(changed, conf.Filter, conf.Levels)
+}
+
+func (jl *JournaldLogger) Log(level LogLevel, messageType, payload string,
+	fields LogFields) (err error) {
+
+	if !jl.shouldEmit(level, messageType, fields) {
+		return
+	}
+	return jl.Emit(level, messageType, payload, fields)
+}
+
+// A JournalEmitter emits journal entries using the journald native protocol.
+type JournalEmitter struct {
+	conn       net.Conn
+	identifier string
+}
+
+// Emit encodes and sends a journal entry. Implements LogEmitter.Emit.
+func (je *JournalEmitter) Emit(level LogLevel, messageType, payload string,
+	fields LogFields) (err error) {
+
+	msg := je.format(level, messageType, payload, fields)
+	if _, err = je.conn.Write(msg); err != nil {
+		return fmt.Errorf("Error sending journald message: %s", err)
+	}
+	return nil
+}
+
+// format encodes a journal entry. The message type is sent as MESSAGE_TYPE,
+// followed by the log fields sorted by name.
+func (je *JournalEmitter) format(level LogLevel, messageType, payload string,
+	fields LogFields) []byte {
+
+	buf := new(bytes.Buffer)
+	writeJournalField(buf, "MESSAGE", payload)
+	writeJournalField(buf, "PRIORITY", strconv.Itoa(int(level)))
+	writeJournalField(buf, "SYSLOG_IDENTIFIER", je.identifier)
+	writeJournalField(buf, "MESSAGE_TYPE", messageType)
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeJournalField(buf, journalFieldName(name), fields[name])
+	}
+	return buf.Bytes()
+}
+
+// writeJournalField writes a single field. Values that contain newlines are
+// written with an explicit length, per the journald native protocol.
+func writeJournalField(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(name)
+	if strings.IndexByte(value, '\n') < 0 {
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// journalFieldName converts name to a valid journal field name: upper-case
+// letters, digits, and underscores, not starting with an underscore or digit,
+// and at most 64 characters long. Leading underscores are reserved for trusted
+// fields set by journald.
+func journalFieldName(name string) string {
+	field := []byte(strings.ToUpper(name))
+	if len(field) > 62 {
+		field = field[:62]
+	}
+	for i, c := range field {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			field[i] = '_'
+		}
+	}
+	if len(field) == 0 || field[0] == '_' || (field[0] >= '0' && field[0] <= '9') {
+		field = append([]byte("F_"), field...)
+	}
+	return string(field)
+}
+
+// Close closes the journald socket. Implements LogEmitter.Close.
+func (je *JournalEmitter) Close() error {
+	return je.conn.Close()
+}
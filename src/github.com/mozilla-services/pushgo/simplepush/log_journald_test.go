@@ -0,0 +1,79 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJournaldLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushgo-journal")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "socket")
+
+	pc, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Fatalf("Error listening on %q: %s", path, err)
+	}
+	defer pc.Close()
+
+	jl := new(JournaldLogger)
+	conf := jl.ConfigStruct().(*JournaldLoggerConfig)
+	conf.Path = path
+	conf.Filter = int32(INFO)
+	if err = jl.Init(nil, conf); err != nil {
+		t.Fatalf("Error initializing journald logger: %s", err)
+	}
+	defer jl.Close()
+
+	tests := []struct {
+		level       LogLevel
+		messageType string
+		payload     string
+		fields      LogFields
+		expected    string
+	}{
+		{ERROR, "worker", "Howdy", LogFields{"uaid": "abc", "_pid": "1", "2x": "y"},
+			"MESSAGE=Howdy\nPRIORITY=3\nSYSLOG_IDENTIFIER=pushgo\n" +
+				"MESSAGE_TYPE=worker\nF_2X=y\nF__PID=1\nUAID=abc\n"},
+		{INFO, "http", "Two\nlines", LogFields{"remote-addr": "::1"},
+			"MESSAGE\n\x09\x00\x00\x00\x00\x00\x00\x00Two\nlines\nPRIORITY=6\n" +
+				"SYSLOG_IDENTIFIER=pushgo\nMESSAGE_TYPE=http\nREMOTE_ADDR=::1\n"},
+	}
+	buf := make([]byte, 1024)
+	for _, test := range tests {
+		if err = jl.Log(test.level, test.messageType, test.payload,
+			test.fields); err != nil {
+
+			t.Fatalf("Error logging %q: %s", test.payload, err)
+		}
+		pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Error reading journal entry: %s", err)
+		}
+		if actual := string(buf[:n]); actual != test.expected {
+			t.Errorf("Wrong journal entry: got %q; want %q",
+				actual, test.expected)
+		}
+	}
+
+	// Filtered messages should not be sent.
+	if err = jl.Log(DEBUG, "test", "Ignored", nil); err != nil {
+		t.Fatalf("Error logging filtered message: %s", err)
+	}
+	pc.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, _, err := pc.ReadFrom(buf); err == nil {
+		t.Errorf("Unexpected journal entry for filtered message: %q", buf[:n])
+	}
+}
@@ -0,0 +1,234 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RotateTimeFormat is the timestamp appended to the names of rotated log
+// files. Timestamps sort in rotation order.
+const RotateTimeFormat = "20060102T150405.000000000"
+
+// ErrFileClosed is returned when writing to a closed RotatingFile.
+var ErrFileClosed = errors.New("Log file closed")
+
+// RotateOptions specifies when a RotatingFile is rotated, and how many
+// rotated files are kept.
+type RotateOptions struct {
+	MaxSize    int64         // Rotate once the file exceeds this size, in bytes.
+	MaxAge     time.Duration // Rotate once the file is this old.
+	MaxBackups int           // Number of rotated files to keep; 0 keeps all.
+	Compress   bool          // Gzip rotated files.
+}
+
+// A RotatingFile is a log file that is rotated by size and age. Rotated
+// files are renamed with a timestamp suffix, and optionally compressed.
+// Writes are serialized, and rotation only happens between writes, so each
+// message is written to exactly one file.
+type RotatingFile struct {
+	path     string
+	opts     RotateOptions
+	lock     sync.Mutex // Protects the following fields.
+	file     *os.File
+	size     int64
+	openedAt time.Time
+	closed   bool
+	cleanup  sync.Mutex     // Serializes compression and pruning.
+	pending  sync.WaitGroup // Background compression and pruning.
+}
+
+// OpenRotatingFile opens or creates the log file at path, appending to any
+// existing contents.
+func OpenRotatingFile(path string, opts RotateOptions) (*RotatingFile, error) {
+	r := &RotatingFile{path: path, opts: opts}
+	file, size, err := r.open()
+	if err != nil {
+		return nil, err
+	}
+	r.file, r.size, r.openedAt = file, size, timeNow()
+	return r, nil
+}
+
+// Path returns the path to the active log file.
+func (r *RotatingFile) Path() string { return r.path }
+
+// open opens the log file, returning its current size.
+func (r *RotatingFile) open() (file *os.File, size int64, err error) {
+	if file, err = os.OpenFile(r.path,
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666); err != nil {
+
+		return nil, 0, fmt.Errorf("Error opening log file %q: %s", r.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, fmt.Errorf("Error reading log file %q: %s", r.path, err)
+	}
+	return file, info.Size(), nil
+}
+
+// Write writes a log message, rotating the file first if the message would
+// exceed the maximum size, or the file is older than the maximum age.
+// Implements io.Writer.Write().
+func (r *RotatingFile) Write(p []byte) (n int, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return 0, ErrFileClosed
+	}
+	if r.shouldRotate(len(p)) {
+		// If the file cannot be rotated, keep writing to the current file
+		// instead of dropping the message. Rotation is retried on the next
+		// write.
+		r.rotate()
+	}
+	n, err = r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// shouldRotate indicates whether writing n bytes requires rotating the file.
+// Empty files are never rotated, so a message larger than the maximum size is
+// still written.
+func (r *RotatingFile) shouldRotate(n int) bool {
+	if r.size == 0 {
+		return false
+	}
+	if r.opts.MaxSize > 0 && r.size+int64(n) > r.opts.MaxSize {
+		return true
+	}
+	return r.opts.MaxAge > 0 && timeNow().Sub(r.openedAt) >= r.opts.MaxAge
+}
+
+// Rotate renames the active log file and opens a new one.
+func (r *RotatingFile) Rotate() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return ErrFileClosed
+	}
+	return r.rotate()
+}
+
+func (r *RotatingFile) rotate() error {
+	backup := r.path + "." + timeNow().UTC().Format(RotateTimeFormat)
+	if err := os.Rename(r.path, backup); err != nil {
+		return fmt.Errorf("Error rotating log file %q: %s", r.path, err)
+	}
+	file, size, err := r.open()
+	if err != nil {
+		// Continue writing to the renamed file.
+		return err
+	}
+	r.file.Close()
+	r.file, r.size, r.openedAt = file, size, timeNow()
+	r.pending.Add(1)
+	go r.cleanupBackups(backup)
+	return nil
+}
+
+// Reopen closes and reopens the log file at the same path. This should be
+// called after the file is moved by an external tool like logrotate. If the
+// file cannot be reopened, the current file remains open.
+func (r *RotatingFile) Reopen() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return ErrFileClosed
+	}
+	file, size, err := r.open()
+	if err != nil {
+		return err
+	}
+	r.file.Close()
+	r.file, r.size, r.openedAt = file, size, timeNow()
+	return nil
+}
+
+// Close closes the log file, and waits for rotated files to be compressed.
+// Implements io.Closer.Close().
+func (r *RotatingFile) Close() (err error) {
+	r.lock.Lock()
+	if r.closed {
+		r.lock.Unlock()
+		return nil
+	}
+	r.closed = true
+	err = r.file.Close()
+	r.lock.Unlock()
+	r.pending.Wait()
+	return err
+}
+
+// cleanupBackups compresses the newly rotated file, if enabled, and removes
+// the oldest rotated files beyond the retention count. Errors are ignored:
+// logging them would write to the file being rotated.
+func (r *RotatingFile) cleanupBackups(backup string) {
+	defer r.pending.Done()
+	r.cleanup.Lock()
+	defer r.cleanup.Unlock()
+	if r.opts.Compress {
+		compressFile(backup)
+	}
+	if r.opts.MaxBackups <= 0 {
+		return
+	}
+	backups := r.backups()
+	for len(backups) > r.opts.MaxBackups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+}
+
+// backups returns the rotated log files, oldest first.
+func (r *RotatingFile) backups() (names []string) {
+	prefix := r.path + "."
+	matches, _ := filepath.Glob(prefix + "*")
+	for _, name := range matches {
+		suffix := strings.TrimSuffix(name[len(prefix):], ".gz")
+		if _, err := time.Parse(RotateTimeFormat, suffix); err != nil {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// compressFile gzips the file at path, replacing it with path.gz.
+func compressFile(path string) (err error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dest, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
+		0666)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dest)
+	if _, err = io.Copy(gz, src); err == nil {
+		err = gz.Close()
+	}
+	if closeErr := dest.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
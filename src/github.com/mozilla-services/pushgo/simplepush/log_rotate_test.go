@@ -0,0 +1,164 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mockRotateClock advances the mock time by one second on each call, so that
+// rotated files have distinct names.
+func mockRotateClock() {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time {
+		now = now.Add(1 * time.Second)
+		return now
+	}
+}
+
+func readLogFile(t *testing.T, name string) string {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatalf("Error reading log file %q: %s", name, err)
+	}
+	return string(data)
+}
+
+func TestRotatingFileSize(t *testing.T) {
+	mockRotateClock()
+	defer useStdFuncs()
+
+	dir, err := ioutil.TempDir("", "pushgo-log")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pushgo.log")
+
+	r, err := OpenRotatingFile(path, RotateOptions{MaxSize: 10, MaxBackups: 2})
+	if err != nil {
+		t.Fatalf("Error opening log file: %s", err)
+	}
+	messages := []string{"one\n", "two\n", "three\n", "four\n", "five\n", "six\n"}
+	for _, msg := range messages {
+		if _, err = r.Write([]byte(msg)); err != nil {
+			t.Fatalf("Error writing message %q: %s", msg, err)
+		}
+	}
+	if err = r.Close(); err != nil {
+		t.Fatalf("Error closing log file: %s", err)
+	}
+	if _, err = r.Write([]byte("seven\n")); err != ErrFileClosed {
+		t.Errorf("Wrong error writing to closed file: got %#v; want %#v",
+			err, ErrFileClosed)
+	}
+
+	// Messages should not be split across files.
+	if s := readLogFile(t, path); s != "six\n" {
+		t.Errorf("Wrong active log contents: got %q", s)
+	}
+	backups := r.backups()
+	if len(backups) != 2 {
+		t.Fatalf("Wrong number of rotated files: got %#v; want 2", backups)
+	}
+	for i, want := range []string{"three\n", "four\nfive\n"} {
+		if s := readLogFile(t, backups[i]); s != want {
+			t.Errorf("Wrong contents for %q: got %q; want %q", backups[i], s, want)
+		}
+	}
+}
+
+func TestRotatingFileAge(t *testing.T) {
+	mockRotateClock()
+	defer useStdFuncs()
+
+	dir, err := ioutil.TempDir("", "pushgo-log")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pushgo.log")
+
+	r, err := OpenRotatingFile(path, RotateOptions{
+		MaxAge:   1 * time.Minute,
+		Compress: true,
+	})
+	if err != nil {
+		t.Fatalf("Error opening log file: %s", err)
+	}
+	r.Write([]byte("old\n"))
+	r.Write([]byte("older\n"))
+	// Age the file past the maximum.
+	r.openedAt = r.openedAt.Add(-1 * time.Minute)
+	r.Write([]byte("new\n"))
+	if err = r.Close(); err != nil {
+		t.Fatalf("Error closing log file: %s", err)
+	}
+
+	if s := readLogFile(t, path); s != "new\n" {
+		t.Errorf("Wrong active log contents: got %q", s)
+	}
+	backups := r.backups()
+	if len(backups) != 1 || !strings.HasSuffix(backups[0], ".gz") {
+		t.Fatalf("Wrong rotated files: got %#v; want 1 compressed file", backups)
+	}
+	f, err := os.Open(backups[0])
+	if err != nil {
+		t.Fatalf("Error opening rotated file: %s", err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("Error reading compressed file: %s", err)
+	}
+	data, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("Error decompressing rotated file: %s", err)
+	}
+	if s := string(data); s != "old\nolder\n" {
+		t.Errorf("Wrong rotated contents: got %q", s)
+	}
+}
+
+func TestRotatingFileReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushgo-log")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pushgo.log")
+
+	r, err := OpenRotatingFile(path, RotateOptions{})
+	if err != nil {
+		t.Fatalf("Error opening log file: %s", err)
+	}
+	defer r.Close()
+	r.Write([]byte("before\n"))
+
+	// Simulate logrotate: writes after the move go to the moved file until
+	// the log is reopened.
+	moved := path + ".1"
+	if err = os.Rename(path, moved); err != nil {
+		t.Fatalf("Error moving log file: %s", err)
+	}
+	r.Write([]byte("moved\n"))
+	if err = r.Reopen(); err != nil {
+		t.Fatalf("Error reopening log file: %s", err)
+	}
+	r.Write([]byte("after\n"))
+
+	if s := readLogFile(t, moved); s != "before\nmoved\n" {
+		t.Errorf("Wrong moved log contents: got %q", s)
+	}
+	if s := readLogFile(t, path); s != "after\n" {
+		t.Errorf("Wrong reopened log contents: got %q", s)
+	}
+}
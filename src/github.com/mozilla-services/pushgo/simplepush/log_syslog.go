@@ -0,0 +1,337 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mozilla-services/pushgo/retry"
+)
+
+// SyslogTime is the RFC 5424 timestamp format, with microsecond precision.
+const SyslogTime = "2006-01-02T15:04:05.000000Z07:00"
+
+// syslogFacilities maps facility names to RFC 5424 facility codes.
+var syslogFacilities = map[string]int{
+	"kern":     0,
+	"user":     1,
+	"mail":     2,
+	"daemon":   3,
+	"auth":     4,
+	"syslog":   5,
+	"lpr":      6,
+	"news":     7,
+	"uucp":     8,
+	"cron":     9,
+	"authpriv": 10,
+	"ftp":      11,
+	"local0":   16,
+	"local1":   17,
+	"local2":   18,
+	"local3":   19,
+	"local4":   20,
+	"local5":   21,
+	"local6":   22,
+	"local7":   23,
+}
+
+// syslogLocalPaths are the Unix sockets tried, in order, when no syslog
+// address is configured. Taken from package log/syslog.
+var syslogLocalPaths = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+type SyslogLoggerConfig struct {
+	// Proto is the network used to reach the syslog daemon: "unixgram",
+	// "unix", "udp", or "tcp". If both Proto and Addr are empty, the local
+	// syslog socket is used.
+	Proto string
+	Addr  string
+
+	// UseTLS dials the daemon over TLS. Only valid for stream networks.
+	UseTLS bool `toml:"use_tls" env:"use_tls"`
+
+	// Facility is the syslog facility name, e.g. "daemon" or "local0".
+	Facility string
+
+	// Name is the RFC 5424 APP-NAME.
+	Name string `toml:"name" env:"name"`
+
+	// SDID is the structured data ID used for log fields. The default uses
+	// the enterprise number reserved for documentation by RFC 5612.
+	SDID string `toml:"sd_id" env:"sd_id"`
+
+	Filter int32
+	Levels string
+	Queue  LogQueueConfig
+
+	// Retry controls the backoff between attempts to reconnect to the syslog
+	// daemon. Retry.Retries is ignored; reconnects are attempted indefinitely.
+	Retry retry.Config
+}
+
+// syslogStreamProto indicates whether proto is a stream network. Messages
+// sent over stream networks are framed with octet counting, per RFC 6587.
+func syslogStreamProto(proto string) bool {
+	switch proto {
+	case "tcp", "tcp4", "tcp6", "unix":
+		return true
+	}
+	return false
+}
+
+// A SyslogLogger sends RFC 5424 messages to a local or remote syslog daemon.
+// Log levels map directly to syslog severities, and log fields are sent as
+// structured data.
+type SyslogLogger struct {
+	LogEmitter
+	logFilter
+}
+
+func (sl *SyslogLogger) ConfigStruct() interface{} {
+	return &SyslogLoggerConfig{
+		Facility: "daemon",
+		Name:     "pushgo",
+		SDID:     "pushgo@32473",
+		Filter:   0,
+		Queue:    LogQueueConfig{Policy: string(LogQueueBlock)},
+		Retry: retry.Config{
+			Delay:     "100ms",
+			MaxDelay:  "30s",
+			MaxJitter: "100ms",
+		},
+	}
+}
+
+// CheckConfig validates the facility, network, structured data ID, queue, and
+// reconnect settings.
+// Implements ConfigChecker.CheckConfig().
+func (sl *SyslogLogger) CheckConfig(config interface{}) error {
+	conf := config.(*SyslogLoggerConfig)
+	if _, err := ParseLogLevels(conf.Levels); err != nil {
+		return err
+	}
+	if _, ok := syslogFacilities[conf.Facility]; !ok {
+		return fmt.Errorf("Unrecognized syslog facility %q", conf.Facility)
+	}
+	if len(conf.Addr) == 0 && len(conf.Proto) > 0 {
+		return fmt.Errorf("Missing syslog address")
+	}
+	if conf.UseTLS && !syslogStreamProto(conf.Proto) {
+		return fmt.Errorf("Syslog over TLS requires a stream protocol, got %q",
+			conf.Proto)
+	}
+	if len(conf.SDID) == 0 || sdName(conf.SDID) != conf.SDID {
+		return fmt.Errorf("Invalid 'sd_id': %q", conf.SDID)
+	}
+	if err := conf.Queue.CheckConfig(); err != nil {
+		return err
+	}
+	if _, err := conf.Retry.NewHelper(); err != nil {
+		return fmt.Errorf("Invalid reconnect settings: %s", err)
+	}
+	return nil
+}
+
+func (sl *SyslogLogger) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*SyslogLoggerConfig)
+	facility, ok := syslogFacilities[conf.Facility]
+	if !ok {
+		return fmt.Errorf("SyslogLogger: Unrecognized facility %q",
+			conf.Facility)
+	}
+	se := &SyslogEmitter{
+		facility: facility,
+		hostname: syslogHeaderField(app.Hostname(), 255),
+		appName:  syslogHeaderField(conf.Name, 48),
+		procID:   strconv.Itoa(osGetPid()),
+		sdID:     conf.SDID,
+	}
+	rh, err := conf.Retry.NewHelper()
+	if err != nil {
+		return fmt.Errorf("SyslogLogger: Invalid reconnect settings: %s", err)
+	}
+	var dial func() (net.Conn, error)
+	switch {
+	case len(conf.Addr) == 0:
+		dial = dialLocalSyslog
+	case conf.UseTLS:
+		se.stream = true
+		dial = func() (net.Conn, error) {
+			conn, err := tls.Dial(conf.Proto, conf.Addr, nil)
+			if err != nil {
+				return nil, err
+			}
+			return conn, nil
+		}
+	default:
+		se.stream = syslogStreamProto(conf.Proto)
+		dial = func() (net.Conn, error) {
+			return net.Dial(conf.Proto, conf.Addr)
+		}
+	}
+	if se.writer, err = newRedialWriter(dial, rh); err != nil {
+		return fmt.Errorf("SyslogLogger: Error dialing syslog daemon: %s", err)
+	}
+	sl.LogEmitter = conf.Queue.Wrap(se)
+	if err = sl.setFilterConfig(conf.Filter, conf.Levels); err != nil {
+		return fmt.Errorf("SyslogLogger: %s", err)
+	}
+	return nil
+}
+
+// dialLocalSyslog connects to the local syslog daemon, trying datagram and
+// stream sockets at each well-known path.
+func dialLocalSyslog() (conn net.Conn, err error) {
+	for _, network := range []string{"unixgram", "unix"} {
+		for _, path := range syslogLocalPaths {
+			if conn, err = net.Dial(network, path); err == nil {
+				return conn, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("Unable to connect to local syslog daemon: %s", err)
+}
+
+// DroppedMessages implements LogDropCounter.DroppedMessages().
+func (sl *SyslogLogger) DroppedMessages() int64 {
+	return DroppedMessages(sl.LogEmitter)
+}
+
+// Reload applies the log levels from a reloaded configuration. Implements
+// Reloader.Reload().
+func (sl *SyslogLogger) Reload(config interface{}, changed []string) (
+	rejected []string, err error) {
+
+	conf := config.(*SyslogLoggerConfig)
+	return sl.reloadFilter(changed, conf.Filter, conf.Levels)
+}
+
+func (sl *SyslogLogger) Log(level LogLevel, messageType, payload string,
+	fields LogFields) (err error) {
+
+	if !sl.shouldEmit(level, messageType, fields) {
+		return
+	}
+	return sl.Emit(level, messageType, payload, fields)
+}
+
+// A SyslogEmitter emits RFC 5424 messages.
+type SyslogEmitter struct {
+	facility int
+	hostname string
+	appName  string
+	procID   string
+	sdID     string
+	stream   bool
+	writer   *redialWriter
+}
+
+// Emit formats and sends a syslog message. If the connection was lost, it is
+// redialed and the message is sent once more; if redialing fails, messages
+// are dropped until the reconnect backoff expires. Implements
+// LogEmitter.Emit.
+func (se *SyslogEmitter) Emit(level LogLevel, messageType, payload string,
+	fields LogFields) (err error) {
+
+	msg := se.format(level, messageType, payload, fields)
+	_, err = se.writer.Write(msg)
+	if err != nil && err != ErrLogReconnecting && err != ErrLogConnClosed {
+		_, err = se.writer.Write(msg)
+	}
+	return err
+}
+
+// format encodes an RFC 5424 message. The message type is used as the
+// MSGID, and fields are sorted by name.
+func (se *SyslogEmitter) format(level LogLevel, messageType, payload string,
+	fields LogFields) []byte {
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "<%d>1 %s %s %s %s %s ", se.facility*8+int(level),
+		timeNow().Format(SyslogTime), se.hostname, se.appName, se.procID,
+		syslogHeaderField(messageType, 32))
+	writeStructuredData(buf, se.sdID, fields)
+	if len(payload) > 0 {
+		buf.WriteByte(' ')
+		buf.WriteString(payload)
+	}
+	if !se.stream {
+		return buf.Bytes()
+	}
+	// Octet-counting framing; see RFC 6587, section 3.4.1.
+	framed := make([]byte, 0, buf.Len()+8)
+	framed = strconv.AppendInt(framed, int64(buf.Len()), 10)
+	framed = append(framed, ' ')
+	return append(framed, buf.Bytes()...)
+}
+
+// Close closes the connection to the syslog daemon. Implements
+// LogEmitter.Close.
+func (se *SyslogEmitter) Close() error {
+	return se.writer.Close()
+}
+
+// writeStructuredData writes fields as a single SD-ELEMENT, or the NILVALUE
+// if there are no fields.
+func writeStructuredData(w io.Writer, sdID string, fields LogFields) {
+	if len(fields) == 0 {
+		io.WriteString(w, "-")
+		return
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(w, "[%s", sdID)
+	for _, name := range names {
+		fmt.Fprintf(w, " %s=\"%s\"", sdName(name), sdParamEscaper.Replace(fields[name]))
+	}
+	io.WriteString(w, "]")
+}
+
+// sdParamEscaper escapes structured data parameter values, per RFC 5424,
+// section 6.3.3.
+var sdParamEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`, `]`, `\]`)
+
+// sdName converts s to a valid SD-NAME, replacing disallowed characters
+// with underscores and truncating it to 32 characters.
+func sdName(s string) string {
+	name := []byte(s)
+	if len(name) > 32 {
+		name = name[:32]
+	}
+	for i, c := range name {
+		if c <= ' ' || c > '~' || c == '=' || c == ']' || c == '"' {
+			name[i] = '_'
+		}
+	}
+	return string(name)
+}
+
+// syslogHeaderField converts s to a valid header field: printable ASCII,
+// truncated to maxLen characters. Empty fields are replaced with the
+// NILVALUE.
+func syslogHeaderField(s string, maxLen int) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	field := []byte(s)
+	if len(field) > maxLen {
+		field = field[:maxLen]
+	}
+	for i, c := range field {
+		if c <= ' ' || c > '~' {
+			field[i] = '_'
+		}
+	}
+	return string(field)
+}
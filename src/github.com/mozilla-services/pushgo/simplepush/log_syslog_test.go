@@ -0,0 +1,210 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/pushgo/retry"
+)
+
+func newTestSyslogLogger(t *testing.T, conf *SyslogLoggerConfig) *SyslogLogger {
+	app := NewApplication()
+	app.hostname = "example.com"
+	sl := new(SyslogLogger)
+	defaultConf := sl.ConfigStruct().(*SyslogLoggerConfig)
+	conf.Facility, conf.Name, conf.SDID = defaultConf.Facility,
+		defaultConf.Name, defaultConf.SDID
+	conf.Queue = defaultConf.Queue
+	conf.Filter = int32(DEBUG)
+	if err := sl.CheckConfig(conf); err != nil {
+		t.Fatalf("Invalid syslog config: %s", err)
+	}
+	if err := sl.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing syslog logger: %s", err)
+	}
+	return sl
+}
+
+func TestSyslogLoggerUDP(t *testing.T) {
+	useMockFuncs()
+	defer useStdFuncs()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	defer pc.Close()
+
+	sl := newTestSyslogLogger(t, &SyslogLoggerConfig{
+		Proto: "udp",
+		Addr:  pc.LocalAddr().String(),
+	})
+	defer sl.Close()
+
+	tests := []struct {
+		level       LogLevel
+		messageType string
+		payload     string
+		fields      LogFields
+		expected    string
+	}{
+		{WARNING, "worker", "Howdy", LogFields{"uaid": "abc", "a": `q"]\`},
+			`<28>1 2009-11-10T23:00:00.000000Z example.com pushgo 1234 worker ` +
+				`[pushgo@32473 a="q\"\]\\" uaid="abc"] Howdy`},
+		{DEBUG, "", "", nil,
+			`<31>1 2009-11-10T23:00:00.000000Z example.com pushgo 1234 - -`},
+		{ERROR, "bad type", "Oops", LogFields{"bad=name": "1"},
+			`<27>1 2009-11-10T23:00:00.000000Z example.com pushgo 1234 bad_type ` +
+				`[pushgo@32473 bad_name="1"] Oops`},
+	}
+	buf := make([]byte, 1024)
+	for _, test := range tests {
+		if err = sl.Log(test.level, test.messageType, test.payload,
+			test.fields); err != nil {
+
+			t.Fatalf("Error logging %q: %s", test.payload, err)
+		}
+		pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Error reading syslog message: %s", err)
+		}
+		if actual := string(buf[:n]); actual != test.expected {
+			t.Errorf("Wrong syslog message: got %q; want %q",
+				actual, test.expected)
+		}
+	}
+}
+
+func TestSyslogLoggerTCP(t *testing.T) {
+	useMockFuncs()
+	defer useStdFuncs()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	defer l.Close()
+
+	sl := newTestSyslogLogger(t, &SyslogLoggerConfig{
+		Proto: "tcp",
+		Addr:  l.Addr().String(),
+	})
+	defer sl.Close()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Error accepting connection: %s", err)
+	}
+	defer conn.Close()
+
+	if err = sl.Log(INFO, "test", "Hi", nil); err != nil {
+		t.Fatalf("Error logging message: %s", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg := "<30>1 2009-11-10T23:00:00.000000Z example.com pushgo 1234 test - Hi"
+	expected := "67 " + msg
+	actual := make([]byte, len(expected))
+	if _, err = io.ReadFull(conn, actual); err != nil {
+		t.Fatalf("Error reading syslog message: %s", err)
+	}
+	if string(actual) != expected {
+		t.Errorf("Wrong framed syslog message: got %q; want %q",
+			actual, expected)
+	}
+}
+
+func TestSyslogEmitterRedial(t *testing.T) {
+	useMockFuncs()
+	defer useStdFuncs()
+
+	client, server := net.Pipe()
+	dials := 0
+	dial := func() (net.Conn, error) {
+		dials++
+		if dials > 1 {
+			return nil, errors.New("connection refused")
+		}
+		return client, nil
+	}
+	rh := &retry.Helper{Backoff: 2, Delay: 1 * time.Hour, MaxDelay: 1 * time.Hour}
+	w, err := newRedialWriter(dial, rh)
+	if err != nil {
+		t.Fatalf("Error dialing: %s", err)
+	}
+	se := &SyslogEmitter{facility: 3, hostname: "-", appName: "-", procID: "-",
+		sdID: "pushgo@32473", writer: w}
+	defer se.Close()
+
+	// The message should be resent once after redialing.
+	server.Close()
+	if err = se.Emit(INFO, "test", "Lost", nil); err == nil {
+		t.Fatalf("Expected error writing to closed connection")
+	}
+	if dials != 2 {
+		t.Errorf("Wrong dial count after failed write: got %d; want 2", dials)
+	}
+	// Messages should be dropped without redialing until the backoff expires.
+	if err = se.Emit(INFO, "test", "Dropped", nil); err != ErrLogReconnecting {
+		t.Errorf("Wrong error during backoff: got %#v; want %#v",
+			err, ErrLogReconnecting)
+	}
+	if dials != 2 {
+		t.Errorf("Redialed during backoff: got %d dials; want 2", dials)
+	}
+}
+
+func TestSyslogLoggerFilter(t *testing.T) {
+	sl := new(SyslogLogger)
+	sl.SetFilter(WARNING)
+	if !sl.ShouldLog(ERROR) {
+		t.Errorf("Should log ERROR messages with filter WARNING")
+	}
+	if sl.ShouldLog(INFO) {
+		t.Errorf("Should not log INFO messages with filter WARNING")
+	}
+	// Filtered messages are dropped without a connection.
+	if err := sl.Log(DEBUG, "test", "Ignored", nil); err != nil {
+		t.Errorf("Error logging filtered message: %s", err)
+	}
+}
+
+func TestSyslogLoggerCheckConfig(t *testing.T) {
+	sl := new(SyslogLogger)
+	tests := []struct {
+		name string
+		conf *SyslogLoggerConfig
+		ok   bool
+	}{
+		{"Defaults", &SyslogLoggerConfig{}, true},
+		{"Unknown facility", &SyslogLoggerConfig{Facility: "nope"}, false},
+		{"Missing address", &SyslogLoggerConfig{Proto: "udp"}, false},
+		{"TLS over UDP", &SyslogLoggerConfig{
+			Proto: "udp", Addr: "localhost:514", UseTLS: true}, false},
+		{"TLS over TCP", &SyslogLoggerConfig{
+			Proto: "tcp", Addr: "localhost:6514", UseTLS: true}, true},
+		{"Invalid SD-ID", &SyslogLoggerConfig{SDID: "bad id"}, false},
+	}
+	for _, test := range tests {
+		conf := sl.ConfigStruct().(*SyslogLoggerConfig)
+		conf.Proto, conf.Addr, conf.UseTLS = test.conf.Proto, test.conf.Addr,
+			test.conf.UseTLS
+		if len(test.conf.Facility) > 0 {
+			conf.Facility = test.conf.Facility
+		}
+		if len(test.conf.SDID) > 0 {
+			conf.SDID = test.conf.SDID
+		}
+		err := sl.CheckConfig(conf)
+		if (err == nil) != test.ok {
+			t.Errorf("On test %s, got error %v; want ok %v", test.name, err, test.ok)
+		}
+	}
+}
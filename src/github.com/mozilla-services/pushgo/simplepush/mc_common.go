@@ -32,13 +32,36 @@ var (
 	ErrMemcacheStatus StorageError = "memcached returned unexpected health check result"
 	ErrUnknownUAID    StorageError = "Unknown UAID for host"
 	ErrNoNodes        StorageError = "No memcached nodes available"
+
+	ErrRateLimitConflict StorageError = "Too many concurrent rate limit updates"
 )
 
+// cursorKey returns the key for a device's flush cursor.
+func cursorKey(uaid string) string {
+	return "_cursor-" + uaid
+}
+
+// authKey returns the key for a device's credentials.
+func authKey(uaid string) string {
+	return "_auth-" + uaid
+}
+
+// receiptKey returns the key for a channel's receipt request.
+func receiptKey(uaid, chid string) string {
+	return "_receipt-" + joinIDs(uaid, chid)
+}
+
+// rateLimitKey returns the key for a shared rate limit bucket.
+func rateLimitKey(key string) string {
+	return "_ratelimit-" + key
+}
+
 // ChannelRecord represents a channel record persisted to memcached.
 type ChannelRecord struct {
 	State       ChannelState
 	Version     uint64
 	LastTouched int64
+	Accepted    int64 // Time the version was accepted, in nanoseconds.
 }
 
 // ChannelIDs is a list of decoded channel IDs.
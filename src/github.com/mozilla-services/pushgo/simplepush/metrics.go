@@ -6,6 +6,7 @@ package simplepush
 
 import (
 	"bytes"
+	"fmt"
 	"strconv"
 	"strings"
 	"sync"
@@ -27,12 +28,7 @@ func cleanMetricPart(r rune) rune {
 	return '-'
 }
 
-type trec struct {
-	Count uint64
-	Avg   float64
-}
-
-type timer map[string]trec
+type timer map[string]*timerHistogram
 
 type MetricConfig struct {
 	Prefix string
@@ -46,6 +42,11 @@ type MetricsConfig struct {
 	Counters       MetricConfig
 	Timers         MetricConfig
 	Gauges         MetricConfig
+	Prometheus     PrometheusConfig
+
+	// TimerWindow is the period over which timer averages and quantiles are
+	// computed.
+	TimerWindow string `toml:"timer_window" env:"timer_window"`
 }
 
 type Statistician interface {
@@ -69,14 +70,18 @@ type Metrics struct {
 	timer       timer // Timer snapshots.
 	timerPrefix string
 	timerSuffix string
+	timerWindow time.Duration
 
 	gauge       map[string]int64 // Gauge snapshots.
 	gaugePrefix string
 	gaugeSuffix string
 
+	affixLock sync.RWMutex // Protects the name affixes during reloads.
+
 	app            *Application
 	logger         *SimpleLogger
 	statsd         *statsd.Client
+	prom           *PrometheusRegistry
 	born           time.Time
 	storeSnapshots bool
 }
@@ -85,6 +90,7 @@ func (m *Metrics) ConfigStruct() interface{} {
 	return &MetricsConfig{
 		StoreSnapshots: true,
 		Gauges:         MetricConfig{Suffix: "{{.Host}}"},
+		TimerWindow:    "1m",
 	}
 }
 
@@ -119,6 +125,22 @@ func (m *Metrics) Init(app *Application, config interface{}) (err error) {
 			LogFields{"error": err.Error()})
 		return err
 	}
+	if len(conf.TimerWindow) > 0 {
+		if m.timerWindow, err = time.ParseDuration(conf.TimerWindow); err != nil {
+			m.logger.Panic("metrics", "Could not parse timer window",
+				LogFields{"error": err.Error(), "timer_window": conf.TimerWindow})
+			return err
+		}
+	}
+	if conf.Prometheus.Enabled {
+		m.prom, err = NewPrometheusRegistry(app, m.timerWindow,
+			conf.Prometheus.Buckets, conf.Counters, conf.Timers, conf.Gauges)
+		if err != nil {
+			m.logger.Panic("metrics", "Error configuring Prometheus metrics",
+				LogFields{"error": err.Error()})
+			return err
+		}
+	}
 	m.born = time.Now()
 
 	if m.storeSnapshots = conf.StoreSnapshots; m.storeSnapshots {
@@ -130,43 +152,113 @@ func (m *Metrics) Init(app *Application, config interface{}) (err error) {
 	return nil
 }
 
+// CheckConfig validates the metric name affixes and timer window. Implements
+// ConfigChecker.CheckConfig().
+func (m *Metrics) CheckConfig(config interface{}) (err error) {
+	conf := config.(*MetricsConfig)
+	for _, affix := range []string{
+		conf.Counters.Prefix, conf.Counters.Suffix,
+		conf.Timers.Prefix, conf.Timers.Suffix,
+		conf.Gauges.Prefix, conf.Gauges.Suffix,
+	} {
+		if _, err = template.New("affix").Parse(affix); err != nil {
+			return fmt.Errorf("Error parsing metric name affix: %s", err)
+		}
+	}
+	if len(conf.TimerWindow) > 0 {
+		if err = checkDuration("timer_window", conf.TimerWindow); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Prometheus returns the Prometheus metrics registry, or nil if Prometheus
+// metrics are disabled. Implements PrometheusExporter.Prometheus().
+func (m *Metrics) Prometheus() *PrometheusRegistry {
+	return m.prom
+}
+
 func (m *Metrics) setApp(app *Application) {
 	m.app = app
 	m.logger = app.Logger()
 }
 
 func (m *Metrics) setCounterAffixes(rawPrefix, rawSuffix string) (err error) {
-	m.counterPrefix, err = m.formatAffix("counterPrefix", rawPrefix)
+	prefix, err := m.formatAffix("counterPrefix", rawPrefix)
 	if err != nil {
 		return err
 	}
-	m.counterSuffix, err = m.formatAffix("counterSuffix", rawSuffix)
+	suffix, err := m.formatAffix("counterSuffix", rawSuffix)
 	if err != nil {
 		return err
 	}
+	m.affixLock.Lock()
+	m.counterPrefix, m.counterSuffix = prefix, suffix
+	m.affixLock.Unlock()
 	return nil
 }
 
 func (m *Metrics) setTimerAffixes(rawPrefix, rawSuffix string) (err error) {
-	if m.timerPrefix, err = m.formatAffix("timerPrefix", rawPrefix); err != nil {
+	var prefix, suffix string
+	if prefix, err = m.formatAffix("timerPrefix", rawPrefix); err != nil {
 		return err
 	}
-	if m.timerSuffix, err = m.formatAffix("timerSuffix", rawSuffix); err != nil {
+	if suffix, err = m.formatAffix("timerSuffix", rawSuffix); err != nil {
 		return err
 	}
+	m.affixLock.Lock()
+	m.timerPrefix, m.timerSuffix = prefix, suffix
+	m.affixLock.Unlock()
 	return nil
 }
 
 func (m *Metrics) setGaugeAffixes(rawPrefix, rawSuffix string) (err error) {
-	if m.gaugePrefix, err = m.formatAffix("gaugePrefix", rawPrefix); err != nil {
+	var prefix, suffix string
+	if prefix, err = m.formatAffix("gaugePrefix", rawPrefix); err != nil {
 		return err
 	}
-	if m.gaugeSuffix, err = m.formatAffix("gaugeSuffix", rawSuffix); err != nil {
+	if suffix, err = m.formatAffix("gaugeSuffix", rawSuffix); err != nil {
 		return err
 	}
+	m.affixLock.Lock()
+	m.gaugePrefix, m.gaugeSuffix = prefix, suffix
+	m.affixLock.Unlock()
 	return nil
 }
 
+// Reload applies the metric name affixes from a reloaded configuration.
+// Prometheus metrics are labeled when the server starts, so the affixes can
+// only be reloaded if Prometheus metrics are disabled. Implements
+// Reloader.Reload().
+func (m *Metrics) Reload(config interface{}, changed []string) (
+	rejected []string, err error) {
+
+	conf := config.(*MetricsConfig)
+	var apply map[string]bool
+	if m.prom == nil {
+		apply, rejected = liveSettings(changed, "counters", "timers", "gauges")
+	} else {
+		rejected = changed
+	}
+	if apply["counters"] {
+		if err = m.setCounterAffixes(conf.Counters.Prefix, conf.Counters.Suffix); err != nil {
+			return nil, fmt.Errorf("Error setting counter name affixes: %s", err)
+		}
+	}
+	if apply["timers"] {
+		if err = m.setTimerAffixes(conf.Timers.Prefix, conf.Timers.Suffix); err != nil {
+			return nil, fmt.Errorf("Error setting timer name affixes: %s", err)
+		}
+	}
+	if apply["gauges"] {
+		if err = m.setGaugeAffixes(conf.Gauges.Prefix, conf.Gauges.Suffix); err != nil {
+			return nil, fmt.Errorf("Error setting gauge name affixes: %s", err)
+		}
+	}
+	return rejected, nil
+}
+
 // formatAffix parses a raw affix as a template, interpolating the hostname
 // and server version into the resulting string.
 func (m *Metrics) formatAffix(name, raw string) (string, error) {
@@ -188,15 +280,24 @@ func (m *Metrics) formatAffix(name, raw string) (string, error) {
 }
 
 func (m *Metrics) formatCounter(metric string, tags ...string) string {
-	return m.formatMetric(metric, m.counterPrefix, m.counterSuffix, tags...)
+	m.affixLock.RLock()
+	prefix, suffix := m.counterPrefix, m.counterSuffix
+	m.affixLock.RUnlock()
+	return m.formatMetric(metric, prefix, suffix, tags...)
 }
 
 func (m *Metrics) formatTimer(metric string, tags ...string) string {
-	return m.formatMetric(metric, m.timerPrefix, m.timerSuffix, tags...)
+	m.affixLock.RLock()
+	prefix, suffix := m.timerPrefix, m.timerSuffix
+	m.affixLock.RUnlock()
+	return m.formatMetric(metric, prefix, suffix, tags...)
 }
 
 func (m *Metrics) formatGauge(metric string, tags ...string) string {
-	return m.formatMetric(metric, m.gaugePrefix, m.gaugeSuffix, tags...)
+	m.affixLock.RLock()
+	prefix, suffix := m.gaugePrefix, m.gaugeSuffix
+	m.affixLock.RUnlock()
+	return m.formatMetric(metric, prefix, suffix, tags...)
 }
 
 // formatMetric constructs a statsd key from the given metric name, prefix,
@@ -229,7 +330,10 @@ func (m *Metrics) Snapshot() map[string]interface{} {
 		oldMetrics[m.formatCounter(k, "counter")] = v
 	}
 	for k, v := range m.timer {
-		oldMetrics[m.formatTimer(k, "avg")] = v.Avg
+		oldMetrics[m.formatTimer(k, "avg")] = v.Avg()
+		for _, q := range timerQuantiles {
+			oldMetrics[m.formatTimer(k, q.Name)] = v.Quantile(q.Quantile)
+		}
 	}
 	for k, v := range m.gauge {
 		oldMetrics[m.formatGauge(k, "gauge")] = v
@@ -254,6 +358,10 @@ func (m *Metrics) IncrementBy(metric string, count int64) {
 				"type": "counter"})
 	}
 
+	if m.prom != nil {
+		m.prom.Count(metric, count)
+	}
+
 	if statsd := m.statsd; statsd != nil {
 		if count >= 0 {
 			statsd.Inc(m.formatCounter(metric), count, 1.0)
@@ -277,17 +385,12 @@ func (m *Metrics) Timer(metric string, duration time.Duration) {
 
 	if m.storeSnapshots {
 		m.Lock()
-		if t, ok := m.timer[metric]; !ok {
-			m.timer[metric] = trec{
-				Count: 1,
-				Avg:   float64(value),
-			}
-		} else {
-			// calculate running average
-			t.Count = t.Count + 1
-			t.Avg = t.Avg + (float64(value)-t.Avg)/float64(t.Count)
+		t, ok := m.timer[metric]
+		if !ok {
+			t = newTimerHistogram(m.timerWindow)
 			m.timer[metric] = t
 		}
+		t.Record(value)
 		m.Unlock()
 	}
 
@@ -296,6 +399,9 @@ func (m *Metrics) Timer(metric string, duration time.Duration) {
 			LogFields{"value": strconv.FormatInt(value, 10),
 				"type": "timer"})
 	}
+	if m.prom != nil {
+		m.prom.Observe(metric, duration)
+	}
 	if m.statsd != nil {
 		m.statsd.Timing(m.formatTimer(metric), value, 1.0)
 	}
@@ -308,6 +414,10 @@ func (m *Metrics) Gauge(metric string, value int64) {
 		m.Unlock()
 	}
 
+	if m.prom != nil {
+		m.prom.Gauge(metric, value)
+	}
+
 	if statsd := m.statsd; statsd != nil {
 		if value >= 0 {
 			statsd.Gauge(m.formatGauge(metric), value, 1.0)
@@ -329,6 +439,10 @@ func (m *Metrics) GaugeDelta(metric string, delta int64) {
 		m.Unlock()
 	}
 
+	if m.prom != nil {
+		m.prom.GaugeDelta(metric, delta)
+	}
+
 	if m.statsd != nil {
 		m.statsd.GaugeDelta(m.formatGauge(metric), delta, 1.0)
 	}
@@ -0,0 +1,179 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"time"
+)
+
+// Histogram bucket layout. Values below 2 * histSubBuckets are counted
+// exactly; larger values are grouped into histSubBuckets buckets per power
+// of two, bounding the relative error to 1/histSubBuckets. Values above
+// histMaxValue are counted in the last bucket.
+const (
+	histSubBuckets = 32
+	histMaxValue   = 1<<32 - 1
+)
+
+var histBuckets = histIndex(histMaxValue) + 1
+
+// timerQuantiles are the quantiles reported for each timer.
+var timerQuantiles = []struct {
+	Name     string
+	Quantile float64
+}{
+	{"p50", 0.5},
+	{"p95", 0.95},
+	{"p99", 0.99},
+}
+
+// histIndex returns the bucket index for a value.
+func histIndex(value int64) int {
+	if value < 0 {
+		return 0
+	}
+	if value > histMaxValue {
+		value = histMaxValue
+	}
+	if value < 2*histSubBuckets {
+		return int(value)
+	}
+	// Find the shift that places the value in [histSubBuckets,
+	// 2 * histSubBuckets).
+	shift := uint(1)
+	for value>>shift >= 2*histSubBuckets {
+		shift++
+	}
+	return 2*histSubBuckets + int(shift-1)*histSubBuckets +
+		int(value>>shift) - histSubBuckets
+}
+
+// histValue returns the midpoint of the values counted in a bucket.
+func histValue(index int) int64 {
+	if index < 2*histSubBuckets {
+		return int64(index)
+	}
+	shift := uint((index-2*histSubBuckets)/histSubBuckets + 1)
+	mantissa := int64((index-2*histSubBuckets)%histSubBuckets + histSubBuckets)
+	return mantissa<<shift + (1<<shift)/2
+}
+
+// histogramWindow counts the values recorded during a window.
+type histogramWindow struct {
+	counts []uint64
+	count  uint64
+	sum    int64
+}
+
+func newHistogramWindow() *histogramWindow {
+	return &histogramWindow{counts: make([]uint64, histBuckets)}
+}
+
+// timerHistogram is a windowed histogram of timer values. Values are
+// recorded in the current window; when the window elapses, it replaces the
+// previous window. Quantiles are computed over both windows, so that they
+// always cover at least one full window of values. Callers must synchronize
+// access.
+type timerHistogram struct {
+	window   time.Duration
+	started  time.Time
+	current  *histogramWindow
+	previous *histogramWindow
+}
+
+func newTimerHistogram(window time.Duration) *timerHistogram {
+	return &timerHistogram{
+		window:   window,
+		started:  timeNow(),
+		current:  newHistogramWindow(),
+		previous: newHistogramWindow(),
+	}
+}
+
+// Record adds a value to the current window.
+func (h *timerHistogram) Record(value int64) {
+	if h.window > 0 {
+		elapsed := timeNow().Sub(h.started)
+		if elapsed >= h.window {
+			if elapsed >= 2*h.window {
+				// No values were recorded during the last window.
+				h.previous = newHistogramWindow()
+			} else {
+				h.previous = h.current
+			}
+			h.current = newHistogramWindow()
+			h.started = timeNow()
+		}
+	}
+	h.current.counts[histIndex(value)]++
+	h.current.count++
+	h.current.sum += value
+}
+
+// windows returns the windows that have not expired.
+func (h *timerHistogram) windows() []*histogramWindow {
+	if h.window <= 0 {
+		return []*histogramWindow{h.current}
+	}
+	elapsed := timeNow().Sub(h.started)
+	if elapsed >= 2*h.window {
+		return nil
+	}
+	if elapsed >= h.window {
+		return []*histogramWindow{h.current}
+	}
+	return []*histogramWindow{h.previous, h.current}
+}
+
+// Count returns the number of values in the unexpired windows.
+func (h *timerHistogram) Count() (count uint64) {
+	for _, w := range h.windows() {
+		count += w.count
+	}
+	return count
+}
+
+// Sum returns the sum of the values in the unexpired windows.
+func (h *timerHistogram) Sum() (sum int64) {
+	for _, w := range h.windows() {
+		sum += w.sum
+	}
+	return sum
+}
+
+// Avg returns the mean of the values in the unexpired windows.
+func (h *timerHistogram) Avg() float64 {
+	count := h.Count()
+	if count == 0 {
+		return 0
+	}
+	return float64(h.Sum()) / float64(count)
+}
+
+// Quantile returns the approximate value at quantile q, where 0 < q <= 1.
+func (h *timerHistogram) Quantile(q float64) int64 {
+	windows := h.windows()
+	var count uint64
+	for _, w := range windows {
+		count += w.count
+	}
+	if count == 0 {
+		return 0
+	}
+	rank := uint64(q*float64(count) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var seen uint64
+	for i := 0; i < histBuckets; i++ {
+		for _, w := range windows {
+			seen += w.counts[i]
+		}
+		if seen >= rank {
+			return histValue(i)
+		}
+	}
+	return histValue(histBuckets - 1)
+}
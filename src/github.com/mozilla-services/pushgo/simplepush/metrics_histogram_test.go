@@ -0,0 +1,101 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistogramBuckets(t *testing.T) {
+	for _, value := range []int64{0, 1, 63, 64, 65, 100, 1000, 12345, 1 << 20,
+		histMaxValue} {
+
+		actual := histValue(histIndex(value))
+		// Buckets are reported by their midpoints.
+		delta := actual - value
+		if delta < -value/histSubBuckets || delta > value/histSubBuckets+1 {
+			t.Errorf("Wrong bucket for %d: got %d", value, actual)
+		}
+	}
+	if index := histIndex(histMaxValue + 1); index != histBuckets-1 {
+		t.Errorf("Wrong bucket for out-of-range value: got %d; want %d",
+			index, histBuckets-1)
+	}
+}
+
+func TestTimerHistogramQuantiles(t *testing.T) {
+	h := newTimerHistogram(0)
+	for value := int64(1); value <= 1000; value++ {
+		h.Record(value)
+	}
+	if count := h.Count(); count != 1000 {
+		t.Errorf("Wrong count: got %d; want 1000", count)
+	}
+	if avg := h.Avg(); avg != 500.5 {
+		t.Errorf("Wrong average: got %f; want 500.5", avg)
+	}
+	tests := []struct {
+		quantile float64
+		expected int64
+	}{
+		{0.5, 500},
+		{0.95, 950},
+		{0.99, 990},
+		{1, 1000},
+	}
+	for _, test := range tests {
+		actual := h.Quantile(test.quantile)
+		if delta := actual - test.expected; delta < -test.expected/histSubBuckets ||
+			delta > test.expected/histSubBuckets {
+
+			t.Errorf("Wrong quantile %f: got %d; want %d", test.quantile,
+				actual, test.expected)
+		}
+	}
+}
+
+func TestTimerHistogramWindow(t *testing.T) {
+	defer useStdFuncs()
+
+	now := time.Unix(1257894000, 0)
+	timeNow = func() time.Time { return now }
+
+	h := newTimerHistogram(1 * time.Minute)
+	for i := 0; i < 10; i++ {
+		h.Record(100)
+	}
+	now = now.Add(90 * time.Second)
+	for i := 0; i < 10; i++ {
+		h.Record(200)
+	}
+	// The first window replaces the previous window.
+	if count := h.Count(); count != 20 {
+		t.Errorf("Wrong count after first window: got %d; want 20", count)
+	}
+	if avg := h.Avg(); avg != 150 {
+		t.Errorf("Wrong average after first window: got %f; want 150", avg)
+	}
+	if p99 := h.Quantile(0.99); p99 != histValue(histIndex(200)) {
+		t.Errorf("Wrong p99 after first window: got %d", p99)
+	}
+
+	// Values recorded before the current window expire.
+	now = now.Add(1 * time.Minute)
+	if count := h.Count(); count != 10 {
+		t.Errorf("Wrong count after second window: got %d; want 10", count)
+	}
+	if p50 := h.Quantile(0.5); p50 != histValue(histIndex(200)) {
+		t.Errorf("Wrong p50 after second window: got %d", p50)
+	}
+
+	now = now.Add(1 * time.Minute)
+	if count := h.Count(); count != 0 {
+		t.Errorf("Wrong count after expiration: got %d; want 0", count)
+	}
+	if p50 := h.Quantile(0.5); p50 != 0 {
+		t.Errorf("Wrong p50 after expiration: got %d; want 0", p50)
+	}
+}
@@ -0,0 +1,332 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// defaultBuckets are the default timer histogram buckets, in seconds.
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type PrometheusConfig struct {
+	// Enabled exposes metrics in the Prometheus text exposition format.
+	Enabled bool
+
+	// Buckets are the upper bounds of the timer histogram buckets, in
+	// seconds.
+	Buckets []float64
+}
+
+// A PrometheusExporter is a Statistician that can expose its metrics to
+// Prometheus. Prometheus returns nil if the exporter is disabled.
+type PrometheusExporter interface {
+	Prometheus() *PrometheusRegistry
+}
+
+// promSeries describes how metric names are exported for a metric type.
+// The literal parts of the configured name affixes are kept in the name;
+// substitutions like {{.Host}} become labels.
+type promSeries struct {
+	prefix string
+	suffix string
+	labels []string // Formatted label pairs.
+}
+
+// name returns the Prometheus name for a metric.
+func (s *promSeries) name(metric string) string {
+	var parts []string
+	if len(s.prefix) > 0 {
+		parts = append(parts, s.prefix)
+	}
+	parts = append(parts, metric)
+	if len(s.suffix) > 0 {
+		parts = append(parts, s.suffix)
+	}
+	return strings.Map(cleanPromName, strings.Join(parts, "_"))
+}
+
+// promHistogram is a cumulative timer histogram. Quantiles are computed
+// from a windowed histogram of the values in microseconds.
+type promHistogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+	window *timerHistogram
+}
+
+// PrometheusRegistry records counters, gauges, and timer histograms, and
+// serves them in the Prometheus text exposition format.
+type PrometheusRegistry struct {
+	sync.Mutex
+	window     time.Duration
+	buckets    []float64
+	counter    promSeries
+	timer      promSeries
+	gauge      promSeries
+	counters   map[string]float64
+	gauges     map[string]float64
+	histograms map[string]*promHistogram
+}
+
+// NewPrometheusRegistry creates a registry with the given histogram buckets
+// and quantile window. The name affixes are parsed the same way as the
+// statsd affixes.
+func NewPrometheusRegistry(app *Application, window time.Duration,
+	buckets []float64, counters, timers, gauges MetricConfig) (
+	r *PrometheusRegistry, err error) {
+
+	if len(buckets) == 0 {
+		buckets = defaultBuckets
+	}
+	r = &PrometheusRegistry{
+		window:     window,
+		buckets:    make([]float64, len(buckets)),
+		counters:   make(map[string]float64),
+		gauges:     make(map[string]float64),
+		histograms: make(map[string]*promHistogram),
+	}
+	copy(r.buckets, buckets)
+	sort.Float64s(r.buckets)
+	host := app.Hostname()
+	if r.counter, err = newPromSeries(host, counters); err != nil {
+		return nil, err
+	}
+	if r.timer, err = newPromSeries(host, timers); err != nil {
+		return nil, err
+	}
+	if r.gauge, err = newPromSeries(host, gauges); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Placeholders used to locate substitutions in the name affixes.
+const (
+	promHostMarker    = "\x00"
+	promVersionMarker = "\x01"
+)
+
+func newPromSeries(host string, conf MetricConfig) (s promSeries, err error) {
+	labels := make(map[string]string)
+	if s.prefix, err = promAffix("prefix", conf.Prefix, host, labels); err != nil {
+		return s, err
+	}
+	if s.suffix, err = promAffix("suffix", conf.Suffix, host, labels); err != nil {
+		return s, err
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s.labels = append(s.labels, promLabel(name, labels[name]))
+	}
+	return s, nil
+}
+
+// promAffix executes an affix template, adding a label for each substitution,
+// and returns the remaining literal text.
+func promAffix(name, raw, host string, labels map[string]string) (
+	string, error) {
+
+	tmpl, err := template.New(name).Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	affix := new(bytes.Buffer)
+	params := struct {
+		Host    string
+		Version string
+	}{promHostMarker, promVersionMarker}
+	if err := tmpl.Execute(affix, params); err != nil {
+		return "", err
+	}
+	literal := affix.String()
+	if strings.Contains(literal, promHostMarker) {
+		labels["host"] = host
+	}
+	if strings.Contains(literal, promVersionMarker) {
+		labels["version"] = VERSION
+	}
+	literal = strings.NewReplacer(promHostMarker, "",
+		promVersionMarker, "").Replace(literal)
+	return strings.Trim(literal, "."), nil
+}
+
+// cleanPromName is a mapping function passed to strings.Map that replaces
+// characters not allowed in Prometheus metric names with underscores.
+func cleanPromName(r rune) rune {
+	if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+		r == '_' || r == ':' {
+		return r
+	}
+	return '_'
+}
+
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func promLabel(name, value string) string {
+	return name + `="` + promLabelEscaper.Replace(value) + `"`
+}
+
+// Count adds delta to a counter. Prometheus counters may only increase, so
+// negative deltas are ignored.
+func (r *PrometheusRegistry) Count(metric string, delta int64) {
+	if delta < 0 {
+		return
+	}
+	r.Lock()
+	r.counters[metric] += float64(delta)
+	r.Unlock()
+}
+
+func (r *PrometheusRegistry) Gauge(metric string, value int64) {
+	r.Lock()
+	r.gauges[metric] = float64(value)
+	r.Unlock()
+}
+
+func (r *PrometheusRegistry) GaugeDelta(metric string, delta int64) {
+	r.Lock()
+	r.gauges[metric] += float64(delta)
+	r.Unlock()
+}
+
+// Observe adds a timer value to the metric's histogram.
+func (r *PrometheusRegistry) Observe(metric string, duration time.Duration) {
+	value := duration.Seconds()
+	r.Lock()
+	defer r.Unlock()
+	h, ok := r.histograms[metric]
+	if !ok {
+		h = &promHistogram{
+			counts: make([]uint64, len(r.buckets)),
+			window: newTimerHistogram(r.window),
+		}
+		r.histograms[metric] = h
+	}
+	for i, bound := range r.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+	h.window.Record(int64(duration / time.Microsecond))
+}
+
+// Export writes all metrics in the Prometheus text exposition format.
+func (r *PrometheusRegistry) Export(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	r.Lock()
+	for _, metric := range sortedKeys(r.counters) {
+		name := r.counter.name(metric) + "_total"
+		writePromType(bw, name, "counter")
+		writePromSample(bw, name, r.counter.labels, r.counters[metric])
+	}
+	for _, metric := range sortedKeys(r.gauges) {
+		name := r.gauge.name(metric)
+		writePromType(bw, name, "gauge")
+		writePromSample(bw, name, r.gauge.labels, r.gauges[metric])
+	}
+	metrics := make([]string, 0, len(r.histograms))
+	for metric := range r.histograms {
+		metrics = append(metrics, metric)
+	}
+	sort.Strings(metrics)
+	for _, metric := range metrics {
+		r.writeHistogram(bw, metric, r.histograms[metric])
+	}
+	r.Unlock()
+	return bw.Flush()
+}
+
+func (r *PrometheusRegistry) writeHistogram(bw *bufio.Writer, metric string,
+	h *promHistogram) {
+
+	name := r.timer.name(metric) + "_seconds"
+	labels := r.timer.labels
+	writePromType(bw, name, "histogram")
+	bucketLabels := make([]string, len(labels)+1)
+	copy(bucketLabels, labels)
+	for i, bound := range r.buckets {
+		bucketLabels[len(labels)] = promLabel("le", formatPromValue(bound))
+		writePromSample(bw, name+"_bucket", bucketLabels, float64(h.counts[i]))
+	}
+	bucketLabels[len(labels)] = promLabel("le", "+Inf")
+	writePromSample(bw, name+"_bucket", bucketLabels, float64(h.count))
+	writePromSample(bw, name+"_sum", labels, h.sum)
+	writePromSample(bw, name+"_count", labels, float64(h.count))
+
+	// Export the windowed quantiles as a summary.
+	name = r.timer.name(metric) + "_window_seconds"
+	writePromType(bw, name, "summary")
+	for _, q := range timerQuantiles {
+		bucketLabels[len(labels)] = promLabel("quantile",
+			formatPromValue(q.Quantile))
+		writePromSample(bw, name, bucketLabels,
+			microsToSeconds(h.window.Quantile(q.Quantile)))
+	}
+	writePromSample(bw, name+"_sum", labels, microsToSeconds(h.window.Sum()))
+	writePromSample(bw, name+"_count", labels, float64(h.window.Count()))
+}
+
+func microsToSeconds(micros int64) float64 {
+	return float64(micros) / float64(time.Second/time.Microsecond)
+}
+
+// ServeHTTP serves the metrics to the Prometheus scraper.
+func (r *PrometheusRegistry) ServeHTTP(resp http.ResponseWriter,
+	req *http.Request) {
+
+	resp.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.Export(resp)
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writePromType(bw *bufio.Writer, name, typ string) {
+	bw.WriteString("# TYPE ")
+	bw.WriteString(name)
+	bw.WriteByte(' ')
+	bw.WriteString(typ)
+	bw.WriteByte('\n')
+}
+
+func writePromSample(bw *bufio.Writer, name string, labels []string,
+	value float64) {
+
+	bw.WriteString(name)
+	if len(labels) > 0 {
+		bw.WriteByte('{')
+		bw.WriteString(strings.Join(labels, ","))
+		bw.WriteByte('}')
+	}
+	bw.WriteByte(' ')
+	bw.WriteString(formatPromValue(value))
+	bw.WriteByte('\n')
+}
+
+func formatPromValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
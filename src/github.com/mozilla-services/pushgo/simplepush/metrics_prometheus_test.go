@@ -0,0 +1,138 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rafrombrc/gomock/gomock"
+)
+
+func TestMetricsPrometheus(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(false).AnyTimes()
+
+	app := NewApplication()
+	app.hostname = "test.mozilla.org"
+	app.SetLogger(mckLogger)
+
+	m := new(Metrics)
+	conf := m.ConfigStruct().(*MetricsConfig)
+	conf.Counters.Prefix = "pushgo"
+	conf.Prometheus = PrometheusConfig{
+		Enabled: true,
+		Buckets: []float64{0.5, 0.1},
+	}
+	if err := m.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing metrics: %s", err)
+	}
+	if m.Prometheus() == nil {
+		t.Fatalf("Prometheus registry not initialized")
+	}
+
+	m.IncrementBy("updates.client.hello", 2)
+	m.IncrementBy("updates.client.hello", -1)
+	m.Increment("updates.client.ping")
+	m.Gauge("update.client.connections", 5)
+	m.GaugeDelta("update.client.connections", -1)
+	m.Timer("client.flush", 50*time.Millisecond)
+	m.Timer("client.flush", 300*time.Millisecond)
+	m.Timer("client.flush", 2*time.Second)
+
+	resp := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://push.example.com/metrics", nil)
+	m.Prometheus().ServeHTTP(resp, req)
+
+	expected := `# TYPE pushgo_updates_client_hello_total counter
+pushgo_updates_client_hello_total 2
+# TYPE pushgo_updates_client_ping_total counter
+pushgo_updates_client_ping_total 1
+# TYPE update_client_connections gauge
+update_client_connections{host="test.mozilla.org"} 4
+# TYPE client_flush_seconds histogram
+client_flush_seconds_bucket{le="0.1"} 1
+client_flush_seconds_bucket{le="0.5"} 2
+client_flush_seconds_bucket{le="+Inf"} 3
+client_flush_seconds_sum 2.35
+client_flush_seconds_count 3
+# TYPE client_flush_window_seconds summary
+client_flush_window_seconds{quantile="0.5"} 0.299008
+client_flush_window_seconds{quantile="0.95"} 2.015232
+client_flush_window_seconds{quantile="0.99"} 2.015232
+client_flush_window_seconds_sum 2.35
+client_flush_window_seconds_count 3
+`
+	if body := resp.Body.String(); body != expected {
+		t.Errorf("Wrong Prometheus output: got %q; want %q", body, expected)
+	}
+	if typ := resp.Header().Get("Content-Type"); typ != "text/plain; version=0.0.4" {
+		t.Errorf("Wrong content type: got %q", typ)
+	}
+}
+
+func TestMetricsPrometheusLabels(t *testing.T) {
+	tests := []struct {
+		name   string
+		affix  MetricConfig
+		metric string
+		asName string
+		labels []string
+	}{
+		{
+			name:   "No affixes",
+			metric: "updates.appserver.incoming",
+			asName: "updates_appserver_incoming",
+		},
+		{
+			name:   "Host suffix",
+			affix:  MetricConfig{Suffix: "{{.Host}}"},
+			metric: "client.socket.connect",
+			asName: "client_socket_connect",
+			labels: []string{`host="test.mozilla.org"`},
+		},
+		{
+			name:   "Literal prefix; version suffix",
+			affix:  MetricConfig{Prefix: "pushgo.simplepush", Suffix: "v{{.Version}}"},
+			metric: "ping.success",
+			asName: "pushgo_simplepush_ping_success_v",
+			labels: []string{`version="` + VERSION + `"`},
+		},
+		{
+			name:   "Host and version",
+			affix:  MetricConfig{Prefix: "{{.Version}}.", Suffix: "{{.Host}}"},
+			metric: "router.broadcast.hit",
+			asName: "router_broadcast_hit",
+			labels: []string{`host="test.mozilla.org"`, `version="` + VERSION + `"`},
+		},
+	}
+	for _, test := range tests {
+		series, err := newPromSeries("test.mozilla.org", test.affix)
+		if err != nil {
+			t.Errorf("On test %s, error parsing affixes: %s", test.name, err)
+			continue
+		}
+		if name := series.name(test.metric); name != test.asName {
+			t.Errorf("On test %s, wrong metric name: got %q; want %q",
+				test.name, name, test.asName)
+		}
+		if len(series.labels) != len(test.labels) {
+			t.Errorf("On test %s, wrong labels: got %#v; want %#v",
+				test.name, series.labels, test.labels)
+			continue
+		}
+		for i, label := range series.labels {
+			if label != test.labels[i] {
+				t.Errorf("On test %s, wrong label: got %q; want %q",
+					test.name, label, test.labels[i])
+			}
+		}
+	}
+}
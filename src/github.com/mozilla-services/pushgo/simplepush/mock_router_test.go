@@ -47,15 +47,15 @@ func (_mr *_MockRouterRecorder) Close() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Close")
 }
 
-func (_m *MockRouter) Route(cancelSignal <-chan bool, uaid string, chid string, version int64, sentAt time.Time, logID string, data string) (bool, error) {
-	ret := _m.ctrl.Call(_m, "Route", cancelSignal, uaid, chid, version, sentAt, logID, data)
+func (_m *MockRouter) Route(cancelSignal <-chan bool, uaid string, chid string, version int64, sentAt time.Time, logID string, data string, span *Span) (bool, error) {
+	ret := _m.ctrl.Call(_m, "Route", cancelSignal, uaid, chid, version, sentAt, logID, data, span)
 	ret0, _ := ret[0].(bool)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-func (_mr *_MockRouterRecorder) Route(arg0, arg1, arg2, arg3, arg4, arg5, arg6 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "Route", arg0, arg1, arg2, arg3, arg4, arg5, arg6)
+func (_mr *_MockRouterRecorder) Route(arg0, arg1, arg2, arg3, arg4, arg5, arg6, arg7 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Route", arg0, arg1, arg2, arg3, arg4, arg5, arg6, arg7)
 }
 
 func (_m *MockRouter) Register(uaid string) error {
@@ -75,14 +75,14 @@ func (_mr *_MockWorkerRecorder) Run() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Run")
 }
 
-func (_m *MockWorker) Send(chid string, version int64, data string) error {
-	ret := _m.ctrl.Call(_m, "Send", chid, version, data)
+func (_m *MockWorker) Send(chid string, version int64, data string, accepted time.Time, path DeliveryPath, span *Span) error {
+	ret := _m.ctrl.Call(_m, "Send", chid, version, data, accepted, path, span)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-func (_mr *_MockWorkerRecorder) Send(arg0, arg1, arg2 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "Send", arg0, arg1, arg2)
+func (_mr *_MockWorkerRecorder) Send(arg0, arg1, arg2, arg3, arg4, arg5 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Send", arg0, arg1, arg2, arg3, arg4, arg5)
 }
 
 func (_m *MockWorker) Flush(lastAccessed int64) error {
@@ -95,6 +95,26 @@ func (_mr *_MockWorkerRecorder) Flush(arg0 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Flush", arg0)
 }
 
+func (_m *MockWorker) Idle() bool {
+	ret := _m.ctrl.Call(_m, "Idle")
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+func (_mr *_MockWorkerRecorder) Idle() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Idle")
+}
+
+func (_m *MockWorker) Redirect(origin string) error {
+	ret := _m.ctrl.Call(_m, "Redirect", origin)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockWorkerRecorder) Redirect(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Redirect", arg0)
+}
+
 func (_m *MockWorker) Close() error {
 	ret := _m.ctrl.Call(_m, "Close")
 	ret0, _ := ret[0].(error)
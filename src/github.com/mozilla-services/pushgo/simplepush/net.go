@@ -91,6 +91,16 @@ func ParseRetryAfter(header string) (d time.Duration, ok bool) {
 	return 0, false
 }
 
+// FormatRetryAfter formats d as a Retry-After header value, in whole
+// seconds. Partial seconds are rounded up.
+func FormatRetryAfter(d time.Duration) string {
+	sec := int64((d + time.Second - 1) / time.Second)
+	if sec < 1 {
+		sec = 1
+	}
+	return strconv.FormatInt(sec, 10)
+}
+
 type ListenerError struct {
 	Message     string
 	IsTemporary bool
@@ -221,12 +231,14 @@ type keepAliver interface {
 
 // LimitListener restricts the number of concurrent connections accepted by the
 // underlying listener, and sets a keep-alive timer on accepted connections.
-// Based on tcpKeepAliveListener from package net/http, copyright 2009,
-// The Go Authors.
+// If Proxy is set, connections from trusted peers report the client address
+// sent in the PROXY protocol header. Based on tcpKeepAliveListener from
+// package net/http, copyright 2009, The Go Authors.
 type LimitListener struct {
 	net.Listener
 	MaxConns        int
 	KeepAlivePeriod time.Duration
+	Proxy           *ProxyProtocol
 	conns           int32
 	closeOnce       Once
 }
@@ -266,6 +278,9 @@ func (l *LimitListener) Accept() (conn net.Conn, err error) {
 		return nil, err
 	}
 	l.setKeepAlive(socket)
+	if l.Proxy != nil {
+		socket = l.Proxy.Wrap(socket)
+	}
 	l.addConn()
 	return &limitConn{Conn: socket, removeConn: l.removeConn}, nil
 }
@@ -277,39 +292,47 @@ func (l *LimitListener) Close() error {
 
 // Listen returns an active HTTP listener. This is identical to ListenAndServe
 // from package net/http, but listens on a random port if addr is omitted, and
-// does not call http.Server.Serve. Copyright 2009, The Go Authors.
-func Listen(addr string, maxConns int, keepAlivePeriod time.Duration) (
-	net.Listener, error) {
+// does not call http.Server.Serve. addr may also be a Unix domain socket or a
+// systemd socket; see Bind. If proxy is non-nil, the listener accepts PROXY
+// protocol headers from trusted peers. Copyright 2009, The Go Authors.
+func Listen(addr string, perms *SocketPerms, maxConns int,
+	keepAlivePeriod time.Duration, proxy *ProxyProtocol) (net.Listener, error) {
 
-	ln, err := net.Listen("tcp", addr)
+	ln, err := Bind(addr, perms)
 	if err != nil {
 		return nil, err
 	}
 	return &LimitListener{Listener: ln, MaxConns: maxConns,
-		KeepAlivePeriod: keepAlivePeriod}, nil
+		KeepAlivePeriod: keepAlivePeriod, Proxy: proxy}, nil
 }
 
-// ListenTLS returns an active HTTPS listener. Based on ListenAndServeTLS from
-// package net/http, copyright 2009, The Go Authors.
-func ListenTLS(addr, certFile, keyFile string, maxConns int,
-	keepAlivePeriod time.Duration) (net.Listener, error) {
+// ListenTLS returns an active HTTPS listener that serves the certificates in
+// certs. The PROXY protocol header, if enabled, precedes the TLS handshake.
+// Based on ListenAndServeTLS from package net/http, copyright 2009, The Go
+// Authors.
+func ListenTLS(addr string, perms *SocketPerms, certs *CertStore,
+	maxConns int, keepAlivePeriod time.Duration, proxy *ProxyProtocol) (
+	net.Listener, error) {
 
-	ln, err := Listen(addr, maxConns, keepAlivePeriod)
-	if err != nil {
-		return nil, err
-	}
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	ln, err := Listen(addr, perms, maxConns, keepAlivePeriod, proxy)
 	if err != nil {
 		return nil, err
 	}
-	return newTLSListener(ln, cert), nil
+	return newTLSListener(ln, certs), nil
+}
+
+// A TLSListener is a TLS listener that selects certificates from a
+// CertStore. The certificates can be reloaded while the listener is open.
+type TLSListener struct {
+	net.Listener
+	Certs *CertStore
 }
 
 // newTLSListener returns a TLS listener with required Mozilla settings.
-func newTLSListener(ln net.Listener, cert tls.Certificate) net.Listener {
+func newTLSListener(ln net.Listener, certs *CertStore) *TLSListener {
 	config := &tls.Config{
-		NextProtos:   []string{"http/1.1"},
-		Certificates: []tls.Certificate{cert},
+		NextProtos:     []string{"http/1.1"},
+		GetCertificate: certs.GetCertificate,
 		// The following are Mozilla required TLS settings.
 		MinVersion:               tls.VersionTLS10,
 		PreferServerCipherSuites: true,
@@ -325,5 +348,5 @@ func newTLSListener(ln net.Listener, cert tls.Certificate) net.Listener {
 			tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
 			tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA},
 	}
-	return tls.NewListener(ln, config)
+	return &TLSListener{Listener: tls.NewListener(ln, config), Certs: certs}
 }
@@ -696,7 +696,7 @@ func TestNetBadTLSCipher(t *testing.T) {
 		tls.TLS_RSA_WITH_RC4_128_SHA,
 	}
 	pipe := newPipeListener()
-	tlsLn := newTLSListener(pipe, tlsConf.Certificates[0])
+	tlsLn := newTLSListener(pipe, newTestCertStore(tlsConf.Certificates...))
 	defer tlsLn.Close()
 
 	var wg sync.WaitGroup // Waits for client handshake.
@@ -740,7 +740,7 @@ func TestNetListenTLS(t *testing.T) {
 		t.Fatalf("Error initializing TLS config: %s", err)
 	}
 	pipe := newPipeListener()
-	tlsLn := newTLSListener(pipe, tlsConf.Certificates[0])
+	tlsLn := newTLSListener(pipe, newTestCertStore(tlsConf.Certificates...))
 	defer tlsLn.Close()
 
 	var wg sync.WaitGroup // Synchronizes the handler and client.
@@ -793,3 +793,22 @@ func TestNetListenTLS(t *testing.T) {
 	// Wait for the client and handler to finish.
 	wg.Wait()
 }
+
+func TestNetFormatRetryAfter(t *testing.T) {
+	tests := []struct {
+		name     string
+		delay    time.Duration
+		expected string
+	}{
+		{"Whole seconds", 2 * time.Second, "2"},
+		{"Partial seconds rounded up", 1500 * time.Millisecond, "2"},
+		{"Less than a second", 1 * time.Millisecond, "1"},
+		{"No delay", 0, "1"},
+	}
+	for _, test := range tests {
+		if actual := FormatRetryAfter(test.delay); actual != test.expected {
+			t.Errorf("On test %s, got %q; want %q", test.name, actual,
+				test.expected)
+		}
+	}
+}
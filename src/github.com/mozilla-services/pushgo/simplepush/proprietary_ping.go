@@ -29,7 +29,7 @@ var (
 	UnsupportedProtocolErr = errors.New("Unsupported Ping Request")
 	ConfigurationErr       = errors.New("Configuration Error")
 	ProtocolErr            = errors.New("A protocol error occurred. See logs for details.")
-	PingerClosedErr        = &PingerError{"Pinger closed", false}
+	PingerClosedErr        = &PingerError{"Pinger closed", false, 0}
 )
 
 var AvailablePings = make(AvailableExtensions)
@@ -51,6 +51,10 @@ func IsPingerTemporary(err error) bool {
 type PingerError struct {
 	Message   string
 	Temporary bool
+
+	// RetryAfter is the delay requested by the remote server before the
+	// next attempt, or 0 if the server did not specify one.
+	RetryAfter time.Duration
 }
 
 func (err *PingerError) Error() string {
@@ -120,6 +124,13 @@ func (ml *UDPPing) ConfigStruct() interface{} {
 	}
 }
 
+// CheckConfig validates the carrier proxy URL. Implements
+// ConfigChecker.CheckConfig().
+func (r *UDPPing) CheckConfig(config interface{}) error {
+	conf := config.(*UDPPingConfig)
+	return checkURL("url", conf.URL)
+}
+
 func (r *UDPPing) Init(app *Application, config interface{}) error {
 	r.app = app
 	r.config = config.(*UDPPingConfig)
@@ -232,6 +243,25 @@ func (r *GCMPing) ConfigStruct() interface{} {
 	}
 }
 
+// CheckConfig validates the GCM API key, URL, TTL, and retry settings.
+// Implements ConfigChecker.CheckConfig().
+func (r *GCMPing) CheckConfig(config interface{}) (err error) {
+	conf := config.(*GCMPingConfig)
+	if len(conf.APIKey) == 0 {
+		return fmt.Errorf("Missing GCM API key")
+	}
+	if err = checkURL("url", conf.URL); err != nil {
+		return err
+	}
+	if err = checkDuration("ttl", conf.TTL); err != nil {
+		return err
+	}
+	if _, err = conf.Retry.NewHelper(); err != nil {
+		return fmt.Errorf("Invalid retry settings: %s", err)
+	}
+	return nil
+}
+
 func (r *GCMPing) Init(app *Application, config interface{}) (err error) {
 	r.logger = app.Logger()
 	r.metrics = app.Metrics()
@@ -293,9 +323,8 @@ func (r *GCMPing) Register(uaid string, pingData []byte) (err error) {
 	return nil
 }
 
-func (r *GCMPing) retryAfter(header string) (ok bool) {
-	d, ok := ParseRetryAfter(header)
-	if !ok {
+func (r *GCMPing) retryAfter(d time.Duration) (ok bool) {
+	if d <= 0 {
 		return true
 	}
 	select {
@@ -307,20 +336,70 @@ func (r *GCMPing) retryAfter(header string) (ok bool) {
 }
 
 func (r *GCMPing) Send(uaid string, vers int64, data string) (ok bool, err error) {
+	body, err := r.newRequest(uaid, data)
+	if err != nil || body == nil {
+		return false, err
+	}
+	sendOnce := func() (err error) {
+		if err = r.post(body, data); err != nil {
+			pingErr, ok := err.(*PingerError)
+			if ok && !r.retryAfter(pingErr.RetryAfter) {
+				return PingerClosedErr
+			}
+		}
+		return err
+	}
+	retries, err := r.rh.RetryFunc(sendOnce)
+	r.metrics.IncrementBy("ping.gcm.retry", int64(retries))
+	if err != nil {
+		if r.logger.ShouldLog(ERROR) {
+			r.logger.Error("propping", "Failed to send GCM message",
+				LogFields{"error": err.Error(), "uaid": uaid})
+		}
+		r.metrics.Increment("ping.gcm.error")
+		return false, err
+	}
+	r.metrics.Increment("ping.gcm.success")
+	return true, nil
+}
+
+// SendOnce makes a single attempt to send a GCM message, leaving retries to
+// the caller. Temporary errors include the server's Retry-After delay, if
+// any.
+func (r *GCMPing) SendOnce(uaid string, vers int64, data string) (ok bool, err error) {
+	body, err := r.newRequest(uaid, data)
+	if err != nil || body == nil {
+		return false, err
+	}
+	if err = r.post(body, data); err != nil {
+		if r.logger.ShouldLog(WARNING) {
+			r.logger.Warn("propping", "Failed to send GCM message",
+				LogFields{"error": err.Error(), "uaid": uaid})
+		}
+		r.metrics.Increment("ping.gcm.error")
+		return false, err
+	}
+	r.metrics.Increment("ping.gcm.success")
+	return true, nil
+}
+
+// newRequest returns the encoded GCM request body for the given device. The
+// body is nil if the device does not have a GCM registration.
+func (r *GCMPing) newRequest(uaid string, data string) (body []byte, err error) {
 	pingData, err := r.store.FetchPing(uaid)
 	if err != nil {
 		if r.logger.ShouldLog(ERROR) {
 			r.logger.Error("propping", "Could not fetch GCM registration data",
 				LogFields{"error": err.Error(), "uaid": uaid})
 		}
-		return false, err
+		return nil, err
 	}
 	if len(pingData) == 0 {
 		if r.logger.ShouldLog(INFO) {
 			r.logger.Info("propping", "No GCM registration data for device",
 				LogFields{"uaid": uaid})
 		}
-		return false, nil
+		return nil, nil
 	}
 	ping := new(GCMPingData)
 	if err = json.Unmarshal(pingData, ping); err != nil {
@@ -328,14 +407,14 @@ func (r *GCMPing) Send(uaid string, vers int64, data string) (ok bool, err error
 			r.logger.Warn("propping", "Could not parse GCM registration data",
 				LogFields{"error": err.Error(), "uaid": uaid})
 		}
-		return false, err
+		return nil, err
 	}
 	if len(ping.RegID) == 0 {
 		if r.logger.ShouldLog(INFO) {
 			r.logger.Info("propping", "Missing GCM registration ID",
 				LogFields{"uaid": uaid})
 		}
-		return false, nil
+		return nil, nil
 	}
 	request := &GCMRequest{
 		// google docs lie. You MUST send the regid as an array, even if it's one
@@ -352,67 +431,56 @@ func (r *GCMPing) Send(uaid string, vers int64, data string) (ok bool, err error
 		r.logger.Debug("propping", "GCM Ping data",
 			LogFields{"connect": string(pingData)})
 	}
-	body, err := json.Marshal(request)
-	if err != nil {
+	if body, err = json.Marshal(request); err != nil {
 		if r.logger.ShouldLog(ERROR) {
 			r.logger.Error("propping", "Could not marshal GCM request",
 				LogFields{"error": err.Error(), "uaid": uaid})
 		}
-		return false, err
+		return nil, err
 	}
-	sendOnce := func() (err error) {
-		req, err := http.NewRequest("POST", r.url, bytes.NewReader(body))
-		if err != nil {
-			return err
-		}
-		req.Header.Add("Authorization", fmt.Sprintf("key=%s", r.apiKey))
-		req.Header.Add("Content-Type", "application/json")
-		if r.logger.ShouldLog(DEBUG) {
-			r.logger.Debug("propping", "#### Sending GCM update",
-				LogFields{
-					"url":           r.url,
-					"headers":       fmt.Sprintf("%+v", req.Header),
-					"authorization": fmt.Sprintf("key=%s", r.apiKey),
-					"body":          string(body),
-					"data":          string(data),
-				})
-		}
-		resp, err := r.client.Do(req)
-		if err != nil {
-			return err
-		}
-		defer resp.Body.Close()
-		// Consume the response body so the underlying TCP connection can be reused.
-		io.Copy(ioutil.Discard, resp.Body)
-		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-			if r.logger.ShouldLog(DEBUG) {
-				r.logger.Debug("propping", "Ping message sent successfully.", nil)
-			}
-			return nil
-		}
-		if resp.StatusCode >= 500 && resp.StatusCode < 600 {
-			ok := r.retryAfter(resp.Header.Get("Retry-After"))
-			if !ok {
-				return PingerClosedErr
-			}
-			return &PingerError{fmt.Sprintf(
-				"Retrying after receiving status code: %d", resp.StatusCode), true}
-		}
-		return &PingerError{fmt.Sprintf(
-			"Unexpected status code: %d", resp.StatusCode), false}
+	return body, nil
+}
+
+// post sends an encoded GCM request. 5xx responses are returned as temporary
+// errors, with the delay from the Retry-After header.
+func (r *GCMPing) post(body []byte, data string) (err error) {
+	req, err := http.NewRequest("POST", r.url, bytes.NewReader(body))
+	if err != nil {
+		return err
 	}
-	retries, err := r.rh.RetryFunc(sendOnce)
-	r.metrics.IncrementBy("ping.gcm.retry", int64(retries))
+	req.Header.Add("Authorization", fmt.Sprintf("key=%s", r.apiKey))
+	req.Header.Add("Content-Type", "application/json")
+	if r.logger.ShouldLog(DEBUG) {
+		r.logger.Debug("propping", "#### Sending GCM update",
+			LogFields{
+				"url":           r.url,
+				"headers":       fmt.Sprintf("%+v", req.Header),
+				"authorization": fmt.Sprintf("key=%s", r.apiKey),
+				"body":          string(body),
+				"data":          string(data),
+			})
+	}
+	resp, err := r.client.Do(req)
 	if err != nil {
-		if r.logger.ShouldLog(ERROR) {
-			r.logger.Error("propping", "Failed to send GCM message",
-				LogFields{"error": err.Error(), "uaid": uaid})
+		return err
+	}
+	defer resp.Body.Close()
+	// Consume the response body so the underlying TCP connection can be reused.
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		if r.logger.ShouldLog(DEBUG) {
+			r.logger.Debug("propping", "Ping message sent successfully.", nil)
 		}
-		r.metrics.Increment("ping.gcm.error")
-		return false, err
+		return nil
 	}
-	r.metrics.Increment("ping.gcm.success")
-	return true, nil
+	if resp.StatusCode >= 500 && resp.StatusCode < 600 {
+		retryAfter, _ := ParseRetryAfter(resp.Header.Get("Retry-After"))
+		return &PingerError{fmt.Sprintf(
+			"Retrying after receiving status code: %d", resp.StatusCode),
+			true, retryAfter}
+	}
+	return &PingerError{fmt.Sprintf(
+		"Unexpected status code: %d", resp.StatusCode), false, 0}
 }
 
 func (r *GCMPing) Status() (ok bool, err error) {
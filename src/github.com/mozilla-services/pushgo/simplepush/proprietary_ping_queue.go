@@ -0,0 +1,390 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mozilla-services/pushgo/retry"
+)
+
+var ErrPingQueueFull = errors.New("Proprietary ping queue full")
+
+// A PingAttempter is a PropPinger that can make a single delivery attempt,
+// leaving retries to the caller. The ping queue uses it to schedule retries
+// without blocking a worker for the backoff or Retry-After delay.
+type PingAttempter interface {
+	SendOnce(uaid string, vers int64, data string) (ok bool, err error)
+}
+
+// A PingQueueStore is a Store that can persist queued proprietary pings, so
+// that pending pings survive a restart. Pings are grouped by host.
+type PingQueueStore interface {
+	PutQueuedPing(host string, ping *QueuedPing) error
+	DropQueuedPing(host, id string) error
+	FetchQueuedPings(host string) ([]*QueuedPing, error)
+}
+
+// QueuedPing is a pending proprietary ping.
+type QueuedPing struct {
+	ID        string `json:"id"`
+	UAID      string `json:"uaid"`
+	ChannelID string `json:"chid"`
+	Version   int64  `json:"version"`
+	Data      string `json:"data,omitempty"`
+	RequestID string `json:"rid,omitempty"`
+	QueuedAt  int64  `json:"queued_at"`
+	Attempts  int    `json:"attempts"`
+}
+
+type PingQueueConfig struct {
+	// Enabled queues proprietary pings for asynchronous delivery. If
+	// disabled, pings are sent while handling the update request.
+	Enabled bool
+
+	// Workers is the number of goroutines sending queued pings.
+	Workers int
+
+	// MaxSize is the maximum number of pending pings, including pings
+	// waiting to be retried. Pings are sent synchronously if the queue is
+	// full.
+	MaxSize int `toml:"max_size" env:"max_size"`
+
+	// MaxAge is the maximum time a ping may remain in the queue before it
+	// is abandoned.
+	MaxAge string `toml:"max_age" env:"max_age"`
+
+	// Persist stores pending pings in the storage adapter. The adapter must
+	// support persistent ping queues. If disabled, pending pings are passed
+	// to Fallback when the queue is closed.
+	Persist bool
+
+	Retry retry.Config
+}
+
+// PingQueue delivers proprietary pings asynchronously, using a bounded pool
+// of workers. Temporary errors are retried with exponential backoff, or
+// after the delay requested by the remote server. Delivered pings are passed
+// to Sent; pings that cannot be delivered are passed to Fallback.
+type PingQueue struct {
+	// Sent is called with pings accepted by the proprietary service.
+	Sent func(ping *QueuedPing)
+
+	// Fallback is called with pings that could not be delivered.
+	Fallback func(ping *QueuedPing)
+
+	logger      *SimpleLogger
+	metrics     Statistician
+	pinger      PropPinger
+	store       PingQueueStore
+	host        string
+	rh          *retry.Helper
+	workers     int
+	maxSize     int
+	maxAge      time.Duration
+	items       chan *QueuedPing
+	pendingLock sync.Mutex
+	pending     map[string]*QueuedPing
+	closeOnce   Once
+	closeSignal chan bool
+	closeWait   sync.WaitGroup
+}
+
+// NewPingQueue creates a ping queue for the application's proprietary
+// pinger.
+func NewPingQueue(app *Application, conf *PingQueueConfig) (
+	q *PingQueue, err error) {
+
+	q = &PingQueue{
+		logger:      app.Logger(),
+		metrics:     app.Metrics(),
+		pinger:      app.PropPinger(),
+		host:        app.Hostname(),
+		workers:     conf.Workers,
+		maxSize:     conf.MaxSize,
+		pending:     make(map[string]*QueuedPing),
+		closeSignal: make(chan bool),
+	}
+	if q.workers < 1 {
+		q.workers = 1
+	}
+	if q.maxSize < 1 {
+		q.maxSize = 1
+	}
+	// The channel can hold every pending ping, so retries never block.
+	q.items = make(chan *QueuedPing, q.maxSize)
+	if len(conf.MaxAge) > 0 {
+		if q.maxAge, err = time.ParseDuration(conf.MaxAge); err != nil {
+			q.logger.Panic("propping", "Could not parse max ping age",
+				LogFields{"error": err.Error(), "max_age": conf.MaxAge})
+			return nil, err
+		}
+	}
+	if q.rh, err = conf.Retry.NewHelper(); err != nil {
+		q.logger.Panic("propping", "Error configuring ping queue retry helper",
+			LogFields{"error": err.Error()})
+		return nil, err
+	}
+	if conf.Persist {
+		store, ok := app.Store().(PingQueueStore)
+		if !ok {
+			q.logger.Panic("propping",
+				"Storage adapter does not support persistent ping queues", nil)
+			return nil, ConfigurationErr
+		}
+		q.store = store
+	}
+	return q, nil
+}
+
+// Start restores persisted pings and starts the workers.
+func (q *PingQueue) Start() {
+	q.restore()
+	q.closeWait.Add(q.workers + 1)
+	for i := 0; i < q.workers; i++ {
+		go q.run()
+	}
+	go q.sendStats()
+}
+
+// Enqueue adds a ping to the queue. Enqueue returns ErrPingQueueFull if the
+// queue has reached its maximum size.
+func (q *PingQueue) Enqueue(uaid, chid string, version int64, data string,
+	requestID string) (err error) {
+
+	pingID, err := idGenerate()
+	if err != nil {
+		return err
+	}
+	ping := &QueuedPing{
+		ID:        pingID,
+		UAID:      uaid,
+		ChannelID: chid,
+		Version:   version,
+		Data:      data,
+		RequestID: requestID,
+		QueuedAt:  timeNow().UnixNano(),
+	}
+	if !q.add(ping) {
+		q.metrics.Increment("ping.queue.full")
+		return ErrPingQueueFull
+	}
+	if q.store != nil {
+		if err = q.store.PutQueuedPing(q.host, ping); err != nil {
+			q.remove(ping)
+			return err
+		}
+	}
+	q.metrics.Increment("ping.queue.queued")
+	q.push(ping)
+	return nil
+}
+
+// Len returns the number of pending pings.
+func (q *PingQueue) Len() int {
+	q.pendingLock.Lock()
+	defer q.pendingLock.Unlock()
+	return len(q.pending)
+}
+
+// Age returns the time since the oldest pending ping was queued.
+func (q *PingQueue) Age() (age time.Duration) {
+	q.pendingLock.Lock()
+	defer q.pendingLock.Unlock()
+	var oldest int64
+	for _, ping := range q.pending {
+		if oldest == 0 || ping.QueuedAt < oldest {
+			oldest = ping.QueuedAt
+		}
+	}
+	if oldest == 0 {
+		return 0
+	}
+	return timeNow().Sub(time.Unix(0, oldest))
+}
+
+func (q *PingQueue) Close() error {
+	return q.closeOnce.Do(q.close)
+}
+
+func (q *PingQueue) close() error {
+	close(q.closeSignal)
+	q.closeWait.Wait()
+	if q.store != nil {
+		// Persisted pings are restored on the next start.
+		return nil
+	}
+	// The app server has already been told that these updates were accepted,
+	// so pass the undelivered pings, including pings waiting to be retried,
+	// to Fallback instead of dropping them.
+	q.pendingLock.Lock()
+	pings := make([]*QueuedPing, 0, len(q.pending))
+	for _, ping := range q.pending {
+		pings = append(pings, ping)
+	}
+	q.pendingLock.Unlock()
+	for _, ping := range pings {
+		q.finish(ping, false)
+	}
+	return nil
+}
+
+func (q *PingQueue) add(ping *QueuedPing) bool {
+	q.pendingLock.Lock()
+	defer q.pendingLock.Unlock()
+	if len(q.pending) >= q.maxSize {
+		return false
+	}
+	q.pending[ping.ID] = ping
+	return true
+}
+
+func (q *PingQueue) remove(ping *QueuedPing) {
+	q.pendingLock.Lock()
+	delete(q.pending, ping.ID)
+	q.pendingLock.Unlock()
+}
+
+func (q *PingQueue) push(ping *QueuedPing) {
+	select {
+	case <-q.closeSignal:
+	case q.items <- ping:
+	}
+}
+
+// restore queues pings persisted by a previous run.
+func (q *PingQueue) restore() {
+	if q.store == nil {
+		return
+	}
+	pings, err := q.store.FetchQueuedPings(q.host)
+	if err != nil {
+		if q.logger.ShouldLog(ERROR) {
+			q.logger.Error("propping", "Could not fetch persisted pings",
+				LogFields{"error": err.Error(), "host": q.host})
+		}
+		return
+	}
+	for _, ping := range pings {
+		if !q.add(ping) {
+			q.metrics.Increment("ping.queue.full")
+			q.finish(ping, false)
+			continue
+		}
+		q.push(ping)
+	}
+	if q.logger.ShouldLog(INFO) {
+		q.logger.Info("propping", "Restored persisted pings",
+			LogFields{"count": strconv.Itoa(len(pings)), "host": q.host})
+	}
+}
+
+func (q *PingQueue) run() {
+	defer q.closeWait.Done()
+	for {
+		select {
+		case <-q.closeSignal:
+			return
+		case ping := <-q.items:
+			q.deliver(ping)
+		}
+	}
+}
+
+func (q *PingQueue) sendStats() {
+	defer q.closeWait.Done()
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.closeSignal:
+			return
+		case <-ticker.C:
+			q.metrics.Gauge("ping.queue.depth", int64(q.Len()))
+			q.metrics.Gauge("ping.queue.age", int64(q.Age()/time.Millisecond))
+		}
+	}
+}
+
+// deliver makes a single attempt to send a ping, scheduling a retry if the
+// attempt fails with a temporary error.
+func (q *PingQueue) deliver(ping *QueuedPing) {
+	if q.maxAge > 0 && timeNow().Sub(time.Unix(0, ping.QueuedAt)) > q.maxAge {
+		if q.logger.ShouldLog(WARNING) {
+			q.logger.Warn("propping", "Abandoning expired ping", LogFields{
+				"rid":  ping.RequestID,
+				"uaid": ping.UAID,
+				"chid": ping.ChannelID})
+		}
+		q.metrics.Increment("ping.queue.expired")
+		q.finish(ping, false)
+		return
+	}
+	ping.Attempts++
+	ok, err := q.send(ping)
+	if err == nil {
+		q.finish(ping, ok)
+		return
+	}
+	if !IsPingerTemporary(err) || ping.Attempts > q.rh.Retries {
+		if q.logger.ShouldLog(WARNING) {
+			q.logger.Warn("propping", "Could not send queued ping", LogFields{
+				"rid":      ping.RequestID,
+				"uaid":     ping.UAID,
+				"chid":     ping.ChannelID,
+				"attempts": strconv.Itoa(ping.Attempts),
+				"error":    err.Error()})
+		}
+		q.metrics.Increment("ping.queue.error")
+		q.finish(ping, false)
+		return
+	}
+	delay := q.rh.RetryDelay(ping.Attempts)
+	if pingErr, ok := err.(*PingerError); ok && pingErr.RetryAfter > delay {
+		delay = pingErr.RetryAfter
+	}
+	if q.store != nil {
+		// Persist the attempt count, so that restarts don't reset it.
+		q.store.PutQueuedPing(q.host, ping)
+	}
+	q.metrics.Increment("ping.queue.retry")
+	time.AfterFunc(delay, func() { q.push(ping) })
+}
+
+func (q *PingQueue) send(ping *QueuedPing) (ok bool, err error) {
+	if attempter, isAttempter := q.pinger.(PingAttempter); isAttempter {
+		return attempter.SendOnce(ping.UAID, ping.Version, ping.Data)
+	}
+	return q.pinger.Send(ping.UAID, ping.Version, ping.Data)
+}
+
+// finish removes a ping from the queue. Undelivered pings are passed to
+// Fallback before they are removed.
+func (q *PingQueue) finish(ping *QueuedPing, delivered bool) {
+	defer q.remove(ping)
+	if q.store != nil {
+		if err := q.store.DropQueuedPing(q.host, ping.ID); err != nil &&
+			q.logger.ShouldLog(WARNING) {
+
+			q.logger.Warn("propping", "Could not drop persisted ping",
+				LogFields{"error": err.Error(), "uaid": ping.UAID})
+		}
+	}
+	if delivered {
+		q.metrics.Increment("ping.queue.sent")
+		q.metrics.Timer("ping.queue.latency",
+			timeNow().Sub(time.Unix(0, ping.QueuedAt)))
+		if q.Sent != nil {
+			q.Sent(ping)
+		}
+		return
+	}
+	if q.Fallback != nil {
+		q.Fallback(ping)
+	}
+}
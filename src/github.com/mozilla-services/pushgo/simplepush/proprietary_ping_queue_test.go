@@ -0,0 +1,143 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/mozilla-services/pushgo/retry"
+)
+
+// waitForPings waits for all pending pings to leave the queue.
+func waitForPings(q *PingQueue, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for q.Len() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return true
+}
+
+func TestPingQueue(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(false).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+
+	uaid := "deadbeef00000000000000000000"
+	chid := "decafbad00000000000000000000"
+
+	conf := &PingQueueConfig{
+		Enabled: true,
+		Workers: 2,
+		MaxSize: 2,
+		MaxAge:  "1m",
+		Retry: retry.Config{
+			Retries:   2,
+			Delay:     "1ms",
+			MaxDelay:  "10ms",
+			MaxJitter: "0",
+		},
+	}
+
+	Convey("Proprietary ping queue", t, func() {
+		mckStat := &TestMetrics{}
+		mckStat.Init(nil, nil)
+		mckPinger := NewMockPropPinger(mockCtrl)
+
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		app.SetPropPinger(mckPinger)
+
+		q, err := NewPingQueue(app, conf)
+		So(err, ShouldBeNil)
+		defer q.Close()
+
+		fallbacks := make(chan *QueuedPing, 2)
+		q.Fallback = func(ping *QueuedPing) { fallbacks <- ping }
+
+		Convey("Should send queued pings", func() {
+			mckPinger.EXPECT().Send(uaid, int64(1), "data").Return(true, nil)
+
+			q.Start()
+			So(q.Enqueue(uaid, chid, 1, "data", ""), ShouldBeNil)
+			So(waitForPings(q, 1*time.Second), ShouldBeTrue)
+			So(mckStat.Counters["ping.queue.queued"], ShouldEqual, 1)
+			So(mckStat.Counters["ping.queue.sent"], ShouldEqual, 1)
+			So(len(fallbacks), ShouldEqual, 0)
+		})
+
+		Convey("Should retry temporary errors", func() {
+			gomock.InOrder(
+				mckPinger.EXPECT().Send(uaid, int64(1), "data").Return(
+					false, &PingerError{"Service unavailable", true, 0}),
+				mckPinger.EXPECT().Send(uaid, int64(1), "data").Return(true, nil),
+			)
+
+			q.Start()
+			So(q.Enqueue(uaid, chid, 1, "data", ""), ShouldBeNil)
+			So(waitForPings(q, 1*time.Second), ShouldBeTrue)
+			So(mckStat.Counters["ping.queue.retry"], ShouldEqual, 1)
+			So(mckStat.Counters["ping.queue.sent"], ShouldEqual, 1)
+			So(len(fallbacks), ShouldEqual, 0)
+		})
+
+		Convey("Should fall back on permanent errors", func() {
+			mckPinger.EXPECT().Send(uaid, int64(1), "data").Return(
+				false, &PingerError{"Unexpected status code: 400", false, 0})
+
+			q.Start()
+			So(q.Enqueue(uaid, chid, 1, "data", "rid"), ShouldBeNil)
+			So(waitForPings(q, 1*time.Second), ShouldBeTrue)
+			So(mckStat.Counters["ping.queue.error"], ShouldEqual, 1)
+			ping := <-fallbacks
+			So(ping.UAID, ShouldEqual, uaid)
+			So(ping.ChannelID, ShouldEqual, chid)
+			So(ping.Version, ShouldEqual, 1)
+			So(ping.RequestID, ShouldEqual, "rid")
+		})
+
+		Convey("Should fall back after exhausting retries", func() {
+			mckPinger.EXPECT().Send(uaid, int64(1), "data").Return(
+				false, &PingerError{"Service unavailable", true, 0}).Times(3)
+
+			q.Start()
+			So(q.Enqueue(uaid, chid, 1, "data", ""), ShouldBeNil)
+			So(waitForPings(q, 1*time.Second), ShouldBeTrue)
+			So(mckStat.Counters["ping.queue.retry"], ShouldEqual, 2)
+			So(mckStat.Counters["ping.queue.error"], ShouldEqual, 1)
+			So(<-fallbacks, ShouldNotBeNil)
+		})
+
+		Convey("Should reject pings if the queue is full", func() {
+			// Don't start the workers, so that pings remain pending.
+			So(q.Enqueue(uaid, chid, 1, "data", ""), ShouldBeNil)
+			So(q.Enqueue(uaid, chid, 2, "data", ""), ShouldBeNil)
+			So(q.Enqueue(uaid, chid, 3, "data", ""), ShouldEqual, ErrPingQueueFull)
+			So(q.Len(), ShouldEqual, 2)
+			So(mckStat.Counters["ping.queue.full"], ShouldEqual, 1)
+		})
+
+		Convey("Should fall back on close if pings are not persisted", func() {
+			// Don't start the workers, so that the ping remains pending.
+			So(q.Enqueue(uaid, chid, 1, "data", ""), ShouldBeNil)
+			So(q.Close(), ShouldBeNil)
+			So(q.Len(), ShouldEqual, 0)
+			So(len(fallbacks), ShouldEqual, 1)
+			ping := <-fallbacks
+			So(ping.Version, ShouldEqual, 1)
+		})
+	})
+}
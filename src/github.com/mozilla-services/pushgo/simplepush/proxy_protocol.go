@@ -0,0 +1,352 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultProxyHeaderTimeout is the time allowed for a trusted peer to send a
+// PROXY protocol header.
+const DefaultProxyHeaderTimeout = 5 * time.Second
+
+const (
+	proxyV1Prefix    = "PROXY "
+	proxyV1MaxLength = 107 // Including the trailing CRLF.
+
+	proxyV2HeaderSize = 16
+	proxyV2Local      = 0x20
+	proxyV2Proxy      = 0x21
+	proxyV2TCP4       = 0x11
+	proxyV2UDP4       = 0x12
+	proxyV2TCP6       = 0x21
+	proxyV2UDP6       = 0x22
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var (
+	// ErrProxyHeader is returned when reading from a connection that did not
+	// send a valid PROXY protocol header.
+	ErrProxyHeader = errors.New("Invalid PROXY protocol header")
+
+	// ErrNoProxyHeader is returned when reading from a trusted connection
+	// that did not send a PROXY protocol header.
+	ErrNoProxyHeader = errors.New("Missing PROXY protocol header")
+)
+
+// ParseCIDRs parses a list of CIDR blocks, like "10.0.0.0/8". Bare IP
+// addresses are treated as single-address blocks.
+func ParseCIDRs(cidrs []string) (nets []*net.IPNet, err error) {
+	nets = make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if strings.IndexByte(cidr, '/') < 0 {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid IP address %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets[i] = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+			continue
+		}
+		if _, nets[i], err = net.ParseCIDR(cidr); err != nil {
+			return nil, fmt.Errorf("Invalid CIDR block %q: %s", cidr, err)
+		}
+	}
+	return nets, nil
+}
+
+// addrIP returns the IP address of addr, or nil if addr is not an IP
+// address.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	}
+	if addr == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// ProxyProtocol accepts PROXY protocol v1 and v2 headers from trusted peers,
+// like TCP load balancers, and reports the original client and server
+// addresses as the remote and local addresses of accepted connections.
+// Connections from other peers are left as-is.
+type ProxyProtocol struct {
+	// Trusted is the list of peers allowed to send PROXY headers. Trusted
+	// peers must send a header before any other data.
+	Trusted []*net.IPNet
+
+	// Timeout is the time allowed to read the header. Defaults to
+	// DefaultProxyHeaderTimeout.
+	Timeout time.Duration
+}
+
+// IsTrusted indicates whether addr is a trusted peer.
+func (p *ProxyProtocol) IsTrusted(addr net.Addr) bool {
+	ip := addrIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, block := range p.Trusted {
+		if block.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Wrap returns a connection that reads a PROXY header from c if c is a
+// trusted peer, or c unchanged otherwise. The header is read on the first
+// call to Read, RemoteAddr, or LocalAddr, so that a slow peer does not block
+// the accept loop.
+func (p *ProxyProtocol) Wrap(c net.Conn) net.Conn {
+	if !p.IsTrusted(c.RemoteAddr()) {
+		return c
+	}
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = DefaultProxyHeaderTimeout
+	}
+	return &proxyConn{Conn: c, timeout: timeout}
+}
+
+// proxyConn is a connection from a trusted peer, prefixed with a PROXY
+// protocol header.
+type proxyConn struct {
+	net.Conn
+	timeout    time.Duration
+	headerOnce sync.Once
+	remoteAddr net.Addr
+	localAddr  net.Addr
+	buffered   []byte // Data read past the end of the header.
+	err        error  // Error reading the header.
+
+	deadlineLock sync.Mutex // Protects readDeadline.
+	readDeadline time.Time  // The caller's read deadline.
+}
+
+func (c *proxyConn) readHeaderOnce() {
+	c.headerOnce.Do(c.readHeader)
+}
+
+// readHeader reads and parses the PROXY header, then restores the caller's
+// read deadline. Callers should use readHeaderOnce instead.
+func (c *proxyConn) readHeader() {
+	c.deadlineLock.Lock()
+	deadline := timeNow().Add(c.timeout)
+	if !c.readDeadline.IsZero() && c.readDeadline.Before(deadline) {
+		deadline = c.readDeadline
+	}
+	c.Conn.SetReadDeadline(deadline)
+	c.deadlineLock.Unlock()
+	defer func() {
+		c.deadlineLock.Lock()
+		c.Conn.SetReadDeadline(c.readDeadline)
+		c.deadlineLock.Unlock()
+	}()
+
+	// The v1 header is at most 107 bytes, and the v2 addresses are at most
+	// 36 bytes; a small buffer avoids holding 4 KB per idle connection.
+	r := bufio.NewReaderSize(c.Conn, 256)
+	c.remoteAddr, c.localAddr, c.err = readProxyHeader(r)
+	if n := r.Buffered(); n > 0 {
+		data, _ := r.Peek(n)
+		c.buffered = append([]byte(nil), data...)
+	}
+}
+
+// Read implements net.Conn.Read.
+func (c *proxyConn) Read(b []byte) (n int, err error) {
+	c.readHeaderOnce()
+	if c.err != nil {
+		return 0, c.err
+	}
+	if len(c.buffered) > 0 {
+		n = copy(b, c.buffered)
+		if c.buffered = c.buffered[n:]; len(c.buffered) == 0 {
+			c.buffered = nil
+		}
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// SetDeadline implements net.Conn.SetDeadline.
+func (c *proxyConn) SetDeadline(t time.Time) error {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline records the read deadline, so that it can be restored
+// after reading the header. Implements net.Conn.SetReadDeadline.
+func (c *proxyConn) SetReadDeadline(t time.Time) error {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// RemoteAddr returns the client address from the PROXY header, or the
+// peer address if the header does not include addresses. Implements
+// net.Conn.RemoteAddr.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeaderOnce()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the server address from the PROXY header, or the
+// listener address if the header does not include addresses. Implements
+// net.Conn.LocalAddr.
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.readHeaderOnce()
+	if c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+// readProxyHeader reads a v1 or v2 PROXY header from r. The returned
+// addresses are nil for health checks and unsupported address families.
+func readProxyHeader(r *bufio.Reader) (remote, local net.Addr, err error) {
+	// The shortest v1 header, "PROXY UNKNOWN\r\n", is longer than the v2
+	// signature.
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		if err == io.EOF {
+			err = ErrNoProxyHeader
+		}
+		return nil, nil, err
+	}
+	if bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if bytes.HasPrefix(sig, []byte(proxyV1Prefix)) {
+		return readProxyV1(r)
+	}
+	return nil, nil, ErrNoProxyHeader
+}
+
+// readProxyV1 reads a human-readable v1 header, like
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+func readProxyV1(r *bufio.Reader) (remote, local net.Addr, err error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		if err == bufio.ErrBufferFull {
+			err = ErrProxyHeader
+		}
+		return nil, nil, err
+	}
+	if len(line) > proxyV1MaxLength || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, ErrProxyHeader
+	}
+	parts := strings.Split(string(line[len(proxyV1Prefix):len(line)-2]), " ")
+	if parts[0] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(parts) != 5 || parts[0] != "TCP4" && parts[0] != "TCP6" {
+		return nil, nil, ErrProxyHeader
+	}
+	srcIP, dstIP := net.ParseIP(parts[1]), net.ParseIP(parts[2])
+	if srcIP == nil || dstIP == nil {
+		return nil, nil, ErrProxyHeader
+	}
+	if isV4 := parts[0] == "TCP4"; (srcIP.To4() != nil) != isV4 ||
+		(dstIP.To4() != nil) != isV4 {
+		return nil, nil, ErrProxyHeader
+	}
+	srcPort, err := parseProxyPort(parts[3])
+	if err != nil {
+		return nil, nil, err
+	}
+	dstPort, err := parseProxyPort(parts[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	return &net.TCPAddr{IP: srcIP, Port: srcPort},
+		&net.TCPAddr{IP: dstIP, Port: dstPort}, nil
+}
+
+// parseProxyPort parses a decimal port number from a v1 header. Leading
+// zeros are not allowed.
+func parseProxyPort(s string) (int, error) {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || len(s) > 1 && s[0] == '0' {
+		return 0, ErrProxyHeader
+	}
+	return int(port), nil
+}
+
+// readProxyV2 reads a binary v2 header. Type-length-value extensions are
+// skipped.
+func readProxyV2(r *bufio.Reader) (remote, local net.Addr, err error) {
+	header := make([]byte, proxyV2HeaderSize)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	command, family := header[12], header[13]
+	length := int(binary.BigEndian.Uint16(header[14:]))
+	if command != proxyV2Local && command != proxyV2Proxy {
+		return nil, nil, ErrProxyHeader
+	}
+	var addrLen int
+	switch family {
+	case proxyV2TCP4, proxyV2UDP4:
+		addrLen = 2*net.IPv4len + 4
+	case proxyV2TCP6, proxyV2UDP6:
+		addrLen = 2*net.IPv6len + 4
+	}
+	if length < addrLen {
+		return nil, nil, ErrProxyHeader
+	}
+	addrs := make([]byte, addrLen)
+	if _, err = io.ReadFull(r, addrs); err != nil {
+		return nil, nil, err
+	}
+	if _, err = r.Discard(length - addrLen); err != nil {
+		return nil, nil, err
+	}
+	if command == proxyV2Local || addrLen == 0 {
+		// Health checks from the proxy, and unsupported families, use the
+		// addresses of the underlying connection.
+		return nil, nil, nil
+	}
+	ipLen := (addrLen - 4) / 2
+	srcIP := net.IP(addrs[:ipLen])
+	dstIP := net.IP(addrs[ipLen : 2*ipLen])
+	srcPort := int(binary.BigEndian.Uint16(addrs[2*ipLen:]))
+	dstPort := int(binary.BigEndian.Uint16(addrs[2*ipLen+2:]))
+	return &net.TCPAddr{IP: srcIP, Port: srcPort},
+		&net.TCPAddr{IP: dstIP, Port: dstPort}, nil
+}
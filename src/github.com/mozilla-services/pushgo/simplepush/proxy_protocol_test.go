@@ -0,0 +1,224 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	tests := []struct {
+		cidrs    []string
+		ip       string
+		contains bool
+		ok       bool
+	}{
+		{[]string{"10.0.0.0/8"}, "10.1.2.3", true, true},
+		{[]string{"10.0.0.0/8", " 192.0.2.1"}, "192.0.2.1", true, true},
+		{[]string{"192.0.2.1"}, "192.0.2.2", false, true},
+		{[]string{"2001:db8::/32"}, "2001:db8::1", true, true},
+		{[]string{"::1"}, "::1", true, true},
+		{[]string{"10.0.0.0/33"}, "", false, false},
+		{[]string{"example.com"}, "", false, false},
+	}
+	for _, test := range tests {
+		nets, err := ParseCIDRs(test.cidrs)
+		if (err == nil) != test.ok {
+			t.Errorf("On test %v, got error %v; want ok %v", test.cidrs, err, test.ok)
+			continue
+		}
+		if !test.ok {
+			continue
+		}
+		p := &ProxyProtocol{Trusted: nets}
+		addr := &net.TCPAddr{IP: net.ParseIP(test.ip), Port: 1234}
+		if actual := p.IsTrusted(addr); actual != test.contains {
+			t.Errorf("On test %v, got %v for %s; want %v", test.cidrs, actual,
+				test.ip, test.contains)
+		}
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(command, family byte, addrs string) string {
+		return fmt.Sprintf("%s%c%c\x00%c%s", proxyV2Signature, command, family,
+			len(addrs), addrs)
+	}
+	tests := []struct {
+		name   string
+		input  string
+		remote string
+		local  string
+		err    error
+	}{
+		{"v1 TCP4", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET /",
+			"192.0.2.1:56324", "198.51.100.1:443", nil},
+		{"v1 TCP6", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\nGET /",
+			"[2001:db8::1]:56324", "[2001:db8::2]:443", nil},
+		{"v1 UNKNOWN", "PROXY UNKNOWN\r\nGET /", "", "", nil},
+		{"v1 mismatched family", "PROXY TCP4 2001:db8::1 198.51.100.1 1 2\r\n",
+			"", "", ErrProxyHeader},
+		{"v1 bad port", "PROXY TCP4 192.0.2.1 198.51.100.1 065536 443\r\n",
+			"", "", ErrProxyHeader},
+		{"v1 missing CR", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\nGET /",
+			"", "", ErrProxyHeader},
+		{"v1 too long", "PROXY " + strings.Repeat("x", 300) + "\r\n",
+			"", "", ErrProxyHeader},
+		{"v2 TCP4", v2(proxyV2Proxy, proxyV2TCP4,
+			"\xc0\x00\x02\x01\xc6\x33\x64\x01\xdc\x04\x01\xbb") + "GET /",
+			"192.0.2.1:56324", "198.51.100.1:443", nil},
+		{"v2 TCP4 with TLVs", v2(proxyV2Proxy, proxyV2TCP4,
+			"\xc0\x00\x02\x01\xc6\x33\x64\x01\xdc\x04\x01\xbb\x04\x00\x01\x00") +
+			"GET /", "192.0.2.1:56324", "198.51.100.1:443", nil},
+		{"v2 TCP6", v2(proxyV2Proxy, proxyV2TCP6,
+			"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01"+
+				"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02"+
+				"\xdc\x04\x01\xbb") + "GET /",
+			"[2001:db8::1]:56324", "[2001:db8::2]:443", nil},
+		{"v2 LOCAL", v2(proxyV2Local, 0, "") + "GET /", "", "", nil},
+		{"v2 short addresses", v2(proxyV2Proxy, proxyV2TCP4, "\xc0\x00"),
+			"", "", ErrProxyHeader},
+		{"v2 bad command", v2(0x22, proxyV2TCP4, ""), "", "", ErrProxyHeader},
+		{"No header", "GET / HTTP/1.1\r\n", "", "", ErrNoProxyHeader},
+		{"Empty", "", "", "", ErrNoProxyHeader},
+	}
+	for _, test := range tests {
+		r := bufio.NewReader(strings.NewReader(test.input))
+		remote, local, err := readProxyHeader(r)
+		if err != test.err {
+			t.Errorf("On test %s, wrong error: got %v; want %v", test.name, err, test.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if actual := fmt.Sprint(remote); remote != nil && actual != test.remote ||
+			remote == nil && len(test.remote) > 0 {
+			t.Errorf("On test %s, wrong remote address: got %v; want %s",
+				test.name, remote, test.remote)
+		}
+		if actual := fmt.Sprint(local); local != nil && actual != test.local ||
+			local == nil && len(test.local) > 0 {
+			t.Errorf("On test %s, wrong local address: got %v; want %s",
+				test.name, local, test.local)
+		}
+		if rest, _ := ioutil.ReadAll(r); string(rest) != "GET /" {
+			t.Errorf("On test %s, wrong data after header: got %q", test.name, rest)
+		}
+	}
+}
+
+func TestProxyProtocolListen(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted string
+		header  string
+		remote  string
+		status  int
+	}{
+		{"Trusted peer", "127.0.0.0/8",
+			"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n",
+			"192.0.2.1:56324", http.StatusOK},
+		{"Trusted health check", "127.0.0.0/8", "PROXY UNKNOWN\r\n",
+			"127.0.0.1", http.StatusOK},
+		{"Trusted peer without header", "127.0.0.0/8", "", "",
+			http.StatusBadRequest},
+		{"Untrusted peer", "10.0.0.0/8", "", "127.0.0.1", http.StatusOK},
+		{"Untrusted peer with header", "10.0.0.0/8",
+			"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "",
+			http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		trusted, err := ParseCIDRs([]string{test.trusted})
+		if err != nil {
+			t.Fatalf("On test %s, error parsing trusted peers: %s", test.name, err)
+		}
+		proxy := &ProxyProtocol{Trusted: trusted, Timeout: 2 * time.Second}
+		ln, err := Listen("127.0.0.1:0", nil, 10, 0, proxy)
+		if err != nil {
+			t.Fatalf("On test %s, error listening: %s", test.name, err)
+		}
+		remoteAddrs := make(chan string, 1)
+		srv := NewServeCloser(&http.Server{
+			Handler: http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+				remoteAddrs <- req.RemoteAddr
+			}),
+		})
+		go srv.Serve(ln)
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("On test %s, error dialing listener: %s", test.name, err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "%sGET / HTTP/1.1\r\nHost: example.com\r\n"+
+			"Connection: close\r\n\r\n", test.header)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		status := 0
+		if err == nil {
+			status = resp.StatusCode
+			resp.Body.Close()
+		}
+		conn.Close()
+		if status != test.status {
+			t.Errorf("On test %s, wrong status: got %d; want %d", test.name,
+				status, test.status)
+		}
+		var remoteAddr string
+		select {
+		case remoteAddr = <-remoteAddrs:
+		default:
+		}
+		if host, _, err := net.SplitHostPort(remoteAddr); err == nil &&
+			strings.IndexByte(test.remote, ':') < 0 {
+			// Ignore the ephemeral port of the local peer.
+			remoteAddr = host
+		}
+		if remoteAddr != test.remote {
+			t.Errorf("On test %s, wrong remote address: got %q; want %q",
+				test.name, remoteAddr, test.remote)
+		}
+		ln.Close()
+		srv.Close()
+	}
+}
+
+// deadlineConn records the read deadline set on a connection.
+type deadlineConn struct {
+	net.Conn
+	readDeadline time.Time
+}
+
+func (c *deadlineConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+func TestProxyConnDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := &deadlineConn{Conn: server}
+	pc := &proxyConn{Conn: conn, timeout: 5 * time.Second}
+	defer pc.Close()
+
+	deadline := time.Now().Add(1 * time.Minute)
+	pc.SetReadDeadline(deadline)
+	go fmt.Fprintf(client, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n")
+	if addr := pc.RemoteAddr().String(); addr != "192.0.2.1:56324" {
+		t.Errorf("Wrong remote address: got %q; want %q", addr, "192.0.2.1:56324")
+	}
+	// Reading the header should restore the caller's read deadline.
+	if !conn.readDeadline.Equal(deadline) {
+		t.Errorf("Wrong read deadline after reading header: got %s; want %s",
+			conn.readDeadline, deadline)
+	}
+}
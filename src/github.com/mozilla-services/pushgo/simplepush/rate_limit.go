@@ -0,0 +1,163 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"container/list"
+	"math"
+	"sync"
+	"time"
+)
+
+// DefaultMaxTrackedKeys is the default number of keys tracked by a
+// RateLimiter.
+const DefaultMaxTrackedKeys = 10000
+
+// A tokenBucket holds up to burst tokens, refilled at a fixed rate.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take refills the bucket, then removes a token if one is available. If the
+// bucket is empty, wait is the time until the next token is available.
+func (b *tokenBucket) take(rate float64, burst int, now time.Time) (
+	ok bool, wait time.Duration) {
+
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += rate * elapsed.Seconds()
+	}
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait = time.Duration(math.Ceil((1 - b.tokens) / rate * float64(time.Second)))
+	return false, wait
+}
+
+// gcraTake applies the generic cell rate algorithm, which is equivalent to a
+// token bucket, but only stores the theoretical arrival time tat of the next
+// event. If the event is allowed, next is the new arrival time to store;
+// otherwise, retryAfter is the time until the next token is available.
+func gcraTake(tat, now time.Time, rate float64, burst int) (
+	next time.Time, ok bool, retryAfter time.Duration) {
+
+	interval := time.Duration(float64(time.Second) / rate)
+	if tat.Before(now) {
+		tat = now
+	}
+	next = tat.Add(interval)
+	limit := now.Add(time.Duration(burst) * interval)
+	if next.After(limit) {
+		return tat, false, next.Sub(limit)
+	}
+	return next, true, 0
+}
+
+// lruEntry is an element of an lruCache.
+type lruEntry struct {
+	key   string
+	value interface{}
+}
+
+// lruCache is a bounded map that evicts the least recently used key when
+// full. lruCache is not safe for concurrent use.
+type lruCache struct {
+	maxKeys int
+	order   *list.List // Most recently used first.
+	keys    map[string]*list.Element
+}
+
+func newLRUCache(maxKeys int) *lruCache {
+	return &lruCache{
+		maxKeys: maxKeys,
+		order:   list.New(),
+		keys:    make(map[string]*list.Element),
+	}
+}
+
+// Get returns the value for key, marking it as recently used.
+func (c *lruCache) Get(key string) (value interface{}, ok bool) {
+	elem, ok := c.keys[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*lruEntry).value, true
+}
+
+// Add adds or replaces the value for key, evicting the least recently used
+// key if the cache is full.
+func (c *lruCache) Add(key string, value interface{}) {
+	if elem, ok := c.keys[key]; ok {
+		elem.Value.(*lruEntry).value = value
+		c.order.MoveToFront(elem)
+		return
+	}
+	if c.order.Len() >= c.maxKeys {
+		if oldest := c.order.Back(); oldest != nil {
+			delete(c.keys, oldest.Value.(*lruEntry).key)
+			c.order.Remove(oldest)
+		}
+	}
+	c.keys[key] = c.order.PushFront(&lruEntry{key, value})
+}
+
+// Len returns the number of keys in the cache.
+func (c *lruCache) Len() int { return c.order.Len() }
+
+// NewRateLimiter creates a token bucket rate limiter that allows rate
+// events per second for each key, with bursts of up to burst events. At most
+// maxKeys keys are tracked; the least recently used key is forgotten when the
+// limit is reached.
+func NewRateLimiter(rate float64, burst, maxKeys int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	if maxKeys < 1 {
+		maxKeys = DefaultMaxTrackedKeys
+	}
+	return &RateLimiter{
+		Rate:    rate,
+		Burst:   burst,
+		buckets: newLRUCache(maxKeys),
+	}
+}
+
+// A RateLimiter enforces per-key token bucket limits. A forgotten key
+// starts again with a full bucket.
+type RateLimiter struct {
+	Rate    float64
+	Burst   int
+	lock    sync.Mutex // Protects buckets.
+	buckets *lruCache
+}
+
+// Allow consumes a token for key. If no tokens are available, Allow returns
+// false and the time until the next token is available.
+func (l *RateLimiter) Allow(key string) (ok bool, retryAfter time.Duration) {
+	now := timeNow()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var bucket *tokenBucket
+	if value, ok := l.buckets.Get(key); ok {
+		bucket = value.(*tokenBucket)
+	} else {
+		bucket = &tokenBucket{tokens: float64(l.Burst), last: now}
+		l.buckets.Add(key, bucket)
+	}
+	return bucket.take(l.Rate, l.Burst, now)
+}
+
+// Tracked returns the number of tracked keys.
+func (l *RateLimiter) Tracked() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.buckets.Len()
+}
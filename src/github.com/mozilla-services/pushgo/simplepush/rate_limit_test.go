@@ -0,0 +1,108 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1257894000, 0).UTC()
+	timeNow = func() time.Time { return now }
+	defer useStdFuncs()
+
+	l := NewRateLimiter(2, 3, 2)
+	tests := []struct {
+		name       string
+		elapsed    time.Duration
+		key        string
+		ok         bool
+		retryAfter time.Duration
+	}{
+		{"First burst token", 0, "a", true, 0},
+		{"Second burst token", 0, "a", true, 0},
+		{"Third burst token", 0, "a", true, 0},
+		{"Burst exhausted", 0, "a", false, 500 * time.Millisecond},
+		{"Partial refill", 250 * time.Millisecond, "a", false, 250 * time.Millisecond},
+		{"Refilled token", 250 * time.Millisecond, "a", true, 0},
+		{"Separate key", 0, "b", true, 0},
+		{"Refill capped at burst", 1 * time.Hour, "a", true, 0},
+		{"Second token after refill", 0, "a", true, 0},
+		{"Third token after refill", 0, "a", true, 0},
+		{"Burst exhausted after refill", 0, "a", false, 500 * time.Millisecond},
+	}
+	for _, test := range tests {
+		now = now.Add(test.elapsed)
+		ok, retryAfter := l.Allow(test.key)
+		if ok != test.ok || retryAfter != test.retryAfter {
+			t.Errorf("On test %s, got %v, %s; want %v, %s", test.name, ok,
+				retryAfter, test.ok, test.retryAfter)
+		}
+	}
+
+	// Adding a third key should evict the least recently used key, "b".
+	l.Allow("c")
+	if tracked := l.Tracked(); tracked != 2 {
+		t.Errorf("Wrong number of tracked keys: got %d; want 2", tracked)
+	}
+	if _, ok := l.buckets.Get("b"); ok {
+		t.Errorf("Least recently used key not evicted")
+	}
+	if ok, _ := l.Allow("a"); ok {
+		t.Errorf("Recently used key should not be evicted")
+	}
+}
+
+func TestLRUCache(t *testing.T) {
+	c := newLRUCache(2)
+	c.Add("a", 1)
+	c.Add("b", 2)
+	c.Get("a")
+	c.Add("c", 3)
+	if _, ok := c.Get("b"); ok {
+		t.Errorf("Expected least recently used key to be evicted")
+	}
+	c.Add("a", 4)
+	if value, ok := c.Get("a"); !ok || value != 4 {
+		t.Errorf("Wrong value for replaced key: got %v, %v; want 4", value, ok)
+	}
+	if c.Len() != 2 {
+		t.Errorf("Wrong cache size: got %d; want 2", c.Len())
+	}
+}
+
+func TestGCRATake(t *testing.T) {
+	start := time.Unix(1257894000, 0).UTC()
+	tests := []struct {
+		name       string
+		tat        time.Time
+		elapsed    time.Duration
+		ok         bool
+		retryAfter time.Duration
+	}{
+		{"Empty bucket state", time.Time{}, 0, true, 0},
+		{"Second burst token", start.Add(500 * time.Millisecond), 0, true, 0},
+		{"Third burst token", start.Add(1 * time.Second), 0, true, 0},
+		{"Burst exhausted", start.Add(1500 * time.Millisecond), 0, false,
+			500 * time.Millisecond},
+		{"Partial refill", start.Add(1500 * time.Millisecond),
+			250 * time.Millisecond, false, 250 * time.Millisecond},
+		{"Refilled token", start.Add(1500 * time.Millisecond),
+			500 * time.Millisecond, true, 0},
+		{"Stale arrival time", start, 1 * time.Hour, true, 0},
+	}
+	for _, test := range tests {
+		now := start.Add(test.elapsed)
+		next, ok, retryAfter := gcraTake(test.tat, now, 2, 3)
+		if ok != test.ok || retryAfter != test.retryAfter {
+			t.Errorf("On test %s, got %v, %s; want %v, %s", test.name, ok,
+				retryAfter, test.ok, test.retryAfter)
+		}
+		if !ok && !next.Equal(test.tat) {
+			t.Errorf("On test %s, arrival time changed to %s", test.name, next)
+		}
+	}
+}
@@ -0,0 +1,561 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mozilla-services/pushgo/retry"
+)
+
+const (
+	// HeaderReceiptURL is the header app servers use to request a delivery
+	// receipt for an update.
+	HeaderReceiptURL = "X-Receipt-URL"
+
+	// HeaderReceiptSignature carries the HMAC-SHA256 signature of a receipt.
+	HeaderReceiptSignature = "X-Receipt-Signature"
+)
+
+// Receipt statuses.
+const (
+	ReceiptDelivered = "delivered"
+	ReceiptExpired   = "expired"
+)
+
+var (
+	ErrNoReceiptStore = errors.New(
+		"Storage adapter does not support delivery receipts")
+	ErrInvalidReceiptURL = errors.New("Invalid receipt URL")
+	ErrReceiptQueueFull  = errors.New("Receipt queue full")
+	ErrReceiptAddress    = errors.New(
+		"Receipt host does not resolve to a public address")
+)
+
+// restrictedReceiptNets are the address blocks receipts are never sent to,
+// unless the host is allowed: unspecified, loopback, private, shared, and
+// link-local addresses. Cloud metadata services use link-local addresses.
+var restrictedReceiptNets = func() []*net.IPNet {
+	nets, err := ParseCIDRs([]string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8",
+		"169.254.0.0/16", "172.16.0.0/12", "192.168.0.0/16",
+		"::/128", "::1/128", "fc00::/7", "fe80::/10",
+	})
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}()
+
+// A ReceiptStore is a Store that can persist receipt requests for each
+// channel.
+type ReceiptStore interface {
+	// FetchReceipt returns the receipt request for a channel, or nil if the
+	// channel does not have one.
+	FetchReceipt(suaid, schid string) (*Receipt, error)
+
+	// PutReceipt stores the receipt request for a channel.
+	PutReceipt(suaid, schid string, receipt *Receipt) error
+
+	// DropReceipt removes the receipt request for a channel.
+	DropReceipt(suaid, schid string) error
+}
+
+// Receipt is a channel's receipt request. ChannelURL is registered with the
+// channel, and applies to every update; URL applies only to the pending
+// update, and overrides ChannelURL. Version is 0 if no update is pending.
+type Receipt struct {
+	ChannelURL string `json:"channel_url,omitempty"`
+	URL        string `json:"url,omitempty"`
+	Version    int64  `json:"version,omitempty"`
+	RequestID  string `json:"rid,omitempty"`
+	Accepted   int64  `json:"accepted,omitempty"`
+}
+
+// ReceiptMessage is the body of a receipt sent to an app server.
+type ReceiptMessage struct {
+	Status    string `json:"status"`
+	ChannelID string `json:"channelID"`
+	Version   int64  `json:"version"`
+	RequestID string `json:"requestID,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type ReceiptsConfig struct {
+	// Enabled sends delivery receipts to app servers that request them. The
+	// storage adapter must support receipts.
+	Enabled bool
+
+	// Key signs receipts with HMAC-SHA256. Required if receipts are enabled.
+	Key string
+
+	// Expiry is the time after which an undelivered update is reported as
+	// expired.
+	Expiry string
+
+	// Workers is the number of goroutines sending receipts.
+	Workers int
+
+	// MaxSize is the maximum number of pending receipts, including receipts
+	// waiting to be retried.
+	MaxSize int `toml:"max_size" env:"max_size"`
+
+	// Timeout is the maximum time to wait for an app server to accept a
+	// receipt.
+	Timeout string
+
+	// AllowedHosts may receive receipts even if they resolve to private,
+	// loopback, or link-local addresses. Receipts to other hosts are only
+	// sent to public addresses.
+	AllowedHosts []string `toml:"allowed_hosts" env:"allowed_hosts"`
+
+	Retry retry.Config
+}
+
+// receiptDelivery is a receipt waiting to be sent.
+type receiptDelivery struct {
+	URL      string
+	Message  ReceiptMessage
+	Attempts int
+}
+
+// expiringReceipt tracks a receipt request for an update accepted by this
+// node, so that it can be reported as expired if the update is never
+// acknowledged.
+type expiringReceipt struct {
+	uaid     string
+	chid     string
+	version  int64
+	deadline time.Time
+}
+
+// ReceiptDispatcher sends signed delivery receipts to app servers, using a
+// bounded pool of workers. Failed requests are retried with exponential
+// backoff. Expiry is tracked in memory by the node that accepted the update,
+// so updates accepted before a restart are not reported as expired.
+type ReceiptDispatcher struct {
+	app          *Application
+	key          []byte
+	expiry       time.Duration
+	workers      int
+	maxSize      int
+	rh           *retry.Helper
+	client       *http.Client
+	allowedHosts map[string]bool
+	items        chan *receiptDelivery
+	pendingLock  sync.Mutex
+	pending      int
+	expiringLock sync.Mutex
+	expiring     map[string]*expiringReceipt
+	closeOnce    Once
+	closeSignal  chan bool
+	closeWait    sync.WaitGroup
+}
+
+// NewReceiptDispatcher creates a receipt dispatcher for the application.
+// The storage adapter is checked when it is set.
+func NewReceiptDispatcher(app *Application, conf *ReceiptsConfig) (
+	d *ReceiptDispatcher, err error) {
+
+	if len(conf.Key) == 0 {
+		return nil, fmt.Errorf("Missing receipt signing key")
+	}
+	d = &ReceiptDispatcher{
+		app:          app,
+		key:          []byte(conf.Key),
+		workers:      conf.Workers,
+		maxSize:      conf.MaxSize,
+		expiring:     make(map[string]*expiringReceipt),
+		allowedHosts: make(map[string]bool),
+		closeSignal:  make(chan bool),
+	}
+	if d.workers < 1 {
+		d.workers = 1
+	}
+	if d.maxSize < 1 {
+		d.maxSize = 1
+	}
+	// The channel can hold every pending receipt, so retries never block.
+	d.items = make(chan *receiptDelivery, d.maxSize)
+	if d.expiry, err = time.ParseDuration(conf.Expiry); err != nil {
+		return nil, fmt.Errorf("Unable to parse 'expiry': %s", err.Error())
+	}
+	timeout, err := time.ParseDuration(conf.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse 'timeout': %s", err.Error())
+	}
+	d.client = &http.Client{
+		Transport: &http.Transport{Dial: d.dial},
+		Timeout:   timeout,
+	}
+	for _, host := range conf.AllowedHosts {
+		d.allowedHosts[strings.ToLower(host)] = true
+	}
+	if d.rh, err = conf.Retry.NewHelper(); err != nil {
+		return nil, fmt.Errorf("Error configuring receipt retry helper: %s",
+			err.Error())
+	}
+	return d, nil
+}
+
+// ValidReceiptURL indicates whether a receipt URL is an absolute HTTPS URL.
+// The host address is checked when the receipt is sent.
+func ValidReceiptURL(rawurl string) bool {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return false
+	}
+	return u.Scheme == "https" && len(u.Host) > 0
+}
+
+// isRestrictedReceiptIP indicates whether ip is in a restricted address
+// block.
+func isRestrictedReceiptIP(ip net.IP) bool {
+	for _, block := range restrictedReceiptNets {
+		if block.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Start starts the workers and the expiry loop.
+func (d *ReceiptDispatcher) Start() {
+	d.closeWait.Add(d.workers + 1)
+	for i := 0; i < d.workers; i++ {
+		go d.run()
+	}
+	go d.expireLoop()
+}
+
+func (d *ReceiptDispatcher) store() ReceiptStore {
+	store, _ := d.app.Store().(ReceiptStore)
+	return store
+}
+
+// Register sets the receipt URL for all updates sent to a channel.
+func (d *ReceiptDispatcher) Register(uaid, chid, receiptURL string) error {
+	return d.store().PutReceipt(uaid, chid, &Receipt{ChannelURL: receiptURL})
+}
+
+// Unregister removes the receipt request for a channel.
+func (d *ReceiptDispatcher) Unregister(uaid, chid string) error {
+	d.untrack(uaid, chid)
+	return d.store().DropReceipt(uaid, chid)
+}
+
+// Track records a receipt request for an update accepted at the given time.
+// If receiptURL is empty, the URL registered with the channel is used; if the
+// channel does not have one, no receipt is sent.
+func (d *ReceiptDispatcher) Track(uaid, chid string, version int64,
+	accepted time.Time, receiptURL, requestID string) error {
+
+	store := d.store()
+	receipt, err := store.FetchReceipt(uaid, chid)
+	if err != nil {
+		return err
+	}
+	if receipt == nil {
+		receipt = new(Receipt)
+	}
+	if len(receiptURL) == 0 && len(receipt.ChannelURL) == 0 {
+		return nil
+	}
+	receipt.URL = receiptURL
+	receipt.Version = version
+	receipt.RequestID = requestID
+	receipt.Accepted = accepted.UnixNano()
+	if err = store.PutReceipt(uaid, chid, receipt); err != nil {
+		return err
+	}
+	d.expiringLock.Lock()
+	d.expiring[joinIDs(uaid, chid)] = &expiringReceipt{
+		uaid:     uaid,
+		chid:     chid,
+		version:  version,
+		deadline: accepted.Add(d.expiry),
+	}
+	d.expiringLock.Unlock()
+	return nil
+}
+
+// Acked sends a delivered receipt if the client acknowledged the pending
+// update for a channel.
+func (d *ReceiptDispatcher) Acked(uaid, chid string, version int64) error {
+	receipt, err := d.store().FetchReceipt(uaid, chid)
+	if err != nil || receipt == nil || receipt.Version == 0 ||
+		version < receipt.Version {
+		return err
+	}
+	d.untrack(uaid, chid)
+	return d.finish(uaid, chid, receipt, ReceiptDelivered)
+}
+
+// expire sends expired receipts for all tracked updates that have not been
+// acknowledged before their deadline.
+func (d *ReceiptDispatcher) expire(now time.Time) {
+	var expired []*expiringReceipt
+	d.expiringLock.Lock()
+	for key, item := range d.expiring {
+		if now.Before(item.deadline) {
+			continue
+		}
+		delete(d.expiring, key)
+		expired = append(expired, item)
+	}
+	d.expiringLock.Unlock()
+	for _, item := range expired {
+		receipt, err := d.store().FetchReceipt(item.uaid, item.chid)
+		if err == nil && (receipt == nil || receipt.Version != item.version) {
+			// Acknowledged on another node, or replaced by a newer update.
+			continue
+		}
+		if err == nil {
+			d.app.Metrics().Increment("receipts.expired")
+			err = d.finish(item.uaid, item.chid, receipt, ReceiptExpired)
+		}
+		if err != nil {
+			logger := d.app.Logger()
+			if logger.ShouldLog(WARNING) {
+				logger.Warn("receipts", "Could not expire receipt", LogFields{
+					"uaid": item.uaid, "chid": item.chid, "error": err.Error()})
+			}
+		}
+	}
+}
+
+// finish clears the pending update from a receipt request, and queues the
+// receipt.
+func (d *ReceiptDispatcher) finish(uaid, chid string, receipt *Receipt,
+	status string) (err error) {
+
+	receiptURL := receipt.URL
+	if len(receiptURL) == 0 {
+		receiptURL = receipt.ChannelURL
+	}
+	message := ReceiptMessage{
+		Status:    status,
+		ChannelID: chid,
+		Version:   receipt.Version,
+		RequestID: receipt.RequestID,
+		Timestamp: timeNow().Unix(),
+	}
+	store := d.store()
+	if len(receipt.ChannelURL) > 0 {
+		err = store.PutReceipt(uaid, chid, &Receipt{
+			ChannelURL: receipt.ChannelURL})
+	} else {
+		err = store.DropReceipt(uaid, chid)
+	}
+	if err != nil {
+		return err
+	}
+	return d.Enqueue(receiptURL, message)
+}
+
+func (d *ReceiptDispatcher) untrack(uaid, chid string) {
+	d.expiringLock.Lock()
+	delete(d.expiring, joinIDs(uaid, chid))
+	d.expiringLock.Unlock()
+}
+
+// Enqueue queues a receipt for delivery. Enqueue returns ErrReceiptQueueFull
+// if the queue has reached its maximum size.
+func (d *ReceiptDispatcher) Enqueue(receiptURL string,
+	message ReceiptMessage) error {
+
+	d.pendingLock.Lock()
+	if d.pending >= d.maxSize {
+		d.pendingLock.Unlock()
+		d.app.Metrics().Increment("receipts.full")
+		return ErrReceiptQueueFull
+	}
+	d.pending++
+	d.pendingLock.Unlock()
+	d.app.Metrics().Increment("receipts.queued")
+	d.push(&receiptDelivery{URL: receiptURL, Message: message})
+	return nil
+}
+
+// Len returns the number of pending receipts.
+func (d *ReceiptDispatcher) Len() int {
+	d.pendingLock.Lock()
+	defer d.pendingLock.Unlock()
+	return d.pending
+}
+
+func (d *ReceiptDispatcher) push(item *receiptDelivery) {
+	select {
+	case <-d.closeSignal:
+	case d.items <- item:
+	}
+}
+
+func (d *ReceiptDispatcher) done() {
+	d.pendingLock.Lock()
+	d.pending--
+	d.pendingLock.Unlock()
+}
+
+func (d *ReceiptDispatcher) run() {
+	defer d.closeWait.Done()
+	for {
+		select {
+		case <-d.closeSignal:
+			return
+		case item := <-d.items:
+			d.deliver(item)
+		}
+	}
+}
+
+func (d *ReceiptDispatcher) expireLoop() {
+	defer d.closeWait.Done()
+	interval := d.expiry / 10
+	if interval <= 0 || interval > 1*time.Minute {
+		interval = 1 * time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.closeSignal:
+			return
+		case <-ticker.C:
+			d.expire(timeNow())
+		}
+	}
+}
+
+// deliver makes a single attempt to send a receipt, scheduling a retry if
+// the attempt fails with a temporary error.
+func (d *ReceiptDispatcher) deliver(item *receiptDelivery) {
+	item.Attempts++
+	metrics := d.app.Metrics()
+	err := d.send(item)
+	if err == nil {
+		metrics.Increment("receipts.sent")
+		d.done()
+		return
+	}
+	if !isReceiptTemporary(err) || item.Attempts > d.rh.Retries {
+		logger := d.app.Logger()
+		if logger.ShouldLog(WARNING) {
+			logger.Warn("receipts", "Could not send receipt", LogFields{
+				"rid":      item.Message.RequestID,
+				"chid":     item.Message.ChannelID,
+				"attempts": strconv.Itoa(item.Attempts),
+				"error":    err.Error()})
+		}
+		metrics.Increment("receipts.error")
+		d.done()
+		return
+	}
+	metrics.Increment("receipts.retry")
+	time.AfterFunc(d.rh.RetryDelay(item.Attempts), func() { d.push(item) })
+}
+
+// send posts a signed receipt to the app server.
+func (d *ReceiptDispatcher) send(item *receiptDelivery) error {
+	body, err := json.Marshal(item.Message)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", item.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderReceiptSignature, "sha256="+d.Sign(body))
+	if len(item.Message.RequestID) > 0 {
+		req.Header.Set(HeaderID, item.Message.RequestID)
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return retry.StatusError(resp.StatusCode)
+	}
+	return nil
+}
+
+// dial connects to an app server. Unless the host is allowed, dial resolves
+// the host and only connects to public addresses, so that receipts can't be
+// used to reach internal services. Checking the address at dial time also
+// covers hosts that resolve to a different address after validation.
+func (d *ReceiptDispatcher) dial(netw, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if d.allowedHosts[strings.ToLower(host)] {
+		return net.DialTimeout(netw, addr, d.client.Timeout)
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if isRestrictedReceiptIP(ip) {
+			continue
+		}
+		return net.DialTimeout(netw, net.JoinHostPort(ip.String(), port),
+			d.client.Timeout)
+	}
+	return nil, ErrReceiptAddress
+}
+
+// Sign returns the hex-encoded HMAC-SHA256 signature of a receipt body.
+func (d *ReceiptDispatcher) Sign(body []byte) string {
+	mac := hmac.New(sha256.New, d.key)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// isReceiptTemporary indicates whether a failed receipt should be retried.
+// Network errors, server errors, and rate limiting are temporary; other
+// client errors and restricted addresses are not.
+func isReceiptTemporary(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	if err == ErrReceiptAddress {
+		return false
+	}
+	status, ok := err.(retry.StatusError)
+	if !ok {
+		return true
+	}
+	return status >= 500 || status == http.StatusTooManyRequests ||
+		status == http.StatusRequestTimeout
+}
+
+func (d *ReceiptDispatcher) Close() error {
+	return d.closeOnce.Do(d.close)
+}
+
+func (d *ReceiptDispatcher) close() error {
+	close(d.closeSignal)
+	d.closeWait.Wait()
+	return nil
+}
@@ -0,0 +1,326 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rafrombrc/gomock/gomock"
+
+	"github.com/mozilla-services/pushgo/retry"
+)
+
+// receiptStore adds receipt support to a mock store.
+type receiptStore struct {
+	*MockStore
+	sync.Mutex
+	receipts map[string]*Receipt
+}
+
+func (s *receiptStore) FetchReceipt(uaid, chid string) (*Receipt, error) {
+	s.Lock()
+	defer s.Unlock()
+	if r, ok := s.receipts[joinIDs(uaid, chid)]; ok {
+		receipt := *r
+		return &receipt, nil
+	}
+	return nil, nil
+}
+
+func (s *receiptStore) PutReceipt(uaid, chid string, r *Receipt) error {
+	s.Lock()
+	defer s.Unlock()
+	s.receipts[joinIDs(uaid, chid)] = r
+	return nil
+}
+
+func (s *receiptStore) DropReceipt(uaid, chid string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.receipts, joinIDs(uaid, chid))
+	return nil
+}
+
+// receiptRequest is a receipt accepted by a test receiver.
+type receiptRequest struct {
+	Signature string
+	Message   ReceiptMessage
+}
+
+// newReceiptReceiver returns a test receiver that fails the first failures
+// requests with a 500, and forwards accepted receipts to the returned channel.
+func newReceiptReceiver(t *testing.T, failures int) (
+	*httptest.Server, <-chan receiptRequest) {
+
+	var (
+		lock     sync.Mutex
+		attempts int
+	)
+	received := make(chan receiptRequest, 5)
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(resp http.ResponseWriter, req *http.Request) {
+			lock.Lock()
+			attempts++
+			fail := attempts <= failures
+			lock.Unlock()
+			if fail {
+				resp.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				t.Errorf("Error reading receipt: %s", err)
+				return
+			}
+			mac := hmac.New(sha256.New, []byte("secret"))
+			mac.Write(body)
+			signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+			if actual := req.Header.Get(HeaderReceiptSignature); actual != signature {
+				t.Errorf("Wrong receipt signature: got %q; want %q",
+					actual, signature)
+			}
+			var message ReceiptMessage
+			if err = json.Unmarshal(body, &message); err != nil {
+				t.Errorf("Error decoding receipt: %s", err)
+			}
+			received <- receiptRequest{signature, message}
+		}))
+	return srv, received
+}
+
+func newTestReceipts(t *testing.T, mockCtrl *gomock.Controller) (
+	*ReceiptDispatcher, *receiptStore) {
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(false).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+	mckStat.EXPECT().Increment(gomock.Any()).AnyTimes()
+
+	app := NewApplication()
+	app.SetLogger(mckLogger)
+	app.SetMetrics(mckStat)
+	store := &receiptStore{
+		MockStore: NewMockStore(mockCtrl),
+		receipts:  make(map[string]*Receipt),
+	}
+	app.SetStore(store)
+
+	d, err := NewReceiptDispatcher(app, &ReceiptsConfig{
+		Key:     "secret",
+		Expiry:  "1h",
+		Workers: 1,
+		MaxSize: 5,
+		Timeout: "1s",
+		// The test receivers listen on the loopback interface.
+		AllowedHosts: []string{"127.0.0.1"},
+		Retry: retry.Config{
+			Retries:   3,
+			Delay:     "1ms",
+			MaxDelay:  "5ms",
+			MaxJitter: "1ms",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error creating receipt dispatcher: %s", err)
+	}
+	return d, store
+}
+
+func waitForReceipt(t *testing.T, received <-chan receiptRequest) (
+	r receiptRequest) {
+
+	select {
+	case r = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for receipt")
+	}
+	return
+}
+
+func TestReceiptsDelivered(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	useMockFuncs()
+	defer useStdFuncs()
+
+	srv, received := newReceiptReceiver(t, 2)
+	defer srv.Close()
+
+	d, store := newTestReceipts(t, mockCtrl)
+	d.Start()
+	defer d.Close()
+
+	uaid := "fce61180716a40ed8e79bf5ff0ba34bc"
+	chid := "2b7c5c27d6224bfeaf1c158c3c57fca3"
+
+	if err := d.Register(uaid, chid, srv.URL+"/channel"); err != nil {
+		t.Fatalf("Error registering receipt URL: %s", err)
+	}
+	if err := d.Track(uaid, chid, 3, timeNow(), srv.URL+"/update", "abc"); err != nil {
+		t.Fatalf("Error tracking receipt: %s", err)
+	}
+	// Older versions should not be reported as delivered.
+	if err := d.Acked(uaid, chid, 2); err != nil {
+		t.Fatalf("Error acknowledging old version: %s", err)
+	}
+	if err := d.Acked(uaid, chid, 3); err != nil {
+		t.Fatalf("Error acknowledging update: %s", err)
+	}
+	r := waitForReceipt(t, received)
+	expected := ReceiptMessage{
+		Status:    ReceiptDelivered,
+		ChannelID: chid,
+		Version:   3,
+		RequestID: "abc",
+		Timestamp: 1257894000,
+	}
+	if r.Message != expected {
+		t.Errorf("Wrong receipt: got %#v; want %#v", r.Message, expected)
+	}
+	// The channel receipt URL should be kept for later updates.
+	receipt, _ := store.FetchReceipt(uaid, chid)
+	if receipt == nil || *receipt != (Receipt{ChannelURL: srv.URL + "/channel"}) {
+		t.Errorf("Wrong receipt request after delivery: %#v", receipt)
+	}
+	// Duplicate acknowledgements should not send another receipt.
+	if err := d.Acked(uaid, chid, 3); err != nil {
+		t.Fatalf("Error acknowledging duplicate update: %s", err)
+	}
+	select {
+	case r = <-received:
+		t.Errorf("Unexpected receipt after duplicate ack: %#v", r.Message)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestReceiptsExpired(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	useMockFuncs()
+	defer useStdFuncs()
+
+	srv, received := newReceiptReceiver(t, 0)
+	defer srv.Close()
+
+	d, store := newTestReceipts(t, mockCtrl)
+	d.Start()
+	defer d.Close()
+
+	uaid := "fce61180716a40ed8e79bf5ff0ba34bc"
+	chid := "2b7c5c27d6224bfeaf1c158c3c57fca3"
+	otherID := "6d8ad23ae4614dfd9f2d2d6e2d1bd9b7"
+
+	// Channels without a receipt URL should not be tracked.
+	if err := d.Track(uaid, otherID, 1, timeNow(), "", "def"); err != nil {
+		t.Fatalf("Error tracking update without receipt: %s", err)
+	}
+	if err := d.Track(uaid, chid, 5, timeNow(), srv.URL, "abc"); err != nil {
+		t.Fatalf("Error tracking receipt: %s", err)
+	}
+	d.expire(timeNow().Add(30 * time.Minute))
+	if n := d.Len(); n != 0 {
+		t.Errorf("Receipt expired early: %d pending", n)
+	}
+	d.expire(timeNow().Add(1 * time.Hour))
+	r := waitForReceipt(t, received)
+	expected := ReceiptMessage{
+		Status:    ReceiptExpired,
+		ChannelID: chid,
+		Version:   5,
+		RequestID: "abc",
+		Timestamp: 1257894000,
+	}
+	if r.Message != expected {
+		t.Errorf("Wrong receipt: got %#v; want %#v", r.Message, expected)
+	}
+	if receipt, _ := store.FetchReceipt(uaid, chid); receipt != nil {
+		t.Errorf("Receipt request not dropped after expiry: %#v", receipt)
+	}
+	if receipt, _ := store.FetchReceipt(uaid, otherID); receipt != nil {
+		t.Errorf("Unexpected receipt request: %#v", receipt)
+	}
+}
+
+func TestValidReceiptURL(t *testing.T) {
+	tests := []struct {
+		url   string
+		valid bool
+	}{
+		{"https://example.com/receipts", true},
+		{"https://localhost:8443", true},
+		{"http://example.com/receipts", false},
+		{"ftp://example.com/receipts", false},
+		{"/receipts", false},
+		{"https://", false},
+		{"%zz", false},
+	}
+	for _, test := range tests {
+		if valid := ValidReceiptURL(test.url); valid != test.valid {
+			t.Errorf("On test %q, got %v; want %v", test.url, valid, test.valid)
+		}
+	}
+}
+
+func TestReceiptsRestrictedAddress(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	srv, received := newReceiptReceiver(t, 0)
+	defer srv.Close()
+
+	d, _ := newTestReceipts(t, mockCtrl)
+	delete(d.allowedHosts, "127.0.0.1")
+
+	err := d.send(&receiptDelivery{URL: srv.URL, Message: ReceiptMessage{
+		Status: ReceiptDelivered, ChannelID: "2b7c5c27d6224bfeaf1c158c3c57fca3"}})
+	if err == nil {
+		t.Fatalf("Expected error sending receipt to a loopback address")
+	}
+	if isReceiptTemporary(err) {
+		t.Errorf("Restricted address error should not be retried: %s", err)
+	}
+	select {
+	case r := <-received:
+		t.Errorf("Unexpected receipt sent to a loopback address: %#v", r)
+	default:
+	}
+
+	tests := []struct {
+		ip         string
+		restricted bool
+	}{
+		{"93.184.216.34", false},
+		{"2606:2800:220:1:248:1893:25c8:1946", false},
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"0.0.0.0", true},
+		{"::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"fd00:ec2::254", true},
+		{"fe80::1", true},
+	}
+	for _, test := range tests {
+		if actual := isRestrictedReceiptIP(net.ParseIP(test.ip)); actual != test.restricted {
+			t.Errorf("On test %s, got %v; want %v", test.ip, actual,
+				test.restricted)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/bbangert/toml"
+	"github.com/kitcambridge/envconf"
+)
+
+// errTypeChanged is returned when decoding an extensible section whose type
+// differs from the running plugin's type.
+var errTypeChanged = errors.New("Plugin type changed")
+
+// A Reloader can apply settings from a changed configuration file while the
+// server is running.
+type Reloader interface {
+	// Reload applies a reloaded configuration, of the same type as the struct
+	// returned by ConfigStruct. changed lists the settings that differ from
+	// the running configuration, as dotted TOML keys. Reload returns the
+	// changed settings that it cannot apply without a restart.
+	Reload(config interface{}, changed []string) (rejected []string, err error)
+}
+
+// ReloadResult describes the settings changed by a configuration reload, as
+// "section.key" names.
+type ReloadResult struct {
+	Applied  []string // Settings applied to the running server.
+	Rejected []string // Settings that require a restart.
+}
+
+// reloadSection is a configuration section that may be reloaded.
+type reloadSection struct {
+	name       string
+	obj        HasConfigStruct
+	extensions AvailableExtensions // Plugin types, for sections with a "type".
+	optional   bool                // The section may be omitted.
+}
+
+// ReloadApplicationFromFileName re-reads the TOML configuration file and
+// applies the changed settings to a running application.
+func ReloadApplicationFromFileName(app *Application, filename string) (
+	result *ReloadResult, err error) {
+
+	var configFile ConfigFile
+	if _, err = toml.DecodeFile(filename, &configFile); err != nil {
+		return nil, fmt.Errorf("Error decoding config file: %s", err)
+	}
+	return ReloadApplication(app, configFile)
+}
+
+// ReloadApplication compares each section of configFile with the
+// configuration used to load app, and asks the corresponding plugin to apply
+// the changed settings. Plugins that do not implement Reloader reject all
+// changes to their sections. Every section is decoded before any settings
+// are applied, so a malformed file leaves the running configuration intact.
+// If a plugin fails to apply its settings, sections reloaded before it keep
+// their new settings.
+func ReloadApplication(app *Application, configFile ConfigFile) (
+	result *ReloadResult, err error) {
+
+	prevFile, env := app.config()
+	if prevFile == nil {
+		return nil, fmt.Errorf("Application was not loaded from a config file")
+	}
+	sections := app.reloadSections()
+	prevConfigs := make([]interface{}, len(sections))
+	nextConfigs := make([]interface{}, len(sections))
+	typeChanged := make([]bool, len(sections))
+	for i, section := range sections {
+		if prevConfigs[i], err = section.decode(env, prevFile); err != nil {
+			return nil, err
+		}
+		nextConfigs[i], err = section.decode(env, configFile)
+		if err == errTypeChanged {
+			typeChanged[i] = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	result = new(ReloadResult)
+	for i, section := range sections {
+		var changed, rejected []string
+		if typeChanged[i] {
+			// Replacing a plugin requires a restart.
+			rejected = []string{"type"}
+		} else if prevConfigs[i] == nil {
+			// The plugin has no configurable settings.
+			continue
+		} else {
+			changed = diffConfig("", reflect.ValueOf(prevConfigs[i]),
+				reflect.ValueOf(nextConfigs[i]))
+			if len(changed) == 0 {
+				continue
+			}
+			if reloader, ok := section.obj.(Reloader); ok {
+				if rejected, err = reloader.Reload(nextConfigs[i], changed); err != nil {
+					return result, fmt.Errorf("Error reloading section '%s': %s",
+						section.name, err)
+				}
+			} else {
+				rejected = changed
+			}
+		}
+		isRejected := make(map[string]bool, len(rejected))
+		for _, key := range rejected {
+			isRejected[key] = true
+			result.Rejected = append(result.Rejected, section.name+"."+key)
+		}
+		for _, key := range changed {
+			if !isRejected[key] {
+				result.Applied = append(result.Applied, section.name+"."+key)
+			}
+		}
+		if len(rejected) == 0 {
+			// Rejected settings are reported again on the next reload, until
+			// the server is restarted.
+			app.setSectionConfig(section.name, configFile)
+		}
+	}
+	return result, nil
+}
+
+// reloadSections returns the reloadable configuration sections, in load
+// order. Plugins that were not loaded from a config file are skipped.
+func (a *Application) reloadSections() (sections []reloadSection) {
+	add := func(name string, plugin interface{},
+		extensions AvailableExtensions, optional bool) {
+
+		if obj, ok := plugin.(HasConfigStruct); ok {
+			sections = append(sections, reloadSection{name, obj, extensions, optional})
+		}
+	}
+	add("default", a, nil, false)
+	if logger := a.Logger(); logger != nil {
+		add("logging", logger.Logger, AvailableLoggers, false)
+	}
+	add("metrics", a.Metrics(), nil, false)
+	add("storage", a.Store(), AvailableStores, false)
+	add("propping", a.PropPinger(), AvailablePings, false)
+	add("router", a.Router(), AvailableRouters, false)
+	add("discovery", a.Locator(), AvailableLocators, false)
+	add("websocket", a.SocketHandler(), nil, false)
+	add("balancer", a.Balancer(), AvailableBalancers, false)
+	add("endpoint", a.EndpointHandler(), nil, false)
+	add("profile", a.ProfileHandlers(), nil, true)
+	add("admin", a.AdminHandlers(), nil, true)
+	return sections
+}
+
+// decode decodes the section from configFile, applying environment
+// overrides. decode returns errTypeChanged if the section is extensible, and
+// its type differs from the running plugin's type.
+func (s reloadSection) decode(env envconf.Environment, configFile ConfigFile) (
+	config interface{}, err error) {
+
+	conf, ok := configFile[s.name]
+	if !ok {
+		if !s.optional {
+			return nil, fmt.Errorf("Missing section '%s'", s.name)
+		}
+		if config = s.obj.ConfigStruct(); config == nil {
+			return nil, nil
+		}
+		if err = env.Decode(toEnvName(s.name), EnvSep, config); err != nil {
+			return nil, fmt.Errorf("Invalid environment variable for section '%s': %s",
+				s.name, err)
+		}
+		return config, nil
+	}
+	if s.extensions == nil {
+		if config = s.obj.ConfigStruct(); config == nil {
+			return nil, nil
+		}
+		if err = toml.PrimitiveDecode(conf, config); err != nil {
+			return nil, fmt.Errorf("Unable to decode config for section '%s': %s",
+				s.name, err)
+		}
+		if err = env.Decode(toEnvName(s.name), EnvSep, config); err != nil {
+			return nil, fmt.Errorf("Invalid environment variable for section '%s': %s",
+				s.name, err)
+		}
+		return config, nil
+	}
+	obj, err := newExtension(s.name, s.extensions, env, conf)
+	if err != nil {
+		return nil, err
+	}
+	if reflect.TypeOf(obj) != reflect.TypeOf(s.obj) {
+		return nil, errTypeChanged
+	}
+	return LoadConfigStruct(s.name, env, conf, s.obj)
+}
+
+// diffConfig returns the names of the settings that differ between two
+// configuration structs of the same type, as dotted TOML keys.
+func diffConfig(prefix string, prev, next reflect.Value) (changed []string) {
+	for prev.Kind() == reflect.Ptr {
+		if prev.IsNil() || next.IsNil() {
+			if prev.IsNil() != next.IsNil() {
+				changed = append(changed, strings.TrimSuffix(prefix, "."))
+			}
+			return changed
+		}
+		prev, next = prev.Elem(), next.Elem()
+	}
+	if prev.Kind() != reflect.Struct {
+		if !reflect.DeepEqual(prev.Interface(), next.Interface()) {
+			changed = append(changed, strings.TrimSuffix(prefix, "."))
+		}
+		return changed
+	}
+	typ := prev.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if len(field.PkgPath) > 0 {
+			// Skip unexported fields.
+			continue
+		}
+		changed = append(changed, diffConfig(prefix+configKey(field)+".",
+			prev.Field(i), next.Field(i))...)
+	}
+	return changed
+}
+
+// liveSettings splits changed settings into those that can be applied while
+// running, and the rest. A live setting also covers the settings nested
+// within it.
+func liveSettings(changed []string, live ...string) (
+	apply map[string]bool, rejected []string) {
+
+	apply = make(map[string]bool)
+	for _, key := range changed {
+		ok := false
+		for _, name := range live {
+			if key == name || strings.HasPrefix(key, name+".") {
+				apply[name], ok = true, true
+				break
+			}
+		}
+		if !ok {
+			rejected = append(rejected, key)
+		}
+	}
+	return apply, rejected
+}
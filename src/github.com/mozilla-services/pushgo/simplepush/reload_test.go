@@ -0,0 +1,179 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bbangert/toml"
+	"github.com/kitcambridge/envconf"
+)
+
+var reloadSource = `
+[default]
+current_host = "push.services.mozilla.com"
+client_min_ping_interval = "20s"
+
+[websocket]
+origins = ["https://push.services.mozilla.com"]
+
+    [websocket.listener]
+    addr = "127.0.0.1:0"
+
+[endpoint]
+max_data_len = 256
+
+    [endpoint.listener]
+    addr = "127.0.0.1:0"
+
+[logging]
+type = "stdout"
+format = "text"
+filter = 0
+
+[metrics]
+
+[storage]
+
+[propping]
+
+[router]
+
+    [router.listener]
+    addr = "127.0.0.1:0"
+
+[discovery]
+type = "static"
+contacts = ["https://a.push.services.mozilla.com"]
+
+[balancer]
+type = "static"
+threshold = 0.5
+`
+
+func loadReloadConfig(t *testing.T, replacements ...string) (configFile ConfigFile) {
+	source := strings.NewReplacer(replacements...).Replace(reloadSource)
+	if _, err := toml.Decode(source, &configFile); err != nil {
+		t.Fatalf("Error decoding config: %s", err)
+	}
+	return configFile
+}
+
+func TestReloadApplication(t *testing.T) {
+	app, err := LoadApplication(loadReloadConfig(t), envconf.New(nil), 0)
+	if err != nil {
+		t.Fatalf("Error initializing app: %s", err)
+	}
+	defer app.Close()
+
+	result, err := ReloadApplication(app, loadReloadConfig(t))
+	if err != nil {
+		t.Fatalf("Error reloading unchanged config: %s", err)
+	}
+	if len(result.Applied) > 0 || len(result.Rejected) > 0 {
+		t.Errorf("Unexpected changes for unchanged config: %#v", result)
+	}
+
+	configFile := loadReloadConfig(t,
+		`client_min_ping_interval = "20s"`, `client_min_ping_interval = "1m"
+token_key = "W8FfY9Tw9PtMSEFJF0MAkw=="`,
+		`current_host = "push.services.mozilla.com"`, `current_host = "localhost"`,
+		`origins = ["https://push.services.mozilla.com"]`,
+		`origins = ["https://loop.services.mozilla.com"]`,
+		`max_data_len = 256`, `max_data_len = 1024`,
+		`filter = 0`, `filter = 7`,
+		`contacts = ["https://a.push.services.mozilla.com"]`,
+		`contacts = ["https://b.push.services.mozilla.com"]`,
+		`threshold = 0.5`, `threshold = 0.75`)
+	if result, err = ReloadApplication(app, configFile); err != nil {
+		t.Fatalf("Error reloading changed config: %s", err)
+	}
+	sort.Strings(result.Applied)
+	applied := []string{
+		"balancer.threshold",
+		"default.client_min_ping_interval",
+		"default.token_key",
+		"discovery.contacts",
+		"endpoint.max_data_len",
+		"logging.filter",
+		"websocket.origins",
+	}
+	if !reflect.DeepEqual(result.Applied, applied) {
+		t.Errorf("Wrong applied settings: got %#v; want %#v",
+			result.Applied, applied)
+	}
+	rejected := []string{"default.current_host"}
+	if !reflect.DeepEqual(result.Rejected, rejected) {
+		t.Errorf("Wrong rejected settings: got %#v; want %#v",
+			result.Rejected, rejected)
+	}
+
+	if d := app.ClientMinPing(); d != 1*time.Minute {
+		t.Errorf("Wrong minimum ping interval: got %s; want 1m", d)
+	}
+	if len(app.TokenKey()) != 16 {
+		t.Errorf("Token key not reloaded: got %#v", app.TokenKey())
+	}
+	if app.Hostname() != "push.services.mozilla.com" {
+		t.Errorf("Rejected hostname applied: got %q", app.Hostname())
+	}
+	if !app.Logger().ShouldLog(DEBUG) {
+		t.Errorf("Log filter not reloaded")
+	}
+	origin, _ := url.ParseRequestURI("https://loop.services.mozilla.com")
+	if sh := app.SocketHandler().(*SocketHandler); !reflect.DeepEqual(
+		sh.origins, []*url.URL{origin}) {
+
+		t.Errorf("Wrong origins: got %#v", sh.origins)
+	}
+	if n := app.EndpointHandler().(*EndpointHandler).MaxDataLen(); n != 1024 {
+		t.Errorf("Wrong maximum data size: got %d; want 1024", n)
+	}
+	contacts, _ := app.Locator().Contacts("")
+	if !reflect.DeepEqual(contacts, []string{"https://b.push.services.mozilla.com"}) {
+		t.Errorf("Wrong contacts: got %#v", contacts)
+	}
+	if b := app.Balancer().(*StaticBalancer); b.threshold != 0.75 {
+		t.Errorf("Wrong balancer threshold: got %f; want 0.75", b.threshold)
+	}
+
+	// Changing the listener address or a plugin type requires a restart.
+	configFile = loadReloadConfig(t,
+		`addr = "127.0.0.1:0"`, `addr = "127.0.0.1:8080"`,
+		`type = "static"`, `type = "etcd"`)
+	if result, err = ReloadApplication(app, configFile); err != nil {
+		t.Fatalf("Error reloading config: %s", err)
+	}
+	for _, key := range []string{
+		"websocket.listener.addr",
+		"endpoint.listener.addr",
+		"router.listener.addr",
+		"discovery.type",
+		"balancer.type",
+	} {
+		found := false
+		for _, name := range result.Rejected {
+			if name == key {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("Setting %q not rejected: got %#v", key, result.Rejected)
+		}
+	}
+
+	// Invalid settings should not be applied.
+	configFile = loadReloadConfig(t,
+		`client_min_ping_interval = "20s"`, `client_min_ping_interval = "soon"`)
+	if _, err = ReloadApplication(app, configFile); err == nil {
+		t.Errorf("Reloaded invalid ping interval")
+	}
+}
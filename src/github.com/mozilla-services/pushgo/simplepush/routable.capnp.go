@@ -9,9 +9,9 @@ import (
 
 type Routable C.Struct
 
-func NewRoutable(s *C.Segment) Routable      { return Routable(s.NewStruct(16, 2)) }
-func NewRootRoutable(s *C.Segment) Routable  { return Routable(s.NewRootStruct(16, 2)) }
-func AutoNewRoutable(s *C.Segment) Routable  { return Routable(s.NewStructAR(16, 2)) }
+func NewRoutable(s *C.Segment) Routable      { return Routable(s.NewStruct(16, 3)) }
+func NewRootRoutable(s *C.Segment) Routable  { return Routable(s.NewRootStruct(16, 3)) }
+func AutoNewRoutable(s *C.Segment) Routable  { return Routable(s.NewStructAR(16, 3)) }
 func ReadRootRoutable(s *C.Segment) Routable { return Routable(s.Root(0).ToStruct()) }
 func (s Routable) ChannelID() string         { return C.Struct(s).GetObject(0).ToText() }
 func (s Routable) SetChannelID(v string)     { C.Struct(s).SetObject(0, s.Segment.NewText(v)) }
@@ -21,6 +21,8 @@ func (s Routable) Time() int64               { return int64(C.Struct(s).Get64(8)
 func (s Routable) SetTime(v int64)           { C.Struct(s).Set64(8, uint64(v)) }
 func (s Routable) Data() string              { return C.Struct(s).GetObject(1).ToText() }
 func (s Routable) SetData(v string)          { C.Struct(s).SetObject(1, s.Segment.NewText(v)) }
+func (s Routable) TraceParent() string       { return C.Struct(s).GetObject(2).ToText() }
+func (s Routable) SetTraceParent(v string)   { C.Struct(s).SetObject(2, s.Segment.NewText(v)) }
 
 // capn.JSON_enabled == false so we stub MarshallJSON().
 func (s Routable) MarshalJSON() (bs []byte, err error) { return }
@@ -28,7 +30,7 @@ func (s Routable) MarshalJSON() (bs []byte, err error) { return }
 type Routable_List C.PointerList
 
 func NewRoutableList(s *C.Segment, sz int) Routable_List {
-	return Routable_List(s.NewCompositeList(16, 2, sz))
+	return Routable_List(s.NewCompositeList(16, 3, sz))
 }
 func (s Routable_List) Len() int          { return C.PointerList(s).Len() }
 func (s Routable_List) At(i int) Routable { return Routable(C.PointerList(s).At(i).ToStruct()) }
@@ -31,9 +31,10 @@ type Router interface {
 	// Close down the router
 	Close() error
 
-	// Route a notification
+	// Route a notification. span is the update's trace span, or nil if the
+	// update is not traced.
 	Route(cancelSignal <-chan bool, uaid, chid string, version int64,
-		sentAt time.Time, logID string, data string) (bool, error)
+		sentAt time.Time, logID string, data string, span *Span) (bool, error)
 
 	// Register handling for a uaid, this func may be called concurrently
 	Register(uaid string) error
@@ -106,6 +106,22 @@ func (*BroadcastRouter) ConfigStruct() interface{} {
 	}
 }
 
+// CheckConfig validates the client timeouts and listener settings.
+// Implements ConfigChecker.CheckConfig().
+func (r *BroadcastRouter) CheckConfig(config interface{}) (err error) {
+	conf := config.(*BroadcastRouterConfig)
+	if err = checkDuration("ctimeout", conf.Ctimeout); err != nil {
+		return err
+	}
+	if err = checkDuration("rwtimeout", conf.Rwtimeout); err != nil {
+		return err
+	}
+	if err = conf.Listener.Check(); err != nil {
+		return fmt.Errorf("Invalid routing listener: %s", err)
+	}
+	return nil
+}
+
 func (r *BroadcastRouter) Init(app *Application, config interface{}) (err error) {
 	conf := config.(*BroadcastRouterConfig)
 
@@ -238,12 +254,14 @@ func (r *BroadcastRouter) RouteHandler(resp http.ResponseWriter, req *http.Reque
 	var (
 		routable   Routable
 		chid, data string
+		span       *Span
 	)
 	segment, err := capn.ReadFromStream(req.Body, nil)
 	if err != nil {
 		if logWarning {
 			r.logger.Warn("router", "Could not read update body",
-				LogFields{"rid": req.Header.Get(HeaderID), "error": err.Error()})
+				LogFields{"rid": req.Header.Get(HeaderID), "uaid": uaid,
+					"error": err.Error()})
 		}
 		goto invalidBody
 	}
@@ -257,6 +275,11 @@ func (r *BroadcastRouter) RouteHandler(resp http.ResponseWriter, req *http.Reque
 		goto invalidBody
 	}
 	r.metrics.Increment("updates.routed.incoming")
+	span = r.app.Tracer().StartSpanFromHeader("router.receive",
+		routable.TraceParent())
+	span.SetAttribute("rid", req.Header.Get(HeaderID))
+	span.SetAttribute("uaid", uaid)
+	span.SetAttribute("chid", chid)
 	// Never trust external data
 	data = routable.Data()
 	if len(data) > r.maxDataLen {
@@ -268,10 +291,14 @@ func (r *BroadcastRouter) RouteHandler(resp http.ResponseWriter, req *http.Reque
 		data = data[:r.maxDataLen]
 	}
 	// routed data is already in storage.
-	if err = worker.Send(chid, routable.Version(), data); err != nil {
+	err = worker.Send(chid, routable.Version(), data,
+		time.Unix(0, routable.Time()), DeliveryRouted, span)
+	span.Finish(err)
+	if err != nil {
 		if logWarning {
 			r.logger.Warn("router", "Could not update local user",
-				LogFields{"rid": req.Header.Get(HeaderID), "error": err.Error()})
+				LogFields{"rid": req.Header.Get(HeaderID), "uaid": uaid,
+					"error": err.Error()})
 		}
 		http.Error(resp, "Server Error", http.StatusInternalServerError)
 		r.metrics.Increment("updates.routed.error")
@@ -351,9 +378,14 @@ func (r *BroadcastRouter) close() (err error) {
 
 // Route routes an update packet to the correct server.
 func (r *BroadcastRouter) Route(cancelSignal <-chan bool, uaid, chid string,
-	version int64, sentAt time.Time, logID string, data string) (
+	version int64, sentAt time.Time, logID string, data string, span *Span) (
 	delivered bool, err error) {
 
+	routeSpan := span.Child("router.route")
+	defer func() {
+		routeSpan.SetAttribute("delivered", strconv.FormatBool(delivered))
+		routeSpan.Finish(err)
+	}()
 	locator := r.app.Locator()
 	if locator == nil {
 		if r.logger.ShouldLog(ERROR) {
@@ -369,18 +401,24 @@ func (r *BroadcastRouter) Route(cancelSignal <-chan bool, uaid, chid string,
 	routable.SetVersion(version)
 	routable.SetTime(sentAt.UnixNano())
 	routable.SetData(data)
+	// Propagate the trace context to the contact.
+	traceParent := routeSpan.TraceParent()
+	routable.SetTraceParent(traceParent)
+	locateSpan := routeSpan.Child("locator.contacts")
 	contacts, err := locator.Contacts(uaid)
+	locateSpan.Finish(err)
 	if err != nil {
 		if r.logger.ShouldLog(CRITICAL) {
 			r.logger.Critical("router", "Could not query discovery service for contacts",
-				LogFields{"rid": logID, "error": err.Error()})
+				LogFields{"rid": logID, "uaid": uaid, "error": err.Error()})
 		}
 		r.metrics.Increment("router.broadcast.error")
 		return false, err
 	}
 	if r.logger.ShouldLog(DEBUG) {
 		r.logger.Debug("router", "Fetched contact list from discovery service",
-			LogFields{"rid": logID, "servers": strings.Join(contacts, ", ")})
+			LogFields{"rid": logID, "uaid": uaid,
+				"servers": strings.Join(contacts, ", ")})
 	}
 	if r.logger.ShouldLog(INFO) {
 		r.logger.Info("router", "Sending push...", LogFields{
@@ -391,11 +429,12 @@ func (r *BroadcastRouter) Route(cancelSignal <-chan bool, uaid, chid string,
 			"data":    data,
 			"time":    strconv.FormatInt(sentAt.UnixNano(), 10)})
 	}
-	delivered, err = r.notifyAll(cancelSignal, contacts, uaid, segment, logID)
+	delivered, err = r.notifyAll(cancelSignal, contacts, uaid, segment, logID,
+		traceParent)
 	if err != nil {
 		if r.logger.ShouldLog(WARNING) {
 			r.logger.Warn("router", "Could not post to server",
-				LogFields{"rid": logID, "error": err.Error()})
+				LogFields{"rid": logID, "uaid": uaid, "error": err.Error()})
 		}
 		r.metrics.Increment("router.broadcast.error")
 		return false, err
@@ -406,7 +445,8 @@ func (r *BroadcastRouter) Route(cancelSignal <-chan bool, uaid, chid string,
 // notifyAll partitions a slice of contacts into buckets, then broadcasts an
 // update to each bucket.
 func (r *BroadcastRouter) notifyAll(cancelSignal <-chan bool, contacts []string,
-	uaid string, segment *capn.Segment, logID string) (delivered bool, err error) {
+	uaid string, segment *capn.Segment, logID string, traceParent string) (
+	delivered bool, err error) {
 
 	for fromIndex := 0; !delivered && fromIndex < len(contacts); {
 		toIndex := fromIndex + r.bucketSize
@@ -414,7 +454,7 @@ func (r *BroadcastRouter) notifyAll(cancelSignal <-chan bool, contacts []string,
 			toIndex = len(contacts)
 		}
 		if delivered, err = r.notifyBucket(cancelSignal, contacts[fromIndex:toIndex],
-			uaid, segment, logID); err != nil {
+			uaid, segment, logID, traceParent); err != nil {
 			break
 		}
 		fromIndex += toIndex
@@ -425,14 +465,14 @@ func (r *BroadcastRouter) notifyAll(cancelSignal <-chan bool, contacts []string,
 // notifyBucket routes a message to all contacts in a bucket, returning as soon
 // as a contact accepts the update.
 func (r *BroadcastRouter) notifyBucket(cancelSignal <-chan bool,
-	contacts []string, uaid string, segment *capn.Segment, logID string) (
-	delivered bool, err error) {
+	contacts []string, uaid string, segment *capn.Segment, logID string,
+	traceParent string) (delivered bool, err error) {
 
 	timeout := r.ctimeout + r.rwtimeout + 1*time.Second
 	deliveries := make(chan bool, len(contacts))
 	for _, contact := range contacts {
 		url := fmt.Sprintf("%s/route/%s", contact, uaid)
-		go r.notifyContact(deliveries, url, segment, logID)
+		go r.notifyContact(deliveries, url, uaid, segment, logID, traceParent)
 	}
 	timer := time.After(timeout)
 	for i := 0; !delivered && i < cap(deliveries); i++ {
@@ -449,7 +489,7 @@ func (r *BroadcastRouter) notifyBucket(cancelSignal <-chan bool,
 
 // notifyContact routes a message to a single contact.
 func (r *BroadcastRouter) notifyContact(deliveries chan<- bool, url string,
-	segment *capn.Segment, logID string) {
+	uaid string, segment *capn.Segment, logID string, traceParent string) {
 
 	buf := bytes.Buffer{}
 	segment.WriteTo(&buf)
@@ -457,22 +497,25 @@ func (r *BroadcastRouter) notifyContact(deliveries chan<- bool, url string,
 	if err != nil {
 		if r.logger.ShouldLog(ERROR) {
 			r.logger.Error("router", "Router request failed",
-				LogFields{"rid": logID, "error": err.Error()})
+				LogFields{"rid": logID, "uaid": uaid, "error": err.Error()})
 		}
 		deliveries <- false
 		return
 	}
 	req.Header.Set(HeaderID, logID)
+	if len(traceParent) > 0 {
+		req.Header.Set(HeaderTraceParent, traceParent)
+	}
 	if r.logger.ShouldLog(DEBUG) {
 		r.logger.Debug("router", "Sending request",
-			LogFields{"rid": logID, "url": url})
+			LogFields{"rid": logID, "uaid": uaid, "url": url})
 	}
 	req.Header.Add("Content-Type", "application/json")
 	resp, err := r.rclient.Do(req)
 	if err != nil {
 		if r.logger.ShouldLog(ERROR) {
 			r.logger.Error("router", "Router send failed",
-				LogFields{"rid": logID, "error": err.Error()})
+				LogFields{"rid": logID, "uaid": uaid, "error": err.Error()})
 		}
 		deliveries <- false
 		return
@@ -484,14 +527,14 @@ func (r *BroadcastRouter) notifyContact(deliveries chan<- bool, url string,
 	if resp.StatusCode != 200 {
 		if r.logger.ShouldLog(DEBUG) {
 			r.logger.Debug("router", "Denied",
-				LogFields{"rid": logID, "url": url})
+				LogFields{"rid": logID, "uaid": uaid, "url": url})
 		}
 		deliveries <- false
 		return
 	}
 	if r.logger.ShouldLog(INFO) {
 		r.logger.Info("router", "Server accepted",
-			LogFields{"rid": logID, "url": url})
+			LogFields{"rid": logID, "uaid": uaid, "url": url})
 	}
 	deliveries <- true
 }
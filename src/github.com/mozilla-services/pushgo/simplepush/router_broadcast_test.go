@@ -70,7 +70,7 @@ func TestBroadcastRouter(t *testing.T) {
 		mckStat.EXPECT().Increment("router.dial.success").AnyTimes()
 		mckStat.EXPECT().Increment("router.dial.error").AnyTimes()
 		delivered, err := router.Route(cancelSignal, uaid, chid, version, sentAt,
-			"", "")
+			"", "", nil)
 		So(err, ShouldBeNil)
 		So(delivered, ShouldBeFalse)
 	})
@@ -85,7 +85,7 @@ func TestBroadcastRouter(t *testing.T) {
 		mckStat.EXPECT().Increment("router.dial.error").AnyTimes()
 		mckStat.EXPECT().Increment("router.broadcast.error").Times(1)
 		delivered, err := router.Route(cancelSignal, uaid, chid, version, sentAt,
-			"", "")
+			"", "", nil)
 		So(err, ShouldEqual, myErr)
 		So(delivered, ShouldBeFalse)
 	})
@@ -102,14 +102,15 @@ func TestBroadcastRouter(t *testing.T) {
 		mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
 		mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
 			gomock.Any()).AnyTimes()
-		mockWorker.EXPECT().Send(chid, version, "").Return(nil)
+		mockWorker.EXPECT().Send(chid, version, "", gomock.Any(),
+			DeliveryRouted, gomock.Any()).Return(nil)
 		mckStat.EXPECT().Gauge("update.client.connections", gomock.Any()).AnyTimes()
 		mckStat.EXPECT().Increment("updates.routed.received")
 		mckStat.EXPECT().Increment("router.dial.success").AnyTimes()
 		mckStat.EXPECT().Increment("router.dial.error").AnyTimes()
 
 		delivered, err := router.Route(cancelSignal, uaid, chid, version, sentAt,
-			"", "")
+			"", "", nil)
 		So(err, ShouldBeNil)
 		So(delivered, ShouldBeTrue)
 	})
@@ -178,9 +179,10 @@ func BenchmarkRouter(b *testing.B) {
 		mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
 		mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
 			gomock.Any()).AnyTimes()
-		mockWorker.EXPECT().Send(chid, version, "").Return(nil)
+		mockWorker.EXPECT().Send(chid, version, "", gomock.Any(),
+			DeliveryRouted, gomock.Any()).Return(nil)
 
-		router.Route(cancelSignal, uaid, chid, version, sentAt, "", "")
+		router.Route(cancelSignal, uaid, chid, version, sentAt, "", "", nil)
 	}
 
 	mckLocator.EXPECT().Close()
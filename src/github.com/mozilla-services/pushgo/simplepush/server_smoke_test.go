@@ -193,6 +193,13 @@ func (t *TestServer) load() (*Application, error) {
 			}
 			return ph, nil
 		},
+		PluginAdmin: func(app *Application) (HasConfigStruct, error) {
+			ah := NewAdminHandlers()
+			if err := ah.Init(app, ah.ConfigStruct()); err != nil {
+				return nil, fmt.Errorf("Error initializing admin handlers: %s", err)
+			}
+			return ah, nil
+		},
 	}
 	return loaders.Load(int(t.LogLevel))
 }
@@ -0,0 +1,237 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Listener address prefixes. Addresses without a prefix are TCP addresses.
+const (
+	// UnixAddrPrefix precedes the path of a Unix domain socket, like
+	// "unix:/run/pushgo/endpoint.sock". Paths starting with "@" are Linux
+	// abstract sockets.
+	UnixAddrPrefix = "unix:"
+
+	// SystemdAddrPrefix precedes the name or index of a socket passed by
+	// systemd socket activation, like "systemd:endpoint" or "systemd:1". The
+	// name is set by the FileDescriptorName= option of the socket unit.
+	// "systemd:" alone selects the first socket.
+	SystemdAddrPrefix = "systemd:"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd.
+var listenFDsStart = 3
+
+// systemdSockets holds the sockets passed by systemd. Each socket may only be
+// used by one listener.
+var systemdSockets struct {
+	sync.Mutex
+	loaded bool
+	files  []*os.File // Nil once claimed by a listener.
+	names  []string
+}
+
+// SocketPerms sets the permissions of a Unix domain socket. A zero Mode
+// keeps the mode set by the umask; a negative UID or GID keeps the owner or
+// group.
+type SocketPerms struct {
+	Mode os.FileMode
+	UID  int
+	GID  int
+}
+
+// ParseSocketPerms parses a socket mode, like "0660", and an owner, like
+// "pushgo" or "pushgo:www-data". Users and groups may be names or numeric
+// IDs. Empty values keep the defaults.
+func ParseSocketPerms(mode, owner string) (perms *SocketPerms, err error) {
+	perms = &SocketPerms{UID: -1, GID: -1}
+	if len(mode) > 0 {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || m > 0777 {
+			return nil, fmt.Errorf("Invalid socket mode %q", mode)
+		}
+		perms.Mode = os.FileMode(m)
+	}
+	if len(owner) == 0 {
+		return perms, nil
+	}
+	userName, groupName := owner, ""
+	if i := strings.IndexByte(owner, ':'); i >= 0 {
+		userName, groupName = owner[:i], owner[i+1:]
+	}
+	if len(userName) > 0 {
+		if perms.UID, err = lookupID(userName, false); err != nil {
+			return nil, err
+		}
+	}
+	if len(groupName) > 0 {
+		if perms.GID, err = lookupID(groupName, true); err != nil {
+			return nil, err
+		}
+	}
+	return perms, nil
+}
+
+// lookupID returns the numeric ID of a user or group name.
+func lookupID(name string, isGroup bool) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	var id string
+	if isGroup {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return -1, fmt.Errorf("Unknown socket group %q: %s", name, err)
+		}
+		id = g.Gid
+	} else {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return -1, fmt.Errorf("Unknown socket owner %q: %s", name, err)
+		}
+		id = u.Uid
+	}
+	return strconv.Atoi(id)
+}
+
+// Bind opens a listener for a TCP, "unix:", or "systemd:" address. perms, if
+// non-nil, sets the permissions of Unix domain sockets.
+func Bind(addr string, perms *SocketPerms) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(addr, UnixAddrPrefix):
+		return listenUnix(addr[len(UnixAddrPrefix):], perms)
+	case strings.HasPrefix(addr, SystemdAddrPrefix):
+		return systemdListener(addr[len(SystemdAddrPrefix):])
+	}
+	return net.Listen("tcp", addr)
+}
+
+// listenUnix listens on a Unix domain socket, replacing a stale socket file
+// left by a previous process.
+func listenUnix(path string, perms *SocketPerms) (ln net.Listener, err error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("Missing Unix socket path")
+	}
+	isAbstract := path[0] == '@'
+	if !isAbstract {
+		if err = removeStaleSocket(path); err != nil {
+			return nil, err
+		}
+	}
+	if ln, err = net.Listen("unix", path); err != nil {
+		return nil, err
+	}
+	if isAbstract || perms == nil {
+		return ln, nil
+	}
+	if perms.Mode != 0 {
+		if err = os.Chmod(path, perms.Mode); err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("Error setting socket mode: %s", err)
+		}
+	}
+	if perms.UID >= 0 || perms.GID >= 0 {
+		if err = os.Chown(path, perms.UID, perms.GID); err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("Error setting socket owner: %s", err)
+		}
+	}
+	return ln, nil
+}
+
+// removeStaleSocket removes the socket file at path if no process is
+// listening on it.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("File %q exists and is not a socket", path)
+	}
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return fmt.Errorf("Socket %q is already in use", path)
+	}
+	return os.Remove(path)
+}
+
+// loadSystemdSockets reads the sockets passed by systemd, as described in
+// sd_listen_fds(3). Callers must hold the systemdSockets lock.
+func loadSystemdSockets() {
+	if systemdSockets.loaded {
+		return
+	}
+	systemdSockets.loaded = true
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != osGetPid() {
+		// The sockets were passed to a different process.
+		return
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return
+	}
+	var names []string
+	if fdNames := os.Getenv("LISTEN_FDNAMES"); len(fdNames) > 0 {
+		names = strings.Split(fdNames, ":")
+	}
+	systemdSockets.files = make([]*os.File, count)
+	systemdSockets.names = make([]string, count)
+	for i := 0; i < count; i++ {
+		name := "unknown"
+		if i < len(names) {
+			name = names[i]
+		}
+		systemdSockets.files[i] = os.NewFile(uintptr(listenFDsStart+i), name)
+		systemdSockets.names[i] = name
+	}
+}
+
+// systemdListener returns a listener for the systemd socket with the given
+// name or index.
+func systemdListener(name string) (net.Listener, error) {
+	systemdSockets.Lock()
+	defer systemdSockets.Unlock()
+	loadSystemdSockets()
+	index := -1
+	if len(name) == 0 {
+		index = 0
+	} else if n, err := strconv.Atoi(name); err == nil {
+		index = n
+	} else {
+		for i, socketName := range systemdSockets.names {
+			if socketName == name {
+				index = i
+				break
+			}
+		}
+	}
+	if index < 0 || index >= len(systemdSockets.files) {
+		return nil, fmt.Errorf("No systemd socket %q", name)
+	}
+	f := systemdSockets.files[index]
+	if f == nil {
+		return nil, fmt.Errorf("Systemd socket %q is already in use", name)
+	}
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("Error using systemd socket %q: %s", name, err)
+	}
+	// FileListener duplicates the descriptor.
+	f.Close()
+	systemdSockets.files[index] = nil
+	return ln, nil
+}
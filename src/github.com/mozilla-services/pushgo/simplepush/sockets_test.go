@@ -0,0 +1,167 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestParseSocketPerms(t *testing.T) {
+	tests := []struct {
+		name, mode, owner string
+		expected          *SocketPerms
+	}{
+		{"Defaults", "", "", &SocketPerms{0, -1, -1}},
+		{"Octal mode", "0660", "", &SocketPerms{0660, -1, -1}},
+		{"Numeric owner", "", "1000", &SocketPerms{0, 1000, -1}},
+		{"Numeric owner and group", "600", "1000:33", &SocketPerms{0600, 1000, 33}},
+		{"Group only", "", ":33", &SocketPerms{0, -1, 33}},
+		{"Invalid mode", "rw-rw----", "", nil},
+		{"Mode out of range", "1777", "", nil},
+		{"Unknown owner", "", "pushgo-no-such-user", nil},
+	}
+	for _, test := range tests {
+		actual, err := ParseSocketPerms(test.mode, test.owner)
+		if test.expected == nil {
+			if err == nil {
+				t.Errorf("On test %s, got %#v; want error", test.name, actual)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("On test %s, got error %s", test.name, err)
+			continue
+		}
+		if *actual != *test.expected {
+			t.Errorf("On test %s, got %#v; want %#v", test.name, actual,
+				test.expected)
+		}
+	}
+}
+
+func TestBindUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushgo-sockets")
+	if err != nil {
+		t.Fatalf("Error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "endpoint.sock")
+
+	ln, err := Bind(UnixAddrPrefix+path, &SocketPerms{0600, -1, -1})
+	if err != nil {
+		t.Fatalf("Error listening on Unix socket: %s", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Error reading socket permissions: %s", err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("Wrong socket mode: got %o; want 600", mode)
+	}
+	if _, err = Bind(UnixAddrPrefix+path, nil); err == nil {
+		t.Errorf("Expected error binding a socket in use")
+	}
+	ln.Close()
+
+	// Replace a socket file left by a previous process.
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatalf("Error creating stale socket: %s", err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+	if ln, err = Bind(UnixAddrPrefix+path, nil); err != nil {
+		t.Fatalf("Error replacing stale socket: %s", err)
+	}
+	ln.Close()
+
+	// Refuse to replace other files.
+	filePath := filepath.Join(dir, "file")
+	if err = ioutil.WriteFile(filePath, nil, 0644); err != nil {
+		t.Fatalf("Error writing file: %s", err)
+	}
+	if _, err = Bind(UnixAddrPrefix+filePath, nil); err == nil {
+		t.Errorf("Expected error replacing a regular file")
+	}
+	if _, err = Bind(UnixAddrPrefix, nil); err == nil {
+		t.Errorf("Expected error for missing socket path")
+	}
+}
+
+func TestBindSystemd(t *testing.T) {
+	defer useStdFuncs()
+
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening on TCP socket: %s", err)
+	}
+	defer tcpLn.Close()
+	f, err := tcpLn.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("Error duplicating TCP socket: %s", err)
+	}
+	// Pass a raw descriptor as the only systemd socket, so that it is only
+	// closed by the inherited listener.
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatalf("Error duplicating TCP socket: %s", err)
+	}
+
+	prevStart := listenFDsStart
+	listenFDsStart = fd
+	osGetPid = func() int { return 1234 }
+	os.Setenv("LISTEN_PID", "1234")
+	os.Setenv("LISTEN_FDS", "1")
+	os.Setenv("LISTEN_FDNAMES", "endpoint")
+	defer func() {
+		listenFDsStart = prevStart
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+		systemdSockets.Lock()
+		systemdSockets.loaded = false
+		systemdSockets.files = nil
+		systemdSockets.names = nil
+		systemdSockets.Unlock()
+	}()
+
+	if _, err = Bind(SystemdAddrPrefix+"router", nil); err == nil {
+		t.Errorf("Expected error for unknown systemd socket")
+	}
+	if _, err = Bind(SystemdAddrPrefix+"1", nil); err == nil {
+		t.Errorf("Expected error for out-of-range systemd socket")
+	}
+	ln, err := Bind(SystemdAddrPrefix+"endpoint", nil)
+	if err != nil {
+		t.Fatalf("Error using systemd socket: %s", err)
+	}
+	defer ln.Close()
+	if ln.Addr().String() != tcpLn.Addr().String() {
+		t.Errorf("Wrong systemd socket address: got %s; want %s", ln.Addr(),
+			tcpLn.Addr())
+	}
+	if _, err = Bind(SystemdAddrPrefix, nil); err == nil {
+		t.Errorf("Expected error reusing systemd socket")
+	}
+
+	// Connections to the original socket should be accepted by the
+	// inherited listener.
+	go func() {
+		if c, err := net.Dial("tcp", tcpLn.Addr().String()); err == nil {
+			c.Close()
+		}
+	}()
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Error accepting connection: %s", err)
+	}
+	c.Close()
+}
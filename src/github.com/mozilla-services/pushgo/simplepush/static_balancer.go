@@ -37,12 +37,30 @@ func (b *StaticBalancer) Init(app *Application, config interface{}) error {
 	return nil
 }
 
+// Reload applies the redirection threshold from a reloaded configuration.
+// Implements Reloader.Reload().
+func (b *StaticBalancer) Reload(config interface{}, changed []string) (
+	rejected []string, err error) {
+
+	conf := config.(*StaticBalancerConf)
+	apply, rejected := liveSettings(changed, "threshold")
+	if apply["threshold"] {
+		b.Lock()
+		b.threshold = conf.Threshold
+		b.Unlock()
+	}
+	return rejected, nil
+}
+
 func (*StaticBalancer) Close() error          { return nil }
 func (*StaticBalancer) Status() (bool, error) { return true, nil }
 
 func (b *StaticBalancer) shouldRedirect() (currentWorkers int64, ok bool) {
 	currentWorkers = int64(b.workerCount())
-	ok = float64(currentWorkers+1)/float64(b.maxWorkers) >= b.threshold
+	b.Lock()
+	threshold := b.threshold
+	b.Unlock()
+	ok = float64(currentWorkers+1)/float64(b.maxWorkers) >= threshold
 	return
 }
 
@@ -59,3 +77,15 @@ func (b *StaticBalancer) RedirectURL() (url string, ok bool, err error) {
 	b.Unlock()
 	return b.redirects[nextIndex], true, nil
 }
+
+// ChoosePeer returns the next redirect origin. Implements
+// PeerChooser.ChoosePeer().
+func (b *StaticBalancer) ChoosePeer() (url string, ok bool, err error) {
+	b.Lock()
+	defer b.Unlock()
+	if len(b.redirects) == 0 {
+		return
+	}
+	b.currentIndex = (b.currentIndex + 1) % len(b.redirects)
+	return b.redirects[b.currentIndex], true, nil
+}
@@ -4,11 +4,16 @@
 
 package simplepush
 
+import (
+	"sync"
+)
+
 type StaticLocatorConf struct {
 	Contacts []string
 }
 
 type StaticLocator struct {
+	sync.RWMutex
 	logger   *SimpleLogger
 	metrics  Statistician
 	contacts []string
@@ -18,6 +23,18 @@ func (*StaticLocator) ConfigStruct() interface{} {
 	return new(StaticLocatorConf)
 }
 
+// CheckConfig validates the contact URLs. Implements
+// ConfigChecker.CheckConfig().
+func (l *StaticLocator) CheckConfig(config interface{}) error {
+	conf := config.(*StaticLocatorConf)
+	for _, contact := range conf.Contacts {
+		if err := checkURL("contacts", contact); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (l *StaticLocator) Init(app *Application, config interface{}) error {
 	conf := config.(*StaticLocatorConf)
 	l.logger = app.Logger()
@@ -26,9 +43,30 @@ func (l *StaticLocator) Init(app *Application, config interface{}) error {
 	return nil
 }
 
-func (l *StaticLocator) Close() error                      { return nil }
-func (l *StaticLocator) Contacts(string) ([]string, error) { return l.contacts, nil }
-func (l *StaticLocator) Status() (bool, error)             { return true, nil }
+// Reload applies the contact list from a reloaded configuration. Implements
+// Reloader.Reload().
+func (l *StaticLocator) Reload(config interface{}, changed []string) (
+	rejected []string, err error) {
+
+	conf := config.(*StaticLocatorConf)
+	apply, rejected := liveSettings(changed, "contacts")
+	if apply["contacts"] {
+		l.Lock()
+		l.contacts = conf.Contacts
+		l.Unlock()
+	}
+	return rejected, nil
+}
+
+func (l *StaticLocator) Close() error { return nil }
+
+func (l *StaticLocator) Contacts(string) ([]string, error) {
+	l.RLock()
+	defer l.RUnlock()
+	return l.contacts, nil
+}
+
+func (l *StaticLocator) Status() (bool, error) { return true, nil }
 
 func init() {
 	AvailableLocators["static"] = func() HasConfigStruct { return new(StaticLocator) }
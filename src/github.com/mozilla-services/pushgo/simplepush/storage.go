@@ -60,8 +60,29 @@ type Update struct {
 	ChannelID string `json:"channelID"`
 	Version   uint64 `json:"version"`
 	Data      string `json:"data"`
+
+	// Accepted is the time the update was accepted from the app server, or
+	// the zero time if unknown. Path is the route the update took to reach
+	// the client. Neither is sent to the client.
+	Accepted time.Time    `json:"-"`
+	Path     DeliveryPath `json:"-"`
 }
 
+// DeliveryPath describes how an update reached a client.
+type DeliveryPath string
+
+const (
+	// DeliveryDirect updates were sent by the node that accepted them.
+	DeliveryDirect DeliveryPath = "direct"
+
+	// DeliveryRouted updates were routed to the client's node.
+	DeliveryRouted DeliveryPath = "routed"
+
+	// DeliveryFlushed updates were fetched from storage and flushed to the
+	// client, typically on reconnect.
+	DeliveryFlushed DeliveryPath = "flushed"
+)
+
 // DbConf specifies generic database adapter options.
 type DbConf struct {
 	// TimeoutLive is the active channel record timeout. Defaults to 3 days.
@@ -112,8 +133,9 @@ type Store interface {
 	// Register creates a channel record in the backing store.
 	Register(suaid, schid string, version int64) error
 
-	// Update updates the channel record version.
-	Update(suaid, schid string, version int64) error
+	// Update updates the channel record version. accepted is the time the
+	// update was accepted from the app server.
+	Update(suaid, schid string, version int64, accepted time.Time) error
 
 	// Unregister marks a channel record as inactive.
 	Unregister(suaid, schid string) error
@@ -141,6 +163,19 @@ type Store interface {
 	DropPing(suaid string) error
 }
 
+// A CursorStore is a Store that can persist a flush cursor for each device:
+// the time of the last flush after which the client had acknowledged every
+// pending update. Workers pass the cursor to FetchAll, so that reconnecting
+// clients only receive updates that have changed since.
+type CursorStore interface {
+	// FetchCursor returns the flush cursor for a device, or the zero time if
+	// the device does not have a cursor.
+	FetchCursor(suaid string) (time.Time, error)
+
+	// PutCursor stores the flush cursor for a device.
+	PutCursor(suaid string, cursor time.Time) error
+}
+
 // keySep is the primary key separator.
 var keySep = "."
 
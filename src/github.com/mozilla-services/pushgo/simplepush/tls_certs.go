@@ -0,0 +1,172 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoCertificates is returned when creating a certificate store without
+// any certificates.
+var ErrNoCertificates = errors.New("No TLS certificates configured")
+
+// A CertPair names a PEM-encoded certificate file and its private key.
+type CertPair struct {
+	CertFile string
+	KeyFile  string
+}
+
+// NewCertStore loads the certificate pairs. The first pair is the default
+// certificate, served to clients that do not send a server name, or that
+// request a name not covered by any certificate.
+func NewCertStore(pairs []CertPair) (*CertStore, error) {
+	if len(pairs) == 0 {
+		return nil, ErrNoCertificates
+	}
+	s := &CertStore{pairs: pairs}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// A CertStore holds the certificates served by a TLS listener, and selects
+// them by the SNI server name. Reloading the store replaces the certificates
+// for new handshakes; established connections are not affected.
+type CertStore struct {
+	// WatchInterval is how often the application checks the certificate
+	// files for changes. Zero disables checking.
+	WatchInterval time.Duration
+
+	pairs    []CertPair
+	lock     sync.RWMutex // Protects certs, names, and modTimes.
+	certs    []*tls.Certificate
+	names    map[string]*tls.Certificate
+	modTimes []time.Time
+}
+
+// String returns the certificate file names. Implements fmt.Stringer.
+func (s *CertStore) String() string {
+	files := make([]string, len(s.pairs))
+	for i, pair := range s.pairs {
+		files[i] = pair.CertFile
+	}
+	return strings.Join(files, ", ")
+}
+
+// statFiles returns the modification times of the certificate and key
+// files.
+func (s *CertStore) statFiles() (modTimes []time.Time, err error) {
+	modTimes = make([]time.Time, 0, 2*len(s.pairs))
+	for _, pair := range s.pairs {
+		for _, name := range []string{pair.CertFile, pair.KeyFile} {
+			info, err := os.Stat(name)
+			if err != nil {
+				return nil, err
+			}
+			modTimes = append(modTimes, info.ModTime())
+		}
+	}
+	return modTimes, nil
+}
+
+// Modified indicates whether any certificate or key file changed since the
+// certificates were last loaded.
+func (s *CertStore) Modified() (bool, error) {
+	modTimes, err := s.statFiles()
+	if err != nil {
+		return false, err
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for i, modTime := range modTimes {
+		if !modTime.Equal(s.modTimes[i]) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Reload loads all certificate pairs. The current certificates are only
+// replaced if every pair loads successfully.
+func (s *CertStore) Reload() error {
+	// Stat the files first, so that a file replaced while loading is
+	// reported as modified on the next check.
+	modTimes, err := s.statFiles()
+	if err != nil {
+		return fmt.Errorf("Error reading TLS certificate: %s", err)
+	}
+	certs := make([]tls.Certificate, len(s.pairs))
+	for i, pair := range s.pairs {
+		if certs[i], err = tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile); err != nil {
+			return fmt.Errorf("Error loading TLS certificate %q: %s",
+				pair.CertFile, err)
+		}
+	}
+	return s.setCerts(certs, modTimes)
+}
+
+// setCerts replaces the current certificates, indexing them by the DNS names
+// they cover. If two certificates cover the same name, the first one wins.
+func (s *CertStore) setCerts(certs []tls.Certificate,
+	modTimes []time.Time) error {
+
+	ptrs := make([]*tls.Certificate, len(certs))
+	names := make(map[string]*tls.Certificate)
+	for i := range certs {
+		cert := &certs[i]
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("Error parsing TLS certificate: %s", err)
+		}
+		cert.Leaf = leaf
+		ptrs[i] = cert
+		certNames := leaf.DNSNames
+		if len(certNames) == 0 && len(leaf.Subject.CommonName) > 0 {
+			certNames = []string{leaf.Subject.CommonName}
+		}
+		for _, name := range certNames {
+			name = strings.ToLower(name)
+			if _, ok := names[name]; !ok {
+				names[name] = cert
+			}
+		}
+	}
+	s.lock.Lock()
+	s.certs = ptrs
+	s.names = names
+	s.modTimes = modTimes
+	s.lock.Unlock()
+	return nil
+}
+
+// GetCertificate returns the certificate for the server name requested by
+// the client. Wildcard certificates match a single label. Implements
+// tls.Config.GetCertificate.
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (
+	*tls.Certificate, error) {
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if len(name) > 0 {
+		if cert, ok := s.names[name]; ok {
+			return cert, nil
+		}
+		if i := strings.IndexByte(name, '.'); i > 0 {
+			if cert, ok := s.names["*"+name[i:]]; ok {
+				return cert, nil
+			}
+		}
+	}
+	return s.certs[0], nil
+}
@@ -0,0 +1,186 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestCertStore returns a certificate store with the given in-memory
+// certificates.
+func newTestCertStore(certs ...tls.Certificate) *CertStore {
+	s := new(CertStore)
+	if err := s.setCerts(certs, nil); err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// newTestCert returns a PEM-encoded self-signed certificate for the given
+// names, and its private key.
+func newTestCert(names ...string) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-1 * time.Hour),
+		NotAfter:     time.Now().Add(1 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// writeTestCert writes a certificate for the given names to certFile and
+// keyFile.
+func writeTestCert(certFile, keyFile string, names ...string) error {
+	certPEM, keyPEM, err := newTestCert(names...)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(keyFile, keyPEM, 0600)
+}
+
+// certName returns the first DNS name covered by cert.
+func certName(cert *tls.Certificate) string {
+	if cert == nil || cert.Leaf == nil || len(cert.Leaf.DNSNames) == 0 {
+		return ""
+	}
+	return cert.Leaf.DNSNames[0]
+}
+
+func TestCertStoreGetCertificate(t *testing.T) {
+	var certs []tls.Certificate
+	for _, names := range [][]string{
+		{"push.example.com"},
+		{"push.example.net", "updates.example.net"},
+		{"*.example.org"},
+	} {
+		certPEM, keyPEM, err := newTestCert(names...)
+		if err != nil {
+			t.Fatalf("Error generating certificate: %s", err)
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			t.Fatalf("Error parsing certificate: %s", err)
+		}
+		certs = append(certs, cert)
+	}
+	s := newTestCertStore(certs...)
+	tests := []struct {
+		name, serverName string
+		expected         string
+	}{
+		{"No server name", "", "push.example.com"},
+		{"Default certificate name", "push.example.com", "push.example.com"},
+		{"Alternate name", "updates.example.net", "push.example.net"},
+		{"Mixed case with trailing dot", "Push.Example.NET.", "push.example.net"},
+		{"Wildcard certificate", "push.example.org", "*.example.org"},
+		{"Wildcard matches one label", "a.push.example.org", "push.example.com"},
+		{"Unknown name", "push.example.edu", "push.example.com"},
+	}
+	for _, test := range tests {
+		cert, err := s.GetCertificate(&tls.ClientHelloInfo{
+			ServerName: test.serverName})
+		if err != nil {
+			t.Errorf("On test %s, got error %s", test.name, err)
+			continue
+		}
+		if actual := certName(cert); actual != test.expected {
+			t.Errorf("On test %s, got %q; want %q", test.name, actual,
+				test.expected)
+		}
+	}
+}
+
+func TestCertStoreReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushgo-certs")
+	if err != nil {
+		t.Fatalf("Error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "push.crt")
+	keyFile := filepath.Join(dir, "push.key")
+	if err = writeTestCert(certFile, keyFile, "push.example.com"); err != nil {
+		t.Fatalf("Error writing certificate: %s", err)
+	}
+	s, err := NewCertStore([]CertPair{{certFile, keyFile}})
+	if err != nil {
+		t.Fatalf("Error loading certificates: %s", err)
+	}
+	if modified, err := s.Modified(); err != nil || modified {
+		t.Errorf("Unchanged certificates reported as modified: %v, %v",
+			modified, err)
+	}
+
+	// Replace the certificate, moving the modification time forward in case
+	// the file system has coarse timestamps.
+	if err = writeTestCert(certFile, keyFile, "push.example.net"); err != nil {
+		t.Fatalf("Error replacing certificate: %s", err)
+	}
+	later := time.Now().Add(1 * time.Minute)
+	os.Chtimes(certFile, later, later)
+	if modified, err := s.Modified(); err != nil || !modified {
+		t.Errorf("Replaced certificate not reported as modified: %v, %v",
+			modified, err)
+	}
+	if err = s.Reload(); err != nil {
+		t.Fatalf("Error reloading certificates: %s", err)
+	}
+	cert, _ := s.GetCertificate(&tls.ClientHelloInfo{})
+	if name := certName(cert); name != "push.example.net" {
+		t.Errorf("Wrong certificate after reload: got %q; want push.example.net",
+			name)
+	}
+
+	// Invalid certificates should not replace the current certificates.
+	if err = ioutil.WriteFile(keyFile, []byte("invalid"), 0600); err != nil {
+		t.Fatalf("Error writing invalid key: %s", err)
+	}
+	if err = s.Reload(); err == nil {
+		t.Errorf("Expected error reloading invalid key")
+	}
+	cert, _ = s.GetCertificate(&tls.ClientHelloInfo{})
+	if name := certName(cert); name != "push.example.net" {
+		t.Errorf("Wrong certificate after failed reload: got %q; want %q",
+			name, "push.example.net")
+	}
+
+	if _, err = NewCertStore(nil); err != ErrNoCertificates {
+		t.Errorf("Wrong error for empty store: got %v; want %s", err,
+			ErrNoCertificates)
+	}
+}
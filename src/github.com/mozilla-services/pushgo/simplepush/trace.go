@@ -0,0 +1,367 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HeaderTraceParent is the W3C trace context header.
+const HeaderTraceParent = "traceparent"
+
+var ErrUnknownExporter = errors.New("Unknown trace exporter")
+
+type TracingConfig struct {
+	// Enabled records spans for updates, and propagates the trace context
+	// to other nodes.
+	Enabled bool
+
+	// Exporter is the span exporter: "otlp" sends spans to an OpenTelemetry
+	// collector; "memory" keeps spans in memory, for testing.
+	Exporter string
+
+	// Endpoint is the URL of the collector's OTLP/HTTP traces endpoint.
+	Endpoint string
+
+	// ServiceName is the service name reported to the collector.
+	ServiceName string `toml:"service_name" env:"service_name"`
+
+	// BatchSize is the maximum number of spans sent in a single request.
+	BatchSize int `toml:"batch_size" env:"batch_size"`
+
+	// FlushInterval is the maximum time to wait before exporting finished
+	// spans.
+	FlushInterval string `toml:"flush_interval" env:"flush_interval"`
+}
+
+// TraceContext identifies a span within a trace.
+type TraceContext struct {
+	TraceID string // 32 lowercase hex digits.
+	SpanID  string // 16 lowercase hex digits.
+	Sampled bool
+}
+
+// ParseTraceParent parses a traceparent header value. ok is false if the
+// value is malformed.
+func ParseTraceParent(value string) (tc TraceContext, ok bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return tc, false
+	}
+	// Versions other than 00 may append fields.
+	if parts[0] == "00" && len(parts) != 4 {
+		return tc, false
+	}
+	if !isTraceHex(parts[1], 32) || !isTraceHex(parts[2], 16) ||
+		!isTraceHex(parts[3], 2) {
+		return tc, false
+	}
+	flags, _ := hex.DecodeString(parts[3])
+	tc = TraceContext{
+		TraceID: parts[1],
+		SpanID:  parts[2],
+		Sampled: flags[0]&1 == 1,
+	}
+	if !tc.Valid() {
+		return TraceContext{}, false
+	}
+	return tc, true
+}
+
+// isTraceHex indicates whether s is a lowercase hex string of length n.
+func isTraceHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !(s[i] >= '0' && s[i] <= '9' || s[i] >= 'a' && s[i] <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Valid indicates whether the trace and span IDs are set. All-zero IDs are
+// invalid.
+func (tc TraceContext) Valid() bool {
+	return len(tc.TraceID) == 32 && strings.Trim(tc.TraceID, "0") != "" &&
+		len(tc.SpanID) == 16 && strings.Trim(tc.SpanID, "0") != ""
+}
+
+// String formats the context as a traceparent header value.
+func (tc TraceContext) String() string {
+	flags := "00"
+	if tc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", tc.TraceID, tc.SpanID, flags)
+}
+
+// newTraceID returns a random hex-encoded ID of n bytes.
+func newTraceID(n int) string {
+	id := make([]byte, n)
+	if _, err := rand.Read(id); err != nil {
+		return strings.Repeat("0", 2*n)
+	}
+	return hex.EncodeToString(id)
+}
+
+// Span records a single operation. All Span methods are safe to call on a
+// nil Span, so that callers need not check whether tracing is enabled.
+type Span struct {
+	tracer     *Tracer
+	Name       string
+	Context    TraceContext
+	ParentID   string
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	Error      string
+}
+
+// Child starts a new span within the same trace.
+func (s *Span) Child(name string) *Span {
+	if s == nil {
+		return nil
+	}
+	return s.tracer.StartSpan(name, s.Context)
+}
+
+// SetAttribute annotates the span.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.Attributes[key] = value
+}
+
+// Finish ends the span, recording err if the operation failed, and passes
+// the span to the exporter.
+func (s *Span) Finish(err error) {
+	if s == nil {
+		return
+	}
+	s.End = timeNow()
+	if err != nil {
+		s.Error = err.Error()
+	}
+	s.tracer.finish(s)
+}
+
+// TraceParent returns the traceparent header value for the span, or an
+// empty string if the span is nil.
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	return s.Context.String()
+}
+
+// A SpanExporter sends finished spans to a tracing backend.
+type SpanExporter interface {
+	ExportSpans(spans []*Span) error
+	Close() error
+}
+
+// Tracer creates spans and exports them in batches.
+type Tracer struct {
+	app           *Application
+	exporter      SpanExporter
+	batchSize     int
+	maxPending    int
+	flushInterval time.Duration
+	pendingLock   sync.Mutex
+	pending       []*Span
+	flushLock     sync.Mutex
+	closeOnce     Once
+	closeSignal   chan bool
+	closeWait     sync.WaitGroup
+}
+
+// NewTracer creates a tracer for the application. Spans are exported
+// through the exporter named in the config.
+func NewTracer(app *Application, conf *TracingConfig) (t *Tracer, err error) {
+	var exporter SpanExporter
+	switch conf.Exporter {
+	case "otlp":
+		exporter = NewOTLPExporter(conf.Endpoint, conf.ServiceName,
+			app.Hostname())
+	case "memory":
+		exporter = NewMemoryExporter()
+	default:
+		return nil, ErrUnknownExporter
+	}
+	t = &Tracer{
+		app:         app,
+		exporter:    exporter,
+		batchSize:   conf.BatchSize,
+		closeSignal: make(chan bool),
+	}
+	if t.batchSize < 1 {
+		t.batchSize = 1
+	}
+	t.maxPending = 10 * t.batchSize
+	if len(conf.FlushInterval) > 0 {
+		if t.flushInterval, err = time.ParseDuration(conf.FlushInterval); err != nil {
+			return nil, fmt.Errorf("Unable to parse 'flush_interval': %s",
+				err.Error())
+		}
+	}
+	return t, nil
+}
+
+// Exporter returns the span exporter.
+func (t *Tracer) Exporter() SpanExporter {
+	return t.exporter
+}
+
+// Start starts exporting finished spans at the flush interval.
+func (t *Tracer) Start() {
+	if t.flushInterval <= 0 {
+		return
+	}
+	t.closeWait.Add(1)
+	go t.run()
+}
+
+// StartSpan starts a span. If parent is valid, the span joins the parent's
+// trace; otherwise, StartSpan starts a new trace. StartSpan returns nil if
+// t is nil.
+func (t *Tracer) StartSpan(name string, parent TraceContext) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{
+		tracer:     t,
+		Name:       name,
+		Start:      timeNow(),
+		Attributes: make(map[string]string),
+	}
+	if parent.Valid() {
+		s.Context.TraceID = parent.TraceID
+		s.Context.Sampled = parent.Sampled
+		s.ParentID = parent.SpanID
+	} else {
+		s.Context.TraceID = newTraceID(16)
+		s.Context.Sampled = true
+	}
+	s.Context.SpanID = newTraceID(8)
+	return s
+}
+
+// StartSpanFromHeader starts a span that continues the trace named by a
+// traceparent header value.
+func (t *Tracer) StartSpanFromHeader(name, traceParent string) *Span {
+	parent, _ := ParseTraceParent(traceParent)
+	return t.StartSpan(name, parent)
+}
+
+func (t *Tracer) finish(s *Span) {
+	if !s.Context.Sampled {
+		// The caller asked us not to record this trace.
+		return
+	}
+	t.pendingLock.Lock()
+	if len(t.pending) >= t.maxPending {
+		t.pendingLock.Unlock()
+		t.app.Metrics().Increment("tracing.dropped")
+		return
+	}
+	t.pending = append(t.pending, s)
+	shouldFlush := len(t.pending) >= t.batchSize
+	t.pendingLock.Unlock()
+	if shouldFlush {
+		go t.Flush()
+	}
+}
+
+// Flush exports all finished spans.
+func (t *Tracer) Flush() (err error) {
+	t.flushLock.Lock()
+	defer t.flushLock.Unlock()
+	for {
+		t.pendingLock.Lock()
+		batch := t.pending
+		if len(batch) > t.batchSize {
+			batch = batch[:t.batchSize]
+		}
+		t.pending = t.pending[len(batch):]
+		t.pendingLock.Unlock()
+		if len(batch) == 0 {
+			return nil
+		}
+		if err = t.exporter.ExportSpans(batch); err != nil {
+			logger := t.app.Logger()
+			if logger.ShouldLog(WARNING) {
+				logger.Warn("tracing", "Could not export spans", LogFields{
+					"error": err.Error(), "count": strconv.Itoa(len(batch))})
+			}
+			t.app.Metrics().IncrementBy("tracing.dropped", int64(len(batch)))
+			return err
+		}
+		t.app.Metrics().IncrementBy("tracing.exported", int64(len(batch)))
+	}
+}
+
+func (t *Tracer) run() {
+	defer t.closeWait.Done()
+	ticker := time.NewTicker(t.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.closeSignal:
+			return
+		case <-ticker.C:
+			t.Flush()
+		}
+	}
+}
+
+// Close exports the remaining spans and closes the exporter.
+func (t *Tracer) Close() error {
+	return t.closeOnce.Do(t.close)
+}
+
+func (t *Tracer) close() error {
+	close(t.closeSignal)
+	t.closeWait.Wait()
+	t.Flush()
+	return t.exporter.Close()
+}
+
+// MemoryExporter keeps exported spans in memory. Used for testing.
+type MemoryExporter struct {
+	sync.Mutex
+	spans []*Span
+}
+
+func NewMemoryExporter() *MemoryExporter {
+	return new(MemoryExporter)
+}
+
+func (e *MemoryExporter) ExportSpans(spans []*Span) error {
+	e.Lock()
+	e.spans = append(e.spans, spans...)
+	e.Unlock()
+	return nil
+}
+
+// Spans returns all exported spans.
+func (e *MemoryExporter) Spans() []*Span {
+	e.Lock()
+	defer e.Unlock()
+	spans := make([]*Span, len(e.spans))
+	copy(spans, e.spans)
+	return spans
+}
+
+func (e *MemoryExporter) Close() error { return nil }
@@ -0,0 +1,159 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// OTLP span status codes.
+const (
+	otlpStatusUnset = 0
+	otlpStatusError = 2
+)
+
+// OTLPExporter sends spans to an OpenTelemetry collector, using the OTLP/HTTP
+// JSON encoding.
+type OTLPExporter struct {
+	url      string
+	resource otlpResource
+	client   *http.Client
+}
+
+func NewOTLPExporter(url, serviceName, host string) *OTLPExporter {
+	if len(serviceName) == 0 {
+		serviceName = "pushgo"
+	}
+	return &OTLPExporter{
+		url: url,
+		resource: otlpResource{Attributes: []otlpAttribute{
+			newOTLPAttribute("service.name", serviceName),
+			newOTLPAttribute("service.version", VERSION),
+			newOTLPAttribute("host.name", host),
+		}},
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	StartTime    string          `json:"startTimeUnixNano"`
+	EndTime      string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string          `json:"key"`
+	Value otlpStringValue `json:"value"`
+}
+
+type otlpStringValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func newOTLPAttribute(key, value string) otlpAttribute {
+	return otlpAttribute{key, otlpStringValue{value}}
+}
+
+func newOTLPSpan(s *Span) otlpSpan {
+	span := otlpSpan{
+		TraceID:      s.Context.TraceID,
+		SpanID:       s.Context.SpanID,
+		ParentSpanID: s.ParentID,
+		Name:         s.Name,
+		StartTime:    strconv.FormatInt(s.Start.UnixNano(), 10),
+		EndTime:      strconv.FormatInt(s.End.UnixNano(), 10),
+		Status:       otlpStatus{Code: otlpStatusUnset},
+	}
+	keys := make([]string, 0, len(s.Attributes))
+	for key := range s.Attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		span.Attributes = append(span.Attributes,
+			newOTLPAttribute(key, s.Attributes[key]))
+	}
+	if len(s.Error) > 0 {
+		span.Status = otlpStatus{Code: otlpStatusError, Message: s.Error}
+	}
+	return span
+}
+
+// ExportSpans posts spans to the collector. Implements
+// SpanExporter.ExportSpans().
+func (e *OTLPExporter) ExportSpans(spans []*Span) error {
+	scope := otlpScopeSpans{
+		Scope: otlpScope{Name: "pushgo", Version: VERSION},
+		Spans: make([]otlpSpan, len(spans)),
+	}
+	for i, s := range spans {
+		scope.Spans[i] = newOTLPSpan(s)
+	}
+	body, err := json.Marshal(otlpRequest{[]otlpResourceSpans{{
+		Resource:   e.resource,
+		ScopeSpans: []otlpScopeSpans{scope},
+	}}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Unexpected collector response: %s", resp.Status)
+	}
+	return nil
+}
+
+func (e *OTLPExporter) Close() error { return nil }
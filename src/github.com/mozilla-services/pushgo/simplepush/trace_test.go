@@ -0,0 +1,217 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/rafrombrc/gomock/gomock"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		ok      bool
+		sampled bool
+	}{
+		{"Sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"Not sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"Future version", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true, true},
+		{"Extra fields", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, false},
+		{"Invalid version", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"Uppercase", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false, false},
+		{"Short trace ID", "00-4bf92f3577b34da6-00f067aa0ba902b7-01", false, false},
+		{"Zero trace ID", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"Zero span ID", "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"Empty", "", false, false},
+	}
+	for _, test := range tests {
+		tc, ok := ParseTraceParent(test.value)
+		if ok != test.ok {
+			t.Errorf("On test %s, wrong result: got %v; want %v",
+				test.name, ok, test.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if tc.Sampled != test.sampled {
+			t.Errorf("On test %s, wrong sampled flag: got %v; want %v",
+				test.name, tc.Sampled, test.sampled)
+		}
+		if tc.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("On test %s, wrong trace ID: %q", test.name, tc.TraceID)
+		}
+		if tc.SpanID != "00f067aa0ba902b7" {
+			t.Errorf("On test %s, wrong span ID: %q", test.name, tc.SpanID)
+		}
+	}
+	value := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	if tc, _ := ParseTraceParent(value); tc.String() != value {
+		t.Errorf("Wrong traceparent value: got %q; want %q", tc.String(), value)
+	}
+}
+
+func newTestTracer(t *testing.T, mockCtrl *gomock.Controller,
+	conf *TracingConfig) *Tracer {
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(false).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+	mckStat.EXPECT().Increment(gomock.Any()).AnyTimes()
+	mckStat.EXPECT().IncrementBy(gomock.Any(), gomock.Any()).AnyTimes()
+
+	app := NewApplication()
+	app.hostname = "test.mozilla.org"
+	app.SetLogger(mckLogger)
+	app.SetMetrics(mckStat)
+
+	tracer, err := NewTracer(app, conf)
+	if err != nil {
+		t.Fatalf("Error creating tracer: %s", err)
+	}
+	return tracer
+}
+
+func TestTracerSpans(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	tracer := newTestTracer(t, mockCtrl, &TracingConfig{
+		Exporter:  "memory",
+		BatchSize: 10,
+	})
+	exporter := tracer.Exporter().(*MemoryExporter)
+
+	parent := tracer.StartSpanFromHeader("endpoint.update",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	parent.SetAttribute("uaid", "123")
+	child := parent.Child("router.route")
+	child.Finish(errors.New("oops"))
+	parent.Finish(nil)
+
+	// Unsampled traces should not be exported.
+	tracer.StartSpanFromHeader("endpoint.update",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00").Finish(nil)
+
+	if spans := exporter.Spans(); len(spans) != 0 {
+		t.Errorf("Spans exported before flush: %d", len(spans))
+	}
+	if err := tracer.Flush(); err != nil {
+		t.Fatalf("Error flushing spans: %s", err)
+	}
+	spans := exporter.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("Wrong span count: got %d; want 2", len(spans))
+	}
+	if spans[0] != child || spans[1] != parent {
+		t.Errorf("Spans exported out of order")
+	}
+	if parent.Context.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Parent span did not continue trace: %q", parent.Context.TraceID)
+	}
+	if parent.ParentID != "00f067aa0ba902b7" {
+		t.Errorf("Wrong parent span ID: %q", parent.ParentID)
+	}
+	if child.Context.TraceID != parent.Context.TraceID {
+		t.Errorf("Child span started new trace: %q", child.Context.TraceID)
+	}
+	if child.ParentID != parent.Context.SpanID {
+		t.Errorf("Wrong child parent ID: got %q; want %q",
+			child.ParentID, parent.Context.SpanID)
+	}
+	if child.Error != "oops" {
+		t.Errorf("Wrong child error: %q", child.Error)
+	}
+	if parent.Attributes["uaid"] != "123" {
+		t.Errorf("Missing parent attribute: %#v", parent.Attributes)
+	}
+
+	// Spans without a parent start new traces.
+	root := tracer.StartSpan("router.receive", TraceContext{})
+	if !root.Context.Valid() || !root.Context.Sampled || len(root.ParentID) > 0 {
+		t.Errorf("Invalid root span context: %#v", root.Context)
+	}
+
+	// Nil spans should be safe to use.
+	var span *Span
+	span.SetAttribute("uaid", "123")
+	span.Child("router.route").Finish(nil)
+	if len(span.TraceParent()) > 0 {
+		t.Errorf("Nil span returned traceparent: %q", span.TraceParent())
+	}
+}
+
+func TestTracerOTLP(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	requests := make(chan otlpRequest, 1)
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(resp http.ResponseWriter, req *http.Request) {
+			if typ := req.Header.Get("Content-Type"); typ != "application/json" {
+				t.Errorf("Wrong content type: %q", typ)
+			}
+			var body otlpRequest
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				t.Errorf("Error decoding request: %s", err)
+			}
+			requests <- body
+		}))
+	defer srv.Close()
+
+	tracer := newTestTracer(t, mockCtrl, &TracingConfig{
+		Exporter:    "otlp",
+		Endpoint:    srv.URL + "/v1/traces",
+		ServiceName: "pushgo-test",
+		BatchSize:   10,
+	})
+	useMockFuncs()
+	defer useStdFuncs()
+	span := tracer.StartSpanFromHeader("endpoint.update",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	span.SetAttribute("uaid", "123")
+	span.Finish(errors.New("oops"))
+	if err := tracer.Close(); err != nil {
+		t.Fatalf("Error closing tracer: %s", err)
+	}
+
+	var body otlpRequest
+	select {
+	case body = <-requests:
+	default:
+		t.Fatalf("Spans not exported on close")
+	}
+	if len(body.ResourceSpans) != 1 {
+		t.Fatalf("Wrong resource span count: %d", len(body.ResourceSpans))
+	}
+	resource := body.ResourceSpans[0]
+	if attr := resource.Resource.Attributes[0]; attr.Key != "service.name" ||
+		attr.Value.StringValue != "pushgo-test" {
+		t.Errorf("Wrong service name: %#v", attr)
+	}
+	if len(resource.ScopeSpans) != 1 || len(resource.ScopeSpans[0].Spans) != 1 {
+		t.Fatalf("Wrong exported spans: %#v", resource.ScopeSpans)
+	}
+	expected := otlpSpan{
+		TraceID:      "4bf92f3577b34da6a3ce929d0e0e4736",
+		SpanID:       span.Context.SpanID,
+		ParentSpanID: "00f067aa0ba902b7",
+		Name:         "endpoint.update",
+		StartTime:    "1257894000000000000",
+		EndTime:      "1257894000000000000",
+		Attributes:   []otlpAttribute{newOTLPAttribute("uaid", "123")},
+		Status:       otlpStatus{Code: otlpStatusError, Message: "oops"},
+	}
+	if actual := resource.ScopeSpans[0].Spans[0]; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Wrong exported span: got %#v; want %#v", actual, expected)
+	}
+}
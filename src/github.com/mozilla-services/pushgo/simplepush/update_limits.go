@@ -0,0 +1,125 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Names of the update rate limits, used in metric names and shared rate
+// limit keys.
+const (
+	UpdateLimitIP      = "ip"
+	UpdateLimitUAID    = "uaid"
+	UpdateLimitChannel = "channel"
+)
+
+// ErrNoRateLimitStore is returned when shared update limits are enabled, but
+// the storage adapter cannot hold rate limit state.
+var ErrNoRateLimitStore = errors.New(
+	"Storage adapter does not support shared rate limits")
+
+// A RateLimitStore is a Store that can hold token buckets shared by all
+// nodes in the cluster.
+type RateLimitStore interface {
+	// TakeToken consumes a token from the bucket for key, which holds up to
+	// burst tokens and refills at rate tokens per second. If the bucket is
+	// empty, TakeToken returns false and the time until the next token is
+	// available.
+	TakeToken(key string, rate float64, burst int) (
+		ok bool, retryAfter time.Duration, err error)
+}
+
+// UpdateLimitsConfig configures rate limits for application servers sending
+// updates. Updates are limited by source IP address, device, and channel.
+// Zero disables a limit.
+type UpdateLimitsConfig struct {
+	// Shared stores the limits in the storage adapter, so that they apply
+	// across the cluster instead of to each node.
+	Shared bool `toml:"shared" env:"shared"`
+
+	// IPRate, UAIDRate, and ChannelRate are the number of updates allowed
+	// per second, with bursts of up to IPBurst, UAIDBurst, and ChannelBurst.
+	IPRate       float64 `toml:"ip_rate" env:"ip_rate"`
+	IPBurst      int     `toml:"ip_burst" env:"ip_burst"`
+	UAIDRate     float64 `toml:"uaid_rate" env:"uaid_rate"`
+	UAIDBurst    int     `toml:"uaid_burst" env:"uaid_burst"`
+	ChannelRate  float64 `toml:"channel_rate" env:"channel_rate"`
+	ChannelBurst int     `toml:"channel_burst" env:"channel_burst"`
+
+	// MaxTracked is the number of keys tracked by each limit when the limits
+	// are not shared. The least recently seen key is forgotten once the
+	// limit is reached.
+	MaxTracked int `toml:"max_tracked" env:"max_tracked"`
+}
+
+// Enabled indicates whether any limits are set.
+func (conf UpdateLimitsConfig) Enabled() bool {
+	return conf.IPRate > 0 || conf.UAIDRate > 0 || conf.ChannelRate > 0
+}
+
+// Check validates the limit settings.
+func (conf UpdateLimitsConfig) Check() error {
+	if conf.IPRate < 0 || conf.UAIDRate < 0 || conf.ChannelRate < 0 {
+		return fmt.Errorf("Rate limits must not be negative")
+	}
+	if conf.IPBurst < 0 || conf.UAIDBurst < 0 || conf.ChannelBurst < 0 {
+		return fmt.Errorf("Burst sizes must not be negative")
+	}
+	return nil
+}
+
+// NewUpdateLimiter creates an update limiter with the given settings. If the
+// limits are shared, store must implement RateLimitStore.
+func NewUpdateLimiter(conf UpdateLimitsConfig, store Store) (
+	*UpdateLimiter, error) {
+
+	l := &UpdateLimiter{limits: make(map[string]*RateLimiter)}
+	if conf.Shared {
+		var ok bool
+		if l.store, ok = store.(RateLimitStore); !ok {
+			return nil, ErrNoRateLimitStore
+		}
+	}
+	if conf.IPRate > 0 {
+		l.limits[UpdateLimitIP] = NewRateLimiter(conf.IPRate, conf.IPBurst,
+			conf.MaxTracked)
+	}
+	if conf.UAIDRate > 0 {
+		l.limits[UpdateLimitUAID] = NewRateLimiter(conf.UAIDRate, conf.UAIDBurst,
+			conf.MaxTracked)
+	}
+	if conf.ChannelRate > 0 {
+		l.limits[UpdateLimitChannel] = NewRateLimiter(conf.ChannelRate,
+			conf.ChannelBurst, conf.MaxTracked)
+	}
+	return l, nil
+}
+
+// An UpdateLimiter enforces rate limits on incoming updates, either locally
+// or across the cluster.
+type UpdateLimiter struct {
+	store  RateLimitStore // Nil if the limits are not shared.
+	limits map[string]*RateLimiter
+}
+
+// Allow consumes a token for key from the named limit. If no tokens are
+// available, Allow returns false and the time until the next token is
+// available. Unset limits allow all updates.
+func (l *UpdateLimiter) Allow(limit, key string) (
+	ok bool, retryAfter time.Duration, err error) {
+
+	rl, ok := l.limits[limit]
+	if !ok {
+		return true, 0, nil
+	}
+	if l.store != nil {
+		return l.store.TakeToken(limit+"-"+key, rl.Rate, rl.Burst)
+	}
+	ok, retryAfter = rl.Allow(key)
+	return ok, retryAfter, nil
+}
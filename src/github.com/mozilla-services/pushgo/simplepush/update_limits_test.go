@@ -0,0 +1,168 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/rafrombrc/gomock/gomock"
+)
+
+// testRateLimitStore is a Store that records shared rate limit requests.
+type testRateLimitStore struct {
+	Store
+	keys []string
+	ok   bool
+}
+
+func (s *testRateLimitStore) TakeToken(key string, rate float64, burst int) (
+	bool, time.Duration, error) {
+
+	s.keys = append(s.keys, key)
+	if !s.ok {
+		return false, 1500 * time.Millisecond, nil
+	}
+	return true, 0, nil
+}
+
+func TestUpdateLimiter(t *testing.T) {
+	useMockFuncs()
+	defer useStdFuncs()
+
+	l, err := NewUpdateLimiter(UpdateLimitsConfig{
+		UAIDRate:  1,
+		UAIDBurst: 2,
+	}, nil)
+	if err != nil {
+		t.Fatalf("Error creating update limiter: %s", err)
+	}
+	tests := []struct {
+		name       string
+		limit, key string
+		ok         bool
+		retryAfter time.Duration
+	}{
+		{"First device update", UpdateLimitUAID, "a", true, 0},
+		{"Second device update", UpdateLimitUAID, "a", true, 0},
+		{"Device limit exceeded", UpdateLimitUAID, "a", false, 1 * time.Second},
+		{"Separate device", UpdateLimitUAID, "b", true, 0},
+		{"Unset limit", UpdateLimitIP, "192.0.2.1", true, 0},
+	}
+	for _, test := range tests {
+		ok, retryAfter, err := l.Allow(test.limit, test.key)
+		if err != nil {
+			t.Errorf("On test %s, got error %s", test.name, err)
+			continue
+		}
+		if ok != test.ok || retryAfter != test.retryAfter {
+			t.Errorf("On test %s, got %v, %s; want %v, %s", test.name, ok,
+				retryAfter, test.ok, test.retryAfter)
+		}
+	}
+}
+
+func TestUpdateLimiterShared(t *testing.T) {
+	conf := UpdateLimitsConfig{Shared: true, ChannelRate: 1, ChannelBurst: 1}
+	if _, err := NewUpdateLimiter(conf, nil); err != ErrNoRateLimitStore {
+		t.Errorf("Wrong error for unsupported store: got %v; want %s", err,
+			ErrNoRateLimitStore)
+	}
+	store := &testRateLimitStore{ok: true}
+	l, err := NewUpdateLimiter(conf, store)
+	if err != nil {
+		t.Fatalf("Error creating shared update limiter: %s", err)
+	}
+	if ok, _, _ := l.Allow(UpdateLimitChannel, "a.b"); !ok {
+		t.Errorf("Update rejected by shared limit")
+	}
+	store.ok = false
+	ok, retryAfter, _ := l.Allow(UpdateLimitChannel, "a.b")
+	if ok || retryAfter != 1500*time.Millisecond {
+		t.Errorf("Wrong shared limit result: got %v, %s; want false, 1.5s", ok,
+			retryAfter)
+	}
+	l.Allow(UpdateLimitUAID, "a")
+	if len(store.keys) != 2 || store.keys[0] != "channel-a.b" {
+		t.Errorf("Wrong shared limit keys: got %#v", store.keys)
+	}
+}
+
+func TestUpdateLimitsCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		conf UpdateLimitsConfig
+		ok   bool
+	}{
+		{"Disabled", UpdateLimitsConfig{}, true},
+		{"Negative rate", UpdateLimitsConfig{IPRate: -1}, false},
+		{"Negative burst", UpdateLimitsConfig{UAIDRate: 1, UAIDBurst: -1}, false},
+		{"Channel limit", UpdateLimitsConfig{ChannelRate: 0.5, ChannelBurst: 5}, true},
+	}
+	for _, test := range tests {
+		if err := test.conf.Check(); (err == nil) != test.ok {
+			t.Errorf("On test %s, got error %v; want ok %v", test.name, err, test.ok)
+		}
+	}
+}
+
+func TestEndpointUpdateLimits(t *testing.T) {
+	useMockFuncs()
+	defer useStdFuncs()
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(),
+		gomock.Any(), gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+
+	app := NewApplication()
+	app.SetLogger(mckLogger)
+	app.SetMetrics(mckStat)
+
+	eh := NewEndpointHandler()
+	eh.setApp(app)
+	eh.setMaxDataLen(512)
+	eh.limits, _ = NewUpdateLimiter(UpdateLimitsConfig{IPRate: 0.5, IPBurst: 1}, nil)
+	app.SetEndpointHandler(eh)
+
+	newRequest := func() *http.Request {
+		return &http.Request{
+			Method:     "PUT",
+			Header:     http.Header{},
+			URL:        &url.URL{Path: "/update/123", RawQuery: "version=abc"},
+			RemoteAddr: "192.0.2.1:1234",
+		}
+	}
+
+	mckStat.EXPECT().Increment("updates.appserver.invalid")
+	resp := httptest.NewRecorder()
+	eh.ServeMux().ServeHTTP(resp, newRequest())
+	if resp.Code != http.StatusBadRequest {
+		t.Errorf("Wrong status for first update: got %d; want %d", resp.Code,
+			http.StatusBadRequest)
+	}
+
+	mckStat.EXPECT().Increment("updates.appserver.limited." + UpdateLimitIP)
+	resp = httptest.NewRecorder()
+	eh.ServeMux().ServeHTTP(resp, newRequest())
+	if resp.Code != http.StatusTooManyRequests {
+		t.Errorf("Wrong status for second update: got %d; want %d", resp.Code,
+			http.StatusTooManyRequests)
+	}
+	if retryAfter := resp.HeaderMap.Get("Retry-After"); retryAfter != "2" {
+		t.Errorf("Wrong Retry-After header: got %q; want 2", retryAfter)
+	}
+	body, isJSON := getJSON(resp.HeaderMap, resp.Body)
+	if !isJSON || body.String() != `"Too Many Requests"` {
+		t.Errorf("Wrong response body: got %q", resp.Body.String())
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/mozilla-services/pushgo/id"
@@ -46,13 +47,23 @@ type Worker interface {
 	// is closed by either party.
 	Run()
 
-	// Send delivers an update containing chid, version, and data.
-	Send(chid string, version int64, data string) error
+	// Send delivers an update containing chid, version, and data. accepted is
+	// the time the update was accepted from the app server, and path is the
+	// route the update took to reach this node.
+	Send(chid string, version int64, data string, accepted time.Time,
+		path DeliveryPath, span *Span) error
 
 	// Flush delivers all pending updates since the lastAccessed time,
 	// expressed in seconds since Epoch.
 	Flush(lastAccessed int64) error
 
+	// Idle indicates whether the client has acknowledged every update written
+	// to it, and has no updates waiting to be written.
+	Idle() bool
+
+	// Redirect asks the client to reconnect to a different host.
+	Redirect(origin string) error
+
 	// Close unblocks the run loop and closes the underlying socket.
 	Close() error
 }
@@ -71,6 +82,47 @@ type WorkerWS struct {
 	pingInt      time.Duration
 	helloTimeout time.Duration
 	pongInterval time.Duration
+	ackTimeout   time.Duration
+	maxRedeliver int
+	writeTimeout time.Duration
+	batchWindow  time.Duration
+	outbound     chan outboundUpdates
+	unackedLock  sync.Mutex
+	unacked      map[string]*unackedUpdate
+	ackCursor    int64           // Persisted flush cursor, in seconds since Epoch.
+	flushCursor  int64           // Start of the last flush, in seconds since Epoch.
+	flushPending map[string]bool // Flushed channels awaiting acknowledgement.
+	deviceAuth   *DeviceAuth     // Credentials for the connected device.
+	authSecret   string          // Newly issued secret, sent with the reply.
+	limits       *ClientLimiter  // Optional per-client handshake limits.
+	clientIP     string          // The client address used for limits.
+}
+
+// cursorSkew allows for clock skew between the nodes that update channel
+// records and the node that flushes them.
+var cursorSkew = 1 * time.Second
+
+// outboundUpdates is a notification queued for the write loop. Flushes also
+// include the channels that expired since the last flush.
+type outboundUpdates struct {
+	updates []Update
+	expired []string
+}
+
+// add coalesces queued updates and expired channels into the batch.
+func (b *outboundUpdates) add(queued outboundUpdates) {
+	b.updates = coalesceUpdates(b.updates, queued.updates)
+	b.expired = append(b.expired, queued.expired...)
+}
+
+// unackedUpdate is an update written to the socket, but not yet acknowledged
+// by the client. The embedded update records when the update was accepted,
+// and how it was delivered.
+type unackedUpdate struct {
+	Update
+	firstSent    time.Time
+	lastSent     time.Time
+	redeliveries int
 }
 
 type WorkerState int
@@ -89,6 +141,7 @@ type HelloRequest struct {
 	DeviceID   string            `json:"uaid"`
 	ChannelIDs []json.RawMessage `json:"channelIDs"`
 	PingData   json.RawMessage   `json:"connect"`
+	Secret     string            `json:"secret"`
 }
 
 type HelloReply struct {
@@ -96,10 +149,12 @@ type HelloReply struct {
 	DeviceID    string  `json:"uaid"`
 	Status      int     `json:"status"`
 	RedirectURL *string `json:"redirect,omitempty"`
+	Secret      string  `json:"secret,omitempty"`
 }
 
 type RegisterRequest struct {
-	ChannelID string `json:"channelID"`
+	ChannelID  string `json:"channelID"`
+	ReceiptURL string `json:"receiptURL,omitempty"`
 }
 
 type RegisterReply struct {
@@ -143,6 +198,10 @@ type SendData struct {
 }
 
 func NewWorker(app *Application, socket Socket, logID string) *WorkerWS {
+	queueSize := app.clientQueueSize
+	if queueSize < 1 {
+		queueSize = 1
+	}
 	return &WorkerWS{
 		Socket:       socket,
 		born:         timeNow(),
@@ -152,9 +211,14 @@ func NewWorker(app *Application, socket Socket, logID string) *WorkerWS {
 		store:        app.Store(),
 		logID:        logID,
 		state:        WorkerInactive,
-		pingInt:      app.clientMinPing,
+		pingInt:      app.ClientMinPing(),
 		helloTimeout: app.clientHelloTimeout,
 		pongInterval: app.clientPongInterval,
+		ackTimeout:   app.clientAckTimeout,
+		maxRedeliver: app.clientRedeliveries,
+		writeTimeout: app.clientWriteTimeout,
+		batchWindow:  app.clientBatchWindow,
+		outbound:     make(chan outboundUpdates, queueSize),
 	}
 }
 
@@ -214,7 +278,7 @@ func (w *WorkerWS) sniffer() {
 				if w.state == WorkerInactive {
 					if w.logger.ShouldLog(DEBUG) {
 						w.logger.Debug("worker", "Worker Idle connection. Closing socket",
-							LogFields{"rid": w.logID})
+							LogFields{"rid": w.logID, "uaid": w.uaid})
 					}
 					w.stop()
 					continue
@@ -227,7 +291,7 @@ func (w *WorkerWS) sniffer() {
 			if err != io.EOF {
 				if w.logger.ShouldLog(ERROR) && !harmlessConnectionError(err) {
 					w.logger.Error("worker", "Websocket Error",
-						LogFields{"rid": w.logID, "error": ErrStr(err)})
+						LogFields{"rid": w.logID, "uaid": w.uaid, "error": ErrStr(err)})
 				}
 			}
 			continue
@@ -250,7 +314,7 @@ func (w *WorkerWS) sniffer() {
 						"error":    syntaxErr.Error()})
 				} else {
 					w.logger.Warn("worker", "Error validating request payload",
-						LogFields{"rid": w.logID, "error": ErrStr(err)})
+						LogFields{"rid": w.logID, "uaid": w.uaid, "error": ErrStr(err)})
 				}
 			}
 			w.stop()
@@ -262,7 +326,7 @@ func (w *WorkerWS) sniffer() {
 		//ignore {} pings for logging purposes.
 		if len(msg) > 5 && w.logger.ShouldLog(DEBUG) {
 			w.logger.Debug("worker", "Socket receive",
-				LogFields{"rid": w.logID, "raw": string(msg)})
+				LogFields{"rid": w.logID, "uaid": w.uaid, "raw": string(msg)})
 		}
 		header := new(RequestHeader)
 		if isPingBody(msg) {
@@ -270,7 +334,7 @@ func (w *WorkerWS) sniffer() {
 		} else if err = json.Unmarshal(msg, header); err != nil {
 			if logWarning {
 				w.logger.Warn("worker", "Error parsing request header",
-					LogFields{"rid": w.logID, "error": ErrStr(err)})
+					LogFields{"rid": w.logID, "uaid": w.uaid, "error": ErrStr(err)})
 			}
 			w.handleError(msg, ErrInvalidHeader)
 			w.stop()
@@ -291,14 +355,14 @@ func (w *WorkerWS) sniffer() {
 		default:
 			if logWarning {
 				w.logger.Warn("worker", "Bad command",
-					LogFields{"rid": w.logID, "cmd": header.Type})
+					LogFields{"rid": w.logID, "uaid": w.uaid, "cmd": header.Type})
 			}
 			err = ErrUnsupportedType
 		}
 		if err != nil {
 			if w.logger.ShouldLog(DEBUG) {
 				w.logger.Debug("worker", "Run returned error",
-					LogFields{"rid": w.logID, "cmd": header.Type, "error": ErrStr(err)})
+					LogFields{"rid": w.logID, "uaid": w.uaid, "cmd": header.Type, "error": ErrStr(err)})
 			}
 			w.handleError(msg, err)
 			w.stop()
@@ -341,11 +405,18 @@ func (w *WorkerWS) Run() {
 		return
 	}()
 
+	stopWriters := make(chan bool)
+	defer close(stopWriters)
+	go w.writeLoop(stopWriters)
+	if w.ackTimeout > 0 {
+		go w.redeliveryLoop(stopWriters)
+	}
+
 	w.sniffer()
 
 	if w.logger.ShouldLog(INFO) {
 		w.logger.Info("worker", "Run has completed a shut-down",
-			LogFields{"rid": w.logID})
+			LogFields{"rid": w.logID, "uaid": w.uaid})
 	}
 }
 
@@ -359,13 +430,20 @@ func (w *WorkerWS) Hello(header *RequestHeader, message []byte) (err error) {
 			if err, _ := r.(error); err != nil && w.logger.ShouldLog(ERROR) {
 				stack := make([]byte, 1<<16)
 				n := runtime.Stack(stack, false)
-				w.logger.Error("worker", "Unhandled error", LogFields{"rid": w.logID,
+				w.logger.Error("worker", "Unhandled error", LogFields{"rid": w.logID, "uaid": w.uaid,
 					"cmd": "hello", "error": ErrStr(err), "stack": string(stack[:n])})
 			}
 			err = ErrInvalidParams
 		}
 	}()
 
+	if w.limits != nil {
+		if err = w.limits.AllowHello(w.clientIP); err != nil {
+			w.rejectHello(header, err)
+			w.stop()
+			return nil
+		}
+	}
 	request := new(HelloRequest)
 	if err = json.Unmarshal(message, request); err != nil {
 		return ErrInvalidParams
@@ -385,21 +463,34 @@ func (w *WorkerWS) Hello(header *RequestHeader, message []byte) (err error) {
 	}
 	reply := fmt.Sprintf(`{"messageType":%q,"uaid":%q,"status":200}`,
 		header.Type, uaid)
+	if len(w.authSecret) > 0 {
+		replyBytes, _ := json.Marshal(HelloReply{
+			Type:     header.Type,
+			DeviceID: uaid,
+			Status:   200,
+			Secret:   w.authSecret,
+		})
+		reply = string(replyBytes)
+		// The secret is only sent once.
+		w.authSecret = ""
+	}
 	if err = w.WriteText(reply); err != nil {
 		if logWarning {
 			w.logger.Warn("worker", "Error writing client handshake", LogFields{
-				"rid": w.logID, "error": err.Error()})
+				"rid": w.logID, "uaid": w.uaid, "error": err.Error()})
 		}
 		return err
 	}
 	w.metrics.Increment("updates.client.hello")
 	if w.logger.ShouldLog(INFO) {
 		w.logger.Info("worker", "Client successfully connected",
-			LogFields{"rid": w.logID})
+			LogFields{"rid": w.logID, "uaid": w.uaid})
 	}
 	w.state = WorkerActive
-	// Get the lastAccessed time from wherever
-	return w.Flush(0)
+	// Only flush updates that changed since the client last acknowledged all
+	// pending updates.
+	w.ackCursor = w.fetchCursor()
+	return w.Flush(w.ackCursor)
 }
 
 // registerDevice adds the worker to the worker map and registers the
@@ -412,11 +503,17 @@ func (w *WorkerWS) registerDevice(header *RequestHeader,
 		return false, err
 	}
 	w.SetUAID(uaid)
-	if allowRedirect {
+	// Draining nodes redirect all connecting clients.
+	if allowRedirect || w.app.Draining() {
 		if wroteReply = w.checkRedirect(header); wroteReply {
 			return
 		}
 	}
+	if w.app.deviceAuth {
+		if err = w.issueCredentials(uaid); err != nil {
+			return false, err
+		}
+	}
 	// register any proprietary connection requirements
 	w.registerPropPing([]byte(request.PingData))
 	// Add the worker to the map and register with the router.
@@ -439,7 +536,7 @@ func (w *WorkerWS) handshake(request *HelloRequest) (
 		// Must include "channelIDs" (even if empty)
 		if logWarning {
 			w.logger.Warn("worker", "Missing ChannelIDs",
-				LogFields{"rid": w.logID})
+				LogFields{"rid": w.logID, "uaid": w.uaid})
 		}
 		return "", false, ErrNoParams
 	}
@@ -450,35 +547,45 @@ func (w *WorkerWS) handshake(request *HelloRequest) (
 			// caller to flush pending notifications, but avoid querying the balancer.
 			if w.logger.ShouldLog(DEBUG) {
 				w.logger.Debug("worker", "Duplicate client handshake",
-					LogFields{"rid": w.logID})
+					LogFields{"rid": w.logID, "uaid": w.uaid})
 			}
 			return currentID, false, nil
 		}
 		// if there's already a Uaid for this device, don't accept a new one
 		if logWarning {
 			w.logger.Warn("worker", "Conflicting UAIDs",
-				LogFields{"rid": w.logID})
+				LogFields{"rid": w.logID, "uaid": w.uaid})
 		}
 		return "", false, ErrExistingID
 	}
 	var (
 		prevWorker      Worker
 		workerConnected bool
+		authenticated   bool
 	)
 	if len(request.DeviceID) == 0 {
 		if w.logger.ShouldLog(DEBUG) {
 			w.logger.Debug("worker", "Generating new UAID for device",
-				LogFields{"rid": w.logID})
+				LogFields{"rid": w.logID, "uaid": w.uaid})
 		}
 		goto forceReset
 	}
 	if !id.Valid(request.DeviceID) {
 		if logWarning {
 			w.logger.Warn("worker", "Invalid character in UAID",
-				LogFields{"rid": w.logID})
+				LogFields{"rid": w.logID, "uaid": w.uaid})
 		}
 		goto forceReset
 	}
+	if w.app.deviceAuth {
+		// Authenticate the client before touching any existing device state.
+		if authenticated, err = w.authenticate(request); err != nil {
+			return "", false, err
+		}
+		if !authenticated {
+			goto forceReset
+		}
+	}
 	if !w.store.CanStore(len(request.ChannelIDs)) {
 		// are there a suspicious number of channels?
 		if logWarning {
@@ -510,16 +617,83 @@ func (w *WorkerWS) handshake(request *HelloRequest) (
 	return request.DeviceID, true, nil
 
 forceReset:
+	w.deviceAuth = nil
 	if deviceID, err = idGenerate(); err != nil {
 		return "", false, err
 	}
 	return deviceID, true, nil
 }
 
+// authenticate verifies the credentials presented by a reconnecting client.
+// Devices that have not been issued credentials are rejected, unless the
+// application is migrating existing devices to device authentication; those
+// devices receive a secret once the handshake completes.
+func (w *WorkerWS) authenticate(request *HelloRequest) (ok bool, err error) {
+	store := w.store.(DeviceAuthStore)
+	auth, err := store.FetchDeviceAuth(request.DeviceID)
+	if err != nil {
+		if w.logger.ShouldLog(ERROR) {
+			w.logger.Error("worker", "Could not fetch device credentials",
+				LogFields{"rid": w.logID, "uaid": request.DeviceID,
+					"error": err.Error()})
+		}
+		return false, err
+	}
+	if auth == nil {
+		if w.app.deviceAuthMigrate {
+			return true, nil
+		}
+		if w.logger.ShouldLog(WARNING) {
+			w.logger.Warn("worker",
+				"Device has no credentials; resetting UAID",
+				LogFields{"rid": w.logID, "uaid": request.DeviceID})
+		}
+		w.metrics.Increment("updates.client.auth_missing")
+		return false, nil
+	}
+	if !auth.Verify(request.Secret) {
+		if w.logger.ShouldLog(WARNING) {
+			w.logger.Warn("worker",
+				"Device authentication failed; resetting UAID",
+				LogFields{"rid": w.logID, "uaid": request.DeviceID})
+		}
+		w.metrics.Increment("updates.client.auth_failed")
+		return false, nil
+	}
+	w.deviceAuth = auth
+	return true, nil
+}
+
+// issueCredentials issues a secret to a device without credentials.
+// Authenticated devices keep their existing secret.
+func (w *WorkerWS) issueCredentials(uaid string) (err error) {
+	if w.deviceAuth != nil {
+		return nil
+	}
+	secret, err := newDeviceToken()
+	if err != nil {
+		return err
+	}
+	auth := &DeviceAuth{SecretHash: hashDeviceSecret(secret)}
+	if err = w.store.(DeviceAuthStore).PutDeviceAuth(uaid, auth); err != nil {
+		if w.logger.ShouldLog(ERROR) {
+			w.logger.Error("worker", "Could not store device credentials",
+				LogFields{"rid": w.logID, "uaid": uaid, "error": err.Error()})
+		}
+		return err
+	}
+	w.deviceAuth = auth
+	w.authSecret = secret
+	return nil
+}
+
 // checkRedirect determines if a connecting client should be redirected to a
 // different host. wroteReply indicates whether checkRedirect responded to the
 // client; if so, the caller should close the connection.
 func (w *WorkerWS) checkRedirect(header *RequestHeader) (wroteReply bool) {
+	if w.app.Draining() {
+		return w.rejectDraining(header)
+	}
 	b := w.app.Balancer()
 	if b == nil {
 		return false
@@ -529,7 +703,7 @@ func (w *WorkerWS) checkRedirect(header *RequestHeader) (wroteReply bool) {
 	if err != nil {
 		if w.logger.ShouldLog(WARNING) {
 			w.logger.Warn("worker", "Failed to redirect client", LogFields{
-				"error": err.Error(), "rid": w.logID, "cmd": header.Type})
+				"error": err.Error(), "rid": w.logID, "uaid": w.uaid, "cmd": header.Type})
 		}
 		reply := fmt.Sprintf(`{"messageType":%q,"uaid":%q,"status":429}`,
 			header.Type, uaid)
@@ -541,7 +715,28 @@ func (w *WorkerWS) checkRedirect(header *RequestHeader) (wroteReply bool) {
 	}
 	if w.logger.ShouldLog(DEBUG) {
 		w.logger.Debug("worker", "Redirecting client", LogFields{
-			"rid": w.logID, "cmd": header.Type, "origin": origin})
+			"rid": w.logID, "uaid": w.uaid, "cmd": header.Type, "origin": origin})
+	}
+	reply := fmt.Sprintf(`{"messageType":%q,"uaid":%q,"status":307,"redirect":%q}`,
+		header.Type, uaid, origin)
+	w.WriteText(reply)
+	return true
+}
+
+// rejectDraining redirects a client connecting to a draining node to a peer,
+// or asks it to retry later if no peers are available.
+func (w *WorkerWS) rejectDraining(header *RequestHeader) (wroteReply bool) {
+	uaid := w.UAID()
+	origin, ok := w.app.drainPeer()
+	if !ok {
+		reply := fmt.Sprintf(`{"messageType":%q,"uaid":%q,"status":503}`,
+			header.Type, uaid)
+		w.WriteText(reply)
+		return true
+	}
+	if w.logger.ShouldLog(DEBUG) {
+		w.logger.Debug("worker", "Redirecting client from draining node",
+			LogFields{"rid": w.logID, "uaid": w.uaid, "cmd": header.Type, "origin": origin})
 	}
 	reply := fmt.Sprintf(`{"messageType":%q,"uaid":%q,"status":307,"redirect":%q}`,
 		header.Type, uaid, origin)
@@ -549,6 +744,42 @@ func (w *WorkerWS) checkRedirect(header *RequestHeader) (wroteReply bool) {
 	return true
 }
 
+// rejectHello asks a client that exceeded the handshake rate to retry later.
+func (w *WorkerWS) rejectHello(header *RequestHeader, err error) {
+	w.metrics.Increment("client.limit." + ClientLimitHelloRate)
+	if w.logger.ShouldLog(NOTICE) {
+		w.logger.Notice("worker", "Rejected client handshake", LogFields{
+			"rid": w.logID, "uaid": w.uaid, "remoteAddr": w.clientIP,
+			"error": err.Error()})
+	}
+	reply := fmt.Sprintf(`{"messageType":%q,"uaid":%q,"status":429}`,
+		header.Type, w.UAID())
+	w.WriteText(reply)
+}
+
+// Idle implements Worker.Idle.
+func (w *WorkerWS) Idle() bool {
+	if len(w.outbound) > 0 {
+		return false
+	}
+	w.unackedLock.Lock()
+	defer w.unackedLock.Unlock()
+	return len(w.unacked) == 0
+}
+
+// Redirect implements Worker.Redirect. The redirect is sent as an unsolicited
+// handshake reply, matching the reply sent to clients redirected by the
+// balancer.
+func (w *WorkerWS) Redirect(origin string) error {
+	if w.logger.ShouldLog(DEBUG) {
+		w.logger.Debug("worker", "Redirecting client",
+			LogFields{"rid": w.logID, "uaid": w.uaid, "origin": origin})
+	}
+	reply := fmt.Sprintf(`{"messageType":"hello","uaid":%q,"status":307,"redirect":%q}`,
+		w.UAID(), origin)
+	return w.WriteText(reply)
+}
+
 // registerPropPing registers the client with the proprietary pinger if one is
 // set and connect is not empty.
 func (w *WorkerWS) registerPropPing(connect []byte) (err error) {
@@ -576,7 +807,7 @@ func (w *WorkerWS) Ack(_ *RequestHeader, message []byte) (err error) {
 			if err, _ := r.(error); err != nil && w.logger.ShouldLog(ERROR) {
 				stack := make([]byte, 1<<16)
 				n := runtime.Stack(stack, false)
-				w.logger.Error("worker", "Unhandled error", LogFields{"rid": w.logID,
+				w.logger.Error("worker", "Unhandled error", LogFields{"rid": w.logID, "uaid": w.uaid,
 					"cmd": "ack", "error": ErrStr(err), "stack": string(stack[:n])})
 			}
 			err = ErrInvalidParams
@@ -594,10 +825,27 @@ func (w *WorkerWS) Ack(_ *RequestHeader, message []byte) (err error) {
 		return ErrNoParams
 	}
 	w.metrics.Increment("updates.client.ack")
+	w.trackAcked(request.Updates, request.Expired)
+	for _, update := range request.Updates {
+		delete(w.flushPending, update.ChannelID)
+	}
+	for _, channelID := range request.Expired {
+		delete(w.flushPending, channelID)
+	}
 	for _, update := range request.Updates {
 		if err = w.store.Drop(uaid, update.ChannelID); err != nil {
 			goto logError
 		}
+		if receipts := w.app.Receipts(); receipts != nil {
+			err := receipts.Acked(uaid, update.ChannelID, int64(update.Version))
+			if err != nil && w.logger.ShouldLog(WARNING) {
+				w.logger.Warn("worker", "Could not send delivery receipt", LogFields{
+					"rid":   w.logID,
+					"cmd":   "ack",
+					"chid":  update.ChannelID,
+					"error": ErrStr(err)})
+			}
+		}
 	}
 	for _, channelID := range request.Expired {
 		if err = w.store.Drop(uaid, channelID); err != nil {
@@ -606,14 +854,15 @@ func (w *WorkerWS) Ack(_ *RequestHeader, message []byte) (err error) {
 	}
 	if w.logger.ShouldLog(DEBUG) {
 		w.logger.Debug("worker", "sending response",
-			LogFields{"rid": w.logID, "cmd": "ack"})
+			LogFields{"rid": w.logID, "uaid": w.uaid, "cmd": "ack"})
 	}
-	// Get the lastAccessed time from wherever.
-	return w.Flush(0)
+	// Skip updates sent by the previous flush that are still awaiting
+	// acknowledgement.
+	return w.Flush(w.flushCursor)
 logError:
 	if w.logger.ShouldLog(WARNING) {
 		w.logger.Warn("worker", "sending response",
-			LogFields{"rid": w.logID, "cmd": "ack", "error": ErrStr(err)})
+			LogFields{"rid": w.logID, "uaid": w.uaid, "cmd": "ack", "error": ErrStr(err)})
 	}
 	return err
 }
@@ -625,7 +874,7 @@ func (w *WorkerWS) Register(header *RequestHeader, message []byte) (err error) {
 			if err, _ := r.(error); err != nil && w.logger.ShouldLog(ERROR) {
 				stack := make([]byte, 1<<16)
 				n := runtime.Stack(stack, false)
-				w.logger.Error("worker", "Unhandled error", LogFields{"rid": w.logID,
+				w.logger.Error("worker", "Unhandled error", LogFields{"rid": w.logID, "uaid": w.uaid,
 					"cmd": "register", "error": ErrStr(err), "stack": string(stack[:n])})
 			}
 			err = ErrInvalidParams
@@ -640,18 +889,31 @@ func (w *WorkerWS) Register(header *RequestHeader, message []byte) (err error) {
 	if err = json.Unmarshal(message, request); err != nil || !id.Valid(request.ChannelID) {
 		return ErrInvalidParams
 	}
+	if len(request.ReceiptURL) > 0 && !ValidReceiptURL(request.ReceiptURL) {
+		return ErrInvalidParams
+	}
 	if err = w.store.Register(uaid, request.ChannelID, 0); err != nil {
 		if w.logger.ShouldLog(WARNING) {
 			w.logger.Warn("worker", "Register failed, error updating backing store",
-				LogFields{"rid": w.logID, "cmd": "register", "error": ErrStr(err)})
+				LogFields{"rid": w.logID, "uaid": w.uaid, "cmd": "register", "error": ErrStr(err)})
 		}
 		return err
 	}
+	receipts := w.app.Receipts()
+	if receipts != nil && len(request.ReceiptURL) > 0 {
+		if err = receipts.Register(uaid, request.ChannelID, request.ReceiptURL); err != nil {
+			if w.logger.ShouldLog(WARNING) {
+				w.logger.Warn("worker", "Register failed, error storing receipt URL",
+					LogFields{"rid": w.logID, "uaid": w.uaid, "cmd": "register", "error": ErrStr(err)})
+			}
+			return err
+		}
+	}
 	key, err := w.store.IDsToKey(uaid, request.ChannelID)
 	if err != nil {
 		if w.logger.ShouldLog(WARNING) {
 			w.logger.Warn("worker", "Error generating primary key",
-				LogFields{"rid": w.logID, "cmd": "register", "error": ErrStr(err)})
+				LogFields{"rid": w.logID, "uaid": w.uaid, "cmd": "register", "error": ErrStr(err)})
 		}
 		return err
 	}
@@ -698,7 +960,7 @@ func (w *WorkerWS) Unregister(header *RequestHeader, message []byte) (err error)
 			if err, _ := r.(error); err != nil && w.logger.ShouldLog(ERROR) {
 				stack := make([]byte, 1<<16)
 				n := runtime.Stack(stack, false)
-				w.logger.Error("worker", "Unhandled error", LogFields{"rid": w.logID,
+				w.logger.Error("worker", "Unhandled error", LogFields{"rid": w.logID, "uaid": w.uaid,
 					"cmd": "register", "error": ErrStr(err), "stack": string(stack[:n])})
 			}
 			err = ErrInvalidParams
@@ -708,7 +970,7 @@ func (w *WorkerWS) Unregister(header *RequestHeader, message []byte) (err error)
 	if uaid == "" {
 		if logWarning {
 			w.logger.Warn("worker", "Unregister failed, missing sock.uaid",
-				LogFields{"rid": w.logID})
+				LogFields{"rid": w.logID, "uaid": w.uaid})
 		}
 		return ErrNoHandshake
 	}
@@ -719,7 +981,7 @@ func (w *WorkerWS) Unregister(header *RequestHeader, message []byte) (err error)
 	if len(request.ChannelID) == 0 {
 		if logWarning {
 			w.logger.Warn("worker", "Unregister failed, missing channelID",
-				LogFields{"rid": w.logID})
+				LogFields{"rid": w.logID, "uaid": w.uaid})
 		}
 		return ErrNoParams
 	}
@@ -727,26 +989,37 @@ func (w *WorkerWS) Unregister(header *RequestHeader, message []byte) (err error)
 	if err = w.store.Unregister(uaid, request.ChannelID); err != nil {
 		if logWarning {
 			w.logger.Warn("worker", "Unregister failed, error updating backing store",
-				LogFields{"rid": w.logID, "error": ErrStr(err)})
+				LogFields{"rid": w.logID, "uaid": w.uaid, "error": ErrStr(err)})
 		}
 	} else if w.logger.ShouldLog(DEBUG) {
 		w.logger.Debug("worker", "sending response",
-			LogFields{"rid": w.logID, "cmd": "unregister"})
+			LogFields{"rid": w.logID, "uaid": w.uaid, "cmd": "unregister"})
+	}
+	if receipts := w.app.Receipts(); receipts != nil {
+		if err := receipts.Unregister(uaid, request.ChannelID); err != nil && logWarning {
+			w.logger.Warn("worker", "Unregister failed, error dropping receipt",
+				LogFields{"rid": w.logID, "uaid": w.uaid, "error": ErrStr(err)})
+		}
 	}
 	w.WriteJSON(UnregisterReply{header.Type, 200, request.ChannelID})
 	w.metrics.Increment("updates.client.unregister")
 	return nil
 }
 
-// Send implements Worker.Send. If Send panics and a proprietary pinger is
-// set, the update will be delivered via the proprietary mechanism.
-func (w *WorkerWS) Send(chid string, version int64, data string) (err error) {
+// Send implements Worker.Send. Send only queues the update for the write loop,
+// and returns an error if the outbound queue is full. The proprietary pinger
+// fallback for failed writes is handled by writeUpdates.
+func (w *WorkerWS) Send(chid string, version int64, data string,
+	accepted time.Time, path DeliveryPath, span *Span) (err error) {
+
+	sendSpan := span.Child("worker.send")
+	defer func() { sendSpan.Finish(err) }()
 	startTime := timeNow()
 	uaid := w.UAID()
 	if uaid == "" {
 		if w.logger.ShouldLog(WARNING) {
 			w.logger.Warn("worker", "Failed to send update to unidentified client",
-				LogFields{"rid": w.logID})
+				LogFields{"rid": w.logID, "uaid": w.uaid})
 		}
 		// Have the server clean up records associated with this UAID.
 		// (Probably "none", but still good for housekeeping)
@@ -754,23 +1027,143 @@ func (w *WorkerWS) Send(chid string, version int64, data string) (err error) {
 		return nil
 	}
 	defer func() {
-		endTime := timeNow()
+		// The write loop records the time taken to write the update.
 		if w.logger.ShouldLog(INFO) {
-			w.logger.Info("worker", "Update sent to client", LogFields{
-				"duration": strconv.FormatInt(int64(endTime.Sub(startTime)), 10),
+			w.logger.Info("worker", "Update queued for client", LogFields{
+				"duration": strconv.FormatInt(int64(timeNow().Sub(startTime)), 10),
 				"uaid":     uaid})
 		}
-		r := recover()
-		if r == nil {
-			if err != nil {
+	}()
+	if w.logger.ShouldLog(DEBUG) {
+		w.logger.Debug("worker", "Sending update to client", LogFields{
+			"rid":     w.logID,
+			"uaid":    uaid,
+			"chid":    chid,
+			"version": strconv.FormatInt(version, 10),
+		})
+	}
+	sendSpan.SetAttribute("uaid", uaid)
+	// hand craft a notification update to the client. Updates queued while
+	// a write is in flight are batched by the write loop.
+	return w.queueUpdates([]Update{{
+		ChannelID: chid,
+		Version:   uint64(version),
+		Data:      data,
+		Accepted:  accepted,
+		Path:      path,
+	}}, nil)
+}
+
+// queueUpdates adds updates and expired channels to the outbound queue
+// without blocking. If the queue is full, the client is disconnected; the
+// updates remain in storage, and will be flushed when the client reconnects.
+func (w *WorkerWS) queueUpdates(updates []Update, expired []string) error {
+	select {
+	case w.outbound <- outboundUpdates{updates, expired}:
+		return nil
+	default:
+	}
+	if w.logger.ShouldLog(WARNING) {
+		w.logger.Warn("worker", "Outbound queue full; disconnecting client",
+			LogFields{"rid": w.logID, "uaid": w.UAID()})
+	}
+	w.metrics.Increment("client.socket.overflow")
+	w.disconnect()
+	return ErrSlowClient
+}
+
+// writeLoop writes queued updates to the socket until stop is closed, or a
+// write fails. Notifications are only written by the write loop, so that
+// writes don't interleave, and each write is bound by the write timeout.
+func (w *WorkerWS) writeLoop(stop <-chan bool) {
+	for {
+		select {
+		case <-stop:
+			return
+		case queued := <-w.outbound:
+			batch := w.batchUpdates(stop, queued)
+			if err := w.writeUpdates(batch); err != nil {
+				w.disconnect()
 				return
 			}
-			w.metrics.Timer("client.flush", endTime.Sub(startTime))
+		}
+	}
+}
+
+// batchUpdates coalesces a queued notification with all other queued
+// notifications, and any notifications queued within the batch window, into
+// a single batch.
+func (w *WorkerWS) batchUpdates(stop <-chan bool, queued outboundUpdates) (
+	batch outboundUpdates) {
+
+	batch.add(queued)
+	var window <-chan time.Time
+	if w.batchWindow > 0 {
+		timer := time.NewTimer(w.batchWindow)
+		defer timer.Stop()
+		window = timer.C
+	}
+	for {
+		select {
+		case queued = <-w.outbound:
+			batch.add(queued)
+			continue
+		default:
+		}
+		if window == nil {
+			return batch
+		}
+		select {
+		case <-stop:
+			return batch
+		case <-window:
+			// Drain updates queued since the last check, then return.
+			window = nil
+		case queued = <-w.outbound:
+			batch.add(queued)
+		}
+	}
+}
+
+// coalesceUpdates appends updates to batch, keeping only the highest version
+// for each channel.
+func coalesceUpdates(batch []Update, updates []Update) []Update {
+	for _, update := range updates {
+		merged := false
+		for i := range batch {
+			if batch[i].ChannelID != update.ChannelID {
+				continue
+			}
+			if update.Version > batch[i].Version {
+				batch[i] = update
+			}
+			merged = true
+			break
+		}
+		if !merged {
+			batch = append(batch, update)
+		}
+	}
+	return batch
+}
+
+// writeUpdates writes a notification containing a batch of updates and
+// expired channels to the socket. If writeUpdates panics and a proprietary
+// pinger is set, the updates will be delivered via the proprietary mechanism.
+func (w *WorkerWS) writeUpdates(batch outboundUpdates) (err error) {
+	startTime := timeNow()
+	uaid := w.UAID()
+	updates := batch.updates
+	defer func() {
+		r := recover()
+		if r == nil {
 			return
 		}
 		pinger := w.app.PropPinger()
 		if pinger != nil {
-			pinger.Send(uaid, version, data)
+			for _, update := range updates {
+				pinger.Send(uaid, int64(update.Version), update.Data)
+			}
 		}
 		err = fmt.Errorf("Error sending update: %#v", r)
 		if w.logger.ShouldLog(ERROR) {
@@ -782,22 +1175,33 @@ func (w *WorkerWS) Send(chid string, version int64, data string) (err error) {
 					"stack": string(stack[:n])})
 		}
 	}()
-	if w.logger.ShouldLog(DEBUG) {
-		w.logger.Debug("worker", "Sending update to client", LogFields{
-			"rid":     w.logID,
-			"uaid":    uaid,
-			"chid":    chid,
-			"version": strconv.FormatInt(version, 10),
-		})
+	if w.writeTimeout > 0 {
+		// Clear the deadline once the write completes, so that it doesn't apply
+		// to replies written by the read loop.
+		w.SetWriteDeadline(timeNow().Add(w.writeTimeout))
+		defer w.SetWriteDeadline(time.Time{})
+	}
+	reply := FlushReply{"notification", updates, batch.expired}
+	if err = w.WriteJSON(reply); err != nil {
+		if w.logger.ShouldLog(WARNING) {
+			w.logger.Warn("worker", "Error writing updates; disconnecting client",
+				LogFields{"rid": w.logID, "uaid": uaid, "error": ErrStr(err)})
+		}
+		return err
 	}
-	// hand craft a notification update to the client.
-	// TODO: allow bulk updates.
-	updates := []Update{{chid, uint64(version), data}}
-	w.WriteJSON(FlushReply{"notification", updates, nil})
-	w.metrics.Increment("updates.sent")
+	w.metrics.Timer("client.flush", timeNow().Sub(startTime))
+	w.trackSent(updates)
+	w.metrics.IncrementBy("updates.sent", int64(len(updates)))
 	return nil
 }
 
+// disconnect stops the worker and closes the underlying socket, unblocking
+// the read loop.
+func (w *WorkerWS) disconnect() {
+	w.stop()
+	w.Socket.Close()
+}
+
 // Flush implements Worker.Flush.
 func (w *WorkerWS) Flush(lastAccessed int64) (err error) {
 	startTime := timeNow()
@@ -806,7 +1210,7 @@ func (w *WorkerWS) Flush(lastAccessed int64) (err error) {
 		if w.logger.ShouldLog(WARNING) {
 			w.logger.Warn("worker",
 				"Failed to flush pending updates to unidentified client",
-				LogFields{"rid": w.logID})
+				LogFields{"rid": w.logID, "uaid": w.uaid})
 		}
 		w.stop()
 		return nil
@@ -831,9 +1235,13 @@ func (w *WorkerWS) Flush(lastAccessed int64) (err error) {
 		}
 		return err
 	}
+	w.trackFlushed(startTime, updates, expired)
 	if len(updates) == 0 && len(expired) == 0 {
 		return nil
 	}
+	for i := range updates {
+		updates[i].Path = DeliveryFlushed
+	}
 	if w.logger.ShouldLog(DEBUG) {
 		logStrings := make([]string, len(updates))
 		for i, update := range updates {
@@ -844,8 +1252,181 @@ func (w *WorkerWS) Flush(lastAccessed int64) (err error) {
 			"rid":     w.logID,
 			"updates": fmt.Sprintf("[%s]", strings.Join(logStrings, ", "))})
 	}
-	w.WriteJSON(FlushReply{"notification", updates, expired})
-	w.metrics.IncrementBy("updates.sent", int64(len(updates)))
+	// Queue the updates instead of writing them from the read loop, so that
+	// the write loop is the only writer.
+	return w.queueUpdates(updates, expired)
+}
+
+// fetchCursor returns the persisted flush cursor for the client, or 0 if the
+// store does not support cursors.
+func (w *WorkerWS) fetchCursor() int64 {
+	store, ok := w.store.(CursorStore)
+	if !ok {
+		return 0
+	}
+	cursor, err := store.FetchCursor(w.UAID())
+	if err != nil {
+		if w.logger.ShouldLog(WARNING) {
+			w.logger.Warn("worker", "Could not fetch flush cursor",
+				LogFields{"rid": w.logID, "uaid": w.UAID(), "error": ErrStr(err)})
+		}
+		return 0
+	}
+	if cursor.IsZero() {
+		return 0
+	}
+	return cursor.Unix()
+}
+
+// trackFlushed records the channels included in a flush that started at
+// startTime. Once the client has acknowledged every flushed channel, all
+// remaining records changed after the start of the latest flush, so the
+// start time is persisted as the client's flush cursor.
+func (w *WorkerWS) trackFlushed(startTime time.Time, updates []Update,
+	expired []string) {
+
+	w.flushCursor = startTime.Add(-cursorSkew).Unix()
+	if w.flushPending == nil {
+		w.flushPending = make(map[string]bool)
+	}
+	for _, update := range updates {
+		w.flushPending[update.ChannelID] = true
+	}
+	for _, chid := range expired {
+		w.flushPending[chid] = true
+	}
+	if len(w.flushPending) > 0 || w.flushCursor <= w.ackCursor {
+		return
+	}
+	store, ok := w.store.(CursorStore)
+	if !ok {
+		return
+	}
+	if err := store.PutCursor(w.UAID(), time.Unix(w.flushCursor, 0)); err != nil {
+		if w.logger.ShouldLog(WARNING) {
+			w.logger.Warn("worker", "Could not store flush cursor",
+				LogFields{"rid": w.logID, "uaid": w.UAID(), "error": ErrStr(err)})
+		}
+		return
+	}
+	w.ackCursor = w.flushCursor
+}
+
+// trackSent records updates written to the socket, so that they can be
+// resent if the client does not acknowledge them within the ack timeout, and
+// so that the delivery latency can be measured when the client acknowledges
+// them. Updates are not tracked if redelivery is disabled, so that idle
+// clients are not kept waiting for acknowledgements.
+func (w *WorkerWS) trackSent(updates []Update) {
+	if w.ackTimeout == 0 || len(updates) == 0 {
+		return
+	}
+	now := timeNow()
+	w.unackedLock.Lock()
+	defer w.unackedLock.Unlock()
+	if w.unacked == nil {
+		w.unacked = make(map[string]*unackedUpdate)
+	}
+	for _, update := range updates {
+		pending, ok := w.unacked[update.ChannelID]
+		if ok && pending.Version == update.Version {
+			// Flushing an unacknowledged update extends its deadline.
+			pending.lastSent = now
+			continue
+		}
+		w.unacked[update.ChannelID] = &unackedUpdate{
+			Update:    update,
+			firstSent: now,
+			lastSent:  now,
+		}
+	}
+}
+
+// trackAcked stops tracking acknowledged updates and expired channels, and
+// records the time between accepting each acknowledged update from the app
+// server and the client's acknowledgement.
+func (w *WorkerWS) trackAcked(updates []Update, expired []string) {
+	now := timeNow()
+	w.unackedLock.Lock()
+	defer w.unackedLock.Unlock()
+	for _, update := range updates {
+		pending, ok := w.unacked[update.ChannelID]
+		if !ok || update.Version < pending.Version {
+			continue
+		}
+		w.metrics.Timer("client.ack.latency", now.Sub(pending.firstSent))
+		if !pending.Accepted.IsZero() {
+			latency := now.Sub(pending.Accepted)
+			w.metrics.Timer("delivery.latency", latency)
+			w.metrics.Timer("delivery.latency."+string(pending.Path), latency)
+		}
+		delete(w.unacked, update.ChannelID)
+	}
+	for _, chid := range expired {
+		delete(w.unacked, chid)
+	}
+}
+
+// redeliveryLoop periodically redelivers unacknowledged updates until stop
+// is closed.
+func (w *WorkerWS) redeliveryLoop(stop <-chan bool) {
+	ticker := time.NewTicker(w.ackTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if w.stopped() {
+				return
+			}
+			w.redeliverUnacked()
+		}
+	}
+}
+
+// redeliverUnacked queues all updates that have not been acknowledged within
+// the ack timeout. Updates are abandoned after the maximum number of
+// redeliveries; they remain in storage, and will be flushed when the client
+// reconnects.
+func (w *WorkerWS) redeliverUnacked() (err error) {
+	now := timeNow()
+	var updates []Update
+	w.unackedLock.Lock()
+	for chid, pending := range w.unacked {
+		if now.Sub(pending.lastSent) < w.ackTimeout {
+			continue
+		}
+		if w.maxRedeliver > 0 && pending.redeliveries >= w.maxRedeliver {
+			if w.logger.ShouldLog(WARNING) {
+				w.logger.Warn("worker", "Client did not acknowledge update", LogFields{
+					"rid":     w.logID,
+					"uaid":    w.UAID(),
+					"chid":    chid,
+					"version": strconv.FormatUint(pending.Version, 10)})
+			}
+			w.metrics.Increment("updates.client.unacked")
+			delete(w.unacked, chid)
+			continue
+		}
+		pending.redeliveries++
+		pending.lastSent = now
+		updates = append(updates, pending.Update)
+	}
+	w.unackedLock.Unlock()
+	if len(updates) == 0 {
+		return nil
+	}
+	if w.logger.ShouldLog(DEBUG) {
+		w.logger.Debug("worker", "Redelivering unacknowledged updates", LogFields{
+			"rid":     w.logID,
+			"uaid":    w.UAID(),
+			"updates": strconv.Itoa(len(updates))})
+	}
+	if err = w.queueUpdates(updates, nil); err != nil {
+		return err
+	}
+	w.metrics.IncrementBy("updates.client.redelivered", int64(len(updates)))
 	return nil
 }
 
@@ -858,7 +1439,7 @@ func (w *WorkerWS) Ping(header *RequestHeader, _ []byte) (err error) {
 				source = "No Socket Origin"
 			}
 			w.logger.Warn("worker", "Client sending too many pings",
-				LogFields{"rid": w.logID, "source": source})
+				LogFields{"rid": w.logID, "uaid": w.uaid, "source": source})
 		}
 		w.stop()
 		w.metrics.Increment("updates.client.too_many_pings")
@@ -926,7 +1507,9 @@ func (r *NoWorker) Run() {
 	r.Logger.Debug("noworker", "Run", nil)
 }
 
-func (r *NoWorker) Send(channel string, version int64, data string) error {
+func (r *NoWorker) Send(channel string, version int64, data string,
+	accepted time.Time, path DeliveryPath, span *Span) error {
+
 	r.Logger.Debug("noworker", "Got Send", LogFields{
 		"channel": channel,
 		"data":    data,
@@ -937,6 +1520,8 @@ func (r *NoWorker) Send(channel string, version int64, data string) error {
 }
 
 func (r *NoWorker) Flush(lastAccessed int64) error { return nil }
+func (r *NoWorker) Idle() bool                     { return true }
+func (r *NoWorker) Redirect(origin string) error   { return nil }
 
 // o4fs
 // vim: set tabstab=4 softtabstop=4 shiftwidth=4 noexpandtab
@@ -164,7 +164,7 @@ func TestWorkerFlush(t *testing.T) {
 		Convey("Should reject unidentified clients", func() {
 			wws.SetUAID("")
 
-			err := wws.Send("", int64(0), "")
+			err := wws.Send("", int64(0), "", time.Time{}, DeliveryDirect, nil)
 			So(err, ShouldBeNil)
 			So(wws.stopped(), ShouldBeTrue)
 		})
@@ -186,24 +186,32 @@ func TestWorkerFlush(t *testing.T) {
 			wws.SetUAID(uaid)
 
 			updates := []Update{
-				{"263d09f8950b11e4a1f83c15c2c622fe", 2, "I'm a little teapot"},
-				{"bac9d83a950b11e4bd713c15c2c622fe", 4, "Short and stout"},
+				{ChannelID: "263d09f8950b11e4a1f83c15c2c622fe", Version: 2,
+					Data: "I'm a little teapot"},
+				{ChannelID: "bac9d83a950b11e4bd713c15c2c622fe", Version: 4,
+					Data: "Short and stout"},
 			}
 			expired := []string{"c778e94a950b11e4ba7f3c15c2c622fe"}
 
 			gomock.InOrder(
 				mckStore.EXPECT().FetchAll(uaid, gomock.Any()).Return(
 					updates, expired, nil),
+				mckStat.EXPECT().Timer("client.flush", gomock.Any()),
+			)
+			err := wws.Flush(0)
+			So(err, ShouldBeNil)
+
+			// Flushed updates are written by the write loop.
+			gomock.InOrder(
 				mckSocket.EXPECT().WriteJSON(FlushReply{
 					Type:    "notification",
 					Updates: updates,
 					Expired: expired,
 				}),
-				mckStat.EXPECT().IncrementBy("updates.sent", int64(2)),
 				mckStat.EXPECT().Timer("client.flush", gomock.Any()),
+				mckStat.EXPECT().IncrementBy("updates.sent", int64(2)),
 			)
-
-			err := wws.Flush(0)
+			err = wws.writeUpdates(<-wws.outbound)
 			So(err, ShouldBeNil)
 		})
 
@@ -221,6 +229,101 @@ func TestWorkerFlush(t *testing.T) {
 	})
 }
 
+// cursorStore adds flush cursor support to a mock store.
+type cursorStore struct {
+	*MockStore
+	cursors map[string]time.Time
+}
+
+func (s *cursorStore) FetchCursor(uaid string) (time.Time, error) {
+	return s.cursors[uaid], nil
+}
+
+func (s *cursorStore) PutCursor(uaid string, cursor time.Time) error {
+	s.cursors[uaid] = cursor
+	return nil
+}
+
+func TestWorkerFlushCursor(t *testing.T) {
+	useMockFuncs()
+	defer useStdFuncs()
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+	mckStore := NewMockStore(mockCtrl)
+	mckSocket := NewMockSocket(mockCtrl)
+
+	Convey("Should flush updates since the last acknowledged flush", t, func() {
+		uaid := "0c5e2ba1f0a6498fa4c9ed4b0e3a6b7d"
+		chidA := "263d09f8950b11e4a1f83c15c2c622fe"
+		chidB := "bac9d83a950b11e4bd713c15c2c622fe"
+		lastCursor := time.Unix(1257890000, 0)
+		flushCursor := timeNow().Add(-cursorSkew).Unix()
+
+		store := &cursorStore{mckStore, map[string]time.Time{uaid: lastCursor}}
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		app.SetStore(store)
+
+		wws := NewWorker(app, mckSocket, "test")
+		wws.SetUAID(uaid)
+		So(wws.fetchCursor(), ShouldEqual, lastCursor.Unix())
+		wws.ackCursor = lastCursor.Unix()
+
+		updates := []Update{
+			{ChannelID: chidA, Version: 2},
+			{ChannelID: chidB, Version: 4},
+		}
+		gomock.InOrder(
+			mckStore.EXPECT().FetchAll(uaid, lastCursor).Return(updates, nil, nil),
+			mckStat.EXPECT().Timer("client.flush", gomock.Any()),
+			mckSocket.EXPECT().WriteJSON(FlushReply{
+				Type:    "notification",
+				Updates: updates,
+			}),
+			mckStat.EXPECT().Timer("client.flush", gomock.Any()),
+			mckStat.EXPECT().IncrementBy("updates.sent", int64(2)),
+		)
+		So(wws.Flush(wws.ackCursor), ShouldBeNil)
+		So(wws.writeUpdates(<-wws.outbound), ShouldBeNil)
+		So(wws.flushCursor, ShouldEqual, flushCursor)
+
+		Convey("Should not advance the cursor until all updates are acknowledged", func() {
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("updates.client.ack"),
+				mckStore.EXPECT().Drop(uaid, chidA),
+				mckStore.EXPECT().FetchAll(uaid, time.Unix(flushCursor, 0)).Return(
+					nil, nil, nil),
+				mckStat.EXPECT().Timer("client.flush", gomock.Any()),
+			)
+			ackBytes, _ := json.Marshal(ACKRequest{Updates: []Update{
+				{ChannelID: chidA, Version: 2}}})
+			So(wws.Ack(nil, ackBytes), ShouldBeNil)
+			So(store.cursors[uaid], ShouldResemble, lastCursor)
+
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("updates.client.ack"),
+				mckStore.EXPECT().Drop(uaid, chidB),
+				mckStore.EXPECT().FetchAll(uaid, time.Unix(flushCursor, 0)).Return(
+					nil, nil, nil),
+				mckStat.EXPECT().Timer("client.flush", gomock.Any()),
+			)
+			ackBytes, _ = json.Marshal(ACKRequest{Updates: []Update{
+				{ChannelID: chidB, Version: 4}}})
+			So(wws.Ack(nil, ackBytes), ShouldBeNil)
+			So(store.cursors[uaid], ShouldResemble, time.Unix(flushCursor, 0))
+			So(wws.ackCursor, ShouldEqual, flushCursor)
+		})
+	})
+}
+
 func TestWorkerSend(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
@@ -249,7 +352,7 @@ func TestWorkerSend(t *testing.T) {
 			So(wws.stopped(), ShouldBeTrue)
 		})
 
-		Convey("Should send a proprietary ping if flush panics", func() {
+		Convey("Should send a proprietary ping if writing updates panics", func() {
 			uaid := "4dd3327e8a68462389eb6ab771c05867"
 			wws.SetUAID(uaid)
 
@@ -261,16 +364,17 @@ func TestWorkerSend(t *testing.T) {
 			chid := "41d1a3a6517b47d5a4aaabd82ae5f3ba"
 			version := int64(3)
 			data := "Unfortunately, as you probably already know, people"
+			update := Update{ChannelID: chid, Version: uint64(version), Data: data}
 
 			gomock.InOrder(
 				mckSocket.EXPECT().WriteJSON(FlushReply{
 					Type:    "notification",
-					Updates: []Update{{chid, uint64(version), data}},
+					Updates: []Update{update},
 				}).Do(writePanic),
 				mckPinger.EXPECT().Send(uaid, version, data),
 			)
 
-			err := wws.Send(chid, version, data)
+			err := wws.writeUpdates(outboundUpdates{updates: []Update{update}})
 			So(err, ShouldNotBeNil)
 		})
 
@@ -281,18 +385,161 @@ func TestWorkerSend(t *testing.T) {
 			version := int64(3)
 			data := "Here is my handle; here is my spout"
 
+			acceptedAt := timeNow().Add(-2 * time.Second)
+
+			err := wws.Send(chid, version, data, acceptedAt, DeliveryRouted, nil)
+			So(err, ShouldBeNil)
+
 			gomock.InOrder(
 				mckSocket.EXPECT().WriteJSON(FlushReply{
-					Type:    "notification",
-					Updates: []Update{{chid, uint64(version), data}},
+					Type: "notification",
+					Updates: []Update{{
+						ChannelID: chid,
+						Version:   uint64(version),
+						Data:      data,
+						Accepted:  acceptedAt,
+						Path:      DeliveryRouted,
+					}},
 				}),
-				mckStat.EXPECT().Increment("updates.sent"),
 				mckStat.EXPECT().Timer("client.flush", gomock.Any()),
+				mckStat.EXPECT().IncrementBy("updates.sent", int64(1)),
 			)
+			err = wws.writeUpdates(<-wws.outbound)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Should set a write deadline", func() {
+			app.clientWriteTimeout = 5 * time.Second
+			wws := NewWorker(app, mckSocket, "test")
+			wws.SetUAID("8b3ddd8c9b7d4d6e8d8f2e2a9c5b1f47")
 
-			err := wws.Send(chid, version, data)
+			updates := []Update{
+				{ChannelID: "b1f0e5c4f6a34d6fa2c4b0fd9ad7c1e0", Version: 1}}
+			gomock.InOrder(
+				mckSocket.EXPECT().SetWriteDeadline(gomock.Any()),
+				mckSocket.EXPECT().WriteJSON(FlushReply{
+					Type:    "notification",
+					Updates: updates,
+				}),
+				mckStat.EXPECT().Timer("client.flush", gomock.Any()),
+				mckStat.EXPECT().IncrementBy("updates.sent", int64(1)),
+				mckSocket.EXPECT().SetWriteDeadline(time.Time{}),
+			)
+			err := wws.writeUpdates(outboundUpdates{updates: updates})
 			So(err, ShouldBeNil)
 		})
+
+		Convey("Should disconnect clients if the queue is full", func() {
+			wws.SetUAID("b9c5c9d0b3e6420f9a8b7c9cbbfa6a54")
+
+			chid := "e9d3b5f4a6c84e0d9f1b2a3c4d5e6f70"
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("client.socket.overflow"),
+				mckSocket.EXPECT().Close(),
+			)
+			So(wws.Send(chid, 1, "", time.Time{}, DeliveryDirect, nil),
+				ShouldBeNil)
+			So(wws.Send(chid, 2, "", time.Time{}, DeliveryDirect, nil),
+				ShouldEqual, ErrSlowClient)
+			So(wws.stopped(), ShouldBeTrue)
+		})
+
+		Convey("Should disconnect clients if a write fails", func() {
+			wws.SetUAID("0f4f1a4b2d7c4c8b9a6e5d4c3b2a1f0e")
+
+			writeErr := errors.New("connection reset by peer")
+			gomock.InOrder(
+				mckSocket.EXPECT().WriteJSON(gomock.Any()).Return(writeErr),
+				mckSocket.EXPECT().Close(),
+			)
+			wws.outbound <- outboundUpdates{updates: []Update{
+				{ChannelID: "4c3b2a1f0e0f4f1a4b2d7c4c8b9a6e5d", Version: 1}}}
+			wws.writeLoop(make(chan bool))
+			So(wws.stopped(), ShouldBeTrue)
+		})
+	})
+}
+
+func TestWorkerBatch(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+	mckSocket := NewMockSocket(mockCtrl)
+
+	Convey("Should batch queued updates", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		app.clientQueueSize = 4
+
+		chidA := "5b0e4d5c2a7f4a3d8c1b9e6f0a2d4c8e"
+		chidB := "9f3e2d1c0b4a49e8a7d6c5b4a3f2e1d0"
+
+		Convey("Should keep the highest version for each channel", func() {
+			batch := coalesceUpdates(nil, []Update{
+				{ChannelID: chidA, Version: 2, Data: "two"},
+				{ChannelID: chidB, Version: 1, Data: "one"},
+				{ChannelID: chidA, Version: 1, Data: "stale"},
+			})
+			batch = coalesceUpdates(batch, []Update{
+				{ChannelID: chidA, Version: 3, Data: "three"}})
+			So(len(batch), ShouldEqual, 2)
+			So(batch[0], ShouldResemble,
+				Update{ChannelID: chidA, Version: 3, Data: "three"})
+			So(batch[1], ShouldResemble,
+				Update{ChannelID: chidB, Version: 1, Data: "one"})
+		})
+
+		Convey("Should coalesce updates queued during a write", func() {
+			wws := NewWorker(app, mckSocket, "test")
+			wws.outbound <- outboundUpdates{updates: []Update{
+				{ChannelID: chidB, Version: 4}}}
+			wws.outbound <- outboundUpdates{updates: []Update{
+				{ChannelID: chidA, Version: 5}}}
+
+			batch := wws.batchUpdates(make(chan bool), outboundUpdates{
+				updates: []Update{{ChannelID: chidA, Version: 2}}})
+			So(batch.updates, ShouldResemble, []Update{
+				{ChannelID: chidA, Version: 5},
+				{ChannelID: chidB, Version: 4},
+			})
+			So(len(wws.outbound), ShouldEqual, 0)
+		})
+
+		Convey("Should coalesce updates queued within the batch window", func() {
+			app.clientBatchWindow = 50 * time.Millisecond
+			wws := NewWorker(app, mckSocket, "test")
+			go func() {
+				wws.outbound <- outboundUpdates{updates: []Update{
+					{ChannelID: chidB, Version: 6}}}
+			}()
+
+			batch := wws.batchUpdates(make(chan bool), outboundUpdates{
+				updates: []Update{{ChannelID: chidA, Version: 1}}})
+			So(batch.updates, ShouldResemble, []Update{
+				{ChannelID: chidA, Version: 1},
+				{ChannelID: chidB, Version: 6},
+			})
+		})
+
+		Convey("Should include expired channels from queued flushes", func() {
+			wws := NewWorker(app, mckSocket, "test")
+			wws.outbound <- outboundUpdates{
+				updates: []Update{{ChannelID: chidA, Version: 3}},
+				expired: []string{chidB},
+			}
+
+			batch := wws.batchUpdates(make(chan bool), outboundUpdates{
+				updates: []Update{{ChannelID: chidA, Version: 2}}})
+			So(batch.updates, ShouldResemble, []Update{
+				{ChannelID: chidA, Version: 3}})
+			So(batch.expired, ShouldResemble, []string{chidB})
+		})
 	})
 }
 
@@ -380,8 +627,10 @@ func TestWorkerACK(t *testing.T) {
 			wws.SetUAID(uaid)
 
 			flushUpdates := []Update{
-				{"263d09f8950b11e4a1f83c15c2c622fe", 2, "I'm a little teapot"},
-				{"bac9d83a950b11e4bd713c15c2c622fe", 4, "Short and stout"},
+				{ChannelID: "263d09f8950b11e4a1f83c15c2c622fe", Version: 2,
+					Data: "I'm a little teapot"},
+				{ChannelID: "bac9d83a950b11e4bd713c15c2c622fe", Version: 4,
+					Data: "Short and stout"},
 			}
 			flushExpired := []string{"c778e94a950b11e4ba7f3c15c2c622fe"}
 
@@ -390,12 +639,6 @@ func TestWorkerACK(t *testing.T) {
 				mckStore.EXPECT().Drop(uaid, "3b17fc39d36547789cb97d73a3b291bb"),
 				mckStore.EXPECT().FetchAll(uaid, gomock.Any()).Return(
 					flushUpdates, flushExpired, nil),
-				mckSocket.EXPECT().WriteJSON(FlushReply{
-					Type:    "notification",
-					Updates: flushUpdates,
-					Expired: flushExpired,
-				}),
-				mckStat.EXPECT().IncrementBy("updates.sent", int64(2)),
 				mckStat.EXPECT().Timer("client.flush", gomock.Any()),
 			)
 
@@ -405,6 +648,9 @@ func TestWorkerACK(t *testing.T) {
 			})
 			err := wws.Ack(nil, ackBytes)
 			So(err, ShouldBeNil)
+			queued := <-wws.outbound
+			So(queued.updates, ShouldResemble, flushUpdates)
+			So(queued.expired, ShouldResemble, flushExpired)
 		})
 
 		Convey("Should not flush pending updates if an error occurs", func() {
@@ -454,6 +700,237 @@ func TestWorkerACK(t *testing.T) {
 	})
 }
 
+func TestWorkerRedelivery(t *testing.T) {
+	useMockFuncs()
+	defer useStdFuncs()
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+	mckStore := NewMockStore(mockCtrl)
+	mckSocket := NewMockSocket(mockCtrl)
+
+	Convey("Should redeliver unacknowledged updates", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		app.SetStore(mckStore)
+		app.clientAckTimeout = 10 * time.Second
+		app.clientRedeliveries = 2
+
+		sentAt := timeNow()
+		now := sentAt
+		timeNow = func() time.Time { return now }
+
+		uaid := "58bbb10f2ef7484d9c6e4ee5bb88d28a"
+		chid := "2ae4ad5f2ef44ce8a5a5e8e2f2e6c77d"
+		update := Update{ChannelID: chid, Version: 3,
+			Data: "Tip me over and pour me out"}
+		notification := FlushReply{
+			Type:    "notification",
+			Updates: []Update{update},
+		}
+
+		wws := NewWorker(app, mckSocket, "test")
+		wws.SetUAID(uaid)
+
+		gomock.InOrder(
+			mckSocket.EXPECT().WriteJSON(notification),
+			mckStat.EXPECT().Timer("client.flush", gomock.Any()),
+			mckStat.EXPECT().IncrementBy("updates.sent", int64(1)),
+		)
+		So(wws.writeUpdates(outboundUpdates{updates: []Update{update}}),
+			ShouldBeNil)
+
+		Convey("Should not redeliver updates before the ack timeout", func() {
+			now = sentAt.Add(5 * time.Second)
+			So(wws.redeliverUnacked(), ShouldBeNil)
+			So(len(wws.outbound), ShouldEqual, 0)
+		})
+
+		Convey("Should redeliver updates after the ack timeout", func() {
+			mckStat.EXPECT().IncrementBy("updates.client.redelivered", int64(1))
+			now = sentAt.Add(10 * time.Second)
+			So(wws.redeliverUnacked(), ShouldBeNil)
+			redelivered := <-wws.outbound
+			So(len(redelivered.updates), ShouldEqual, 1)
+			So(redelivered.updates[0], ShouldResemble, update)
+		})
+
+		Convey("Should abandon updates after the maximum redeliveries", func() {
+			mckStat.EXPECT().IncrementBy("updates.client.redelivered",
+				int64(1)).Times(2)
+			for i := 1; i <= 2; i++ {
+				now = sentAt.Add(time.Duration(i) * 10 * time.Second)
+				So(wws.redeliverUnacked(), ShouldBeNil)
+				<-wws.outbound
+			}
+			mckStat.EXPECT().Increment("updates.client.unacked")
+			now = sentAt.Add(30 * time.Second)
+			So(wws.redeliverUnacked(), ShouldBeNil)
+			So(len(wws.unacked), ShouldEqual, 0)
+			So(len(wws.outbound), ShouldEqual, 0)
+		})
+
+		Convey("Should stop tracking acknowledged updates", func() {
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("updates.client.ack"),
+				mckStat.EXPECT().Timer("client.ack.latency", 4*time.Second),
+				mckStore.EXPECT().Drop(uaid, chid),
+				mckStore.EXPECT().FetchAll(uaid, gomock.Any()).Return(nil, nil, nil),
+				mckStat.EXPECT().Timer("client.flush", gomock.Any()),
+			)
+			now = sentAt.Add(4 * time.Second)
+			ackBytes, _ := json.Marshal(ACKRequest{Updates: []Update{
+				{ChannelID: chid, Version: 3}}})
+			So(wws.Ack(nil, ackBytes), ShouldBeNil)
+
+			now = sentAt.Add(10 * time.Second)
+			So(wws.redeliverUnacked(), ShouldBeNil)
+			So(len(wws.unacked), ShouldEqual, 0)
+		})
+
+		Convey("Should keep tracking updates if a stale version is acknowledged", func() {
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("updates.client.ack"),
+				mckStore.EXPECT().Drop(uaid, chid),
+				mckStore.EXPECT().FetchAll(uaid, gomock.Any()).Return(nil, nil, nil),
+				mckStat.EXPECT().Timer("client.flush", gomock.Any()),
+			)
+			ackBytes, _ := json.Marshal(ACKRequest{Updates: []Update{
+				{ChannelID: chid, Version: 2}}})
+			So(wws.Ack(nil, ackBytes), ShouldBeNil)
+			_, isTracked := wws.unacked[chid]
+			So(isTracked, ShouldBeTrue)
+		})
+	})
+
+	Convey("Should not track updates if redelivery is disabled", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		app.SetStore(mckStore)
+
+		wws := NewWorker(app, mckSocket, "test")
+		wws.SetUAID("58bbb10f2ef7484d9c6e4ee5bb88d28a")
+
+		gomock.InOrder(
+			mckSocket.EXPECT().WriteJSON(gomock.Any()),
+			mckStat.EXPECT().Timer("client.flush", gomock.Any()),
+			mckStat.EXPECT().IncrementBy("updates.sent", int64(1)),
+		)
+		So(wws.writeUpdates(outboundUpdates{updates: []Update{
+			{ChannelID: "2ae4ad5f2ef44ce8a5a5e8e2f2e6c77d", Version: 3}}}),
+			ShouldBeNil)
+		So(len(wws.unacked), ShouldEqual, 0)
+		So(wws.Idle(), ShouldBeTrue)
+	})
+}
+
+func TestWorkerDeliveryLatency(t *testing.T) {
+	useMockFuncs()
+	defer useStdFuncs()
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+	mckStore := NewMockStore(mockCtrl)
+	mckSocket := NewMockSocket(mockCtrl)
+
+	Convey("Should measure delivery latency when the client acknowledges updates", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		app.SetStore(mckStore)
+		app.clientAckTimeout = 10 * time.Second
+
+		sentAt := timeNow()
+		now := sentAt
+		timeNow = func() time.Time { return now }
+
+		uaid := "d4c8bfb2a4e34d0b8d4b5bb5e0d7a1c9"
+		chid := "7e2f4a1c9b3d4e8f8a6c5b4d3e2f1a0b"
+		acceptedAt := sentAt.Add(-3 * time.Second)
+
+		wws := NewWorker(app, mckSocket, "test")
+		wws.SetUAID(uaid)
+
+		ackAfter := func(elapsed time.Duration) error {
+			gomock.InOrder(
+				mckStore.EXPECT().Drop(uaid, chid),
+				mckStore.EXPECT().FetchAll(uaid, gomock.Any()).Return(nil, nil, nil),
+				mckStat.EXPECT().Timer("client.flush", gomock.Any()),
+			)
+			now = sentAt.Add(elapsed)
+			ackBytes, _ := json.Marshal(ACKRequest{Updates: []Update{
+				{ChannelID: chid, Version: 3}}})
+			return wws.Ack(nil, ackBytes)
+		}
+
+		Convey("Should record the latency of routed updates", func() {
+			So(wws.Send(chid, 3, "", acceptedAt, DeliveryRouted, nil), ShouldBeNil)
+			mckSocket.EXPECT().WriteJSON(gomock.Any())
+			mckStat.EXPECT().Timer("client.flush", gomock.Any())
+			mckStat.EXPECT().IncrementBy("updates.sent", int64(1))
+			So(wws.writeUpdates(<-wws.outbound), ShouldBeNil)
+
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("updates.client.ack"),
+				mckStat.EXPECT().Timer("client.ack.latency", 2*time.Second),
+				mckStat.EXPECT().Timer("delivery.latency", 5*time.Second),
+				mckStat.EXPECT().Timer("delivery.latency.routed", 5*time.Second),
+			)
+			So(ackAfter(2*time.Second), ShouldBeNil)
+		})
+
+		Convey("Should record the latency of flushed updates", func() {
+			gomock.InOrder(
+				mckStore.EXPECT().FetchAll(uaid, gomock.Any()).Return(
+					[]Update{{ChannelID: chid, Version: 3, Accepted: acceptedAt}},
+					nil, nil),
+				mckStat.EXPECT().Timer("client.flush", gomock.Any()),
+				mckSocket.EXPECT().WriteJSON(gomock.Any()),
+				mckStat.EXPECT().Timer("client.flush", gomock.Any()),
+				mckStat.EXPECT().IncrementBy("updates.sent", int64(1)),
+			)
+			So(wws.Flush(0), ShouldBeNil)
+			So(wws.writeUpdates(<-wws.outbound), ShouldBeNil)
+
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("updates.client.ack"),
+				mckStat.EXPECT().Timer("client.ack.latency", 1*time.Second),
+				mckStat.EXPECT().Timer("delivery.latency", 4*time.Second),
+				mckStat.EXPECT().Timer("delivery.latency.flushed", 4*time.Second),
+			)
+			So(ackAfter(1*time.Second), ShouldBeNil)
+		})
+
+		Convey("Should skip updates without an acceptance time", func() {
+			So(wws.Send(chid, 3, "", time.Time{}, DeliveryDirect, nil), ShouldBeNil)
+			mckSocket.EXPECT().WriteJSON(gomock.Any())
+			mckStat.EXPECT().Timer("client.flush", gomock.Any())
+			mckStat.EXPECT().IncrementBy("updates.sent", int64(1))
+			So(wws.writeUpdates(<-wws.outbound), ShouldBeNil)
+
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("updates.client.ack"),
+				mckStat.EXPECT().Timer("client.ack.latency", 1*time.Second),
+			)
+			So(ackAfter(1*time.Second), ShouldBeNil)
+		})
+	})
+}
+
 func TestWorkerUnregister(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
@@ -671,6 +1148,150 @@ func TestWorkerHandshakeDupe(t *testing.T) {
 	})
 }
 
+// authStore adds device credential support to a mock store.
+type authStore struct {
+	*MockStore
+	creds map[string]*DeviceAuth
+}
+
+func (s *authStore) FetchDeviceAuth(uaid string) (*DeviceAuth, error) {
+	return s.creds[uaid], nil
+}
+
+func (s *authStore) PutDeviceAuth(uaid string, auth *DeviceAuth) error {
+	s.creds[uaid] = auth
+	return nil
+}
+
+func TestWorkerDeviceAuth(t *testing.T) {
+	useMockFuncs()
+	defer useStdFuncs()
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+	mckStore := NewMockStore(mockCtrl)
+	mckSocket := NewMockSocket(mockCtrl)
+	mckRouter := NewMockRouter(mockCtrl)
+
+	Convey("Should authenticate devices", t, func() {
+		uaid := "7f0bd4e4953c11e4b9ab3c15c2c622fe"
+		legacyID := "2b4f1ab6953c11e4a1c53c15c2c622fe"
+		secret := "b9f1c2e0a5bd4c4ba2f3b4f2c63bba2d"
+
+		store := &authStore{mckStore, map[string]*DeviceAuth{
+			uaid: {SecretHash: hashDeviceSecret(secret)},
+		}}
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		app.SetRouter(mckRouter)
+		app.deviceAuth = true
+		So(app.SetStore(store), ShouldBeNil)
+
+		wws := NewWorker(app, mckSocket, "test")
+
+		// expectHello sets up the calls made by a successful handshake, and
+		// decodes the reply.
+		expectHello := func(deviceID string, reply *HelloReply) {
+			gomock.InOrder(
+				mckRouter.EXPECT().Register(deviceID).Return(nil),
+				mckSocket.EXPECT().WriteText(gomock.Any()).Do(func(text string) {
+					json.Unmarshal([]byte(text), reply)
+				}).Return(nil),
+				mckStat.EXPECT().Increment("updates.client.hello"),
+				mckStore.EXPECT().FetchAll(deviceID, gomock.Any()).Return(
+					nil, nil, nil),
+				mckStat.EXPECT().Timer("client.flush", gomock.Any()),
+			)
+		}
+
+		Convey("Should require a storage adapter that supports credentials", func() {
+			So(app.SetStore(mckStore), ShouldEqual, ErrNoDeviceAuth)
+		})
+
+		Convey("Should issue a secret to new devices", func() {
+			reply := new(HelloReply)
+			expectHello(testID, reply)
+
+			err := wws.Hello(&RequestHeader{Type: "hello"},
+				[]byte(`{"uaid":"","channelIDs":[]}`))
+			So(err, ShouldBeNil)
+			So(reply.DeviceID, ShouldEqual, testID)
+			So(reply.Secret, ShouldNotEqual, "")
+			So(store.creds[testID], ShouldResemble, &DeviceAuth{
+				SecretHash: hashDeviceSecret(reply.Secret),
+			})
+		})
+
+		Convey("Should accept the device secret", func() {
+			reply := new(HelloReply)
+			mckStore.EXPECT().CanStore(0).Return(true)
+			expectHello(uaid, reply)
+
+			err := wws.Hello(&RequestHeader{Type: "hello"}, []byte(fmt.Sprintf(
+				`{"uaid":%q,"channelIDs":[],"secret":%q}`, uaid, secret)))
+			So(err, ShouldBeNil)
+			So(reply.DeviceID, ShouldEqual, uaid)
+			So(reply.Secret, ShouldEqual, "")
+			So(store.creds[uaid].SecretHash, ShouldEqual, hashDeviceSecret(secret))
+		})
+
+		Convey("Should reset the device ID on mismatch", func() {
+			reply := new(HelloReply)
+			mckStat.EXPECT().Increment("updates.client.auth_failed")
+			expectHello(testID, reply)
+
+			err := wws.Hello(&RequestHeader{Type: "hello"}, []byte(fmt.Sprintf(
+				`{"uaid":%q,"channelIDs":[],"secret":"wrong"}`, uaid)))
+			So(err, ShouldBeNil)
+			So(reply.DeviceID, ShouldEqual, testID)
+			So(reply.Secret, ShouldNotEqual, "")
+			So(store.creds[uaid].SecretHash, ShouldEqual, hashDeviceSecret(secret))
+		})
+
+		Convey("Should not accept the stored hash as the secret", func() {
+			auth := store.creds[uaid]
+			So(auth.Verify(""), ShouldBeFalse)
+			So(auth.Verify(auth.SecretHash), ShouldBeFalse)
+			So(auth.Verify(secret), ShouldBeTrue)
+		})
+
+		Convey("Should reset devices without credentials", func() {
+			reply := new(HelloReply)
+			mckStat.EXPECT().Increment("updates.client.auth_missing")
+			expectHello(testID, reply)
+
+			err := wws.Hello(&RequestHeader{Type: "hello"}, []byte(fmt.Sprintf(
+				`{"uaid":%q,"channelIDs":[]}`, legacyID)))
+			So(err, ShouldBeNil)
+			So(reply.DeviceID, ShouldEqual, testID)
+			So(store.creds[legacyID], ShouldBeNil)
+		})
+
+		Convey("Should issue secrets to existing devices while migrating", func() {
+			app.deviceAuthMigrate = true
+			reply := new(HelloReply)
+			mckStore.EXPECT().CanStore(0).Return(true)
+			expectHello(legacyID, reply)
+
+			err := wws.Hello(&RequestHeader{Type: "hello"}, []byte(fmt.Sprintf(
+				`{"uaid":%q,"channelIDs":[]}`, legacyID)))
+			So(err, ShouldBeNil)
+			So(reply.DeviceID, ShouldEqual, legacyID)
+			So(reply.Secret, ShouldNotEqual, "")
+			So(store.creds[legacyID], ShouldResemble, &DeviceAuth{
+				SecretHash: hashDeviceSecret(reply.Secret),
+			})
+		})
+	})
+}
+
 func TestWorkerError(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
@@ -1453,8 +2074,10 @@ func TestHandshakeFlush(t *testing.T) {
 		Convey("Should flush updates after handshake", func() {
 			uaid := "b0b8afe6950c11e49aa73c15c2c622fe"
 			updates := []Update{
-				{"263d09f8950b11e4a1f83c15c2c622fe", 2, "I'm a little teapot"},
-				{"bac9d83a950b11e4bd713c15c2c622fe", 4, "Short and stout"},
+				{ChannelID: "263d09f8950b11e4a1f83c15c2c622fe", Version: 2,
+					Data: "I'm a little teapot"},
+				{ChannelID: "bac9d83a950b11e4bd713c15c2c622fe", Version: 4,
+					Data: "Short and stout"},
 			}
 			expired := []string{"c778e94a950b11e4ba7f3c15c2c622fe"}
 
@@ -1467,20 +2090,17 @@ func TestHandshakeFlush(t *testing.T) {
 				mckStat.EXPECT().Increment("updates.client.hello"),
 				mckStore.EXPECT().FetchAll(uaid, gomock.Any()).Return(
 					updates, expired, nil),
-				mckSocket.EXPECT().WriteJSON(FlushReply{
-					Type:    "notification",
-					Updates: updates,
-					Expired: expired,
-				}),
-				mckStat.EXPECT().IncrementBy("updates.sent", int64(2)),
 				mckStat.EXPECT().Timer("client.flush", gomock.Any()),
 			)
 			err := wws.Hello(&RequestHeader{Type: "hello"}, []byte(`{
 				"uaid": "b0b8afe6950c11e49aa73c15c2c622fe",
 				"channelIDs": ["1", "2", "3"]
 			}`))
-
 			So(err, ShouldBeNil)
+
+			queued := <-wws.outbound
+			So(queued.updates, ShouldResemble, updates)
+			So(queued.expired, ShouldResemble, expired)
 		})
 
 		Convey("Should not flush updates if the handshake fails", func() {